@@ -1,10 +1,11 @@
 module logingest
 
-go 1.21
+go 1.24
 
 require (
 	github.com/aws/aws-sdk-go v1.50.29
 	github.com/joho/godotenv v1.5.1
+	google.golang.org/protobuf v1.33.0
 )
 
 require github.com/jmespath/go-jmespath v0.4.0 // indirect
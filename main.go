@@ -1,33 +1,110 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"compress/zlib"
+	"container/heap"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/joho/godotenv"
+	"google.golang.org/protobuf/encoding/protowire"
 	"io"
 	"log"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 type LogEntry struct {
-	Timestamp int64  `json:"time"`
-	Message   string `json:"log"`
+	Timestamp       int64             `json:"time"`
+	Message         string            `json:"log"`
+	Level           string            `json:"level,omitempty"`
+	Fields          map[string]string `json:"fields,omitempty"`
+	ClientTimestamp int64             `json:"client_ts,omitempty"`
+
+	// Bucket overrides the minute whose object the entry is stored in, for backfills and repairs. It is only accepted at ingest
+	// (or from the X-Target-Minute header of the request) and not stored
+	Bucket string `json:"bucket,omitempty"`
+}
+
+// field returns the value of a named field of the entry, level and log refer to the top-level attributes
+func (e LogEntry) field(name string) (string, bool) {
+	switch name {
+	case "level":
+		return e.Level, e.Level != ""
+	case "log":
+		return e.Message, true
+	}
+	value, ok := e.Fields[name]
+	return value, ok
+}
+
+// UnmarshalJSON also accepts numeric levels, e.g. syslog severities sent as {"level":3}, which are kept as their decimal string
+func (e *LogEntry) UnmarshalJSON(data []byte) error {
+	type plainLogEntry LogEntry
+	var entry struct {
+		plainLogEntry
+		Level json.RawMessage `json:"level,omitempty"`
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return err
+	}
+	*e = LogEntry(entry.plainLogEntry)
+
+	if len(entry.Level) == 0 || string(entry.Level) == "null" {
+		return nil
+	}
+	if entry.Level[0] == '"' {
+		return json.Unmarshal(entry.Level, &e.Level)
+	}
+	var number json.Number
+	if err := json.Unmarshal(entry.Level, &number); err != nil {
+		return fmt.Errorf("invalid level %s", entry.Level)
+	}
+	e.Level = number.String()
+	return nil
 }
 
 var (
 	logChannel           = make(chan LogEntry, 100000)
 	inMemorySearchBuffer []LogEntry
+	bufferIndex          = make(map[int64][]LogEntry) // the entries of inMemorySearchBuffer by minute, see bufferMinute
+	bufferMu             sync.RWMutex
+	bufferDisabled       bool // DISABLE_BUFFER, recent entries are then queried from the local files, see bufferEntries
 	logsDirectory        = "./logs"
 	s3Client             *s3.S3
 	accessKeyID          = os.Getenv("AWS_ACCESS_KEY_ID")
@@ -35,8 +112,261 @@ var (
 	region               = os.Getenv("AWS_REGION")
 	bucketName           = os.Getenv("S3_BUCKET_NAME")
 	s3ObjectKeysPrefix   = "mihir_joshi/"
+	s3KeySuffix          = ".json"
+	s3DayPrefix          = false  // objects in a directory per day under the prefix, see minuteKey
+	s3ReadPrefixes       []string // earlier prefixes still queried but never written to, see getS3ObjectByKey
+	s3ObjectTags         = ""
+	apiKey               = os.Getenv("API_KEY")
+	scopedKeys           []scopedKey    // API_KEYS and API_KEYS_FILE, see parseScopedKeys
+	concurrencyLimits    map[string]int // MAX_CONCURRENT_REQUESTS by endpoint, see limitConcurrency
+	readOnly             atomic.Bool
+	metrics              = &metricsRegistry{kinds: make(map[string]string), values: make(map[string]float64)}
+
+	// Above memoryHighWatermark bytes of heap, ingestion is shed until memory is released, 0 disables the check
+	memoryHighWatermark uint64
+	memoryCheckInterval = 1 * time.Second
+	memoryPressure      atomic.Bool
+	heapAlloc           atomic.Uint64
+
+	// Once logsDirectory holds maxLocalDiskBytes, ingestion is rejected (diskFullPolicy "reject") or dropped ("drop")
+	maxLocalDiskBytes int64
+	diskFullPolicy    = "reject"
+	localDiskUsage    atomic.Int64
+
+	// Below minFreeDiskBytes or minFreeInodes on the filesystem of logsDirectory, /ready answers 503, 0 is no minimum
+	minFreeDiskBytes   int64
+	minFreeInodes      int64
+	localDiskFreeBytes atomic.Int64
+	localFreeInodes    atomic.Int64
+	localDiskLow       atomic.Bool
+
+	// Query results exported with output=s3 are written under exportPrefix and deleted after exportTTL,
+	// exportLifecycleReady is set once the lifecycle rule expiring leftover exports is in place. It is a sibling of
+	// the object prefix, so that exports are neither listed as minutes nor expired by the RETENTION rule
+	exportPrefix         = "exports/"
+	exportTTL            = 1 * time.Hour
+	exportLifecycleReady bool
+	exportLifecycleMu    sync.Mutex
+
+	// Defaults for queries that omit start/end or text
+	defaultQueryLast time.Duration
+	defaultQueryText string
+
+	// Maximum number of objects a single query fetches, 0 is unlimited
+	maxQueryObjects = 0
+
+	// Soft cap on the number of entries a query returns, checked between objects, 0 is unlimited
+	maxResultEntries = 0
+
+	// Number of objects merged at a time by sort=time queries
+	sortBufferObjects = 8
+
+	// Maximum number of messages returned by distinct=true queries, and of patterns counted by /top
+	maxDistinctGroups = 1000
+
+	// How long after a minute ends late entries may still arrive for it, see availabilityHandler
+	lateGrace = 1 * time.Minute
+
+	// Time zone of the minute labels of object keys, see formatMinute
+	keyLocation = time.Local
+
+	// Format version of written minute objects, see decodeObjectEntries
+	objectFormatVersion = 0
+
+	// Compressed objects decompressing to more than this many bytes are rejected as unreadable, 0 is unlimited
+	maxDecompressedBytes = int64(1024 * 1024 * 1024)
+
+	// Stored as the Instance-Id metadata of every uploaded object, the hostname unless INSTANCE_ID is set, see putMinuteObject
+	instanceID string
+
+	// Objects larger than multipartThreshold bytes are uploaded with the multipart API
+	multipartThreshold   = 64 * 1024 * 1024
+	multipartPartSize    = int64(8 * 1024 * 1024)
+	multipartConcurrency = 4
+
+	// With CONDITIONAL_WRITES, merged minute objects are only replaced if unchanged since they were read, see storeMinute
+	conditionalWrites        = false
+	conditionalWriteAttempts = 5
+	errWriteConflict         = errors.New("object was written concurrently")
+
+	// Minutes with more entries are uploaded as parts minute-0001, minute-0002, ..., 0 is unlimited
+	maxEntriesPerObject = 0
+
+	// Upload retries: jittered exponential backoff, dead-lettering a file once uploadMaxElapsed has passed since its first failure
+	uploadRetryInitialInterval = 1 * time.Second
+	uploadRetryMaxInterval     = 1 * time.Minute
+	uploadRetryJitter          = 0.5
+	uploadMaxElapsed           = 15 * time.Minute
+	deadLetterDirectory        = "./dead_letter"
+	uploadRetries              = make(map[string]*uploadRetry)
+	uploadsInFlight            = make(map[string]bool)
+	uploadStateMu              sync.Mutex   // guards uploadRetries and uploadsInFlight
+	uploadMu                   sync.RWMutex // held shared by the periodic uploads, exclusively by the shutdown and repairs
+	uploadConcurrency          = 4
+	uploadInflightBytes        = &byteBudget{} // MAX_UPLOAD_INFLIGHT_BYTES, the local file bytes uploaded at once, unlimited when 0
+	uploadPublishers           []uploadPublisher
+
+	// Entries persisted from the buffer by persistBufferHandler, by store and entryDedupKey, skipped once when their local file is uploaded
+	persistedEntries = make(map[string]int)
+	persistedMu      sync.Mutex
+
+	stdoutSinkEnabled = false
+
+	// With RESPONSE_NEWLINE, JSON responses of /query and /list end with a newline, see marshalResponse
+	responseNewline = false
+
+	// Query results estimated above streamThreshold bytes are encoded entry by entry instead of at once, 0 is never, see streamEntries
+	streamThreshold int64
+
+	// Entries at or above errorStoreLevel are also (copy) or only (move) stored under {prefix}errors/, off when empty
+	errorStoreLevel     = ""
+	errorStoreMode      = "copy"
+	errorStoreDirectory = filepath.Join(logsDirectory, "errors")
+
+	// ingestAccepting is cleared on shutdown, ingestSendMu is held shared while a request sends to logChannel
+	ingestAccepting atomic.Bool
+	ingestSendMu    sync.RWMutex
+
+	shutdownTimeout = 30 * time.Second
+	flushMu         sync.Mutex
+	flushSort       = "timestamp" // order of a flushed batch: timestamp, ingest (arrival order) or none
+
+	// With flushMaxDelay set, ticks accumulate drained entries until one of the thresholds is reached, see accumulateLogChannel
+	flushMaxDelay    time.Duration
+	flushMaxEntries  int
+	flushMaxBytes    int64
+	accumulated      []LogEntry // guarded by flushMu
+	accumulatedBytes int64
+	accumulatedSince time.Time
+	shutdownStorage  = make(chan struct{})
+	storageStopped   = make(chan struct{})
+
+	// Retries of a failing Sink.Write, per batch and independently for every sink. A batch still failing after
+	// sinkRetryAttempts is held and retried on later flushes, backing off up to sinkRetryMaxInterval,
+	// while any sink holds batches ingestion is rejected with 503
+	sinkRetryAttempts        = 3
+	sinkRetryInitialInterval = 100 * time.Millisecond
+	sinkRetryMaxInterval     = 30 * time.Second
+	failingSinks             atomic.Int32
+
+	// Ingest request bodies larger than this are rejected with 413, 0 is unlimited
+	maxIngestBodyBytes int64
+
+	// Ingest requests with more entries than this are rejected with 413, 0 is unlimited
+	maxIngestEntries  int
+	errTooManyEntries = errors.New("too many log entries")
+
+	// Ingest requests whose body isn't read and decoded within this are aborted with 408, 0 is no deadline
+	ingestRequestTimeout time.Duration
+
+	// Fill ratio of logChannel / MAX_LOCAL_DISK_BYTES above which ingest responses carry X-Ingest-Advice: slow-down
+	backpressureThreshold = 0.8
+
+	// Handling of entries too far from server time, see admitLogEntries
+	maxClockSkew    = 1 * time.Hour
+	clockSkewPolicy = "accept"
+
+	// Median drift of recent entries from server time above which a warning is logged, 0 is off, see recordClockDrift
+	clockDriftWarning time.Duration
+	clockDrift        driftWindow
+
+	// Handling of messages that look like JSON but don't parse, see admitLogEntries
+	embeddedJSONPolicy = "off"
+
+	// Age after which stored entries are expected to be deleted (by an S3 lifecycle rule), ingesting older ones is wasted work
+	retention             time.Duration
+	rejectBeyondRetention = true
+
+	// With MANAGE_LIFECYCLE, the lifecycle rule of the prefix is created at startup to expire objects after RETENTION, see ensureLifecycleRule
+	manageLifecycle           = false
+	lifecycleTransitionIADays = int64(0)
+
+	// Symbolic names of numeric levels, nil unless LEVEL_NUMERIC_MAP is set
+	levelNumericMap map[string]string
+
+	// Patterns replaced by redactionPlaceholder in messages and field values at ingest, see redactEntries
+	redactionRules       []*regexp.Regexp
+	redactionPlaceholder = "[redacted]"
+
+	// Stamped into the source field of entries without one, see stampSource
+	sourceName     string
+	sourceClientIP bool
+
+	// Address of the UDP and TCP syslog listeners, off when empty, see listenSyslog
+	syslogAddr string
+
+	// Address of the GELF UDP listener, off when empty, see listenGELF
+	gelfAddr string
+
+	// Address of the Fluentd forward protocol listener, off when empty, see listenForward
+	forwardAddr string
+
+	// Address of the gRPC LogService listener, off when empty, see listenGRPC. Its server is shut down with the HTTP server
+	grpcAddr   string
+	grpcServer *http.Server
+
+	// Suppression of retried ingests, see dedupStore
+	ingestDedup  = &dedupStore{expiry: make(map[string]time.Time)}
+	dedupEntries = false
+
+	// Per-tenant ingest limits, tenants are identified by the X-Tenant-ID header
+	defaultTenant   = "default"
+	tenantQuotaFile = ""
+	tenantQuotas    = &tenantQuotaTracker{
+		overrides: make(map[string]tenantLimits),
+		usage:     make(map[string]*tenantUsage),
+	}
+
+	// End-to-end self-test, see runCanary. Off unless CANARY_INTERVAL is set
+	canaryInterval     time.Duration
+	canaryTag          = "canary"
+	canaryTimeout      = 5 * time.Minute
+	canaryPollInterval = 5 * time.Second
+
+	// Metadata backfill job, see backfillHandler
+	backfillStateFile = "./backfill_state.json"
+	backfillRate      = 10.0 // objects per second
+	backfill          = &backfillJob{}
+
+	// With LOADTEST_ENABLED, /admin/loadtest generates synthetic ingest traffic, see runLoadTest
+	loadTestEnabled = false
+	loadTest        = &loadTestJob{}
+
+	// With KEEP_LOCAL, uploaded local files are archived to keepLocalDirectory instead of being deleted, see repairHandler
+	keepLocal          = false
+	keepLocalDirectory = "./archive"
+
+	// With QUERY_COMPACTED_HOURS, queries spanning a whole hour read its compacted hourly object when there is one, see compactedHour
+	queryCompactedHours = false
+
+	// With COMPACTION_INTERVAL, the hours written to are compacted into their hourly object, see periodicallyCompact
+	compactionInterval time.Duration
+	compactAfter       = 1 * time.Hour
+	compactMaxObjects  int
+	pendingCompaction  = make(map[string]*pendingHour) // by store and hour, e.g. errors/2024-03-02-05
+	compactionMu       sync.Mutex
+
+	// Once s3Breaker opens, queries are served from the buffer and the local files without S3 unless QUERY_LOCAL_FALLBACK=false
+	s3Breaker          = &circuitBreaker{threshold: 5, cooldown: 30 * time.Second}
+	queryLocalFallback = true
+
+	// With manifestPrefix set, a gzipped manifest of the objects of every day is kept under it, see dayManifest
+	manifestPrefix = ""
+	manifests      = make(map[string]*dayManifest)
+	manifestMu     sync.Mutex
+
+	// Audit trail of admin operations, appended to auditLogFile or, with auditPrefix set, written as objects under it
+	auditLogFile = "./audit.log"
+	auditPrefix  = ""
+	auditMu      sync.Mutex
 )
 
+type uploadRetry struct {
+	attempts     int
+	firstFailure time.Time
+	nextAttempt  time.Time
+}
+
 /*
 To handle ingestion of logs.
 This handler writes logEntries to the in-memory buffer logChannel
@@ -57,334 +387,9069 @@ func ingestHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+	setBackpressureHeaders(w)
+
+	if !ingestAccepting.Load() {
+		http.Error(w, "Shutting down, retry later", http.StatusServiceUnavailable)
 		return
 	}
-	// Parse the JSON log entries array
-	var logEntries []LogEntry
-	err = json.Unmarshal(body, &logEntries)
-	if err != nil {
-		http.Error(w, "Failed to parse log entries", http.StatusBadRequest)
+	if readOnly.Load() {
+		http.Error(w, "Ingestion is disabled, the service is in read-only mode", http.StatusServiceUnavailable)
 		return
 	}
-
-	for _, logEntry := range logEntries {
-		fmt.Println("Processing log entry: ", logEntry.Timestamp, logEntry.Message)
-		logChannel <- logEntry
+	if memoryPressure.Load() {
+		metrics.add("ingest_shed_requests_total", 1)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Under memory pressure, retry later", http.StatusServiceUnavailable)
+		return
 	}
-
-	w.WriteHeader(http.StatusCreated)
-	fmt.Fprintf(w, "Log entry stored successfully")
-}
-
-/*
-This handler parses the start and end timestamps,
-generates a list of possible S3ObjectKeys for each minute,
-queries S3 for the list of files
-
-GET http://localhost:8080/query?start=1685426738&end=1685426739&text=test
-*/
-func queryHandler(w http.ResponseWriter, r *http.Request) {
-	// Parse query parameters
-	startTimestamp := r.URL.Query().Get("start")
-	endTimestamp := r.URL.Query().Get("end")
-	textFilter := r.URL.Query().Get("text")
-
-	// Parse start timestamp
-	startTimeUnix, err := strconv.ParseInt(startTimestamp, 10, 64)
-	startTimeUnix = startTimeUnix - 1 // To get inclusive results when filtering the log entries using .After()
-	if err != nil {
-		http.Error(w, "Invalid start timestamp", http.StatusBadRequest)
+	if failingSinks.Load() > 0 {
+		metrics.add("ingest_sink_backpressure_total", 1)
+		w.Header().Set("Retry-After", strconv.Itoa(int(sinkRetryMaxInterval.Seconds())+1))
+		http.Error(w, "Log entries can't be written out, retry later", http.StatusServiceUnavailable)
 		return
 	}
-	startTime := time.Unix(startTimeUnix, 0)
 
-	// Parse end timestamp
-	endTimeUnix, err := strconv.ParseInt(endTimestamp, 10, 64)
-	endTimeUnix = endTimeUnix + 1 // To get inclusive results when filtering the log entries using .Before()
-	if err != nil {
-		http.Error(w, "Invalid end timestamp", http.StatusBadRequest)
+	tenant := tenantFromRequest(r)
+	if !tenantQuotas.allow(tenant) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
 		return
 	}
-	endTime := time.Unix(endTimeUnix, 0)
-	endMinute := endTime.Format("2006-01-02-15-04")
 
-	// Generate a list of timestamps between start and end timestamps
-	var timestamps []string
-	for t := startTime; t.Before(endTime); t = t.Add(time.Minute) {
-		timestamps = append(timestamps, t.Format("2006-01-02-15-04"))
+	if maxIngestBodyBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxIngestBodyBytes)
 	}
-	timestamps = append(timestamps, endMinute)
-
-	// Retrieve objects from S3 for each timestamp in the list
-	var result []LogEntry
-	for _, timestamp := range timestamps {
-		// Get object from S3
-		objectContent, err := getS3ObjectByKey(bucketName, timestamp)
+	// Compressed bodies are decompressed while decoding, MAX_INGEST_BODY_BYTES (MAX_DECOMPRESSED_BYTES without it) also
+	// bounds their decompressed size, so that a small body can't expand without bound
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		gzipReader, err := gzip.NewReader(r.Body)
 		if err != nil {
-			log.Printf("Error getting S3 object for timestamp %s: %v", timestamp, err)
-			continue
+			http.Error(w, fmt.Sprintf("Invalid gzip body: %v", err), http.StatusBadRequest)
+			return
+		}
+		defer gzipReader.Close()
+		r.Body = gzipReader
+		limit := maxIngestBodyBytes
+		if limit <= 0 {
+			limit = maxDecompressedBytes
 		}
+		if limit > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+	default:
+		http.Error(w, fmt.Sprintf("Unsupported Content-Encoding %q, expected gzip", encoding), http.StatusUnsupportedMediaType)
+		return
+	}
+	ctx := context.Background()
+	if ingestRequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(r.Context(), ingestRequestTimeout)
+		defer cancel()
+		// The context can't interrupt a read blocked on a slow client, the read deadline does
+		deadline, _ := ctx.Deadline()
+		controller := http.NewResponseController(w)
+		controller.SetReadDeadline(deadline)
+		defer controller.SetReadDeadline(time.Time{})
+	}
+	body := ingestBodyPool.Get().(*ingestBody)
+	defer ingestBodyPool.Put(body)
+	body.reset(r.Body)
 
-		// Unmarshal object content
-		var logEntries []LogEntry
-		if err := json.Unmarshal(objectContent, &logEntries); err != nil {
-			log.Printf("Error unmarshalling object content for timestamp %s: %v", timestamp, err)
-			continue
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		mediaType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+		switch strings.TrimSpace(mediaType) {
+		case "application/x-protobuf":
+			format = "protobuf"
+		case "application/x-ndjson":
+			format = "ndjson"
+		}
+	}
+	logEntries, err := decodeLogEntries(format, body)
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			metrics.add("ingest_timeouts_total", 1)
+			w.Header().Set("Connection", "close")
+			http.Error(w, fmt.Sprintf("Request body not received within %s", ingestRequestTimeout), http.StatusRequestTimeout)
+			return
 		}
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, fmt.Sprintf("Request body exceeds %d bytes", maxBytesErr.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if errors.Is(err, errTooManyEntries) {
+			http.Error(w, fmt.Sprintf("Request has more than %d log entries, split the batch into smaller requests", maxIngestEntries), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if format == "hec" {
+			// HEC clients read the code of the response to tell malformed events apart
+			writeHECResponse(w, http.StatusBadRequest, hecResponse{Text: err.Error(), Code: hecErrorCode(err)})
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to parse log entries: %v", err), http.StatusBadRequest)
+		return
+	}
+	bodySize := body.n
 
-		var filteredLogEntries []LogEntry
-		for _, entry := range logEntries {
-			entryTimestamp := time.Unix(entry.Timestamp, 0)
-			if entryTimestamp.After(startTime) && entryTimestamp.Before(endTime) {
-				filteredLogEntries = append(filteredLogEntries, entry)
-			}
+	if maxLocalDiskBytes > 0 && localDiskUsage.Load()+bodySize > maxLocalDiskBytes {
+		metrics.add(fmt.Sprintf("ingest_disk_backpressure_total{policy=%q}", diskFullPolicy), 1)
+		if diskFullPolicy == "drop" {
+			metrics.add("ingest_dropped_bytes_total", float64(bodySize))
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintf(w, "Local disk limit reached, log entries dropped")
+			return
 		}
-		logEntries = filteredLogEntries
+		http.Error(w, "Local disk limit reached, retry later", http.StatusInsufficientStorage)
+		return
+	}
 
-		if textFilter != "" {
-			var filteredLogEntries []LogEntry
-			for _, entry := range logEntries {
-				if strings.Contains(entry.Message, textFilter) {
-					filteredLogEntries = append(filteredLogEntries, entry)
-				}
+	if targetMinute := r.Header.Get("X-Target-Minute"); targetMinute != "" {
+		for i := range logEntries {
+			if logEntries[i].Bucket == "" {
+				logEntries[i].Bucket = targetMinute
 			}
-			result = append(result, filteredLogEntries...)
-		} else {
-			result = append(result, logEntries...)
 		}
 	}
+	redactEntries(logEntries)
+	logEntries, rejected := admitLogEntries(logEntries, time.Now())
+	stampSource(logEntries, r.RemoteAddr)
 
-	for _, entry := range inMemorySearchBuffer {
-		entryTimestamp := time.Unix(entry.Timestamp, 0)
-		if entryTimestamp.After(startTime) && entryTimestamp.Before(endTime) {
-			if textFilter == "" || strings.Contains(entry.Message, textFilter) {
-				result = append(result, entry)
+	// The keys reserved here are committed once the entries are enqueued, and released if the request fails before
+	var reservedKeys []string
+	enqueued := false
+	defer func() {
+		if !enqueued {
+			ingestDedup.release(reservedKeys...)
+		}
+	}()
+	if idempotencyKey := r.Header.Get("Idempotency-Key"); idempotencyKey != "" {
+		switch err := ingestDedup.reserve("request:" + idempotencyKey); err {
+		case errDuplicateKey:
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, "Duplicate request ignored")
+			return
+		case errKeyInFlight:
+			http.Error(w, "A request with this Idempotency-Key is in progress, retry later", http.StatusConflict)
+			return
+		}
+		reservedKeys = append(reservedKeys, "request:"+idempotencyKey)
+	}
+	if dedupEntries && ingestDedup.enabled() {
+		// Entries reserved by a request in flight are left out too, its client retries them if it fails
+		var unseen []LogEntry
+		for _, logEntry := range logEntries {
+			key := entryDedupKey(logEntry)
+			if ingestDedup.reserve(key) == nil {
+				unseen = append(unseen, logEntry)
+				reservedKeys = append(reservedKeys, key)
 			}
 		}
+		logEntries = unseen
 	}
 
-	// Marshal the filtered log entries and send as response
-	responseData, err := json.Marshal(result)
-	if err != nil {
-		http.Error(w, "Error marshalling response data", http.StatusInternalServerError)
+	remainingBytes, remainingEntries, ok := tenantQuotas.consume(tenant, bodySize, int64(len(logEntries)))
+	if remainingBytes >= 0 {
+		w.Header().Set("X-Quota-Remaining-Bytes", strconv.FormatInt(remainingBytes, 10))
+	}
+	if remainingEntries >= 0 {
+		w.Header().Set("X-Quota-Remaining-Entries", strconv.FormatInt(remainingEntries, 10))
+	}
+	if !ok {
+		http.Error(w, "Daily ingest quota exhausted", http.StatusForbidden)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(responseData)
-}
+	var objectKeys []string
+	if r.URL.Query().Get("ack") == "keys" {
+		objectKeys = assignObjectKeys(logEntries, time.Now())
+	}
 
-func getS3ObjectByKey(bucketName, key string) ([]byte, error) {
-	client := getS3Client()
+	// Checked again under ingestSendMu, so that shutdown never drains logChannel while entries are still being sent
+	ingestSendMu.RLock()
+	if !ingestAccepting.Load() {
+		ingestSendMu.RUnlock()
+		http.Error(w, "Shutting down, retry later", http.StatusServiceUnavailable)
+		return
+	}
+	for _, logEntry := range logEntries {
+		// With STDOUT_SINK, stdout carries the entries as NDJSON only
+		if !stdoutSinkEnabled {
+			fmt.Println("Processing log entry: ", logEntry.Timestamp, logEntry.Message)
+		}
+		logChannel <- logEntry
+	}
+	ingestSendMu.RUnlock()
+	enqueued = true
+	ingestDedup.commit(reservedKeys...)
 
-	key = s3ObjectKeysPrefix + key
-	resp, err := client.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(key),
-	})
-	if err != nil {
-		return nil, fmt.Errorf("error getting object from S3: %v", err)
+	if format == "otlp" || format == "otlp_json" {
+		writeOTLPResponse(w, format, rejected)
+		return
+	}
+	if format == "loki" || format == "loki_json" {
+		// Like Loki, the remaining entries are stored and the rejected ones reported with a 400
+		if len(rejected) > 0 {
+			http.Error(w, fmt.Sprintf("%d entries rejected: %s", len(rejected), rejected[0].Reason), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if format == "hec" {
+		response := hecResponse{Text: "Success"}
+		status := http.StatusOK
+		if len(rejected) > 0 {
+			response = hecResponse{Text: fmt.Sprintf("%d events rejected: %s", len(rejected), rejected[0].Reason), Code: hecInvalidDataFormat}
+			status = http.StatusBadRequest
+		}
+		writeHECResponse(w, status, response)
+		return
+	}
+	if len(rejected) > 0 || objectKeys != nil {
+		status := http.StatusCreated
+		if len(logEntries) == 0 && len(rejected) > 0 {
+			status = http.StatusUnprocessableEntity
+		}
+		responseData, err := json.Marshal(ingestResponse{Accepted: len(logEntries), Rejected: rejected, Keys: objectKeys})
+		if err != nil {
+			http.Error(w, "Error marshalling response data", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(responseData)
+		return
 	}
-	defer resp.Body.Close()
 
-	objectContent, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("error reading object content: %v", err)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "Log entry stored successfully")
+}
+
+/*
+setBackpressureHeaders reports the ingest backlog on every ingest response and advises clients to slow down
+once the channel or the local disk is filled beyond BACKPRESSURE_THRESHOLD, even for accepted requests.
+*/
+func setBackpressureHeaders(w http.ResponseWriter) {
+	backlog := len(logChannel)
+	w.Header().Set("X-Ingest-Backlog", strconv.Itoa(backlog))
+
+	channelFull := float64(backlog) >= backpressureThreshold*float64(cap(logChannel))
+	diskFull := maxLocalDiskBytes > 0 && float64(localDiskUsage.Load()) >= backpressureThreshold*float64(maxLocalDiskBytes)
+	if channelFull || diskFull || memoryPressure.Load() || failingSinks.Load() > 0 {
+		metrics.add("ingest_slow_down_advised_total", 1)
+		w.Header().Set("X-Ingest-Advice", "slow-down")
 	}
+}
 
-	return objectContent, nil
+// ingestResponse is returned instead of the plain text confirmation when some entries were rejected or with ack=keys
+type ingestResponse struct {
+	Accepted int             `json:"accepted"`
+	Rejected []rejectedEntry `json:"rejected,omitempty"`
+	Keys     []string        `json:"keys,omitempty"`
 }
 
-func getS3Client() *s3.S3 {
-	if s3Client == nil {
-		sess, err := session.NewSession(&aws.Config{
-			Region:      aws.String(region),
-			Credentials: credentials.NewStaticCredentials(accessKeyID, secretAccessKey, ""),
-		})
-		if err != nil {
-			log.Fatalf("Error creating AWS session: %v", err)
+/*
+assignObjectKeys pins entries without a bucket to the minute they arrived in and returns the keys of the objects
+the entries will be uploaded to, in the error store too when ERROR_STORE_LEVEL is set. Without a bucket, entries
+are stored in the minute they are flushed in, which may already be the next one.
+*/
+func assignObjectKeys(entries []LogEntry, now time.Time) []string {
+	keys := []string{}
+	seen := make(map[string]bool)
+	add := func(minute string) {
+		if key := objectKey(minute); !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
 		}
-		s3Client = s3.New(sess)
 	}
-	return s3Client
+	for i := range entries {
+		if entries[i].Bucket == "" {
+			entries[i].Bucket = formatMinute(now)
+		}
+		isError := errorStoreLevel != "" && isErrorEntry(entries[i])
+		if isError {
+			add("errors/" + entries[i].Bucket)
+		}
+		if !isError || errorStoreMode != "move" {
+			add(entries[i].Bucket)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type rejectedEntry struct {
+	Entry  LogEntry `json:"entry"`
+	Reason string   `json:"reason"`
 }
 
 /*
-GET http://localhost:8080/list
+admitLogEntries applies the ingest policies to entries received at now.
+
+Entries whose timestamp is more than MAX_CLOCK_SKEW away from server time are, depending on CLOCK_SKEW_POLICY,
+accepted as is, rejected, or re-stamped to server time with the original timestamp kept in client_ts.
+
+With LEVEL_NUMERIC_MAP set, numeric levels are replaced by their symbolic names, other levels are kept as is.
+
+With RETENTION and REJECT_BEYOND_RETENTION set, entries older than the retention window are rejected.
 
-Returns a list of all the S3 keys created by this project
+Entries whose bucket isn't a minute of the key format are rejected.
+
+Messages starting with { or [ are checked to be valid JSON with EMBEDDED_JSON_POLICY set to flag, which marks
+invalid ones with the field invalid_json=true, or reject.
 */
-func listHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+func admitLogEntries(entries []LogEntry, now time.Time) (accepted []LogEntry, rejected []rejectedEntry) {
+	recordClockDrift(entries, now)
+	for _, entry := range entries {
+		if entry.Bucket != "" {
+			if _, err := parseMinute(entry.Bucket); err != nil || entry.Bucket != strings.TrimSpace(entry.Bucket) {
+				metrics.add(`ingest_rejected_entries_total{reason="bucket"}`, 1)
+				rejected = append(rejected, rejectedEntry{Entry: entry, Reason: "invalid bucket, expected a minute like 2006-01-02-15-04"})
+				continue
+			}
+		}
+		if rejectBeyondRetention && retention > 0 && time.Unix(entry.Timestamp, 0).Before(now.Add(-retention)) {
+			metrics.add(`ingest_rejected_entries_total{reason="retention"}`, 1)
+			rejected = append(rejected, rejectedEntry{Entry: entry, Reason: "older than retention " + retention.String()})
+			continue
+		}
+		if name, ok := levelNumericMap[strings.TrimSpace(entry.Level)]; ok {
+			entry.Level = name
+		}
+		if embeddedJSONPolicy != "off" && !validEmbeddedJSON(entry.Message) {
+			if embeddedJSONPolicy == "reject" {
+				metrics.add(`ingest_rejected_entries_total{reason="invalid_json"}`, 1)
+				rejected = append(rejected, rejectedEntry{Entry: entry, Reason: "message is malformed JSON"})
+				continue
+			}
+			metrics.add("ingest_invalid_json_entries_total", 1)
+			fields := make(map[string]string, len(entry.Fields)+1)
+			for name, value := range entry.Fields {
+				fields[name] = value
+			}
+			fields["invalid_json"] = "true"
+			entry.Fields = fields
+		}
+		if clockSkewPolicy != "accept" {
+			skew := now.Sub(time.Unix(entry.Timestamp, 0))
+			if skew < 0 {
+				skew = -skew
+			}
+			if skew > maxClockSkew {
+				if clockSkewPolicy == "reject" {
+					metrics.add(`ingest_rejected_entries_total{reason="clock_skew"}`, 1)
+					rejected = append(rejected, rejectedEntry{Entry: entry, Reason: "clock skew exceeds " + maxClockSkew.String()})
+					continue
+				}
+				metrics.add("ingest_restamped_entries_total", 1)
+				entry.ClientTimestamp = entry.Timestamp
+				entry.Timestamp = now.Unix()
+			}
+		}
+		accepted = append(accepted, entry)
 	}
+	return accepted, rejected
+}
 
-	client := getS3Client()
+// Number of recent entries whose median drift is compared to CLOCK_DRIFT_WARNING
+const driftWindowSize = 1000
 
-	var keys []string
+// driftWindow keeps the clock drift of the most recent entries, in seconds
+type driftWindow struct {
+	mu      sync.Mutex
+	samples []float64
+	next    int
+	warning bool
+}
 
-	err := client.ListObjectsPages(&s3.ListObjectsInput{
-		Prefix: aws.String(s3ObjectKeysPrefix),
-		Bucket: aws.String(bucketName),
-	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
-		for _, obj := range page.Contents {
-			keys = append(keys, *obj.Key)
-		}
-		return !lastPage
-	})
-	if err != nil {
-		log.Fatalf("error listing bucket objects: %v", err)
+/*
+recordClockDrift observes the drift of server time from the timestamps of entries in the ingest_clock_drift_seconds
+histogram, positive for entries in the past and negative for entries in the future, whatever CLOCK_SKEW_POLICY does
+with them. Once the median drift of the recent entries exceeds CLOCK_DRIFT_WARNING a warning is logged, and again
+when it is back under it, so that misconfigured client clocks are noticed before entries land in the wrong minutes.
+*/
+func recordClockDrift(entries []LogEntry, now time.Time) {
+	if len(entries) == 0 {
 		return
 	}
-
-	keysJSON, err := json.Marshal(keys)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("error marshalling keys to JSON: %v", err), http.StatusInternalServerError)
+	drifts := make([]float64, len(entries))
+	for i, entry := range entries {
+		drifts[i] = float64(now.Unix() - entry.Timestamp)
+	}
+	metrics.observeAll("ingest_clock_drift_seconds", drifts, driftBuckets)
+	if clockDriftWarning <= 0 {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-
-	w.WriteHeader(http.StatusOK)
-	_, err = w.Write(keysJSON)
-	if err != nil {
-		log.Printf("error writing response: %v", err)
+	clockDrift.mu.Lock()
+	defer clockDrift.mu.Unlock()
+	for _, drift := range drifts {
+		if len(clockDrift.samples) < driftWindowSize {
+			clockDrift.samples = append(clockDrift.samples, drift)
+			continue
+		}
+		clockDrift.samples[clockDrift.next] = drift
+		clockDrift.next = (clockDrift.next + 1) % driftWindowSize
 	}
-}
 
-func periodicallyWriteToStorage() {
-	ticker := time.NewTicker(500 * time.Millisecond)
-	defer ticker.Stop()
+	sorted := append([]float64(nil), clockDrift.samples...)
+	sort.Float64s(sorted)
+	median := time.Duration(sorted[len(sorted)/2]) * time.Second
+	metrics.set("ingest_clock_drift_median_seconds", median.Seconds())
 
-	for {
-		select {
-		case <-ticker.C:
-			var logs []LogEntry
-			for {
-				select {
-				case logEntry := <-logChannel:
-					logs = append(logs, logEntry)
-					inMemorySearchBuffer = append(inMemorySearchBuffer, logEntry)
-				default:
-					if len(logs) > 0 {
-						sort.Slice(logs, func(i, j int) bool {
-							return logs[i].Timestamp < logs[j].Timestamp
-						})
-
-						currentTime := time.Now()
-
-						currentMinuteFileName := fmt.Sprintf("%d-%02d-%02d-%02d-%02d.txt",
-							currentTime.Year(),
-							currentTime.Month(),
-							currentTime.Day(),
-							currentTime.Hour(),
-							currentTime.Minute())
-
-						fileName := filepath.Join(logsDirectory, currentMinuteFileName)
-
-						f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-						if err != nil {
-							log.Printf("Error opening log file %s: %v", fileName, err)
-							continue
-						}
-						defer f.Close()
-
-						for _, entry := range logs {
-							_, err := fmt.Fprintf(f, "{\"time\":  %d, \"log\":\"%s\"}\n", entry.Timestamp, entry.Message)
-							if err != nil {
-								log.Printf("Error writing log to file: %v", err)
-							}
-						}
-
-						logs = nil
-					}
-					break
-				}
-			}
+	warning := median > clockDriftWarning || -median > clockDriftWarning
+	if warning != clockDrift.warning {
+		clockDrift.warning = warning
+		if warning {
+			log.Printf("Warning: median clock drift of the last %d log entries is %s, exceeding CLOCK_DRIFT_WARNING %s, client clocks may be misconfigured", len(sorted), median, clockDriftWarning)
+		} else {
+			log.Printf("Median clock drift of the last %d log entries is back to %s", len(sorted), median)
 		}
 	}
 }
 
-func periodicallyUploadToS3() {
+// validEmbeddedJSON reports whether message is valid JSON if it looks like an object or array, other messages are valid
+func validEmbeddedJSON(message string) bool {
+	trimmed := strings.TrimSpace(message)
+	if !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+		return true
+	}
+	return json.Valid([]byte(trimmed))
+}
+
+/*
+Parses LEVEL_NUMERIC_MAP: "syslog" (or "true") maps the syslog severities 0-7 to EMERG ... DEBUG,
+otherwise the value lists the names of numeric levels, e.g. "10=DEBUG,20=INFO,30=WARN,40=ERROR"
+*/
+func parseLevelNumericMap(value string) (map[string]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if value == "syslog" || value == "true" {
+		levels := make(map[string]string, len(syslogSeverities))
+		for severity, name := range syslogSeverities {
+			levels[strconv.Itoa(severity)] = name
+		}
+		return levels, nil
+	}
+
+	levels := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		number, name, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid level mapping %q, expected number=NAME", pair)
+		}
+		if _, err := strconv.Atoi(number); err != nil {
+			return nil, fmt.Errorf("invalid level number %q", number)
+		}
+		levels[number] = name
+	}
+	return levels, nil
+}
+
+// Patterns enabled by name with REDACT
+var builtinRedactionRules = map[string]string{
+	"email":  `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,
+	"bearer": `(?i)\bbearer\s+[A-Za-z0-9._~+/-]+=*`,
+}
+
+/*
+parseRedactionRules compiles the built-in rules named in REDACT (comma-separated) followed by the custom ones,
+one regular expression per line of REDACTION_RULES_FILE, lines starting with # are ignored
+*/
+func parseRedactionRules(names string, lines []string) ([]*regexp.Regexp, error) {
+	var rules []*regexp.Regexp
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		expr, ok := builtinRedactionRules[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown rule %q, expected email or bearer", name)
+		}
+		rules = append(rules, regexp.MustCompile(expr))
+	}
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		re, err := regexp.Compile(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule on line %d: %v", i+1, err)
+		}
+		rules = append(rules, re)
+	}
+	return rules, nil
+}
+
+// redactEntries replaces the matches of the redaction rules in the messages and field values of entries, before they are admitted
+func redactEntries(entries []LogEntry) {
+	if len(redactionRules) == 0 {
+		return
+	}
+	redact := func(s string) (string, bool) {
+		redacted := s
+		for _, re := range redactionRules {
+			redacted = re.ReplaceAllLiteralString(redacted, redactionPlaceholder)
+		}
+		return redacted, redacted != s
+	}
+	for i := range entries {
+		message, changed := redact(entries[i].Message)
+		entries[i].Message = message
+		for name, value := range entries[i].Fields {
+			if redacted, ok := redact(value); ok {
+				entries[i].Fields[name] = redacted
+				changed = true
+			}
+		}
+		if changed {
+			metrics.add("ingest_redacted_entries_total", 1)
+		}
+	}
+}
+
+// stampSource sets the source field of entries that have none to SOURCE_NAME or, with SOURCE_CLIENT_IP, to the client address
+func stampSource(entries []LogEntry, remoteAddr string) {
+	source := sourceName
+	if source == "" && sourceClientIP {
+		source = remoteAddr
+		if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+			source = host
+		}
+	}
+	if source == "" {
+		return
+	}
+	for i := range entries {
+		if _, ok := entries[i].Fields["source"]; ok {
+			continue
+		}
+		if entries[i].Fields == nil {
+			entries[i].Fields = make(map[string]string)
+		}
+		entries[i].Fields["source"] = source
+	}
+}
+
+// ingestBody wraps a request body in a pooled buffered reader and counts the bytes read from it
+type ingestBody struct {
+	reader *bufio.Reader
+	body   io.Reader
+	n      int64
+}
+
+var ingestBodyPool = sync.Pool{
+	New: func() interface{} {
+		b := &ingestBody{}
+		b.reader = bufio.NewReaderSize(countingReader{b}, 32*1024)
+		return b
+	},
+}
+
+type countingReader struct {
+	b *ingestBody
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.b.body.Read(p)
+	c.b.n += int64(n)
+	return n, err
+}
+
+func (b *ingestBody) reset(body io.Reader) {
+	b.body = body
+	b.n = 0
+	b.reader.Reset(countingReader{b})
+}
+
+func (b *ingestBody) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+/*
+Decodes an ingest request body straight from the request, without reading it into memory first.
+The default format is a JSON array of log entries, format=map accepts a JSON object mapping epoch seconds
+to messages, as sent by legacy producers:
+
+{"1685426738":"msg1","1685426739":"msg2"}
+
+Bodies sent with Content-Type: application/x-protobuf (or format=protobuf) are a LogBatch as defined in log_entry.proto,
+those sent with Content-Type: application/x-ndjson (or format=ndjson) hold one JSON log entry per line, as most shippers send them.
+format=otlp and format=otlp_json decode OTLP log export requests, see otlpLogsHandler, format=loki and
+format=loki_json Loki push requests, see lokiPushHandler, and format=hec Splunk HEC events, see hecEventHandler.
+Bodies with more than MAX_INGEST_ENTRIES entries fail with errTooManyEntries, JSON arrays as soon as the limit is exceeded.
+*/
+func decodeLogEntries(format string, body io.Reader) ([]LogEntry, error) {
+	tooMany := func(n int) bool { return maxIngestEntries > 0 && n > maxIngestEntries }
+	decoder := json.NewDecoder(body)
+	switch format {
+	case "":
+		// Parse the JSON log entries array one entry at a time
+		if err := expectDelim(decoder, '['); err != nil {
+			return nil, err
+		}
+		var logEntries []LogEntry
+		for decoder.More() {
+			if tooMany(len(logEntries) + 1) {
+				return nil, errTooManyEntries
+			}
+			var entry LogEntry
+			if err := decoder.Decode(&entry); err != nil {
+				return nil, err
+			}
+			logEntries = append(logEntries, entry)
+		}
+		if err := expectDelim(decoder, ']'); err != nil {
+			return nil, err
+		}
+		return logEntries, expectEOF(decoder)
+	case "ndjson":
+		var logEntries []LogEntry
+		for {
+			var entry LogEntry
+			err := decoder.Decode(&entry)
+			if err == io.EOF {
+				return logEntries, nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("entry %d: %v", len(logEntries)+1, err)
+			}
+			if tooMany(len(logEntries) + 1) {
+				return nil, errTooManyEntries
+			}
+			logEntries = append(logEntries, entry)
+		}
+	case "map":
+		var messages map[string]string
+		if err := decoder.Decode(&messages); err != nil {
+			return nil, err
+		}
+		if err := expectEOF(decoder); err != nil {
+			return nil, err
+		}
+		if tooMany(len(messages)) {
+			return nil, errTooManyEntries
+		}
+
+		logEntries := make([]LogEntry, 0, len(messages))
+		for key, message := range messages {
+			timestamp, err := strconv.ParseInt(key, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp key %q", key)
+			}
+			logEntries = append(logEntries, LogEntry{Timestamp: timestamp, Message: message})
+		}
+		sort.Slice(logEntries, func(i, j int) bool {
+			return logEntries[i].Timestamp < logEntries[j].Timestamp
+		})
+		return logEntries, nil
+	case "protobuf":
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		logEntries, err := decodeProtobufBatch(data)
+		if err == nil && tooMany(len(logEntries)) {
+			return nil, errTooManyEntries
+		}
+		return logEntries, err
+	case "otlp", "otlp_json":
+		var request otlpLogsRequest
+		if format == "otlp_json" {
+			if err := decoder.Decode(&request); err != nil {
+				return nil, err
+			}
+			if err := expectEOF(decoder); err != nil {
+				return nil, err
+			}
+			if err := request.checkDepth(); err != nil {
+				return nil, err
+			}
+		} else {
+			data, err := io.ReadAll(body)
+			if err != nil {
+				return nil, err
+			}
+			if request, err = decodeOTLPRequest(data); err != nil {
+				return nil, err
+			}
+		}
+		logEntries := otlpEntries(request, time.Now())
+		if tooMany(len(logEntries)) {
+			return nil, errTooManyEntries
+		}
+		return logEntries, nil
+	case "loki", "loki_json":
+		var streams []lokiStream
+		if format == "loki_json" {
+			var request lokiPushRequest
+			if err := decoder.Decode(&request); err != nil {
+				return nil, err
+			}
+			if err := expectEOF(decoder); err != nil {
+				return nil, err
+			}
+			var err error
+			if streams, err = request.streams(); err != nil {
+				return nil, err
+			}
+		} else {
+			data, err := io.ReadAll(body)
+			if err != nil {
+				return nil, err
+			}
+			// Like gzip bodies, the decompressed size falls back to MAX_DECOMPRESSED_BYTES without MAX_INGEST_BODY_BYTES
+			limit := maxIngestBodyBytes
+			if limit <= 0 {
+				limit = maxDecompressedBytes
+			}
+			if data, err = decodeSnappy(data, limit); err != nil {
+				return nil, err
+			}
+			if streams, err = decodeLokiPushRequest(data); err != nil {
+				return nil, err
+			}
+		}
+		logEntries := lokiEntries(streams, time.Now())
+		if tooMany(len(logEntries)) {
+			return nil, errTooManyEntries
+		}
+		return logEntries, nil
+	case "hec":
+		// HEC batches are concatenated event objects, not an array
+		var logEntries []LogEntry
+		for {
+			var event hecEvent
+			if err := decoder.Decode(&event); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			if tooMany(len(logEntries) + 1) {
+				return nil, errTooManyEntries
+			}
+			entry, err := event.entry(time.Now())
+			if err != nil {
+				return nil, fmt.Errorf("event %d: %w", len(logEntries), err)
+			}
+			logEntries = append(logEntries, entry)
+		}
+		if len(logEntries) == 0 {
+			return nil, errHECNoData
+		}
+		return logEntries, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// decodeProtobufBatch decodes the wire format of a LogBatch, unknown fields are skipped
+func decodeProtobufBatch(data []byte) ([]LogEntry, error) {
+	var logEntries []LogEntry
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+		if num == 1 && typ == protowire.BytesType {
+			value, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			entry, err := decodeProtobufEntry(value)
+			if err != nil {
+				return nil, err
+			}
+			logEntries = append(logEntries, entry)
+			data = data[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return logEntries, nil
+}
+
+func decodeProtobufEntry(data []byte) (LogEntry, error) {
+	var entry LogEntry
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return entry, protowire.ParseError(n)
+		}
+		data = data[n:]
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			value, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return entry, protowire.ParseError(n)
+			}
+			entry.Timestamp = int64(value)
+			data = data[n:]
+		case (num == 2 || num == 3) && typ == protowire.BytesType:
+			value, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return entry, protowire.ParseError(n)
+			}
+			if num == 2 {
+				entry.Message = value
+			} else {
+				entry.Level = value
+			}
+			data = data[n:]
+		case num == 4 && typ == protowire.BytesType:
+			value, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return entry, protowire.ParseError(n)
+			}
+			key, fieldValue, err := decodeProtobufMapEntry(value)
+			if err != nil {
+				return entry, err
+			}
+			if entry.Fields == nil {
+				entry.Fields = make(map[string]string)
+			}
+			entry.Fields[key] = fieldValue
+			data = data[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return entry, protowire.ParseError(n)
+			}
+			data = data[n:]
+		}
+	}
+	return entry, nil
+}
+
+func decodeProtobufMapEntry(data []byte) (key, value string, err error) {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		data = data[n:]
+		if (num == 1 || num == 2) && typ == protowire.BytesType {
+			s, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return "", "", protowire.ParseError(n)
+			}
+			if num == 1 {
+				key = s
+			} else {
+				value = s
+			}
+			data = data[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return key, value, nil
+}
+
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("expected %v, got %v", delim, token)
+	}
+	return nil
+}
+
+// expectEOF fails on anything but whitespace after the decoded value, like json.Unmarshal does
+func expectEOF(decoder *json.Decoder) error {
+	if _, err := decoder.Token(); err != io.EOF {
+		if err == nil {
+			return fmt.Errorf("unexpected data after the log entries")
+		}
+		return err
+	}
+	return nil
+}
+
+/*
+enqueueInputEntries admits the entries received by a network input (syslog, ...) like ingestHandler and sends them
+to logChannel. Unlike HTTP clients, the senders can't be asked to retry, so entries are dropped, and counted in
+input_dropped_entries_total, while ingestion is shut down, paused or rejected for backpressure, and false is returned.
+Tenant quotas and deduplication only apply to /ingest.
+*/
+func enqueueInputEntries(input, remoteAddr string, entries []LogEntry) bool {
+	reason := ""
+	switch {
+	case !ingestAccepting.Load():
+		reason = "shutdown"
+	case readOnly.Load():
+		reason = "read_only"
+	case memoryPressure.Load():
+		reason = "memory_pressure"
+	case failingSinks.Load() > 0:
+		reason = "sink_failing"
+	case maxLocalDiskBytes > 0 && localDiskUsage.Load() > maxLocalDiskBytes:
+		reason = "disk_full"
+	}
+	if reason != "" {
+		metrics.add(fmt.Sprintf("input_dropped_entries_total{input=%q,reason=%q}", input, reason), float64(len(entries)))
+		return false
+	}
+
+	redactEntries(entries)
+	entries, rejected := admitLogEntries(entries, time.Now())
+	if len(rejected) > 0 {
+		metrics.add(fmt.Sprintf("input_dropped_entries_total{input=%q,reason=\"rejected\"}", input), float64(len(rejected)))
+	}
+	stampSource(entries, remoteAddr)
+
+	ingestSendMu.RLock()
+	defer ingestSendMu.RUnlock()
+	if !ingestAccepting.Load() {
+		metrics.add(fmt.Sprintf("input_dropped_entries_total{input=%q,reason=\"shutdown\"}", input), float64(len(entries)))
+		return false
+	}
+	for _, logEntry := range entries {
+		logChannel <- logEntry
+	}
+	metrics.add(fmt.Sprintf("input_entries_total{input=%q}", input), float64(len(entries)))
+	return true
+}
+
+// Names of the syslog severities 0-7, the levels of syslog entries
+var syslogSeverities = [...]string{"EMERG", "ALERT", "CRIT", "ERR", "WARNING", "NOTICE", "INFO", "DEBUG"}
+
+// Longest syslog message accepted, TCP connections sending longer ones are closed
+const maxSyslogMessageBytes = 64 * 1024
+
+// Most digits read for the length of an octet counted syslog frame, before it is rejected
+const maxSyslogFrameLengthDigits = 10
+
+// Pause after a failed read of a listener before reading again, so that persistent errors don't spin
+const inputReadErrorBackoff = 100 * time.Millisecond
+
+/*
+listenSyslog receives syslog messages on addr over UDP, one message per datagram, and TCP, framed by octet counting
+("LEN MSG") or by newlines (RFC 6587), and feeds them to logChannel, see parseSyslogMessage.
+Malformed messages are counted in input_invalid_messages_total.
+*/
+func listenSyslog(addr string) error {
+	packetConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		packetConn.Close()
+		return err
+	}
+	log.Printf("Syslog listening on %s (udp, tcp)", addr)
+
+	go receiveSyslogDatagrams(packetConn)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				log.Printf("Error accepting syslog connection: %v", err)
+				time.Sleep(inputReadErrorBackoff)
+				continue
+			}
+			go handleSyslogConn(conn)
+		}
+	}()
+	return nil
+}
+
+// receiveSyslogDatagrams enqueues the syslog message of every datagram received on packetConn until it is closed
+func receiveSyslogDatagrams(packetConn net.PacketConn) {
+	buf := make([]byte, maxSyslogMessageBytes)
+	for {
+		n, remote, err := packetConn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Error receiving syslog datagram: %v", err)
+			time.Sleep(inputReadErrorBackoff)
+			continue
+		}
+		if entry, ok := parseSyslogInput(string(buf[:n])); ok {
+			enqueueInputEntries("syslog", remote.String(), []LogEntry{entry})
+		}
+	}
+}
+
+// handleSyslogConn reads the messages of a TCP syslog connection, enqueueing those that arrived together as one batch
+func handleSyslogConn(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReaderSize(conn, maxSyslogMessageBytes)
+	var batch []LogEntry
+	for {
+		message, err := readSyslogFrame(reader)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Error reading syslog connection from %s: %v", conn.RemoteAddr(), err)
+			}
+			break
+		}
+		if entry, ok := parseSyslogInput(message); ok {
+			batch = append(batch, entry)
+		}
+		if len(batch) > 0 && (reader.Buffered() == 0 || len(batch) >= 1000) {
+			enqueueInputEntries("syslog", conn.RemoteAddr().String(), batch)
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		enqueueInputEntries("syslog", conn.RemoteAddr().String(), batch)
+	}
+}
+
+/*
+readSyslogFrame reads the next message of a TCP syslog stream, octet counted when it starts with a digit.
+The length of an octet counted frame is read a digit at a time, so that a stream of digits without the space ending
+them is rejected after maxSyslogFrameLengthDigits instead of being buffered.
+*/
+func readSyslogFrame(reader *bufio.Reader) (string, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if first[0] >= '0' && first[0] <= '9' {
+		var length []byte
+		for {
+			c, err := reader.ReadByte()
+			if err == io.EOF {
+				return "", io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				return "", err
+			}
+			if c == ' ' {
+				break
+			}
+			length = append(length, c)
+			if c < '0' || c > '9' || len(length) > maxSyslogFrameLengthDigits {
+				return "", fmt.Errorf("invalid syslog frame length %q", length)
+			}
+		}
+		n, err := strconv.Atoi(string(length))
+		if err != nil || n <= 0 || n > maxSyslogMessageBytes {
+			return "", fmt.Errorf("invalid syslog frame length %q", length)
+		}
+		message := make([]byte, n)
+		if _, err := io.ReadFull(reader, message); err != nil {
+			return "", err
+		}
+		return string(message), nil
+	}
+	line, err := reader.ReadSlice('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(line), nil
+}
+
+// parseSyslogInput parses a received message, counting the malformed ones
+func parseSyslogInput(message string) (LogEntry, bool) {
+	message = strings.TrimRight(message, "\r\n\x00")
+	if message == "" {
+		return LogEntry{}, false
+	}
+	entry, err := parseSyslogMessage(message, time.Now())
+	if err != nil {
+		metrics.add(`input_invalid_messages_total{input="syslog"}`, 1)
+		return LogEntry{}, false
+	}
+	return entry, true
+}
+
+/*
+parseSyslogMessage parses an RFC 5424 or RFC 3164 syslog message into an entry. The level is the name of the severity,
+the hostname, app name (or tag), process ID, message ID and facility are kept as fields when present.
+Entries are timestamped now when the header has no usable time. RFC 3164 times, which lack year and zone, are taken
+to be local and in the last year.
+
+<34>1 2024-03-02T05:07:00.123Z web-1 nginx 812 - - connection reset
+<34>Mar  2 05:07:00 web-1 nginx[812]: connection reset
+*/
+func parseSyslogMessage(message string, now time.Time) (LogEntry, error) {
+	end := strings.IndexByte(message, '>')
+	if !strings.HasPrefix(message, "<") || end < 2 || end > 4 {
+		return LogEntry{}, fmt.Errorf("missing syslog priority")
+	}
+	priority, err := strconv.Atoi(message[1:end])
+	if err != nil || priority < 0 || priority > 191 {
+		return LogEntry{}, fmt.Errorf("invalid syslog priority %q", message[1:end])
+	}
+	entry := LogEntry{
+		Timestamp: now.Unix(),
+		Level:     syslogSeverities[priority%8],
+		Fields:    map[string]string{"facility": strconv.Itoa(priority / 8)},
+	}
+	setField := func(name, value string) {
+		if value != "" && value != "-" {
+			entry.Fields[name] = value
+		}
+	}
+	rest := message[end+1:]
+
+	// RFC 5424: VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	if strings.HasPrefix(rest, "1 ") {
+		parts := strings.SplitN(rest[2:], " ", 6)
+		if len(parts) < 6 {
+			return LogEntry{}, fmt.Errorf("incomplete RFC 5424 header")
+		}
+		if parts[0] != "-" {
+			timestamp, err := time.Parse(time.RFC3339Nano, parts[0])
+			if err != nil {
+				return LogEntry{}, fmt.Errorf("invalid RFC 5424 timestamp %q", parts[0])
+			}
+			entry.Timestamp = timestamp.Unix()
+		}
+		setField("host", parts[1])
+		setField("app", parts[2])
+		setField("procid", parts[3])
+		setField("msgid", parts[4])
+		entry.Message = strings.TrimPrefix(skipStructuredData(parts[5]), "\xef\xbb\xbf")
+		return entry, nil
+	}
+
+	// RFC 3164: TIMESTAMP HOSTNAME TAG: MSG, anything else after the priority is the message
+	const stamp = "Jan _2 15:04:05"
+	if len(rest) > len(stamp) && rest[len(stamp)] == ' ' {
+		if timestamp, err := time.ParseInLocation(stamp, rest[:len(stamp)], now.Location()); err == nil {
+			timestamp = timestamp.AddDate(now.Year(), 0, 0)
+			if timestamp.After(now.Add(24 * time.Hour)) {
+				timestamp = timestamp.AddDate(-1, 0, 0)
+			}
+			entry.Timestamp = timestamp.Unix()
+			rest = rest[len(stamp)+1:]
+			if host, body, ok := strings.Cut(rest, " "); ok {
+				setField("host", host)
+				rest = body
+			}
+			if tag, body, ok := strings.Cut(rest, ": "); ok && !strings.Contains(tag, " ") {
+				app, procid, _ := strings.Cut(strings.TrimSuffix(tag, "]"), "[")
+				setField("app", app)
+				setField("procid", procid)
+				rest = body
+			}
+		}
+	}
+	entry.Message = rest
+	return entry, nil
+}
+
+// skipStructuredData returns what follows the STRUCTURED-DATA of an RFC 5424 message, "-" or [id param="value"] elements
+func skipStructuredData(rest string) string {
+	if rest == "-" || strings.HasPrefix(rest, "- ") {
+		return strings.TrimPrefix(strings.TrimPrefix(rest, "-"), " ")
+	}
+	i, quoted := 0, false
+	for i < len(rest) && rest[i] == '[' {
+		for i++; i < len(rest); i++ {
+			if rest[i] == '\\' && quoted {
+				i++
+			} else if rest[i] == '"' {
+				quoted = !quoted
+			} else if rest[i] == ']' && !quoted {
+				i++
+				break
+			}
+		}
+	}
+	return strings.TrimPrefix(rest[i:], " ")
+}
+
+// GELF datagrams start with these bytes when they are a chunk of a larger message
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+const (
+	// Largest decompressed GELF message accepted
+	maxGELFMessageBytes = 1024 * 1024
+	// Chunked GELF messages not complete within this are discarded, as recommended by the GELF specification
+	gelfChunkTimeout = 5 * time.Second
+	// Bounds the chunked messages reassembled at once, chunks of further messages are discarded
+	maxPendingGELFMessages = 1000
+)
+
+// gelfMessage collects the chunks of a chunked GELF message
+type gelfMessage struct {
+	chunks   [][]byte
+	received int
+	first    time.Time
+}
+
+/*
+listenGELF receives GELF messages on addr over UDP, uncompressed, gzip or zlib compressed, and chunked messages
+once all their chunks arrived, and feeds them to logChannel, see parseGELFMessage.
+Malformed messages and discarded chunks are counted in input_invalid_messages_total.
+*/
+func listenGELF(addr string) error {
+	packetConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("GELF listening on %s (udp)", addr)
+
+	go receiveGELFDatagrams(packetConn)
+	return nil
+}
+
+// receiveGELFDatagrams enqueues the GELF messages received on packetConn until it is closed, reassembling chunked ones
+func receiveGELFDatagrams(packetConn net.PacketConn) {
+	pending := make(map[string]*gelfMessage)
+	buf := make([]byte, 65536)
+	for {
+		n, remote, err := packetConn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Error receiving GELF datagram: %v", err)
+			time.Sleep(inputReadErrorBackoff)
+			continue
+		}
+		datagram := buf[:n]
+		if bytes.HasPrefix(datagram, gelfChunkMagic) {
+			datagram = reassembleGELFChunk(pending, append([]byte(nil), datagram...), time.Now())
+			if datagram == nil {
+				continue
+			}
+		}
+		entry, err := parseGELFMessage(datagram, time.Now())
+		if err != nil {
+			metrics.add(`input_invalid_messages_total{input="gelf"}`, 1)
+			continue
+		}
+		enqueueInputEntries("gelf", remote.String(), []LogEntry{entry})
+	}
+}
+
+/*
+reassembleGELFChunk adds a chunk (magic, 8 byte message ID, sequence number, sequence count, payload) to the pending
+messages and returns the message once all its chunks arrived, nil until then. Messages pending for longer than
+gelfChunkTimeout are discarded.
+*/
+func reassembleGELFChunk(pending map[string]*gelfMessage, chunk []byte, now time.Time) []byte {
+	for id, message := range pending {
+		if now.Sub(message.first) > gelfChunkTimeout {
+			metrics.add(`input_invalid_messages_total{input="gelf"}`, 1)
+			delete(pending, id)
+		}
+	}
+
+	if len(chunk) < 12 {
+		metrics.add(`input_invalid_messages_total{input="gelf"}`, 1)
+		return nil
+	}
+	id, sequence, count := string(chunk[2:10]), int(chunk[10]), int(chunk[11])
+	if count == 0 || count > 128 || sequence >= count {
+		metrics.add(`input_invalid_messages_total{input="gelf"}`, 1)
+		return nil
+	}
+	message := pending[id]
+	if message == nil {
+		if len(pending) >= maxPendingGELFMessages {
+			metrics.add(`input_invalid_messages_total{input="gelf"}`, 1)
+			return nil
+		}
+		message = &gelfMessage{chunks: make([][]byte, count), first: now}
+		pending[id] = message
+	}
+	if len(message.chunks) != count || message.chunks[sequence] != nil {
+		return nil
+	}
+	message.chunks[sequence] = chunk[12:]
+	message.received++
+	if message.received < count {
+		return nil
+	}
+	delete(pending, id)
+	return bytes.Join(message.chunks, nil)
+}
+
+/*
+parseGELFMessage decodes a GELF message into an entry: timestamp (fractional seconds, now when missing) becomes time,
+short_message the message, level the name of its syslog severity, and host, full_message and the additional fields
+(prefixed with _) are stored as fields.
+
+{"version":"1.1","host":"web-1","short_message":"connection reset","timestamp":1709356020.123,"level":3,"_user_id":42}
+*/
+func parseGELFMessage(data []byte, now time.Time) (LogEntry, error) {
+	var reader io.Reader = bytes.NewReader(data)
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return LogEntry{}, err
+		}
+		reader = gzipReader
+	case len(data) > 0 && data[0] == 0x78:
+		zlibReader, err := zlib.NewReader(reader)
+		if err != nil {
+			return LogEntry{}, err
+		}
+		reader = zlibReader
+	}
+	content, err := io.ReadAll(io.LimitReader(reader, maxGELFMessageBytes+1))
+	if err != nil {
+		return LogEntry{}, err
+	}
+	if len(content) > maxGELFMessageBytes {
+		return LogEntry{}, fmt.Errorf("GELF message exceeds %d bytes", maxGELFMessageBytes)
+	}
+
+	var message map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(&message); err != nil {
+		return LogEntry{}, err
+	}
+	shortMessage, ok := message["short_message"].(string)
+	if !ok {
+		return LogEntry{}, fmt.Errorf("GELF message without short_message")
+	}
+
+	entry := LogEntry{Timestamp: now.Unix(), Message: shortMessage, Fields: make(map[string]string)}
+	if timestamp, ok := message["timestamp"].(json.Number); ok {
+		seconds, err := timestamp.Float64()
+		if err != nil {
+			return LogEntry{}, fmt.Errorf("invalid GELF timestamp %q", timestamp)
+		}
+		entry.Timestamp = int64(seconds)
+	}
+	if level, ok := message["level"].(json.Number); ok {
+		if severity, err := level.Int64(); err == nil && severity >= 0 && severity < int64(len(syslogSeverities)) {
+			entry.Level = syslogSeverities[severity]
+		}
+	}
+	for name, value := range message {
+		field := strings.TrimPrefix(name, "_")
+		if name != "host" && name != "full_message" && (field == name || field == "id" || field == "") {
+			continue
+		}
+		switch value := value.(type) {
+		case string:
+			entry.Fields[field] = value
+		case json.Number:
+			entry.Fields[field] = value.String()
+		case bool:
+			entry.Fields[field] = strconv.FormatBool(value)
+		}
+	}
+	return entry, nil
+}
+
+// Longest string, binary or collection accepted by the msgpack decoder, bounding what a malformed length can allocate
+const maxMsgpackLength = 16 * 1024 * 1024
+
+// Deepest nesting of msgpack arrays and maps accepted, bounding the recursion of the decoder
+const maxMsgpackDepth = 64
+
+// Most bytes read for one forward protocol message, connections sending longer ones are closed
+const maxForwardMessageBytes = 64 * 1024 * 1024
+
+var errForwardMessageTooLong = fmt.Errorf("forward message exceeds %d bytes", maxForwardMessageBytes)
+
+// msgpackReader is read by the msgpack decoder
+type msgpackReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// limitedMsgpackReader reads at most remaining bytes from reader, failing with errForwardMessageTooLong beyond them
+type limitedMsgpackReader struct {
+	reader    msgpackReader
+	remaining int64
+}
+
+func (r *limitedMsgpackReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, errForwardMessageTooLong
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.reader.Read(p)
+	r.remaining -= int64(n)
+	return n, err
+}
+
+func (r *limitedMsgpackReader) ReadByte() (byte, error) {
+	if r.remaining <= 0 {
+		return 0, errForwardMessageTooLong
+	}
+	b, err := r.reader.ReadByte()
+	if err == nil {
+		r.remaining--
+	}
+	return b, err
+}
+
+// msgpackExt is a msgpack extension value, as the EventTime (type 0) of the forward protocol
+type msgpackExt struct {
+	typ  int8
+	data []byte
+}
+
+/*
+decodeMsgpack reads the next msgpack value. Integers are returned as int64 (uint64 beyond its range), floats as float64,
+str as string, bin as []byte, arrays as []interface{}, maps as map[string]interface{} with their keys formatted
+and extensions as msgpackExt. depth is the number of arrays and maps the value is nested in, values nested in more
+than maxMsgpackDepth are rejected.
+*/
+func decodeMsgpack(reader msgpackReader, depth int) (interface{}, error) {
+	b, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	readN := func(n int) ([]byte, error) {
+		if n < 0 || n > maxMsgpackLength {
+			return nil, fmt.Errorf("msgpack length %d exceeds %d", n, maxMsgpackLength)
+		}
+		data := make([]byte, n)
+		_, err := io.ReadFull(reader, data)
+		return data, err
+	}
+	readUint := func(size int) (uint64, error) {
+		data, err := readN(size)
+		if err != nil {
+			return 0, err
+		}
+		var value uint64
+		for _, b := range data {
+			value = value<<8 | uint64(b)
+		}
+		return value, nil
+	}
+	readLength := func(size int) (int, error) {
+		n, err := readUint(size)
+		return int(n), err
+	}
+
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xe0 == 0xa0:
+		data, err := readN(int(b & 0x1f))
+		return string(data), err
+	case b&0xf0 == 0x90:
+		return decodeMsgpackArray(reader, int(b&0x0f), depth+1)
+	case b&0xf0 == 0x80:
+		return decodeMsgpackMap(reader, int(b&0x0f), depth+1)
+	}
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2, 0xc3:
+		return b == 0xc3, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		value, err := readUint(1 << (b - 0xcc))
+		if value > math.MaxInt64 {
+			return value, err
+		}
+		return int64(value), err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (b - 0xd0)
+		value, err := readUint(size)
+		// Sign extended from the width of the integer
+		shift := 64 - 8*size
+		return int64(value<<shift) >> shift, err
+	case 0xca:
+		value, err := readUint(4)
+		return float64(math.Float32frombits(uint32(value))), err
+	case 0xcb:
+		value, err := readUint(8)
+		return math.Float64frombits(value), err
+	case 0xd9, 0xda, 0xdb, 0xc4, 0xc5, 0xc6:
+		size := map[byte]int{0xd9: 1, 0xda: 2, 0xdb: 4, 0xc4: 1, 0xc5: 2, 0xc6: 4}[b]
+		n, err := readLength(size)
+		if err != nil {
+			return nil, err
+		}
+		data, err := readN(n)
+		if b >= 0xd9 {
+			return string(data), err
+		}
+		return data, err
+	case 0xdc, 0xdd:
+		n, err := readLength(2 << (b - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return decodeMsgpackArray(reader, n, depth+1)
+	case 0xde, 0xdf:
+		n, err := readLength(2 << (b - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return decodeMsgpackMap(reader, n, depth+1)
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xc7, 0xc8, 0xc9:
+		var n int
+		if b >= 0xd4 {
+			n = 1 << (b - 0xd4)
+		} else if n, err = readLength(1 << (b - 0xc7)); err != nil {
+			return nil, err
+		}
+		typ, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		data, err := readN(n)
+		return msgpackExt{typ: int8(typ), data: data}, err
+	}
+	return nil, fmt.Errorf("invalid msgpack type 0x%02x", b)
+}
+
+func decodeMsgpackArray(reader msgpackReader, n, depth int) ([]interface{}, error) {
+	if n > maxMsgpackLength {
+		return nil, fmt.Errorf("msgpack length %d exceeds %d", n, maxMsgpackLength)
+	}
+	if depth > maxMsgpackDepth {
+		return nil, fmt.Errorf("msgpack nesting exceeds %d levels", maxMsgpackDepth)
+	}
+	var values []interface{}
+	for i := 0; i < n; i++ {
+		value, err := decodeMsgpack(reader, depth)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func decodeMsgpackMap(reader msgpackReader, n, depth int) (map[string]interface{}, error) {
+	if n > maxMsgpackLength {
+		return nil, fmt.Errorf("msgpack length %d exceeds %d", n, maxMsgpackLength)
+	}
+	if depth > maxMsgpackDepth {
+		return nil, fmt.Errorf("msgpack nesting exceeds %d levels", maxMsgpackDepth)
+	}
+	values := make(map[string]interface{})
+	for i := 0; i < n; i++ {
+		key, err := decodeMsgpack(reader, depth)
+		if err != nil {
+			return nil, err
+		}
+		value, err := decodeMsgpack(reader, depth)
+		if err != nil {
+			return nil, err
+		}
+		if data, ok := key.([]byte); ok {
+			key = string(data)
+		}
+		values[fmt.Sprint(key)] = value
+	}
+	return values, nil
+}
+
+/*
+listenForward receives events over TCP in the Fluentd forward protocol, as sent by out_forward of fluentd and
+Fluent Bit, and feeds them to logChannel. The Message, Forward, PackedForward and CompressedPackedForward modes are
+accepted, and a chunk option is acknowledged once its events are enqueued, see enqueueInputEntries. Shared key authentication (HELO/PING)
+and the UDP heartbeat are not supported.
+*/
+func listenForward(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Fluentd forward listening on %s (tcp)", addr)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				log.Printf("Error accepting forward connection: %v", err)
+				time.Sleep(inputReadErrorBackoff)
+				continue
+			}
+			go handleForwardConn(conn)
+		}
+	}()
+	return nil
+}
+
+// handleForwardConn reads the forward messages of a connection until it is closed or sends malformed data
+func handleForwardConn(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReaderSize(conn, 64*1024)
+	for {
+		value, err := decodeMsgpack(&limitedMsgpackReader{reader: reader, remaining: maxForwardMessageBytes}, 0)
+		if err != nil {
+			if err != io.EOF {
+				metrics.add(`input_invalid_messages_total{input="forward"}`, 1)
+				log.Printf("Error reading forward connection from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		entries, chunk, err := decodeForwardMessage(value)
+		if err != nil {
+			metrics.add(`input_invalid_messages_total{input="forward"}`, 1)
+			log.Printf("Error decoding forward message from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		// Chunks whose entries were dropped aren't acknowledged, so that the forwarder sends them again
+		if len(entries) > 0 && !enqueueInputEntries("forward", conn.RemoteAddr().String(), entries) {
+			continue
+		}
+		if chunk != "" {
+			if _, err := conn.Write(forwardAck(chunk)); err != nil {
+				log.Printf("Error acknowledging forward chunk to %s: %v", conn.RemoteAddr(), err)
+				return
+			}
+		}
+	}
+}
+
+// decodeForwardMessage returns the entries of a forward protocol message and the chunk ID to acknowledge, if any
+func decodeForwardMessage(value interface{}) ([]LogEntry, string, error) {
+	message, ok := value.([]interface{})
+	if !ok || len(message) < 2 {
+		return nil, "", fmt.Errorf("expected a [tag, ...] array")
+	}
+	tag, ok := message[0].(string)
+	if !ok {
+		return nil, "", fmt.Errorf("expected a string tag")
+	}
+	optionOf := func(i int) map[string]interface{} {
+		if len(message) > i {
+			option, _ := message[i].(map[string]interface{})
+			return option
+		}
+		return nil
+	}
+
+	var entries []LogEntry
+	var option map[string]interface{}
+	switch events := message[1].(type) {
+	case []interface{}:
+		// Forward mode: [tag, [[time, record], ...], option]
+		for _, event := range events {
+			pair, ok := event.([]interface{})
+			if !ok || len(pair) < 2 {
+				return nil, "", fmt.Errorf("expected [time, record] events")
+			}
+			entry, err := forwardEntry(tag, pair[0], pair[1])
+			if err != nil {
+				return nil, "", err
+			}
+			entries = append(entries, entry)
+		}
+		option = optionOf(2)
+	case string, []byte:
+		// PackedForward mode: [tag, msgpack stream of [time, record], option], gzip compressed with compressed=gzip
+		option = optionOf(2)
+		var stream io.Reader
+		if packed, ok := events.([]byte); ok {
+			stream = bytes.NewReader(packed)
+		} else {
+			stream = strings.NewReader(events.(string))
+		}
+		if option["compressed"] == "gzip" {
+			gzipReader, err := gzip.NewReader(stream)
+			if err != nil {
+				return nil, "", err
+			}
+			stream = io.LimitReader(gzipReader, maxMsgpackLength)
+		}
+		packedReader := bufio.NewReader(stream)
+		for {
+			event, err := decodeMsgpack(packedReader, 0)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, "", err
+			}
+			pair, ok := event.([]interface{})
+			if !ok || len(pair) < 2 {
+				return nil, "", fmt.Errorf("expected [time, record] events")
+			}
+			entry, err := forwardEntry(tag, pair[0], pair[1])
+			if err != nil {
+				return nil, "", err
+			}
+			entries = append(entries, entry)
+		}
+	default:
+		// Message mode: [tag, time, record, option]
+		if len(message) < 3 {
+			return nil, "", fmt.Errorf("expected [tag, time, record]")
+		}
+		entry, err := forwardEntry(tag, message[1], message[2])
+		if err != nil {
+			return nil, "", err
+		}
+		entries = append(entries, entry)
+		option = optionOf(3)
+	}
+	chunk, _ := option["chunk"].(string)
+	return entries, chunk, nil
+}
+
+/*
+forwardEntry converts a forward event into an entry. The message is the record's log or message key (the record as
+JSON without either), its level or severity the level, and the tag and the other keys are stored as fields.
+*/
+func forwardEntry(tag string, eventTime, value interface{}) (LogEntry, error) {
+	record, ok := value.(map[string]interface{})
+	if !ok {
+		return LogEntry{}, fmt.Errorf("expected a record map")
+	}
+	entry := LogEntry{Fields: map[string]string{"tag": tag}}
+	switch eventTime := eventTime.(type) {
+	case int64:
+		entry.Timestamp = eventTime
+	case uint64:
+		entry.Timestamp = int64(eventTime)
+	case float64:
+		entry.Timestamp = int64(eventTime)
+	case msgpackExt:
+		// EventTime: seconds and nanoseconds as big-endian 32 bit integers
+		if eventTime.typ != 0 || len(eventTime.data) != 8 {
+			return LogEntry{}, fmt.Errorf("invalid event time extension")
+		}
+		entry.Timestamp = int64(binary.BigEndian.Uint32(eventTime.data[:4]))
+	default:
+		return LogEntry{}, fmt.Errorf("invalid event time %v", eventTime)
+	}
+
+	messageKey := ""
+	for _, key := range []string{"log", "message"} {
+		if message, ok := record[key].(string); ok {
+			entry.Message, messageKey = message, key
+			break
+		}
+	}
+	if messageKey == "" {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return LogEntry{}, err
+		}
+		entry.Message = string(data)
+	}
+	for name, value := range record {
+		if name == messageKey {
+			continue
+		}
+		var field string
+		switch value := value.(type) {
+		case string:
+			field = value
+		case []byte:
+			field = string(value)
+		case int64, uint64, float64, bool:
+			field = fmt.Sprint(value)
+		default:
+			continue
+		}
+		if (name == "level" || name == "severity") && entry.Level == "" {
+			entry.Level = field
+			continue
+		}
+		entry.Fields[name] = field
+	}
+	return entry, nil
+}
+
+// forwardAck encodes the {"ack": chunk} response acknowledging a chunk
+func forwardAck(chunk string) []byte {
+	ack := []byte{0x81, 0xa3, 'a', 'c', 'k'}
+	switch n := len(chunk); {
+	case n < 32:
+		ack = append(ack, 0xa0|byte(n))
+	case n < 256:
+		ack = append(ack, 0xd9, byte(n))
+	default:
+		ack = append(ack, 0xda, byte(n>>8), byte(n))
+	}
+	return append(ack, chunk...)
+}
+
+// Largest message accepted on a gRPC stream, the default receive limit of gRPC servers
+const maxGRPCMessageBytes = 4 * 1024 * 1024
+
+// gRPC status codes answered by the LogService
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+/*
+listenGRPC serves the LogService of log_entry.proto on addr, over HTTP/2 without TLS as gRPC clients connect with
+insecure credentials, so that producers can stream their entries over one long-lived call, see grpcIngestHandler.
+TLS, compressed messages and the reflection and health services are not supported.
+*/
+func listenGRPC(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("gRPC listening on %s (h2c)", addr)
+
+	server := newGRPCServer()
+	grpcServer = server
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Error serving gRPC: %v", err)
+		}
+	}()
+	return nil
+}
+
+// newGRPCServer returns the HTTP/2 only server of the gRPC methods
+func newGRPCServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/logingest.LogService/Ingest", grpcIngestHandler)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		writeGRPCStatus(w, grpcUnimplemented, fmt.Sprintf("unknown method %s", r.URL.Path))
+	})
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Server{Handler: mux, Protocols: &protocols}
+}
+
+/*
+grpcIngestHandler serves the client streaming LogService.Ingest call: each LogBatch message of the stream is
+decoded like a protobuf /ingest body and its entries are sent to logChannel as it arrives, see enqueueInputEntries.
+Once the client closes the stream, the IngestResponse reports the number of entries received.
+
+A message that can't be decoded ends the call with INVALID_ARGUMENT and one arriving while ingestion is paused or
+rejected for backpressure with UNAVAILABLE, the entries of the messages before it are kept, so a client retrying
+the call should only send the remaining ones. With API_KEYS, the call needs a key with the write scope in its
+x-api-key or authorization metadata.
+*/
+func grpcIngestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "Expected a gRPC request", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	if code, ok := checkScope(r, scopeWrite); !ok {
+		if code == http.StatusForbidden {
+			writeGRPCStatus(w, grpcPermissionDenied, fmt.Sprintf("Forbidden, the key lacks the %s scope", scopeWrite))
+		} else {
+			writeGRPCStatus(w, grpcUnauthenticated, "Unauthorized")
+		}
+		return
+	}
+
+	received := 0
+	header := make([]byte, 5)
+	for {
+		// Every message is prefixed with a compression flag and its length
+		if _, err := io.ReadFull(r.Body, header); err == io.EOF {
+			break
+		} else if err != nil {
+			writeGRPCStatus(w, grpcInternal, fmt.Sprintf("Error reading stream: %v", err))
+			return
+		}
+		if header[0] != 0 {
+			writeGRPCStatus(w, grpcUnimplemented, "Compressed messages are not supported")
+			return
+		}
+		length := binary.BigEndian.Uint32(header[1:])
+		if length > maxGRPCMessageBytes {
+			writeGRPCStatus(w, grpcResourceExhausted, fmt.Sprintf("Message of %d bytes exceeds %d bytes", length, maxGRPCMessageBytes))
+			return
+		}
+		message := make([]byte, length)
+		if _, err := io.ReadFull(r.Body, message); err != nil {
+			writeGRPCStatus(w, grpcInternal, fmt.Sprintf("Error reading stream: %v", err))
+			return
+		}
+
+		entries, err := decodeProtobufBatch(message)
+		if err != nil {
+			metrics.add(`input_invalid_messages_total{input="grpc"}`, 1)
+			writeGRPCStatus(w, grpcInvalidArgument, fmt.Sprintf("Invalid LogBatch: %v", err))
+			return
+		}
+		if len(entries) > 0 && !enqueueInputEntries("grpc", r.RemoteAddr, entries) {
+			writeGRPCStatus(w, grpcUnavailable, fmt.Sprintf("Not accepting entries, retry later, %d entries were received", received))
+			return
+		}
+		received += len(entries)
+	}
+
+	// IngestResponse{entries: received}
+	response := protowire.AppendTag(nil, 1, protowire.VarintType)
+	response = protowire.AppendVarint(response, uint64(received))
+	frame := make([]byte, 5, 5+len(response))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(response)))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(append(frame, response...)); err != nil {
+		log.Printf("Error writing gRPC response to %s: %v", r.RemoteAddr, err)
+		return
+	}
+	writeGRPCStatus(w, grpcOK, "")
+}
+
+// writeGRPCStatus ends a gRPC call with the grpc-status and grpc-message trailers, percent-encoding the message
+func writeGRPCStatus(w http.ResponseWriter, code int, message string) {
+	var encoded strings.Builder
+	for i := 0; i < len(message); i++ {
+		if c := message[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		} else {
+			encoded.WriteByte(c)
+		}
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", encoded.String())
+	}
+}
+
+/*
+Receives OpenTelemetry logs over OTLP/HTTP, so that the OpenTelemetry Collector (otlphttp exporter) and SDKs can
+export to the ingester directly. Requests are protobuf (Content-Type: application/x-protobuf) or JSON
+(application/json) encoded ExportLogsServiceRequests, optionally gzip compressed, and are ingested like /ingest
+requests, see otlpEntries. The response is an ExportLogsServiceResponse in the encoding of the request,
+reporting entries rejected by ingest policies as a partial success.
+
+POST http://localhost:8080/v1/logs
+
+{"resourceLogs":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"checkout"}}]},
+"scopeLogs":[{"logRecords":[{"timeUnixNano":"1709356020000000000","severityText":"ERROR","body":{"stringValue":"payment failed"}}]}]}]}
+*/
+func otlpLogsHandler(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+	format := "otlp"
+	switch strings.TrimSpace(mediaType) {
+	case "application/x-protobuf":
+	case "application/json":
+		format = "otlp_json"
+	default:
+		http.Error(w, "Unsupported Content-Type, expected application/x-protobuf or application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	values := r.URL.Query()
+	values.Set("format", format)
+	r.URL.RawQuery = values.Encode()
+	ingestHandler(w, r)
+}
+
+// writeOTLPResponse answers an OTLP export, with the number of rejected records and the first reason as partial success
+func writeOTLPResponse(w http.ResponseWriter, format string, rejected []rejectedEntry) {
+	errorMessage := ""
+	if len(rejected) > 0 {
+		errorMessage = fmt.Sprintf("%d log records rejected: %s", len(rejected), rejected[0].Reason)
+	}
+	if format == "otlp_json" {
+		response := map[string]interface{}{}
+		if len(rejected) > 0 {
+			response["partialSuccess"] = map[string]string{
+				"rejectedLogRecords": strconv.Itoa(len(rejected)),
+				"errorMessage":       errorMessage,
+			}
+		}
+		responseData, err := json.Marshal(response)
+		if err != nil {
+			http.Error(w, "Error marshalling response data", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(responseData)
+		return
+	}
+
+	var response []byte
+	if len(rejected) > 0 {
+		var partialSuccess []byte
+		partialSuccess = protowire.AppendTag(partialSuccess, 1, protowire.VarintType)
+		partialSuccess = protowire.AppendVarint(partialSuccess, uint64(len(rejected)))
+		partialSuccess = protowire.AppendTag(partialSuccess, 2, protowire.BytesType)
+		partialSuccess = protowire.AppendString(partialSuccess, errorMessage)
+		response = protowire.AppendTag(response, 1, protowire.BytesType)
+		response = protowire.AppendBytes(response, partialSuccess)
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// The OTLP ExportLogsServiceRequest, with the JSON field names of the OTLP/JSON encoding
+type otlpLogsRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpResourceLogs struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpScopeLogs struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         otlpInt        `json:"timeUnixNano"`
+	ObservedTimeUnixNano otlpInt        `json:"observedTimeUnixNano"`
+	SeverityNumber       int            `json:"severityNumber"`
+	SeverityText         string         `json:"severityText"`
+	Body                 otlpAnyValue   `json:"body"`
+	Attributes           []otlpKeyValue `json:"attributes"`
+	TraceID              string         `json:"traceId"`
+	SpanID               string         `json:"spanId"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue"`
+	BoolValue   *bool    `json:"boolValue"`
+	IntValue    *otlpInt `json:"intValue"`
+	DoubleValue *float64 `json:"doubleValue"`
+	ArrayValue  *struct {
+		Values []otlpAnyValue `json:"values"`
+	} `json:"arrayValue"`
+	KvlistValue *struct {
+		Values []otlpKeyValue `json:"values"`
+	} `json:"kvlistValue"`
+	BytesValue []byte `json:"bytesValue"`
+}
+
+// Deepest nesting of OTLP arrayValue and kvlistValue accepted, like maxMsgpackDepth for the forward protocol
+const maxOTLPValueDepth = maxMsgpackDepth
+
+// exceedsDepth reports whether arrays and kvlists are nested in v more than depth levels deep
+func (v otlpAnyValue) exceedsDepth(depth int) bool {
+	if depth < 0 {
+		return true
+	}
+	if v.ArrayValue != nil {
+		for _, value := range v.ArrayValue.Values {
+			if value.exceedsDepth(depth - 1) {
+				return true
+			}
+		}
+	}
+	if v.KvlistValue != nil {
+		for _, kv := range v.KvlistValue.Values {
+			if kv.Value.exceedsDepth(depth - 1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkDepth rejects requests with values nested deeper than the protobuf decoder accepts them
+func (request otlpLogsRequest) checkDepth() error {
+	for _, resourceLogs := range request.ResourceLogs {
+		values := make([]otlpAnyValue, 0, len(resourceLogs.Resource.Attributes))
+		for _, kv := range resourceLogs.Resource.Attributes {
+			values = append(values, kv.Value)
+		}
+		for _, scopeLogs := range resourceLogs.ScopeLogs {
+			for _, record := range scopeLogs.LogRecords {
+				values = append(values, record.Body)
+				for _, kv := range record.Attributes {
+					values = append(values, kv.Value)
+				}
+			}
+		}
+		for _, value := range values {
+			if value.exceedsDepth(maxOTLPValueDepth) {
+				return fmt.Errorf("attribute values nested more than %d levels", maxOTLPValueDepth)
+			}
+		}
+	}
+	return nil
+}
+
+// otlpInt is a 64 bit integer of OTLP/JSON, encoded as a decimal string or a number
+type otlpInt int64
+
+func (i *otlpInt) UnmarshalJSON(data []byte) error {
+	value, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid integer %s", data)
+	}
+	*i = otlpInt(value)
+	return nil
+}
+
+// plain returns the value as a string, bool, int64, float64, []byte, []interface{} or map[string]interface{}
+func (v otlpAnyValue) plain() interface{} {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.ArrayValue != nil:
+		values := make([]interface{}, 0, len(v.ArrayValue.Values))
+		for _, value := range v.ArrayValue.Values {
+			values = append(values, value.plain())
+		}
+		return values
+	case v.KvlistValue != nil:
+		values := make(map[string]interface{}, len(v.KvlistValue.Values))
+		for _, kv := range v.KvlistValue.Values {
+			values[kv.Key] = kv.Value.plain()
+		}
+		return values
+	case v.BytesValue != nil:
+		return v.BytesValue
+	}
+	return nil
+}
+
+// text returns the value as the string of an entry message or field, JSON for all values but strings
+func (v otlpAnyValue) text() string {
+	plain := v.plain()
+	switch plain := plain.(type) {
+	case nil:
+		return ""
+	case string:
+		return plain
+	}
+	data, _ := json.Marshal(plain)
+	return string(data)
+}
+
+// Level names of the OTLP severity number ranges 1-4, 5-8, ... 21-24
+var otlpSeverities = [...]string{"TRACE", "DEBUG", "INFO", "WARN", "ERROR", "FATAL"}
+
+/*
+otlpEntries converts OTLP log records into entries. The time is the record's (its observed time, or now, when unset)
+truncated to seconds, the body becomes the message, the severity text (or the name of the severity number) the level,
+and the resource and record attributes, the scope name and the trace and span IDs are stored as fields.
+*/
+func otlpEntries(request otlpLogsRequest, now time.Time) []LogEntry {
+	var entries []LogEntry
+	for _, resourceLogs := range request.ResourceLogs {
+		for _, scopeLogs := range resourceLogs.ScopeLogs {
+			for _, record := range scopeLogs.LogRecords {
+				nanos := int64(record.TimeUnixNano)
+				if nanos == 0 {
+					nanos = int64(record.ObservedTimeUnixNano)
+				}
+				if nanos == 0 {
+					nanos = now.UnixNano()
+				}
+				entry := LogEntry{Timestamp: nanos / int64(time.Second), Message: record.Body.text(), Level: record.SeverityText}
+				if entry.Level == "" && record.SeverityNumber >= 1 && record.SeverityNumber <= 24 {
+					entry.Level = otlpSeverities[(record.SeverityNumber-1)/4]
+				}
+
+				fields := make(map[string]string)
+				for _, attributes := range [][]otlpKeyValue{resourceLogs.Resource.Attributes, record.Attributes} {
+					for _, kv := range attributes {
+						fields[kv.Key] = kv.Value.text()
+					}
+				}
+				for name, value := range map[string]string{"scope": scopeLogs.Scope.Name, "trace_id": record.TraceID, "span_id": record.SpanID} {
+					if value != "" {
+						fields[name] = value
+					}
+				}
+				if len(fields) > 0 {
+					entry.Fields = fields
+				}
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries
+}
+
+// protoField is a field of a protobuf message, value holds varint and fixed values, data length-delimited ones
+type protoField struct {
+	num   protowire.Number
+	value uint64
+	data  []byte
+}
+
+// parseProtoFields splits a protobuf message into its fields, groups are skipped
+func parseProtoFields(data []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+		field := protoField{num: num}
+		switch typ {
+		case protowire.VarintType:
+			field.value, n = protowire.ConsumeVarint(data)
+		case protowire.Fixed64Type:
+			field.value, n = protowire.ConsumeFixed64(data)
+		case protowire.Fixed32Type:
+			var value uint32
+			value, n = protowire.ConsumeFixed32(data)
+			field.value = uint64(value)
+		case protowire.BytesType:
+			field.data, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// decodeOTLPRequest decodes the protobuf encoding of an ExportLogsServiceRequest, unknown fields are skipped
+func decodeOTLPRequest(data []byte) (otlpLogsRequest, error) {
+	var request otlpLogsRequest
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return request, err
+	}
+	for _, field := range fields {
+		if field.num != 1 {
+			continue
+		}
+		var resourceLogs otlpResourceLogs
+		resourceFields, err := parseProtoFields(field.data)
+		if err != nil {
+			return request, err
+		}
+		for _, resourceField := range resourceFields {
+			switch resourceField.num {
+			case 1:
+				attributes, err := parseProtoFields(resourceField.data)
+				if err != nil {
+					return request, err
+				}
+				for _, attribute := range attributes {
+					if attribute.num != 1 {
+						continue
+					}
+					kv, err := decodeOTLPKeyValue(attribute.data, 0)
+					if err != nil {
+						return request, err
+					}
+					resourceLogs.Resource.Attributes = append(resourceLogs.Resource.Attributes, kv)
+				}
+			case 2:
+				scopeLogs, err := decodeOTLPScopeLogs(resourceField.data)
+				if err != nil {
+					return request, err
+				}
+				resourceLogs.ScopeLogs = append(resourceLogs.ScopeLogs, scopeLogs)
+			}
+		}
+		request.ResourceLogs = append(request.ResourceLogs, resourceLogs)
+	}
+	return request, nil
+}
+
+func decodeOTLPScopeLogs(data []byte) (otlpScopeLogs, error) {
+	var scopeLogs otlpScopeLogs
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return scopeLogs, err
+	}
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			scopeFields, err := parseProtoFields(field.data)
+			if err != nil {
+				return scopeLogs, err
+			}
+			for _, scopeField := range scopeFields {
+				if scopeField.num == 1 {
+					scopeLogs.Scope.Name = string(scopeField.data)
+				}
+			}
+		case 2:
+			record, err := decodeOTLPLogRecord(field.data)
+			if err != nil {
+				return scopeLogs, err
+			}
+			scopeLogs.LogRecords = append(scopeLogs.LogRecords, record)
+		}
+	}
+	return scopeLogs, nil
+}
+
+func decodeOTLPLogRecord(data []byte) (otlpLogRecord, error) {
+	var record otlpLogRecord
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return record, err
+	}
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			record.TimeUnixNano = otlpInt(field.value)
+		case 11:
+			record.ObservedTimeUnixNano = otlpInt(field.value)
+		case 2:
+			record.SeverityNumber = int(field.value)
+		case 3:
+			record.SeverityText = string(field.data)
+		case 5:
+			if record.Body, err = decodeOTLPAnyValue(field.data, 0); err != nil {
+				return record, err
+			}
+		case 6:
+			kv, err := decodeOTLPKeyValue(field.data, 0)
+			if err != nil {
+				return record, err
+			}
+			record.Attributes = append(record.Attributes, kv)
+		case 9:
+			record.TraceID = hex.EncodeToString(field.data)
+		case 10:
+			record.SpanID = hex.EncodeToString(field.data)
+		}
+	}
+	return record, nil
+}
+
+// decodeOTLPKeyValue decodes a KeyValue whose value is nested in depth arrays and kvlists
+func decodeOTLPKeyValue(data []byte, depth int) (otlpKeyValue, error) {
+	var kv otlpKeyValue
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return kv, err
+	}
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			kv.Key = string(field.data)
+		case 2:
+			if kv.Value, err = decodeOTLPAnyValue(field.data, depth); err != nil {
+				return kv, err
+			}
+		}
+	}
+	return kv, nil
+}
+
+// decodeOTLPAnyValue decodes an AnyValue nested in depth arrays and kvlists, at most maxOTLPValueDepth
+func decodeOTLPAnyValue(data []byte, depth int) (otlpAnyValue, error) {
+	var value otlpAnyValue
+	if depth > maxOTLPValueDepth {
+		return value, fmt.Errorf("attribute values nested more than %d levels", maxOTLPValueDepth)
+	}
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return value, err
+	}
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			s := string(field.data)
+			value.StringValue = &s
+		case 2:
+			b := field.value != 0
+			value.BoolValue = &b
+		case 3:
+			i := otlpInt(field.value)
+			value.IntValue = &i
+		case 4:
+			f := math.Float64frombits(field.value)
+			value.DoubleValue = &f
+		case 5, 6:
+			elements, err := parseProtoFields(field.data)
+			if err != nil {
+				return value, err
+			}
+			if field.num == 5 {
+				value.ArrayValue = &struct {
+					Values []otlpAnyValue `json:"values"`
+				}{}
+			} else {
+				value.KvlistValue = &struct {
+					Values []otlpKeyValue `json:"values"`
+				}{}
+			}
+			for _, element := range elements {
+				if element.num != 1 {
+					continue
+				}
+				if field.num == 5 {
+					elementValue, err := decodeOTLPAnyValue(element.data, depth+1)
+					if err != nil {
+						return value, err
+					}
+					value.ArrayValue.Values = append(value.ArrayValue.Values, elementValue)
+				} else {
+					kv, err := decodeOTLPKeyValue(element.data, depth+1)
+					if err != nil {
+						return value, err
+					}
+					value.KvlistValue.Values = append(value.KvlistValue.Values, kv)
+				}
+			}
+		case 7:
+			value.BytesValue = append([]byte{}, field.data...)
+		}
+	}
+	return value, nil
+}
+
+/*
+Receives pushes of the Grafana Loki push API, so that promtail, Grafana Agent and other Loki clients can ship
+to the ingester unchanged, configured with the URL of this endpoint. Requests are snappy compressed protobuf
+PushRequests (Content-Type: application/x-protobuf, sent by promtail) or JSON (application/json, optionally gzip
+compressed), and are ingested like /ingest requests, see lokiEntries. Responds 204 No Content, like Loki.
+
+POST http://localhost:8080/loki/api/v1/push
+
+{"streams":[{"stream":{"job":"varlogs","host":"web-1"},"values":[["1709356020000000000","connection reset"]]}]}
+*/
+func lokiPushHandler(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+	format := "loki"
+	switch strings.TrimSpace(mediaType) {
+	case "application/x-protobuf":
+	case "application/json":
+		format = "loki_json"
+	default:
+		http.Error(w, "Unsupported Content-Type, expected application/x-protobuf or application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	values := r.URL.Query()
+	values.Set("format", format)
+	r.URL.RawQuery = values.Encode()
+	ingestHandler(w, r)
+}
+
+/*
+Receives events of the Splunk HTTP Event Collector, so that Splunk forwarders and HEC outputs (fluentd, Vector,
+OpenTelemetry Collector) can ship to the ingester by changing only the URL. The HEC token is sent as
+"Authorization: Splunk <token>" and checked like any other key, a key of API_KEY or API_KEYS with the write scope.
+The body is one or more concatenated event objects, optionally gzip compressed, and is ingested like an /ingest
+request, see hecEvent. Also served on /services/collector and /services/collector/event/1.0.
+
+POST http://localhost:8080/services/collector/event
+
+{"time":1709356020.25,"host":"web-1","sourcetype":"nginx","event":"connection reset","fields":{"region":"eu"}}
+
+{"text":"Success","code":0}
+*/
+func hecEventHandler(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	values.Set("format", "hec")
+	r.URL.RawQuery = values.Encode()
+	ingestHandler(w, r)
+}
+
+/*
+Answers the HEC health check of forwarders, 503 when ingestion is not accepting.
+
+GET http://localhost:8080/services/collector/health
+
+{"text":"HEC is healthy","code":17}
+*/
+func hecHealthHandler(w http.ResponseWriter, r *http.Request) {
+	if !ingestAccepting.Load() || readOnly.Load() {
+		writeHECResponse(w, http.StatusServiceUnavailable, hecResponse{Text: "HEC is unhealthy", Code: hecUnhealthy})
+		return
+	}
+	writeHECResponse(w, http.StatusOK, hecResponse{Text: "HEC is healthy", Code: hecHealthy})
+}
+
+// Status codes of HEC responses
+const (
+	hecNoData            = 5
+	hecInvalidDataFormat = 6
+	hecUnhealthy         = 9
+	hecEventRequired     = 12
+	hecEventBlank        = 13
+	hecHealthy           = 17
+)
+
+var (
+	errHECNoData        = errors.New("no data")
+	errHECEventRequired = errors.New("event field is required")
+	errHECEventBlank    = errors.New("event field cannot be blank")
+)
+
+// hecErrorCode returns the HEC status code of a decoding error of a request
+func hecErrorCode(err error) int {
+	switch {
+	case errors.Is(err, errHECNoData):
+		return hecNoData
+	case errors.Is(err, errHECEventRequired):
+		return hecEventRequired
+	case errors.Is(err, errHECEventBlank):
+		return hecEventBlank
+	}
+	return hecInvalidDataFormat
+}
+
+type hecResponse struct {
+	Text string `json:"text"`
+	Code int    `json:"code"`
+}
+
+func writeHECResponse(w http.ResponseWriter, status int, response hecResponse) {
+	responseData, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "Error marshalling response data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(responseData)
+}
+
+// hecEvent is an event of the HEC event endpoint, time is in seconds, as a number or a string
+type hecEvent struct {
+	Time       json.RawMessage        `json:"time"`
+	Host       string                 `json:"host"`
+	Source     string                 `json:"source"`
+	Sourcetype string                 `json:"sourcetype"`
+	Index      string                 `json:"index"`
+	Event      json.RawMessage        `json:"event"`
+	Fields     map[string]interface{} `json:"fields"`
+}
+
+/*
+entry converts the event into an entry. The time is truncated to seconds (now when unset), a string event becomes
+the message and other events their JSON, and host, source, sourcetype, index and the indexed fields are stored as
+fields, except for a level field, which becomes the level.
+*/
+func (event hecEvent) entry(now time.Time) (LogEntry, error) {
+	entry := LogEntry{Timestamp: now.Unix()}
+	if len(event.Time) > 0 && string(event.Time) != "null" {
+		seconds, err := strconv.ParseFloat(strings.Trim(string(event.Time), `"`), 64)
+		if err != nil {
+			return LogEntry{}, fmt.Errorf("invalid time %s", event.Time)
+		}
+		entry.Timestamp = int64(seconds)
+	}
+
+	if len(event.Event) == 0 || string(event.Event) == "null" {
+		return LogEntry{}, errHECEventRequired
+	}
+	if err := json.Unmarshal(event.Event, &entry.Message); err != nil {
+		var compacted bytes.Buffer
+		if err := json.Compact(&compacted, event.Event); err != nil {
+			return LogEntry{}, err
+		}
+		entry.Message = compacted.String()
+	}
+	if entry.Message == "" {
+		return LogEntry{}, errHECEventBlank
+	}
+
+	fields := make(map[string]string)
+	for name, value := range map[string]string{"host": event.Host, "source": event.Source, "sourcetype": event.Sourcetype, "index": event.Index} {
+		if value != "" {
+			fields[name] = value
+		}
+	}
+	for name, value := range event.Fields {
+		field, ok := value.(string)
+		if !ok {
+			data, err := json.Marshal(value)
+			if err != nil {
+				return LogEntry{}, err
+			}
+			field = string(data)
+		}
+		if name == "level" {
+			entry.Level = field
+			continue
+		}
+		fields[name] = field
+	}
+	if len(fields) > 0 {
+		entry.Fields = fields
+	}
+	return entry, nil
+}
+
+// lokiStream is a stream of a push request, its labels and its lines
+type lokiStream struct {
+	labels  map[string]string
+	entries []lokiStreamEntry
+}
+
+type lokiStreamEntry struct {
+	nanos    int64
+	line     string
+	metadata map[string]string
+}
+
+// The JSON push request, values are [timestamp, line] or [timestamp, line, structured metadata] arrays
+type lokiPushRequest struct {
+	Streams []struct {
+		Stream map[string]string   `json:"stream"`
+		Values [][]json.RawMessage `json:"values"`
+	} `json:"streams"`
+}
+
+func (request lokiPushRequest) streams() ([]lokiStream, error) {
+	var streams []lokiStream
+	for _, stream := range request.Streams {
+		decoded := lokiStream{labels: stream.Stream}
+		for _, value := range stream.Values {
+			if len(value) != 2 && len(value) != 3 {
+				return nil, fmt.Errorf("expected [timestamp, line] values")
+			}
+			var timestamp, line string
+			if err := json.Unmarshal(value[0], &timestamp); err != nil {
+				return nil, fmt.Errorf("invalid timestamp %s, expected a string of nanoseconds", value[0])
+			}
+			nanos, err := strconv.ParseInt(timestamp, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp %q, expected nanoseconds", timestamp)
+			}
+			if err := json.Unmarshal(value[1], &line); err != nil {
+				return nil, fmt.Errorf("invalid line %s", value[1])
+			}
+			entry := lokiStreamEntry{nanos: nanos, line: line}
+			if len(value) == 3 {
+				if err := json.Unmarshal(value[2], &entry.metadata); err != nil {
+					return nil, fmt.Errorf("invalid structured metadata %s", value[2])
+				}
+			}
+			decoded.entries = append(decoded.entries, entry)
+		}
+		streams = append(streams, decoded)
+	}
+	return streams, nil
+}
+
+/*
+decodeLokiPushRequest decodes the protobuf logproto.PushRequest: streams (1) with their labels (1) in the
+{name="value", ...} notation and entries (2) with a timestamp (1), a line (2) and structured metadata (3).
+*/
+func decodeLokiPushRequest(data []byte) ([]lokiStream, error) {
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return nil, err
+	}
+	var streams []lokiStream
+	for _, field := range fields {
+		if field.num != 1 {
+			continue
+		}
+		streamFields, err := parseProtoFields(field.data)
+		if err != nil {
+			return nil, err
+		}
+		var stream lokiStream
+		for _, streamField := range streamFields {
+			switch streamField.num {
+			case 1:
+				if stream.labels, err = parseLokiLabels(string(streamField.data)); err != nil {
+					return nil, err
+				}
+			case 2:
+				entry, err := decodeLokiEntry(streamField.data)
+				if err != nil {
+					return nil, err
+				}
+				stream.entries = append(stream.entries, entry)
+			}
+		}
+		streams = append(streams, stream)
+	}
+	return streams, nil
+}
+
+func decodeLokiEntry(data []byte) (lokiStreamEntry, error) {
+	var entry lokiStreamEntry
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return entry, err
+	}
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			// google.protobuf.Timestamp
+			timestampFields, err := parseProtoFields(field.data)
+			if err != nil {
+				return entry, err
+			}
+			for _, timestampField := range timestampFields {
+				switch timestampField.num {
+				case 1:
+					entry.nanos += int64(timestampField.value) * int64(time.Second)
+				case 2:
+					entry.nanos += int64(timestampField.value)
+				}
+			}
+		case 2:
+			entry.line = string(field.data)
+		case 3:
+			pairFields, err := parseProtoFields(field.data)
+			if err != nil {
+				return entry, err
+			}
+			var name, value string
+			for _, pairField := range pairFields {
+				switch pairField.num {
+				case 1:
+					name = string(pairField.data)
+				case 2:
+					value = string(pairField.data)
+				}
+			}
+			if entry.metadata == nil {
+				entry.metadata = make(map[string]string)
+			}
+			entry.metadata[name] = value
+		}
+	}
+	return entry, nil
+}
+
+// parseLokiLabels parses a label set like {job="varlogs", filename="/var/log/syslog"}
+func parseLokiLabels(labels string) (map[string]string, error) {
+	rest := strings.TrimSpace(labels)
+	if !strings.HasPrefix(rest, "{") || !strings.HasSuffix(rest, "}") {
+		return nil, fmt.Errorf("invalid labels %q", labels)
+	}
+	rest = rest[1 : len(rest)-1]
+	parsed := make(map[string]string)
+	for {
+		rest = strings.TrimLeft(rest, " ,")
+		if rest == "" {
+			return parsed, nil
+		}
+		name, value, found := strings.Cut(rest, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid labels %q", labels)
+		}
+		quoted, err := strconv.QuotedPrefix(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid labels %q", labels)
+		}
+		if parsed[strings.TrimSpace(name)], err = strconv.Unquote(quoted); err != nil {
+			return nil, fmt.Errorf("invalid labels %q", labels)
+		}
+		rest = strings.TrimSpace(value)[len(quoted):]
+	}
+}
+
+/*
+lokiEntries converts the lines of pushed streams into entries. The timestamp is truncated to seconds (now when
+unset), the line becomes the message, and the stream labels and the structured metadata of the line are
+stored as fields, except for a level label or metadata, which becomes the level.
+*/
+func lokiEntries(streams []lokiStream, now time.Time) []LogEntry {
+	var entries []LogEntry
+	for _, stream := range streams {
+		for _, streamEntry := range stream.entries {
+			nanos := streamEntry.nanos
+			if nanos == 0 {
+				nanos = now.UnixNano()
+			}
+			entry := LogEntry{Timestamp: nanos / int64(time.Second), Message: streamEntry.line}
+			fields := make(map[string]string)
+			for _, labels := range []map[string]string{stream.labels, streamEntry.metadata} {
+				for name, value := range labels {
+					if name == "level" {
+						entry.Level = value
+						continue
+					}
+					fields[name] = value
+				}
+			}
+			if len(fields) > 0 {
+				entry.Fields = fields
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+/*
+decodeSnappy decompresses a snappy block, the framing of Loki push requests. The decompressed length is
+bounded by limit (when positive) and reported like an oversized body.
+*/
+func decodeSnappy(data []byte, limit int64) ([]byte, error) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid snappy block")
+	}
+	data = data[n:]
+	if limit > 0 && length > uint64(limit) {
+		return nil, &http.MaxBytesError{Limit: limit}
+	}
+	// No element expands to more than 64 bytes per 2 bytes of input, a longer length is corrupt
+	if length > uint64(len(data))*32+64 {
+		return nil, fmt.Errorf("invalid snappy block length %d", length)
+	}
+	decoded := make([]byte, 0, length)
+	for len(data) > 0 {
+		tag := data[0]
+		var copyLength, offset int
+		switch tag & 3 {
+		case 0:
+			literalLength := int(tag >> 2)
+			data = data[1:]
+			if literalLength >= 60 {
+				size := literalLength - 59
+				if len(data) < size {
+					return nil, fmt.Errorf("truncated snappy block")
+				}
+				literalLength = 0
+				for i := size - 1; i >= 0; i-- {
+					literalLength = literalLength<<8 | int(data[i])
+				}
+				data = data[size:]
+			}
+			literalLength++
+			if literalLength <= 0 || len(data) < literalLength || uint64(len(decoded)+literalLength) > length {
+				return nil, fmt.Errorf("invalid snappy literal")
+			}
+			decoded = append(decoded, data[:literalLength]...)
+			data = data[literalLength:]
+			continue
+		case 1:
+			if len(data) < 2 {
+				return nil, fmt.Errorf("truncated snappy block")
+			}
+			copyLength = 4 + int(tag>>2&7)
+			offset = int(tag>>5)<<8 | int(data[1])
+			data = data[2:]
+		case 2:
+			if len(data) < 3 {
+				return nil, fmt.Errorf("truncated snappy block")
+			}
+			copyLength = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(data[1:3]))
+			data = data[3:]
+		case 3:
+			if len(data) < 5 {
+				return nil, fmt.Errorf("truncated snappy block")
+			}
+			copyLength = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(data[1:5]))
+			data = data[5:]
+		}
+		if offset <= 0 || offset > len(decoded) || uint64(len(decoded)+copyLength) > length {
+			return nil, fmt.Errorf("invalid snappy copy")
+		}
+		// Copies may overlap their own output, so bytes are appended one at a time
+		start := len(decoded) - offset
+		for i := 0; i < copyLength; i++ {
+			decoded = append(decoded, decoded[start+i])
+		}
+	}
+	if uint64(len(decoded)) != length {
+		return nil, fmt.Errorf("invalid snappy block, decoded %d of %d bytes", len(decoded), length)
+	}
+	return decoded, nil
+}
+
+// entryDedupKey identifies an entry by a hash of its timestamp and message
+func entryDedupKey(entry LogEntry) string {
+	hash := sha256.Sum256([]byte(strconv.FormatInt(entry.Timestamp, 10) + "\x00" + entry.Message))
+	return "entry:" + hex.EncodeToString(hash[:16])
+}
+
+/*
+dedupStore remembers idempotency keys (and, with DEDUP_ENTRIES, entry hashes) for ttl, so that retried ingests are suppressed.
+It holds at most maxKeys keys, evicting the oldest first. With a path, keys are appended to a local file and
+loaded again on start, so retries after a restart are suppressed too.
+
+A request reserves its keys before it enqueues anything and commits them once it has, or releases them when it fails,
+so that concurrent retries can't both pass the check and a failed request doesn't suppress its retry.
+*/
+type dedupStore struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	maxKeys  int
+	path     string
+	expiry   map[string]time.Time
+	order    []string        // keys in insertion order, which is also expiry order
+	reserved map[string]bool // keys of requests in flight, neither committed nor released yet
+	file     *os.File
+	lines    int
+}
+
+var (
+	errDuplicateKey = errors.New("duplicate key")
+	errKeyInFlight  = errors.New("key reserved by a request in flight")
+)
+
+type dedupRecord struct {
+	Key     string `json:"k"`
+	Expires int64  `json:"e"`
+}
+
+func (d *dedupStore) enabled() bool {
+	return d.ttl > 0
+}
+
+// reserve claims key for a request, failing with errDuplicateKey if it was committed within ttl and errKeyInFlight if it is reserved
+func (d *dedupStore) reserve(key string) error {
+	if !d.enabled() {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if expires, ok := d.expiry[key]; ok && time.Now().Before(expires) {
+		return errDuplicateKey
+	}
+	if d.reserved[key] {
+		return errKeyInFlight
+	}
+	if d.reserved == nil {
+		d.reserved = make(map[string]bool)
+	}
+	d.reserved[key] = true
+	return nil
+}
+
+// release gives up the reservation of keys by a request that failed, so that its retry isn't suppressed
+func (d *dedupStore) release(keys ...string) {
+	if !d.enabled() {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, key := range keys {
+		delete(d.reserved, key)
+	}
+}
+
+// commit remembers the reserved keys of a request that succeeded for ttl
+func (d *dedupStore) commit(keys ...string) {
+	if !d.enabled() {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, key := range keys {
+		delete(d.reserved, key)
+		d.add(key)
+	}
+}
+
+// add remembers key for ttl, must be called with d.mu held
+func (d *dedupStore) add(key string) {
+	expires := time.Now().Add(d.ttl)
+	if _, ok := d.expiry[key]; !ok {
+		d.order = append(d.order, key)
+	}
+	d.expiry[key] = expires
+	d.evict()
+
+	if d.file != nil {
+		d.appendRecord(dedupRecord{Key: key, Expires: expires.Unix()})
+		if d.lines > 2*d.maxKeys {
+			d.rewrite()
+		}
+	}
+}
+
+// evict drops expired keys and the oldest keys beyond maxKeys, must be called with d.mu held
+func (d *dedupStore) evict() {
+	now := time.Now()
+	for len(d.order) > 0 {
+		key := d.order[0]
+		expires, ok := d.expiry[key]
+		if ok && len(d.order) <= d.maxKeys && now.Before(expires) {
+			break
+		}
+		d.order = d.order[1:]
+		delete(d.expiry, key)
+	}
+}
+
+func (d *dedupStore) appendRecord(record dedupRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	if _, err := d.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Error writing to dedup store %s: %v", d.path, err)
+		return
+	}
+	d.lines++
+}
+
+// load reads the keys persisted at path that have not expired yet and compacts the file
+func (d *dedupStore) load() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	data, err := os.ReadFile(d.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	now := time.Now()
+	for _, line := range strings.Split(string(data), "\n") {
+		var record dedupRecord
+		if line == "" || json.Unmarshal([]byte(line), &record) != nil {
+			continue
+		}
+		expires := time.Unix(record.Expires, 0)
+		if !now.Before(expires) {
+			continue
+		}
+		if _, ok := d.expiry[record.Key]; !ok {
+			d.order = append(d.order, record.Key)
+		}
+		d.expiry[record.Key] = expires
+	}
+	d.evict()
+	return d.rewrite()
+}
+
+// rewrite replaces the file at path with the keys currently held, must be called with d.mu held
+func (d *dedupStore) rewrite() error {
+	if d.file != nil {
+		d.file.Close()
+		d.file = nil
+	}
+
+	tmpPath := d.path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	d.file = f
+	d.lines = 0
+	for _, key := range d.order {
+		d.appendRecord(dedupRecord{Key: key, Expires: d.expiry[key].Unix()})
+	}
+	if err := os.Rename(tmpPath, d.path); err != nil {
+		f.Close()
+		d.file = nil
+		return err
+	}
+	return nil
+}
+
+// tenantFromRequest returns the tenant a request is accounted to
+func tenantFromRequest(r *http.Request) string {
+	if tenant := r.Header.Get("X-Tenant-ID"); tenant != "" {
+		return tenant
+	}
+	return defaultTenant
+}
+
+type tenantLimits struct {
+	rate         float64 // requests per second, 0 disables rate limiting
+	burst        float64
+	quotaBytes   int64 // daily quota, 0 is unlimited
+	quotaEntries int64
+}
+
+type tenantUsage struct {
+	Day     string `json:"day"`
+	Bytes   int64  `json:"bytes"`
+	Entries int64  `json:"entries"`
+
+	tokens     float64
+	lastRefill time.Time
+}
+
+/*
+Per-tenant token bucket rate limits and daily ingest quotas, tracked in memory.
+Daily usage is persisted to tenantQuotaFile (if set) so that restarts don't reset the quotas.
+*/
+type tenantQuotaTracker struct {
+	mu        sync.Mutex
+	defaults  tenantLimits
+	overrides map[string]tenantLimits
+	usage     map[string]*tenantUsage
+}
+
+func (t *tenantQuotaTracker) limits(tenant string) tenantLimits {
+	if limits, ok := t.overrides[tenant]; ok {
+		return limits
+	}
+	return t.defaults
+}
+
+// usageFor returns the usage of tenant for the current day, must be called with t.mu held
+func (t *tenantQuotaTracker) usageFor(tenant string, now time.Time) *tenantUsage {
+	day := now.UTC().Format("2006-01-02")
+	usage, ok := t.usage[tenant]
+	if !ok {
+		usage = &tenantUsage{Day: day, tokens: t.limits(tenant).burst, lastRefill: now}
+		t.usage[tenant] = usage
+	}
+	if usage.lastRefill.IsZero() {
+		usage.tokens = t.limits(tenant).burst
+		usage.lastRefill = now
+	}
+	if usage.Day != day {
+		usage.Day = day
+		usage.Bytes = 0
+		usage.Entries = 0
+	}
+	return usage
+}
+
+// allow takes a token from the tenant's bucket, returning false when the rate limit is exceeded
+func (t *tenantQuotaTracker) allow(tenant string) bool {
+	limits := t.limits(tenant)
+	if limits.rate <= 0 {
+		return true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	usage := t.usageFor(tenant, now)
+	usage.tokens += now.Sub(usage.lastRefill).Seconds() * limits.rate
+	if usage.tokens > limits.burst {
+		usage.tokens = limits.burst
+	}
+	usage.lastRefill = now
+
+	if usage.tokens < 1 {
+		return false
+	}
+	usage.tokens--
+	return true
+}
+
+/*
+consume records an ingest of the given size against the tenant's daily quota.
+It returns the remaining bytes and entries (-1 when unlimited) and false, without recording anything, when the ingest would exceed the quota.
+*/
+func (t *tenantQuotaTracker) consume(tenant string, bytes, entries int64) (int64, int64, bool) {
+	limits := t.limits(tenant)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	usage := t.usageFor(tenant, time.Now())
+	ok := (limits.quotaBytes <= 0 || usage.Bytes+bytes <= limits.quotaBytes) &&
+		(limits.quotaEntries <= 0 || usage.Entries+entries <= limits.quotaEntries)
+	if ok {
+		usage.Bytes += bytes
+		usage.Entries += entries
+	}
+
+	remainingBytes, remainingEntries := int64(-1), int64(-1)
+	if limits.quotaBytes > 0 {
+		remainingBytes = limits.quotaBytes - usage.Bytes
+	}
+	if limits.quotaEntries > 0 {
+		remainingEntries = limits.quotaEntries - usage.Entries
+	}
+	return remainingBytes, remainingEntries, ok
+}
+
+func (t *tenantQuotaTracker) load(fileName string) error {
+	data, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return json.Unmarshal(data, &t.usage)
+}
+
+func (t *tenantQuotaTracker) save(fileName string) error {
+	t.mu.Lock()
+	data, err := json.Marshal(t.usage)
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmpFileName := fileName + ".tmp"
+	if err := os.WriteFile(tmpFileName, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, fileName)
+}
+
+func periodicallySaveTenantQuotas() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := tenantQuotas.save(tenantQuotaFile); err != nil {
+			log.Printf("Error saving tenant quotas to %s: %v", tenantQuotaFile, err)
+		}
+	}
+}
+
+/*
+Parses per-tenant overrides of the default limits, e.g.
+
+TENANT_LIMITS=acme:rate=10,burst=20,bytes=1000000000;other:entries=50000
+*/
+func parseTenantLimits(value string, defaults tenantLimits) (map[string]tenantLimits, error) {
+	overrides := make(map[string]tenantLimits)
+	for _, tenantSpec := range strings.Split(value, ";") {
+		tenantSpec = strings.TrimSpace(tenantSpec)
+		if tenantSpec == "" {
+			continue
+		}
+		tenant, spec, found := strings.Cut(tenantSpec, ":")
+		if !found || tenant == "" {
+			return nil, fmt.Errorf("expected tenant:key=value in %q", tenantSpec)
+		}
+
+		limits := defaults
+		for _, setting := range strings.Split(spec, ",") {
+			key, value, found := strings.Cut(strings.TrimSpace(setting), "=")
+			if !found {
+				return nil, fmt.Errorf("expected key=value in %q", setting)
+			}
+			var err error
+			switch key {
+			case "rate":
+				limits.rate, err = strconv.ParseFloat(value, 64)
+			case "burst":
+				limits.burst, err = strconv.ParseFloat(value, 64)
+			case "bytes":
+				limits.quotaBytes, err = strconv.ParseInt(value, 10, 64)
+			case "entries":
+				limits.quotaEntries, err = strconv.ParseInt(value, 10, 64)
+			default:
+				err = fmt.Errorf("unknown limit %q", key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid limit for tenant %s: %v", tenant, err)
+			}
+		}
+		if limits.burst < limits.rate {
+			limits.burst = limits.rate
+		}
+		overrides[tenant] = limits
+	}
+	return overrides, nil
+}
+
+/*
+This handler parses the start and end timestamps,
+generates a list of possible S3ObjectKeys for each minute,
+queries S3 for the list of files
+
+GET http://localhost:8080/query?start=1685426738&end=1685426739&text=test
+
+Add pick=first or pick=last to only return the earliest or latest matching entry
+
+Add timeout=2s to bound the query: once it expires in-flight S3 fetches are cancelled and the entries
+gathered so far are returned with X-Query-Partial: true and the X-Query-Next cursor to resume from
+
+Add limit=N to page through a range in chunks of N entries: X-Query-Next then carries the minute and the position
+of the last returned entry to pass as cursor, e.g. 2024-03-02-05-07:1709356030:3f2a9c41d0e85b17c6a4e2d18f90b3a5,
+so already returned minutes aren't read again and a minute rewritten in between resumes after the same entry
+
+Add window=5m to group the result into fixed time windows, per_window=N caps the entries returned per window:
+[{"window_start":1685426700,"count":2,"entries":[...]}]
+
+Add context=N to also return the N entries before and after every match in the range, like grep -C
+
+Objects that can't be read are skipped and listed in X-Query-Unreadable, add strict=true to fail the query with 500 instead
+*/
+func queryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		queryRangesHandler(w, r)
+		return
+	}
+
+	query, err := parseLogQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel, err := queryContext(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+	query.ctx = ctx
+
+	pick := r.URL.Query().Get("pick")
+	if pick != "" && pick != "first" && pick != "last" {
+		http.Error(w, "Invalid pick, expected first or last", http.StatusBadRequest)
+		return
+	}
+
+	var projection []string
+	if r.URL.Query().Has("fields") {
+		for _, param := range []string{"distinct", "window", "sort", "output"} {
+			if r.URL.Query().Has(param) {
+				http.Error(w, fmt.Sprintf("fields is not supported with %s", param), http.StatusBadRequest)
+				return
+			}
+		}
+		for _, name := range strings.Split(r.URL.Query().Get("fields"), ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				projection = append(projection, name)
+			}
+		}
+		if len(projection) == 0 {
+			http.Error(w, "Invalid fields, expected a comma-separated list like time,level", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if r.URL.Query().Get("output") == "s3" {
+		if !authorized(r, scopeRead) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		exportQueryToS3(w, query)
+		return
+	}
+
+	if r.URL.Query().Get("sort") == "time" && pick == "" {
+		if query.limit > 0 || query.after.key != "" || query.tail {
+			http.Error(w, "limit and cursor offsets are not supported with sort=time", http.StatusBadRequest)
+			return
+		}
+		writeSortedQuery(w, query)
+		return
+	}
+
+	var result interface{}
+	if pick != "" {
+		result = query.pickEntry(pick)
+	} else if r.URL.Query().Get("distinct") == "true" {
+		groups, truncated := distinctMessages(query, maxDistinctGroups)
+		if truncated {
+			w.Header().Set("X-Query-Truncated", "true")
+		}
+		result = groups
+	} else if r.URL.Query().Has("window") {
+		window, err := time.ParseDuration(r.URL.Query().Get("window"))
+		if err != nil || window < time.Second {
+			http.Error(w, "Invalid window, expected a duration of at least 1s", http.StatusBadRequest)
+			return
+		}
+		perWindow := 0
+		if r.URL.Query().Has("per_window") {
+			perWindow, err = strconv.Atoi(r.URL.Query().Get("per_window"))
+			if err != nil || perWindow <= 0 {
+				http.Error(w, "Invalid per_window", http.StatusBadRequest)
+				return
+			}
+		}
+		result = groupByWindow(query.run(), window, perWindow)
+	} else if r.URL.Query().Has("context") {
+		n, err := strconv.Atoi(r.URL.Query().Get("context"))
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid context, expected a number of entries", http.StatusBadRequest)
+			return
+		}
+		result = query.runWithContext(n)
+	} else {
+		result = query.run()
+	}
+
+	if query.strict && len(query.unreadable) > 0 {
+		http.Error(w, fmt.Sprintf("Unreadable objects: %s", strings.Join(query.unreadable, ",")), http.StatusInternalServerError)
+		return
+	}
+	query.setResponseHeaders(w)
+
+	if entries, ok := result.([]LogEntry); ok && projection != nil {
+		result = projectEntries(entries, projection)
+	}
+	if entries, ok := result.([]LogEntry); ok && streamThreshold > 0 && estimatedResponseSize(entries) > streamThreshold {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := streamEntries(w, r, entries); err != nil {
+			log.Printf("error writing response: %v", err)
+		}
+		return
+	}
+
+	// Marshal the filtered log entries and send as response
+	responseData, err := marshalResponse(r, result)
+	if err != nil {
+		http.Error(w, "Error marshalling response data", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseData)
+}
+
+// marshalResponse encodes v compact, or indented with pretty=true. Indented responses, and all of them with RESPONSE_NEWLINE, end with a newline
+func marshalResponse(r *http.Request, v interface{}) ([]byte, error) {
+	if r.URL.Query().Get("pretty") == "true" {
+		data, err := json.MarshalIndent(v, "", "  ")
+		return append(data, '\n'), err
+	}
+	data, err := json.Marshal(v)
+	if responseNewline {
+		data = append(data, '\n')
+	}
+	return data, err
+}
+
+/*
+projectEntries returns entries with only the attributes named by the fields parameter: time, log, level, client_ts,
+fields (all of them) or the name of a single field, which is returned within fields. Attributes an entry doesn't
+have are left out.
+
+GET http://localhost:8080/query?start=1685426738&end=1685430338&fields=time,level,host
+
+[{"time":1685426740,"level":"ERROR","fields":{"host":"web-1"}}]
+*/
+func projectEntries(entries []LogEntry, names []string) []map[string]interface{} {
+	projected := make([]map[string]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		attributes := make(map[string]interface{}, len(names))
+		var fields map[string]string
+		for _, name := range names {
+			switch name {
+			case "time":
+				attributes["time"] = entry.Timestamp
+			case "log":
+				attributes["log"] = entry.Message
+			case "level":
+				if entry.Level != "" {
+					attributes["level"] = entry.Level
+				}
+			case "client_ts":
+				if entry.ClientTimestamp != 0 {
+					attributes["client_ts"] = entry.ClientTimestamp
+				}
+			case "fields":
+				if len(entry.Fields) > 0 {
+					attributes["fields"] = entry.Fields
+				}
+			default:
+				if value, ok := entry.Fields[name]; ok {
+					if fields == nil {
+						fields = make(map[string]string)
+					}
+					fields[name] = value
+				}
+			}
+		}
+		if _, all := attributes["fields"]; fields != nil && !all {
+			attributes["fields"] = fields
+		}
+		projected = append(projected, attributes)
+	}
+	return projected
+}
+
+// estimatedResponseSize estimates the bytes of the JSON array of entries, stopping once it exceeds STREAM_THRESHOLD
+func estimatedResponseSize(entries []LogEntry) int64 {
+	var size int64
+	for _, entry := range entries {
+		size += approximateEntrySize(entry)
+		if size > streamThreshold {
+			break
+		}
+	}
+	return size
+}
+
+/*
+streamEntries writes entries as the JSON array marshalResponse would, encoding them one at a time so that large
+results aren't held in memory a second time as a single encoded response
+*/
+func streamEntries(w io.Writer, r *http.Request, entries []LogEntry) error {
+	pretty := r.URL.Query().Get("pretty") == "true"
+	out := bufio.NewWriterSize(w, 64*1024)
+	open, separator, end := "[", ",", "]"
+	if pretty {
+		open, separator, end = "[\n  ", ",\n  ", "\n]\n"
+	} else if responseNewline {
+		end = "]\n"
+	}
+
+	out.WriteString(open)
+	for i, entry := range entries {
+		if i > 0 {
+			out.WriteString(separator)
+		}
+		var data []byte
+		var err error
+		if pretty {
+			data, err = json.MarshalIndent(entry, "  ", "  ")
+		} else {
+			data, err = json.Marshal(entry)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := out.Write(data); err != nil {
+			return err
+		}
+	}
+	out.WriteString(end)
+	return out.Flush()
+}
+
+// queryContext returns the context bounding a query by its timeout parameter, nil without one
+func queryContext(r *http.Request) (context.Context, context.CancelFunc, error) {
+	timeout := r.URL.Query().Get("timeout")
+	if timeout == "" {
+		return nil, func() {}, nil
+	}
+	duration, err := time.ParseDuration(timeout)
+	if err != nil || duration <= 0 {
+		return nil, nil, fmt.Errorf("Invalid timeout")
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), duration)
+	return ctx, cancel, nil
+}
+
+// queryRange is one of the time ranges of a multi-range query
+type queryRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// rangeResult holds the matching entries of a queryRange, truncated once the objects or entries of the request are exhausted
+type rangeResult struct {
+	Start     int64      `json:"start"`
+	End       int64      `json:"end"`
+	Entries   []LogEntry `json:"entries"`
+	Truncated bool       `json:"truncated,omitempty"`
+}
+
+/*
+Runs the query of the URL parameters over each time range of the body, e.g. to compare the same hour across days.
+Results are returned per range, in the order of the request. MAX_QUERY_OBJECTS and MAX_RESULT_ENTRIES bound
+all ranges together, the ranges after the budget is used up are returned empty and truncated.
+
+POST http://localhost:8080/query?text=timeout
+
+{"ranges":[{"start":1709352000,"end":1709355599},{"start":1709438400,"end":1709441999}]}
+
+[{"start":1709352000,"end":1709355599,"entries":[{"time":1709353000,"log":"timeout"}]},{"start":1709438400,"end":1709441999,"entries":[]}]
+
+With timestamps instead of ranges, the entries whose timestamp is exactly one of them are returned,
+reading only the minutes of the timestamps, see queryTimestamps.
+
+{"timestamps":[1709353000,1709441000]}
+*/
+func queryRangesHandler(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	for _, param := range []string{"start", "end", "cursor", "limit", "key_glob", "pick", "distinct", "window", "context", "sort", "output"} {
+		if values.Has(param) {
+			http.Error(w, fmt.Sprintf("%s is not supported with ranges", param), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var request struct {
+		Ranges     []queryRange `json:"ranges"`
+		Timestamps []int64      `json:"timestamps"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(request.Ranges) > 0 && len(request.Timestamps) > 0 {
+		http.Error(w, "Expected either ranges or timestamps", http.StatusBadRequest)
+		return
+	}
+	if len(request.Ranges) == 0 && len(request.Timestamps) == 0 {
+		http.Error(w, "Expected at least one range", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel, err := queryContext(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+
+	if len(request.Timestamps) > 0 {
+		queryTimestamps(ctx, w, r, request.Timestamps)
+		return
+	}
+
+	var queries []*logQuery
+	for _, queryRange := range request.Ranges {
+		if queryRange.End < queryRange.Start {
+			http.Error(w, "Invalid range, end is before start", http.StatusBadRequest)
+			return
+		}
+		rangeValues := r.URL.Query()
+		rangeValues.Set("start", strconv.FormatInt(queryRange.Start, 10))
+		rangeValues.Set("end", strconv.FormatInt(queryRange.End, 10))
+		rangeRequest := r.Clone(r.Context())
+		rangeRequest.URL.RawQuery = rangeValues.Encode()
+		query, err := parseLogQuery(rangeRequest)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query.ctx = ctx
+		queries = append(queries, query)
+	}
+
+	// Every range gets what the previous ones left of the budget, an exhausted budget truncates the remaining ranges
+	objectsLeft, entriesLeft := maxQueryObjects, maxResultEntries
+	results := make([]rangeResult, len(queries))
+	partial, degraded, unreadable := false, false, []string{}
+	for i, query := range queries {
+		results[i] = rangeResult{Start: request.Ranges[i].Start, End: request.Ranges[i].End, Entries: []LogEntry{}}
+		if (maxQueryObjects > 0 && objectsLeft <= 0) || (maxResultEntries > 0 && entriesLeft <= 0) {
+			results[i].Truncated = true
+			continue
+		}
+		query.maxObjects, query.maxEntries = objectsLeft, entriesLeft
+		if entries := query.run(); entries != nil {
+			results[i].Entries = entries
+		}
+		objectsLeft -= query.fetched
+		entriesLeft -= query.matched
+		results[i].Truncated = query.truncated
+
+		partial = partial || query.partial
+		degraded = degraded || query.degraded
+		unreadable = append(unreadable, query.unreadable...)
+	}
+
+	fetched := 0
+	for _, query := range queries {
+		fetched += query.fetched
+	}
+	metrics.observe("query_objects_fetched", float64(fetched), queryObjectsBuckets)
+
+	if values.Get("strict") == "true" && len(unreadable) > 0 {
+		http.Error(w, fmt.Sprintf("Unreadable objects: %s", strings.Join(unreadable, ",")), http.StatusInternalServerError)
+		return
+	}
+	for _, result := range results {
+		if result.Truncated {
+			w.Header().Set("X-Query-Truncated", "true")
+		}
+	}
+	if partial {
+		w.Header().Set("X-Query-Partial", "true")
+	}
+	if len(unreadable) > 0 {
+		w.Header().Set("X-Query-Unreadable", strings.Join(unreadable, ","))
+	}
+	if degraded {
+		w.Header().Set("X-Query-Degraded", "true")
+	}
+
+	responseData, err := marshalResponse(r, results)
+	if err != nil {
+		http.Error(w, "Error marshalling response data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseData)
+}
+
+/*
+queryTimestamps returns the entries whose timestamp is exactly one of timestamps and that match the filters of the URL.
+The query spans the earliest to the latest timestamp but only reads the objects of their distinct minutes.
+*/
+func queryTimestamps(ctx context.Context, w http.ResponseWriter, r *http.Request, timestamps []int64) {
+	wanted := make(map[int64]bool, len(timestamps))
+	var minutes []string
+	seenMinutes := make(map[string]bool)
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	for _, timestamp := range timestamps {
+		wanted[timestamp] = true
+		minute := formatMinute(time.Unix(timestamp, 0))
+		if !seenMinutes[minute] {
+			seenMinutes[minute] = true
+			minutes = append(minutes, minute)
+		}
+	}
+
+	values := r.URL.Query()
+	values.Set("start", strconv.FormatInt(timestamps[0], 10))
+	values.Set("end", strconv.FormatInt(timestamps[len(timestamps)-1], 10))
+	timestampsRequest := r.Clone(r.Context())
+	timestampsRequest.URL.RawQuery = values.Encode()
+	query, err := parseLogQuery(timestampsRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query.ctx = ctx
+	query.timestamps = minutes
+	query.predicates = append(query.predicates, func(entry LogEntry) bool {
+		return wanted[entry.Timestamp]
+	})
+
+	entries := query.run()
+	if values.Get("strict") == "true" && len(query.unreadable) > 0 {
+		http.Error(w, fmt.Sprintf("Unreadable objects: %s", strings.Join(query.unreadable, ",")), http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []LogEntry{}
+	}
+	query.setResponseHeaders(w)
+
+	responseData, err := marshalResponse(r, entries)
+	if err != nil {
+		http.Error(w, "Error marshalling response data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseData)
+}
+
+// logQuery is a parsed time range and text filter shared by the query endpoints
+type logQuery struct {
+	startTime  time.Time
+	endTime    time.Time
+	predicates []entryPredicate
+	timestamps []string
+
+	// cursor skips the minutes before it. The query is truncated at next once maxObjects objects are fetched
+	// or maxEntries entries matched, checked between objects so that no minute is split across pages
+	cursor     string
+	maxObjects int
+	maxEntries int
+	fetched    int
+	matched    int
+	truncated  bool
+	next       string
+
+	// limit splits pages within a minute: the matching entries of the cursor minute up to the position after
+	// are skipped, and nextAfter is where the next page resumes in the next minute. With tail, the cursor is
+	// within the minutes not uploaded yet and the buffer, which are paged together, see eachTail
+	limit     int
+	after     entryPosition
+	tail      bool
+	nextAfter entryPosition
+	nextTail  bool
+
+	// ctx bounds the query, once it is done the query is truncated as partial at the first minute not fully read
+	ctx     context.Context
+	partial bool
+
+	// unreadable lists the minutes whose objects exist but couldn't be read, strict queries fail on them
+	unreadable []string
+	strict     bool
+
+	// store is prepended to the minutes of object keys, "errors/" to query the error store
+	store string
+
+	// keyGlob restricts the query to the minutes matching it, listed from S3 on first use
+	keyGlob     string
+	globListed  bool
+	globMinutes []string
+
+	// degraded is set once S3 is skipped because s3Breaker is open, the local files are then read instead
+	degraded bool
+
+	// abandoned is set by a consumer that can't use further entries, e.g. a failed export, no more objects are fetched
+	abandoned bool
+
+	// keys resolves which objects exist from listings, made on first use
+	keys *objectKeyIndex
+}
+
+/*
+parseLogQuery parses the start, end and text parameters of r.
+
+Omitted parameters fall back to DEFAULT_QUERY_LAST (end defaults to now, start to end minus the duration)
+and DEFAULT_QUERY_TEXT, explicitly passed parameters always take precedence.
+*/
+func parseLogQuery(r *http.Request) (*logQuery, error) {
+	// Parse query parameters
+	values := r.URL.Query()
+	startTimestamp := values.Get("start")
+	endTimestamp := values.Get("end")
+	texts := values["text"]
+	if !values.Has("text") && defaultQueryText != "" {
+		texts = []string{defaultQueryText}
+	}
+	predicates, err := parsePredicates(texts, values)
+	if err != nil {
+		return nil, err
+	}
+	store := ""
+	switch values.Get("store") {
+	case "":
+		if errorStoreMode == "move" && errorStoreLevel != "" {
+			predicates = append(predicates, func(entry LogEntry) bool { return !isErrorEntry(entry) })
+		}
+	case "errors":
+		if errorStoreLevel == "" {
+			return nil, fmt.Errorf("The error store is not enabled")
+		}
+		// The in-memory buffer holds the entries of both stores
+		store = "errors/"
+		predicates = append(predicates, isErrorEntry)
+	default:
+		return nil, fmt.Errorf("Invalid store, expected errors")
+	}
+	if defaultQueryLast > 0 {
+		if !values.Has("end") {
+			endTimestamp = strconv.FormatInt(time.Now().Unix(), 10)
+		}
+		if !values.Has("start") {
+			if end, err := strconv.ParseInt(endTimestamp, 10, 64); err == nil {
+				startTimestamp = strconv.FormatInt(end-int64(defaultQueryLast.Seconds()), 10)
+			}
+		}
+	}
+
+	// A cursor is a minute, optionally followed by the position of the entry to resume after within it:
+	// 2024-03-02-05-07:1709356030:3f2a9c41d0e85b17c6a4e2d18f90b3a5, prefixed with tail: when within the buffer
+	cursor := values.Get("cursor")
+	tail := strings.HasPrefix(cursor, "tail:")
+	cursor = strings.TrimPrefix(cursor, "tail:")
+	var after entryPosition
+	if minute, position, ok := strings.Cut(cursor, ":"); ok {
+		timestampText, key, ok := strings.Cut(position, ":")
+		timestamp, err := strconv.ParseInt(timestampText, 10, 64)
+		if !ok || err != nil || key == "" {
+			return nil, fmt.Errorf("Invalid cursor")
+		}
+		cursor, after = minute, entryPosition{timestamp: timestamp, key: key}
+	}
+	if tail && cursor == "" {
+		return nil, fmt.Errorf("Invalid cursor")
+	}
+	if cursor != "" {
+		if _, err := parseMinute(cursor); err != nil {
+			return nil, fmt.Errorf("Invalid cursor")
+		}
+	}
+	limit := 0
+	if values.Has("limit") {
+		limit, err = strconv.Atoi(values.Get("limit"))
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("Invalid limit")
+		}
+	}
+
+	keyGlob := values.Get("key_glob")
+	if keyGlob != "" && store != "" {
+		return nil, fmt.Errorf("key_glob is not supported with store")
+	}
+	if keyGlob != "" {
+		if _, err := path.Match(keyGlob, ""); err != nil {
+			return nil, fmt.Errorf("Invalid key_glob")
+		}
+		// Without a range, a glob selects matching minutes across all time
+		if startTimestamp == "" && endTimestamp == "" {
+			return &logQuery{
+				startTime:  time.Time{},
+				endTime:    time.Unix(253402300799, 0),
+				predicates: predicates,
+				cursor:     cursor,
+				after:      after,
+				tail:       tail,
+				limit:      limit,
+				maxObjects: maxQueryObjects,
+				maxEntries: maxResultEntries,
+				keyGlob:    keyGlob,
+				strict:     values.Get("strict") == "true",
+				store:      store,
+			}, nil
+		}
+	}
+
+	// Parse start timestamp
+	startTimeUnix, err := strconv.ParseInt(startTimestamp, 10, 64)
+	startTimeUnix = startTimeUnix - 1 // To get inclusive results when filtering the log entries using .After()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid start timestamp")
+	}
+	startTime := time.Unix(startTimeUnix, 0)
+
+	// Parse end timestamp
+	endTimeUnix, err := strconv.ParseInt(endTimestamp, 10, 64)
+	endTimeUnix = endTimeUnix + 1 // To get inclusive results when filtering the log entries using .Before()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid end timestamp")
+	}
+	endTime := time.Unix(endTimeUnix, 0)
+	endMinute := formatMinute(endTime)
+
+	// Generate a list of timestamps between start and end timestamps, the loop may stop short of the end minute
+	var timestamps []string
+	for t := startTime; t.Before(endTime); t = t.Add(time.Minute) {
+		timestamps = append(timestamps, formatMinute(t))
+	}
+	if len(timestamps) == 0 || timestamps[len(timestamps)-1] != endMinute {
+		timestamps = append(timestamps, endMinute)
+	}
+
+	return &logQuery{
+		startTime:  startTime,
+		endTime:    endTime,
+		predicates: predicates,
+		timestamps: timestamps,
+		cursor:     cursor,
+		after:      after,
+		tail:       tail,
+		limit:      limit,
+		maxObjects: maxQueryObjects,
+		maxEntries: maxResultEntries,
+		keyGlob:    keyGlob,
+		strict:     values.Get("strict") == "true",
+		store:      store,
+	}, nil
+}
+
+// minutes returns the minutes whose objects the query reads
+func (q *logQuery) minutes() []string {
+	if q.keyGlob == "" {
+		return q.timestamps
+	}
+	if !q.globListed {
+		q.globListed = true
+		minutes, err := listMinutesMatching(q.keyGlob, q.timestamps)
+		if err != nil {
+			log.Printf("Error listing objects matching %s: %v", q.keyGlob, err)
+		}
+		q.globMinutes = minutes
+	}
+	return q.globMinutes
+}
+
+// listMinutesMatching lists the uploaded minutes matching glob, within the range of timestamps when given
+func listMinutesMatching(glob string, timestamps []string) ([]string, error) {
+	first, last := "", ""
+	if len(timestamps) > 0 {
+		first, last = timestamps[0], timestamps[len(timestamps)-1]
+	}
+
+	var minutes []string
+	seen := make(map[string]bool)
+	add := func(minute string) {
+		if seen[minute] {
+			return
+		}
+		if _, err := parseMinute(minute); err != nil {
+			return
+		}
+		if matched, _ := path.Match(glob, minute); matched {
+			seen[minute] = true
+			minutes = append(minutes, minute)
+		}
+	}
+
+	// StartAfter is exclusive, so an extension-less first minute would be skipped by the listing
+	if first != "" {
+		add(first)
+	}
+	for _, prefix := range readPrefixes() {
+		input := &s3.ListObjectsV2Input{
+			Bucket: aws.String(bucketName),
+			Prefix: aws.String(prefix),
+		}
+		if first != "" {
+			input.Prefix = aws.String(listingPrefix(prefix, first, last))
+			input.StartAfter = aws.String(minuteKeyIn(prefix, first))
+		}
+		err := getS3Client().ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				minute := minuteFromKey(*obj.Key)
+				if last != "" && minute > last {
+					return false
+				}
+				add(minute)
+			}
+			return !lastPage
+		})
+		if err != nil {
+			return minutes, err
+		}
+	}
+	// The minutes of the S3_READ_PREFIXES are merged into those of the prefix
+	sort.Strings(minutes)
+	return minutes, nil
+}
+
+// objectKeys returns the index of the existing objects of the query, listed lazily one day at a time
+func (q *logQuery) objectKeys() *objectKeyIndex {
+	if q.keys == nil {
+		q.keys = &objectKeyIndex{listed: make(map[string]map[string]bool)}
+	}
+	return q.keys
+}
+
+// context returns the context bounding the query, the background context unless a timeout was requested
+func (q *logQuery) context() context.Context {
+	if q.ctx == nil {
+		return context.Background()
+	}
+	return q.ctx
+}
+
+// stopPartial marks the query as partial when its context is done, resuming at timestamp
+func (q *logQuery) stopPartial(timestamp string) bool {
+	if q.context().Err() == nil {
+		return false
+	}
+	if !q.truncated {
+		q.truncateAt(timestamp)
+		q.partial = true
+	}
+	return true
+}
+
+// truncateAt ends the query before timestamp, a cursor minute is resumed at the same position
+func (q *logQuery) truncateAt(timestamp string) {
+	q.truncated = true
+	q.next = timestamp
+	q.nextAfter, q.nextTail = entryPosition{}, false
+	if timestamp == q.cursor {
+		q.nextAfter, q.nextTail = q.after, q.tail
+	}
+}
+
+// fetchAllowed reports whether the object of timestamp is to be fetched, marking the query truncated once maxObjects is reached
+func (q *logQuery) fetchAllowed(timestamp string) bool {
+	if q.abandoned || q.truncated || (q.cursor != "" && timestamp < q.cursor) || q.skipS3() {
+		return false
+	}
+	if q.stopPartial(timestamp) {
+		return false
+	}
+	if (q.maxObjects > 0 && q.fetched >= q.maxObjects) || (q.maxEntries > 0 && q.matched >= q.maxEntries) ||
+		(q.limit > 0 && q.matched >= q.limit) {
+		q.truncateAt(timestamp)
+		return false
+	}
+	q.fetched++
+	return true
+}
+
+// setResponseHeaders signals a truncated query and the cursor to continue it with, once the query is done
+func (q *logQuery) setResponseHeaders(w http.ResponseWriter) {
+	metrics.observe("query_objects_fetched", float64(q.fetched), queryObjectsBuckets)
+	if q.truncated {
+		next := q.next
+		if q.nextAfter.key != "" {
+			next = fmt.Sprintf("%s:%d:%s", q.next, q.nextAfter.timestamp, q.nextAfter.key)
+		}
+		if q.nextTail {
+			next = "tail:" + next
+		}
+		w.Header().Set("X-Query-Truncated", "true")
+		w.Header().Set("X-Query-Next", next)
+	}
+	if q.partial {
+		w.Header().Set("X-Query-Partial", "true")
+	}
+	if len(q.unreadable) > 0 {
+		w.Header().Set("X-Query-Unreadable", strings.Join(q.unreadable, ","))
+	}
+	if q.degraded {
+		w.Header().Set("X-Query-Degraded", "true")
+	}
+}
+
+// matches reports whether entry falls strictly between startTime and endTime and satisfies all predicates
+func (q *logQuery) matches(entry LogEntry) bool {
+	entryTimestamp := time.Unix(entry.Timestamp, 0)
+	if !entryTimestamp.After(q.startTime) || !entryTimestamp.Before(q.endTime) {
+		return false
+	}
+	return q.matchesPredicates(entry)
+}
+
+func (q *logQuery) matchesPredicates(entry LogEntry) bool {
+	for _, predicate := range q.predicates {
+		if !predicate(entry) {
+			return false
+		}
+	}
+	return true
+}
+
+type entryPredicate func(entry LogEntry) bool
+
+/*
+Parses the filters of a query, all of which are repeatable and combined with AND:
+
+text=X          the message contains X
+exclude=X       the message doesn't contain X
+regex=X         the message matches the regular expression X
+field=name:X    the field equals X (level, log or any key of fields)
+field=name~X    the field contains X
+
+Leading and trailing whitespace of text, exclude and regex is trimmed, unless trim=false to search for it.
+*/
+func parsePredicates(texts []string, values url.Values) ([]entryPredicate, error) {
+	trim := func(s string) string { return s }
+	if values.Get("trim") != "false" {
+		trim = strings.TrimSpace
+	}
+
+	var predicates []entryPredicate
+	for _, text := range texts {
+		text := trim(text)
+		if text == "" {
+			continue
+		}
+		predicates = append(predicates, func(entry LogEntry) bool {
+			return strings.Contains(entry.Message, text)
+		})
+	}
+	for _, exclude := range values["exclude"] {
+		exclude := trim(exclude)
+		if exclude == "" {
+			continue
+		}
+		predicates = append(predicates, func(entry LogEntry) bool {
+			return !strings.Contains(entry.Message, exclude)
+		})
+	}
+	for _, expr := range values["regex"] {
+		expr = trim(expr)
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regex %q: %v", expr, err)
+		}
+		predicates = append(predicates, func(entry LogEntry) bool {
+			return re.MatchString(entry.Message)
+		})
+	}
+	for _, field := range values["field"] {
+		separator := strings.IndexAny(field, ":~")
+		if separator <= 0 {
+			return nil, fmt.Errorf("Invalid field %q, expected name:value or name~value", field)
+		}
+		name, operator, expected := field[:separator], field[separator], field[separator+1:]
+		predicates = append(predicates, func(entry LogEntry) bool {
+			value, ok := entry.field(name)
+			if !ok {
+				return false
+			}
+			if operator == ':' {
+				return value == expected
+			}
+			return strings.Contains(value, expected)
+		})
+	}
+	return predicates, nil
+}
+
+// run returns the matching entries from S3 followed by the ones still in the in-memory buffer
+func (q *logQuery) run() []LogEntry {
+	var result []LogEntry
+	q.each(func(entries []LogEntry) {
+		result = append(result, entries...)
+	})
+	return result
+}
+
+/*
+runWithContext returns the matching entries together with the n entries before and after each of them, sorted by time.
+
+All entries of the range are read to find the context, so they count towards MAX_RESULT_ENTRIES and limit.
+Overlapping windows are merged, every entry is returned once.
+*/
+func (q *logQuery) runWithContext(n int) []LogEntry {
+	predicates := q.predicates
+	q.predicates = nil
+	entries := q.run()
+	q.predicates = predicates
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Timestamp < entries[j].Timestamp
+	})
+
+	var result []LogEntry
+	included := -1 // index of the last entry added to result
+	for i, entry := range entries {
+		if !q.matchesPredicates(entry) {
+			continue
+		}
+		from, to := i-n, i+n
+		if from <= included {
+			from = included + 1
+		}
+		if from < 0 {
+			from = 0
+		}
+		if to >= len(entries) {
+			to = len(entries) - 1
+		}
+		if from <= to {
+			result = append(result, entries[from:to+1]...)
+			included = to
+		}
+	}
+	return result
+}
+
+// each calls fn with the matching entries of every S3 object, then with the matching entries of the in-memory buffer
+func (q *logQuery) each(fn func(entries []LogEntry)) {
+	// Limit pages leave the minutes the buffer is uploaded to for eachTail
+	tailFrom := ""
+	if q.limit > 0 || q.tail {
+		tailFrom = q.tailFrom()
+	}
+
+	// Retrieve objects from S3 for each timestamp in the list
+	minutes := q.minutes()
+	for i := 0; i < len(minutes); i++ {
+		timestamp := minutes[i]
+		if tailFrom != "" && timestamp >= tailFrom {
+			break
+		}
+		if q.spansHour(minutes, i) {
+			if !q.fetchAllowed(timestamp) {
+				continue
+			}
+			if entries, compacted := q.compactedHour(timestamp); compacted {
+				if len(entries) > 0 {
+					q.matched += len(entries)
+					fn(entries)
+				}
+				i += 59
+				continue
+			}
+			// The hour isn't compacted, its minutes are fetched instead
+			q.fetched--
+		}
+		if !q.fetchAllowed(timestamp) {
+			continue
+		}
+		entries := q.queryObject(timestamp)
+		resume := timestamp == q.cursor && q.after.key != ""
+		if q.limit > 0 || resume {
+			var last entryPosition
+			var cut bool
+			entries, last, cut = q.pageEntries(entries, resume)
+			if cut {
+				q.truncated, q.next = true, timestamp
+				q.nextAfter = last
+			}
+		}
+		if len(entries) > 0 {
+			q.matched += len(entries)
+			fn(entries)
+		}
+	}
+
+	// The buffer is only scanned with the last page of a truncated query, so that its entries are returned once
+	if q.truncated {
+		return
+	}
+	if tailFrom != "" {
+		q.eachTail(minutes, tailFrom, fn)
+		return
+	}
+	bufferEntries := q.bufferEntries()
+	if len(bufferEntries) > 0 {
+		q.matched += len(bufferEntries)
+		fn(bufferEntries)
+	}
+}
+
+/*
+eachTail pages through the minutes from tailFrom on together with the in-memory buffer, as one set ordered by entry position.
+Buffered entries move to the objects of these minutes when uploaded, so a page ending within the buffer resumes after
+the same entry whether or not an upload happened in between.
+*/
+func (q *logQuery) eachTail(minutes []string, tailFrom string, fn func(entries []LogEntry)) {
+	var entries []LogEntry
+	for _, timestamp := range minutes {
+		if timestamp < tailFrom || q.stopPartial(tailFrom) {
+			continue
+		}
+		q.fetched++
+		entries = append(entries, q.queryObject(timestamp)...)
+	}
+	// Nothing of the tail is returned by a partial page, it is resumed as a whole
+	if q.truncated {
+		q.truncateAt(tailFrom)
+		return
+	}
+	entries = append(entries, q.bufferEntries()...)
+
+	entries, last, cut := q.pageEntries(entries, q.tail && q.after.key != "")
+	if cut {
+		q.truncated, q.next = true, tailFrom
+		q.nextAfter, q.nextTail = last, true
+	}
+	if len(entries) > 0 {
+		q.matched += len(entries)
+		fn(entries)
+	}
+}
+
+// tailFrom returns the first minute the buffer may still be uploaded to: that of the oldest local file, or the current minute
+func (q *logQuery) tailFrom() string {
+	if q.tail {
+		return q.cursor
+	}
+	from := formatMinute(time.Now())
+	files, err := listLocalFiles()
+	if err != nil {
+		log.Printf("Error listing local files: %v", err)
+		return from
+	}
+	for _, file := range files {
+		minute := localFileMinute(file.name)
+		if strings.TrimSuffix(minute, path.Base(minute)) == q.store && path.Base(minute) < from {
+			from = path.Base(minute)
+		}
+	}
+	return from
+}
+
+// entryPosition orders entries for limit pages, by time and then by dedup key, independently of the order of their object
+type entryPosition struct {
+	timestamp int64
+	key       string
+}
+
+func positionOf(entry LogEntry) entryPosition {
+	return entryPosition{timestamp: entry.Timestamp, key: strings.TrimPrefix(entryDedupKey(entry), "entry:")}
+}
+
+func (p entryPosition) less(other entryPosition) bool {
+	if p.timestamp != other.timestamp {
+		return p.timestamp < other.timestamp
+	}
+	return p.key < other.key
+}
+
+/*
+pageEntries sorts entries by position, drops those up to q.after when resuming and cuts them at the rest of the limit,
+reporting the position of the last one kept. Entries at the same position (equal time and message) are kept together,
+as a cursor couldn't tell them apart.
+*/
+func (q *logQuery) pageEntries(entries []LogEntry, resume bool) ([]LogEntry, entryPosition, bool) {
+	type positioned struct {
+		position entryPosition
+		entry    LogEntry
+	}
+	sorted := make([]positioned, 0, len(entries))
+	for _, entry := range entries {
+		position := positionOf(entry)
+		if resume && !q.after.less(position) {
+			continue
+		}
+		sorted = append(sorted, positioned{position: position, entry: entry})
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].position.less(sorted[j].position) })
+
+	n, cut := len(sorted), false
+	if q.limit > 0 && q.matched+n > q.limit {
+		n, cut = max(q.limit-q.matched, 0), true
+		for n > 0 && n < len(sorted) && sorted[n].position == sorted[n-1].position {
+			n++
+		}
+	}
+	last := q.after
+	if !resume {
+		last = entryPosition{}
+	}
+	page := make([]LogEntry, n)
+	for i := range page {
+		page[i] = sorted[i].entry
+		last = sorted[i].position
+	}
+	return page, last, cut
+}
+
+// bufferEntries returns the entries of the in-memory buffer matching the query, with those of the local files when S3 is skipped
+// or the buffer is disabled
+func (q *logQuery) bufferEntries() []LogEntry {
+	// Without the buffer, the entries not uploaded yet are read from the local files, those not flushed yet aren't found
+	if bufferDisabled {
+		readStart := time.Now()
+		local := q.localEntries()
+		observeQuerySource("local", readStart)
+		return local
+	}
+	scanStart := time.Now()
+	buffered := q.scanBuffer()
+	observeQuerySource("buffer", scanStart)
+	if q.skipS3() {
+		readStart := time.Now()
+		local := q.localEntries()
+		observeQuerySource("local", readStart)
+		return mergeLocalEntries(local, buffered)
+	}
+	return buffered
+}
+
+// observeQuerySource records the time a query spent reading source (s3, buffer or local) since start
+func observeQuerySource(source string, start time.Time) {
+	metrics.observe(fmt.Sprintf("query_source_duration_seconds{source=%q}", source), time.Since(start).Seconds(), latencyBuckets)
+}
+
+// skipS3 reports whether the query is served without S3 as s3Breaker is open, strict queries always read S3
+func (q *logQuery) skipS3() bool {
+	if q.degraded {
+		return true
+	}
+	q.degraded = queryLocalFallback && !q.strict && s3Breaker.isOpen()
+	return q.degraded
+}
+
+/*
+localEntries returns the matching entries of the local files of the query's store that are not uploaded yet.
+Files are named after the minute they were written in, so those written before the range are skipped,
+allowing for MAX_CLOCK_SKEW.
+*/
+func (q *logQuery) localEntries() []LogEntry {
+	files, err := listLocalFiles()
+	if err != nil {
+		log.Printf("Error listing local files: %v", err)
+		return nil
+	}
+	firstMinute := formatMinute(q.startTime.Add(-maxClockSkew))
+
+	var entries []LogEntry
+	for _, file := range files {
+		minute := localFileMinute(file.name)
+		if strings.TrimSuffix(minute, path.Base(minute)) != q.store || path.Base(minute) < firstMinute {
+			continue
+		}
+		logEntries, _, err := readLocalFile(file.name)
+		if err != nil {
+			log.Printf("Error reading local file %s: %v", file.name, err)
+			continue
+		}
+		for _, entry := range logEntries {
+			if q.matches(entry) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries
+}
+
+// mergeLocalEntries returns the local entries followed by the buffered ones not written to a local file yet
+func mergeLocalEntries(local, buffered []LogEntry) []LogEntry {
+	written := make(map[string]int)
+	for _, entry := range local {
+		written[entryDedupKey(entry)]++
+	}
+	for _, entry := range buffered {
+		key := entryDedupKey(entry)
+		if written[key] > 0 {
+			written[key]--
+			continue
+		}
+		local = append(local, entry)
+	}
+	return local
+}
+
+/*
+scanBuffer returns the entries of the in-memory buffer matching the query, in minute order.
+
+Only the index buckets of the minutes in range are scanned, wide ranges with more minutes than the
+buffer has buckets walk the buckets instead.
+*/
+func (q *logQuery) scanBuffer() []LogEntry {
+	bufferMu.RLock()
+	defer bufferMu.RUnlock()
+
+	first, last := bufferMinute(q.startTime.Unix()+1), bufferMinute(q.endTime.Unix()-1)
+	var minutes []int64
+	if (last-first)/60+1 <= int64(len(bufferIndex)) {
+		for minute := first; minute <= last; minute += 60 {
+			minutes = append(minutes, minute)
+		}
+	} else {
+		for minute := range bufferIndex {
+			if minute >= first && minute <= last {
+				minutes = append(minutes, minute)
+			}
+		}
+		sort.Slice(minutes, func(i, j int) bool { return minutes[i] < minutes[j] })
+	}
+
+	var entries []LogEntry
+	for _, minute := range minutes {
+		for _, entry := range bufferIndex[minute] {
+			if q.matches(entry) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries
+}
+
+// bufferMinute returns the start of the minute of timestamp, the key of bufferIndex
+func bufferMinute(timestamp int64) int64 {
+	return timestamp - ((timestamp%60)+60)%60
+}
+
+// appendToBuffer adds entry to the in-memory buffer and its index, bufferMu must be held
+func appendToBuffer(entry LogEntry) {
+	inMemorySearchBuffer = append(inMemorySearchBuffer, entry)
+	minute := bufferMinute(entry.Timestamp)
+	bufferIndex[minute] = append(bufferIndex[minute], entry)
+}
+
+// resetBuffer replaces the in-memory buffer with entries and rebuilds its index, bufferMu must be held
+func resetBuffer(entries []LogEntry) {
+	inMemorySearchBuffer = nil
+	bufferIndex = make(map[int64][]LogEntry)
+	for _, entry := range entries {
+		appendToBuffer(entry)
+	}
+}
+
+// queryObject fetches the S3 object for a minute timestamp and returns the entries matching the query
+func (q *logQuery) queryObject(timestamp string) []LogEntry {
+	if q.skipS3() {
+		return nil
+	}
+
+	// Get the object, or all parts of the minute, from S3
+	fetchStart := time.Now()
+	logEntries, _, err := getMinuteEntries(q.context(), q.store+timestamp, q.objectKeys())
+	observeQuerySource("s3", fetchStart)
+	if err != nil {
+		// A fetch cancelled by the timeout isn't an error, the minute is where the next page resumes
+		if q.stopPartial(timestamp) {
+			return nil
+		}
+		log.Printf("Error getting S3 object for timestamp %s: %v", timestamp, err)
+		if !isNoSuchKey(err) {
+			q.unreadable = append(q.unreadable, timestamp)
+		}
+		return nil
+	}
+
+	var filteredLogEntries []LogEntry
+	for _, entry := range logEntries {
+		if q.matches(entry) {
+			filteredLogEntries = append(filteredLogEntries, entry)
+		}
+	}
+	return filteredLogEntries
+}
+
+// spansHour reports whether minutes[i] starts a whole hour of the query that may be read from its compacted object
+func (q *logQuery) spansHour(minutes []string, i int) bool {
+	if !queryCompactedHours || q.keyGlob != "" || q.limit > 0 || i+59 >= len(minutes) {
+		return false
+	}
+	first := minutes[i]
+	if !strings.HasSuffix(first, "-00") || first < q.cursor {
+		return false
+	}
+	return minutes[i+59] == hourOfMinute(first)+"-59"
+}
+
+// hourOfMinute returns the hour of a minute, the key of the hour's compacted object: 2024-03-02-05 for 2024-03-02-05-07
+func hourOfMinute(minute string) string {
+	return minute[:len(minute)-len("-04")]
+}
+
+/*
+compactedHour returns the matching entries of the compacted object of the hour starting at minute, and whether
+there is one. Compacted objects are named after the hour instead of the minute and hold the entries of all its
+minutes, the minute objects are only read for hours without one.
+*/
+func (q *logQuery) compactedHour(minute string) ([]LogEntry, bool) {
+	if q.skipS3() {
+		return nil, false
+	}
+	hour := hourOfMinute(minute)
+	fetchStart := time.Now()
+	logEntries, _, err := getMinuteEntries(q.context(), q.store+hour, q.objectKeys())
+	observeQuerySource("s3", fetchStart)
+	if err != nil {
+		if q.stopPartial(minute) {
+			return nil, true
+		}
+		if !isNoSuchKey(err) {
+			log.Printf("Error getting compacted S3 object for hour %s, reading its minutes: %v", hour, err)
+		}
+		return nil, false
+	}
+
+	var filteredLogEntries []LogEntry
+	for _, entry := range logEntries {
+		if q.matches(entry) {
+			filteredLogEntries = append(filteredLogEntries, entry)
+		}
+	}
+	return filteredLogEntries, true
+}
+
+// pendingHour counts the minute objects written to an hour since it was last compacted
+type pendingHour struct {
+	keys   map[string]bool
+	writes int
+}
+
+// markPendingCompaction records that the object at key was written for minute (or a part of it), hourly objects are skipped
+func markPendingCompaction(minute, key string) {
+	dir, name := path.Split(minute)
+	if compactionInterval <= 0 || len(name) < len("2006-01-02-15-04") {
+		return
+	}
+	hour := dir + hourOfMinute(name[:len("2006-01-02-15-04")])
+
+	compactionMu.Lock()
+	defer compactionMu.Unlock()
+	pending, ok := pendingCompaction[hour]
+	if !ok {
+		pending = &pendingHour{keys: make(map[string]bool)}
+		pendingCompaction[hour] = pending
+	}
+	pending.keys[key] = true
+	pending.writes++
+}
+
+/*
+periodicallyCompact compacts, every COMPACTION_INTERVAL, the hours that ended COMPACT_AFTER ago or that have more than
+COMPACT_MAX_OBJECTS minute objects (parts included) written since their last compaction. Hours still being written to
+are compacted again once they are due again, so that the hourly object catches up with their minutes.
+
+Only the hours written to since the start are tracked, hours uploaded before a restart aren't compacted.
+*/
+func periodicallyCompact() {
+	for {
+		time.Sleep(compactionInterval)
+		if readOnly.Load() {
+			continue
+		}
+		compactDueHours(time.Now())
+	}
+}
+
+// compactDueHours compacts the pending hours that are due at now, by their age or their number of objects
+func compactDueHours(now time.Time) {
+	due := make(map[string]int)
+	compactionMu.Lock()
+	for hour, pending := range pendingCompaction {
+		_, name := path.Split(hour)
+		start, err := parseMinute(name + "-00")
+		if err != nil {
+			delete(pendingCompaction, hour)
+			continue
+		}
+		if now.Sub(start.Add(time.Hour)) >= compactAfter || (compactMaxObjects > 0 && len(pending.keys) > compactMaxObjects) {
+			due[hour] = pending.writes
+		}
+	}
+	compactionMu.Unlock()
+
+	for hour, writes := range due {
+		if err := compactHour(hour); err != nil {
+			metrics.add("compaction_errors_total", 1)
+			log.Printf("Error compacting hour %s: %v", hour, err)
+			continue
+		}
+		metrics.add("compactions_total", 1)
+		// Minutes written while the hour was compacted keep it pending
+		compactionMu.Lock()
+		if pending, ok := pendingCompaction[hour]; ok && pending.writes == writes {
+			delete(pendingCompaction, hour)
+		}
+		compactionMu.Unlock()
+	}
+}
+
+// compactHour writes the entries of all minute objects of hour (of its store) to the hour's compacted object, see compactedHour
+func compactHour(hour string) error {
+	dir, _ := path.Split(hour)
+	var minutes []string
+	err := getS3Client().ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucketName),
+		Prefix: aws.String(minuteKey(hour) + "-"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			minute := minuteFromKey(*obj.Key)
+			if len(minutes) == 0 || minutes[len(minutes)-1] != minute {
+				minutes = append(minutes, minute)
+			}
+		}
+		return !lastPage
+	})
+	if err != nil {
+		return fmt.Errorf("error listing the minutes of the hour: %v", err)
+	}
+
+	var logEntries []LogEntry
+	for _, minute := range minutes {
+		minute = dir + path.Base(minute)
+		entries, _, err := getMinuteEntries(context.Background(), minute, nil)
+		if err != nil {
+			return fmt.Errorf("error reading minute %s: %v", minute, err)
+		}
+		logEntries = append(logEntries, entries...)
+	}
+	if len(logEntries) == 0 {
+		return nil
+	}
+	if flushSort == "timestamp" {
+		sort.SliceStable(logEntries, func(i, j int) bool {
+			return logEntries[i].Timestamp < logEntries[j].Timestamp
+		})
+	}
+	if err := putMinuteObject(hour, logEntries); err != nil {
+		return err
+	}
+	log.Printf("Compacted %d minutes of hour %s, %d entries", len(minutes), hour, len(logEntries))
+	return nil
+}
+
+// pendingCompactions returns the number of hours waiting to be compacted and of the objects written to them
+func pendingCompactions() (hours, objects int) {
+	compactionMu.Lock()
+	defer compactionMu.Unlock()
+	for _, pending := range pendingCompaction {
+		objects += len(pending.keys)
+	}
+	return len(pendingCompaction), objects
+}
+
+/*
+circuitBreaker opens after threshold consecutive failed S3 reads and stays open for cooldown. The first read after
+the cooldown is let through, it closes the breaker again on success or reopens it on failure.
+*/
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// isOpen reports whether S3 is to be skipped
+func (b *circuitBreaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Now().Before(b.openUntil)
+}
+
+func (b *circuitBreaker) record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		if b.threshold > 0 && b.failures >= b.threshold {
+			log.Printf("S3 reads succeed again, closing the circuit breaker")
+		}
+		b.failures = 0
+		b.openUntil = time.Time{}
+		metrics.set("s3_breaker_open", 0)
+		return
+	}
+	b.failures++
+	if b.threshold > 0 && b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			log.Printf("%d consecutive S3 reads failed, opening the circuit breaker for %s", b.failures, b.cooldown)
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+		metrics.set("s3_breaker_open", 1)
+	}
+}
+
+// entryCursor iterates the sorted matching entries of one object (or of the in-memory buffer)
+type entryCursor struct {
+	entries []LogEntry
+	pos     int
+}
+
+type entryCursorHeap []*entryCursor
+
+func (h entryCursorHeap) Len() int { return len(h) }
+func (h entryCursorHeap) Less(i, j int) bool {
+	return h[i].entries[h[i].pos].Timestamp < h[j].entries[h[j].pos].Timestamp
+}
+func (h entryCursorHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *entryCursorHeap) Push(x interface{}) { *h = append(*h, x.(*entryCursor)) }
+func (h *entryCursorHeap) Pop() interface{} {
+	old := *h
+	cursor := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return cursor
+}
+
+/*
+eachSorted calls fn with the matching entries in global time order, until fn returns false.
+
+Objects are sorted internally, so they are k-way merged with a heap holding at most sortBufferObjects objects
+(plus the in-memory buffer) at a time: whenever an object is exhausted the next minute is loaded.
+Entries are therefore globally sorted as long as no entry is more than sortBufferObjects minutes away from its object's minute.
+*/
+func (q *logQuery) eachSorted(fn func(entry LogEntry) bool) {
+	h := &entryCursorHeap{}
+	push := func(entries []LogEntry) {
+		if len(entries) == 0 {
+			return
+		}
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Timestamp < entries[j].Timestamp
+		})
+		q.matched += len(entries)
+		heap.Push(h, &entryCursor{entries: entries})
+	}
+
+	minutes := q.minutes()
+	next := 0
+	loadNext := func() {
+		for next < len(minutes) {
+			timestamp := minutes[next]
+			next++
+			if !q.fetchAllowed(timestamp) {
+				continue
+			}
+			if entries := q.queryObject(timestamp); len(entries) > 0 {
+				push(entries)
+				return
+			}
+		}
+	}
+
+	for i := 0; i < sortBufferObjects; i++ {
+		loadNext()
+	}
+
+	bufferEntries := q.bufferEntries()
+	bufferPushed := false
+
+	for {
+		if h.Len() == 0 {
+			loadNext()
+		}
+		// Like each, the buffer is merged in once all minutes are loaded, and only if the query isn't truncated
+		if !bufferPushed && next >= len(minutes) && !q.truncated {
+			bufferPushed = true
+			push(bufferEntries)
+		}
+		if h.Len() == 0 {
+			return
+		}
+
+		cursor := (*h)[0]
+		if !fn(cursor.entries[cursor.pos]) {
+			return
+		}
+		cursor.pos++
+		if cursor.pos < len(cursor.entries) {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+			loadNext()
+		}
+	}
+}
+
+// writeSortedQuery streams the query result as a globally sorted JSON array, truncation is signalled in trailers
+func writeSortedQuery(w http.ResponseWriter, query *logQuery) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Trailer", "X-Query-Truncated, X-Query-Next, X-Query-Partial, X-Query-Unreadable, X-Query-Degraded")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	first := true
+	io.WriteString(w, "[")
+	query.eachSorted(func(entry LogEntry) bool {
+		if !first {
+			io.WriteString(w, ",")
+		}
+		first = false
+		return encoder.Encode(entry) == nil
+	})
+	io.WriteString(w, "]")
+	query.setResponseHeaders(w)
+}
+
+/*
+Returns the earliest (pick=first) or latest (pick=last) entry matching the query.
+
+Minute objects are scanned towards the other end of the range. Entries aren't necessarily stored in the object
+of their own minute (late entries, X-Target-Minute), so once there is a candidate an object is only fetched
+when its min-ts / max-ts metadata may hold a better entry, or when it has none.
+*/
+func (q *logQuery) pickEntry(pick string) []LogEntry {
+	var picked *LogEntry
+	better := func(entry LogEntry) bool {
+		if picked == nil {
+			return true
+		}
+		if pick == "first" {
+			return entry.Timestamp < picked.Timestamp
+		}
+		return entry.Timestamp > picked.Timestamp
+	}
+
+	for _, entry := range q.bufferEntries() {
+		if better(entry) {
+			entry := entry
+			picked = &entry
+		}
+	}
+
+	minutes := q.minutes()
+	keys := make([]string, len(minutes))
+	copy(keys, minutes)
+	if pick == "last" {
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
+
+	for _, timestamp := range keys {
+		if picked != nil {
+			minTs, maxTs, known := objectTimeBounds(q.context(), q.store+timestamp, q.objectKeys())
+			if known && ((pick == "first" && minTs >= picked.Timestamp) || (pick == "last" && maxTs <= picked.Timestamp)) {
+				continue
+			}
+		}
+		if !q.fetchAllowed(timestamp) {
+			continue
+		}
+
+		for _, entry := range q.queryObject(timestamp) {
+			if better(entry) {
+				entry := entry
+				picked = &entry
+			}
+		}
+	}
+
+	if picked == nil {
+		return nil
+	}
+	return []LogEntry{*picked}
+}
+
+/*
+objectTimeBounds returns the min-ts / max-ts metadata of the object of a minute, looked up like getS3ObjectByKey.
+known is false when the object lacks the metadata, or when the minute has no single object (it may be split into parts).
+*/
+func objectTimeBounds(ctx context.Context, minute string, keys *objectKeyIndex) (minTs, maxTs int64, known bool) {
+	client := getS3Client()
+	for _, prefix := range readPrefixes() {
+		existing, listed := keys.existing(ctx, prefix, minute)
+		for _, key := range objectKeyCandidates(prefix, minute) {
+			if listed && !existing[key] {
+				continue
+			}
+			head, err := client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+				Bucket: aws.String(bucketName),
+				Key:    aws.String(key),
+			})
+			if isNoSuchKey(err) {
+				continue
+			}
+			if err != nil || head.Metadata["Min-Ts"] == nil || head.Metadata["Max-Ts"] == nil {
+				return 0, 0, false
+			}
+			minTs, minErr := strconv.ParseInt(*head.Metadata["Min-Ts"], 10, 64)
+			maxTs, maxErr := strconv.ParseInt(*head.Metadata["Max-Ts"], 10, 64)
+			return minTs, maxTs, minErr == nil && maxErr == nil
+		}
+	}
+	return 0, 0, false
+}
+
+type timeWindow struct {
+	WindowStart int64      `json:"window_start"`
+	Count       int        `json:"count"`
+	Entries     []LogEntry `json:"entries"`
+}
+
+/*
+Groups entries into windows aligned to multiples of window since the epoch, in time order. Windows without entries are left out.
+With perWindow, only the earliest perWindow entries of a window are returned, count is the number of entries before the cap.
+*/
+func groupByWindow(entries []LogEntry, window time.Duration, perWindow int) []*timeWindow {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Timestamp < entries[j].Timestamp
+	})
+
+	seconds := int64(window / time.Second)
+	windows := []*timeWindow{}
+	for _, entry := range entries {
+		start := entry.Timestamp - ((entry.Timestamp%seconds)+seconds)%seconds
+		if len(windows) == 0 || windows[len(windows)-1].WindowStart != start {
+			windows = append(windows, &timeWindow{WindowStart: start})
+		}
+		current := windows[len(windows)-1]
+		current.Count++
+		if perWindow == 0 || len(current.Entries) < perWindow {
+			current.Entries = append(current.Entries, entry)
+		}
+	}
+	return windows
+}
+
+type distinctMessage struct {
+	Message string `json:"log"`
+	Count   int    `json:"count"`
+	FirstTs int64  `json:"first_ts"`
+	LastTs  int64  `json:"last_ts"`
+}
+
+/*
+Collapses the entries matching query to their distinct messages with counts, most frequent first.
+Entries are counted object by object as the query reads them, only the groups are kept.
+At most maxGroups messages are tracked, entries with further messages are left out and truncated is reported.
+*/
+func distinctMessages(query *logQuery, maxGroups int) (groups []*distinctMessage, truncated bool) {
+	byMessage := make(map[string]*distinctMessage)
+	query.each(func(entries []LogEntry) {
+		for _, entry := range entries {
+			group, ok := byMessage[entry.Message]
+			if !ok {
+				if len(byMessage) >= maxGroups {
+					truncated = true
+					continue
+				}
+				group = &distinctMessage{Message: entry.Message, FirstTs: entry.Timestamp, LastTs: entry.Timestamp}
+				byMessage[entry.Message] = group
+				groups = append(groups, group)
+			}
+			group.Count++
+			if entry.Timestamp < group.FirstTs {
+				group.FirstTs = entry.Timestamp
+			}
+			if entry.Timestamp > group.LastTs {
+				group.LastTs = entry.Timestamp
+			}
+		}
+	})
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].Count > groups[j].Count
+	})
+	return groups, truncated
+}
+
+/*
+Writes the query result to a temporary export object and responds with a pre-signed URL to it.
+
+The result is streamed to S3 one minute object at a time, so the full result is never held in memory.
+Export objects are deleted after exportTTL. As a pending deletion is lost on restart, exports are also
+expired by a lifecycle rule on EXPORT_PREFIX, which S3 applies with a granularity of days.
+
+{"key":"exports/1709356032-5577006791947779410.json","url":"https://...","expires_at":"2024-03-02T06:07:12Z"}
+*/
+func exportQueryToS3(w http.ResponseWriter, query *logQuery) {
+	if err := ensureExportLifecycleRule(); err != nil {
+		log.Printf("Error managing the lifecycle rule of %s: %v", exportPrefix, err)
+		http.Error(w, "Error exporting query result", http.StatusInternalServerError)
+		return
+	}
+	key := fmt.Sprintf("%s%d-%d.json", exportPrefix, time.Now().Unix(), rand.Int63())
+	expiresAt := time.Now().Add(exportTTL)
+
+	reader, writer := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		encoder := json.NewEncoder(writer)
+		first := true
+		_, err := io.WriteString(writer, "[")
+		query.each(func(entries []LogEntry) {
+			for _, entry := range entries {
+				if err != nil {
+					// The upload failed and closed the pipe, the remaining objects aren't fetched
+					query.abandoned = true
+					return
+				}
+				if !first {
+					_, err = io.WriteString(writer, ",")
+				}
+				first = false
+				if err == nil {
+					err = encoder.Encode(entry)
+				}
+			}
+		})
+		if err == nil {
+			_, err = io.WriteString(writer, "]")
+		}
+		writer.CloseWithError(err)
+	}()
+
+	uploader := s3manager.NewUploaderWithClient(getS3Client())
+	_, err := uploader.Upload(&s3manager.UploadInput{
+		Bucket:      aws.String(bucketName),
+		Key:         aws.String(key),
+		Body:        reader,
+		ContentType: aws.String("application/json"),
+		Expires:     aws.Time(expiresAt),
+	})
+	if err != nil {
+		// The query stops at its next write, so that it isn't left running after the request
+		reader.CloseWithError(err)
+		<-done
+		log.Printf("Error uploading export %s: %v", key, err)
+		http.Error(w, "Error exporting query result", http.StatusInternalServerError)
+		return
+	}
+	time.AfterFunc(exportTTL, func() {
+		deleteExport(key)
+	})
+
+	req, _ := getS3Client().GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	url, err := req.Presign(exportTTL)
+	if err != nil {
+		log.Printf("Error pre-signing export %s: %v", key, err)
+		http.Error(w, "Error exporting query result", http.StatusInternalServerError)
+		return
+	}
+
+	responseData, err := json.Marshal(map[string]string{
+		"key":        key,
+		"url":        url,
+		"expires_at": expiresAt.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		http.Error(w, "Error marshalling response data", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseData)
+}
+
+func deleteExport(key string) {
+	_, err := getS3Client().DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		log.Printf("Error deleting expired export %s: %v", key, err)
+	}
+}
+
+/*
+ensureLifecycleRule puts the lifecycle rule of the object prefix, expiring objects after RETENTION (rounded up to days)
+and transitioning them to STANDARD_IA after LIFECYCLE_TRANSITION_IA_DAYS. The rule is identified by its ID,
+the other rules of the bucket are kept as they are, and nothing is written when the rule is already up to date.
+*/
+func ensureLifecycleRule() error {
+	rule := lifecycleRule(s3ObjectKeysPrefix)
+	if retention > 0 {
+		rule.Expiration = &s3.LifecycleExpiration{Days: aws.Int64(lifecycleDays(retention))}
+	}
+	if lifecycleTransitionIADays > 0 {
+		rule.Transitions = []*s3.Transition{{Days: aws.Int64(lifecycleTransitionIADays), StorageClass: aws.String(s3.TransitionStorageClassStandardIa)}}
+	}
+	if rule.Expiration == nil && rule.Transitions == nil {
+		log.Printf("MANAGE_LIFECYCLE is set without RETENTION or LIFECYCLE_TRANSITION_IA_DAYS, no lifecycle rule to manage")
+		return nil
+	}
+	return putLifecycleRule(rule)
+}
+
+/*
+ensureExportLifecycleRule puts the lifecycle rule expiring the objects under EXPORT_PREFIX after EXPORT_TTL (rounded up to days),
+once per process before the first export. An EXPORT_PREFIX within the object prefix expires by the shorter of both rules.
+*/
+func ensureExportLifecycleRule() error {
+	exportLifecycleMu.Lock()
+	defer exportLifecycleMu.Unlock()
+	if exportLifecycleReady {
+		return nil
+	}
+	rule := lifecycleRule(exportPrefix)
+	rule.Expiration = &s3.LifecycleExpiration{Days: aws.Int64(lifecycleDays(exportTTL))}
+	if err := putLifecycleRule(rule); err != nil {
+		return err
+	}
+	exportLifecycleReady = true
+	return nil
+}
+
+// lifecycleRule returns an enabled lifecycle rule of prefix without actions, identified by the prefix
+func lifecycleRule(prefix string) *s3.LifecycleRule {
+	return &s3.LifecycleRule{
+		ID:     aws.String("log-ingester-" + strings.TrimSuffix(prefix, "/")),
+		Status: aws.String(s3.ExpirationStatusEnabled),
+		Filter: &s3.LifecycleRuleFilter{Prefix: aws.String(prefix)},
+	}
+}
+
+// lifecycleDays returns d in days as lifecycle rules take them, rounded up and at least 1
+func lifecycleDays(d time.Duration) int64 {
+	days := int64((d + 24*time.Hour - 1) / (24 * time.Hour))
+	if days < 1 {
+		days = 1
+	}
+	return days
+}
+
+// putLifecycleRule adds rule to the lifecycle configuration of the bucket, replacing the rule with its ID and keeping the others
+func putLifecycleRule(rule *s3.LifecycleRule) error {
+	client := getS3Client()
+	var rules []*s3.LifecycleRule
+	current, err := client.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(bucketName)})
+	var aerr awserr.Error
+	switch {
+	case err == nil:
+		rules = current.Rules
+	case errors.As(err, &aerr) && aerr.Code() == "NoSuchLifecycleConfiguration":
+	default:
+		return fmt.Errorf("error getting the lifecycle configuration: %v", err)
+	}
+
+	merged := []*s3.LifecycleRule{rule}
+	for _, existing := range rules {
+		if aws.StringValue(existing.ID) != *rule.ID {
+			merged = append(merged, existing)
+		} else if existing.String() == rule.String() {
+			log.Printf("Lifecycle rule %s is up to date", *rule.ID)
+			return nil
+		}
+	}
+
+	_, err = client.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 aws.String(bucketName),
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: merged},
+	})
+	if err != nil {
+		return fmt.Errorf("error putting the lifecycle configuration: %v", err)
+	}
+	log.Printf("Put lifecycle rule %s, keeping %d other rules", *rule.ID, len(merged)-1)
+	return nil
+}
+
+type auditRecord struct {
+	Time       string            `json:"time"`
+	Actor      string            `json:"actor"`
+	RemoteAddr string            `json:"remote_addr"`
+	Operation  string            `json:"operation"`
+	Params     map[string]string `json:"params,omitempty"`
+	Result     string            `json:"result"`
+}
+
+/*
+audit records an authorized admin operation, called by every mutating admin handler once the operation is done.
+The actor is the name of the key of API_KEYS used, or api_key for API_KEY, in which case remote_addr is the distinguishing detail.
+
+{"time":"2024-03-02T05:07:12Z","actor":"api_key","remote_addr":"10.0.0.7:51234","operation":"readonly","params":{"enabled":"true"},"result":"read_only=true"}
+*/
+func audit(r *http.Request, operation, result string) {
+	actor, _, _ := keyOf(r)
+	record := auditRecord{
+		Time:       time.Now().UTC().Format(time.RFC3339),
+		Actor:      actor,
+		RemoteAddr: r.RemoteAddr,
+		Operation:  operation,
+		Result:     result,
+	}
+	for name, values := range r.URL.Query() {
+		if record.Params == nil {
+			record.Params = make(map[string]string)
+		}
+		record.Params[name] = strings.Join(values, ",")
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Error marshalling audit record: %v", err)
+		return
+	}
+
+	if auditPrefix != "" {
+		key := fmt.Sprintf("%s%d-%s.json", auditPrefix, time.Now().UnixNano(), operation)
+		_, err := getS3Client().PutObject(&s3.PutObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader(line),
+		})
+		if err != nil {
+			log.Printf("Error writing audit record %s: %v", key, err)
+		}
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	f, err := os.OpenFile(auditLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Error opening audit log %s: %v", auditLogFile, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("Error writing audit log %s: %v", auditLogFile, err)
+	}
+}
+
+// Scopes of the keys of API_KEYS, API_KEY has all of them
+const (
+	scopeRead  = "read"  // /query, /summary, /download, /list, /availability and /stats
+	scopeWrite = "write" // /ingest
+	scopeAdmin = "admin" // /flush and /admin/*
+)
+
+type scopedKey struct {
+	name   string
+	key    string
+	scopes map[string]bool
+}
+
+/*
+Parses scoped keys, one per line of API_KEYS_FILE or separated by ; in API_KEYS. The name identifies the key in the audit log:
+
+shipper:6f1c...:write
+dashboard:93ad...:read
+ops:d2e7...:read,admin
+*/
+func parseScopedKeys(lines []string) ([]scopedKey, error) {
+	var keys []scopedKey
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// Errors don't quote the entry, which holds the key
+		name, rest, found := strings.Cut(line, ":")
+		separator := strings.LastIndexByte(rest, ':')
+		if !found || name == "" || separator <= 0 {
+			return nil, fmt.Errorf("expected name:key:scopes in entry %d", i+1)
+		}
+		key := scopedKey{name: name, key: rest[:separator], scopes: make(map[string]bool)}
+		for _, scope := range strings.Split(rest[separator+1:], ",") {
+			scope = strings.TrimSpace(scope)
+			if scope != scopeRead && scope != scopeWrite && scope != scopeAdmin {
+				return nil, fmt.Errorf("unknown scope %q of key %s, expected read, write or admin", scope, name)
+			}
+			key.scopes[scope] = true
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// requestKey returns the key r carries, either as a bearer token, a Splunk HEC token or in the X-API-Key header
+func requestKey(r *http.Request) string {
+	key := r.Header.Get("X-API-Key")
+	if bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		key = bearer
+	}
+	if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Splunk "); found {
+		key = token
+	}
+	return key
+}
+
+// keyOf returns the name of the key r carries and its scopes, ok is false for a missing or unknown key
+func keyOf(r *http.Request) (name string, scopes map[string]bool, ok bool) {
+	key := requestKey(r)
+	if key == "" {
+		return "", nil, false
+	}
+	if apiKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(apiKey)) == 1 {
+		return "api_key", map[string]bool{scopeRead: true, scopeWrite: true, scopeAdmin: true}, true
+	}
+	for _, scoped := range scopedKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(scoped.key)) == 1 {
+			return scoped.name, scoped.scopes, true
+		}
+	}
+	return "", nil, false
+}
+
+// authorized reports whether r carries API_KEY or a key of API_KEYS with scope
+func authorized(r *http.Request, scope string) bool {
+	_, scopes, ok := keyOf(r)
+	return ok && scopes[scope]
+}
+
+/*
+Parses the limits of concurrent requests per endpoint, e.g.
+
+MAX_CONCURRENT_REQUESTS=query=8,list=2,summary=4
+*/
+func parseConcurrencyLimits(value string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		endpoint, limit, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("expected endpoint=limit in %q", pair)
+		}
+		switch endpoint {
+		case "query", "summary", "top", "download", "list", "availability":
+		default:
+			return nil, fmt.Errorf("unknown endpoint %q, expected query, summary, top, download, list or availability", endpoint)
+		}
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid limit %q of %s", limit, endpoint)
+		}
+		limits[endpoint] = n
+	}
+	return limits, nil
+}
+
+// limitConcurrency admits at most MAX_CONCURRENT_REQUESTS requests to endpoint at a time, the others are rejected with 429
+func limitConcurrency(endpoint string, handler http.HandlerFunc) http.HandlerFunc {
+	limit := concurrencyLimits[endpoint]
+	if limit <= 0 {
+		return handler
+	}
+	slots := make(chan struct{}, limit)
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+			handler(w, r)
+		default:
+			metrics.add(fmt.Sprintf("requests_rejected_total{endpoint=%q}", endpoint), 1)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many concurrent requests, retry later", http.StatusTooManyRequests)
+		}
+	}
+}
+
+/*
+requireScope guards the read and write endpoints, which are open unless scoped keys are configured with API_KEYS or
+API_KEYS_FILE. A missing or unknown key is answered with 401, a key without scope with 403.
+*/
+func requireScope(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if code, ok := checkScope(r, scope); !ok {
+			if code == http.StatusForbidden {
+				http.Error(w, fmt.Sprintf("Forbidden, the key lacks the %s scope", scope), code)
+			} else {
+				http.Error(w, "Unauthorized", code)
+			}
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// checkScope reports whether r may call an endpoint of scope, code is 401 without a known key and 403 when the key lacks scope.
+// Without API_KEYS every request may
+func checkScope(r *http.Request, scope string) (code int, ok bool) {
+	if len(scopedKeys) == 0 {
+		return http.StatusOK, true
+	}
+	_, scopes, known := keyOf(r)
+	if !known {
+		return http.StatusUnauthorized, false
+	}
+	if !scopes[scope] {
+		return http.StatusForbidden, false
+	}
+	return http.StatusOK, true
+}
+
+/*
+Streams the entries matching the query as a single NDJSON download, in time order.
+Objects are merged like sort=timestamp, with the in-memory buffer and the late entries stored in other minutes' objects,
+holding a bounded number of objects at a time. The query caps are signalled in trailers since the body is already sent.
+
+GET http://localhost:8080/download?start=1685426738&end=1685426799
+*/
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query, err := parseLogQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"logs-%d-%d.ndjson\"", query.startTime.Unix()+1, query.endTime.Unix()-1))
+	w.Header().Set("Trailer", "X-Query-Truncated, X-Query-Next, X-Query-Unreadable, X-Query-Degraded")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	written := 0
+	query.eachSorted(func(entry LogEntry) bool {
+		if err := encoder.Encode(entry); err != nil {
+			return false
+		}
+		written++
+		if flusher != nil && written%1000 == 0 {
+			flusher.Flush()
+		}
+		return true
+	})
+	query.setResponseHeaders(w)
+}
+
+/*
+Returns aggregated stats over the entries matching the query, without the entries themselves
+
+GET http://localhost:8080/summary?start=1685426738&end=1685426739&text=test
+
+{"count":2,"unique":1,"min_ts":1685426738,"max_ts":1685426739,"first_seen":"2023-05-30T06:05:38Z","last_seen":"2023-05-30T06:05:39Z"}
+*/
+func summaryHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := parseLogQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	summary := summarize(query)
+	query.setResponseHeaders(w)
+
+	responseData, err := json.Marshal(summary)
+	if err != nil {
+		http.Error(w, "Error marshalling response data", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseData)
+}
+
+type querySummary struct {
+	Count     int    `json:"count"`
+	Unique    int    `json:"unique"`
+	MinTs     int64  `json:"min_ts,omitempty"`
+	MaxTs     int64  `json:"max_ts,omitempty"`
+	FirstSeen string `json:"first_seen,omitempty"`
+	LastSeen  string `json:"last_seen,omitempty"`
+}
+
+// summarize aggregates the entries matching query object by object as the query reads them, without keeping them
+func summarize(query *logQuery) querySummary {
+	var summary querySummary
+	messages := make(map[string]struct{})
+	query.each(func(entries []LogEntry) {
+		for _, entry := range entries {
+			if summary.Count == 0 || entry.Timestamp < summary.MinTs {
+				summary.MinTs = entry.Timestamp
+			}
+			if summary.Count == 0 || entry.Timestamp > summary.MaxTs {
+				summary.MaxTs = entry.Timestamp
+			}
+			summary.Count++
+			messages[entry.Message] = struct{}{}
+		}
+	})
+	if summary.Count == 0 {
+		return summary
+	}
+	summary.Unique = len(messages)
+	summary.FirstSeen = time.Unix(summary.MinTs, 0).UTC().Format(time.RFC3339)
+	summary.LastSeen = time.Unix(summary.MaxTs, 0).UTC().Format(time.RFC3339)
+	return summary
+}
+
+/*
+Returns the most frequent message patterns of the entries matching a query, e.g. the top errors of the last hour.
+Messages are grouped by messagePattern, takes the same parameters as /summary plus level (case-insensitive)
+and n, the number of patterns returned (10 by default).
+
+GET http://localhost:8080/top?start=1709355600&end=1709359200&level=ERROR&n=10
+
+[{"pattern":"timeout calling {uuid} after {n}ms","count":42,"examples":["timeout calling 0b7f...","..."],"first_ts":1709355612,"last_ts":1709359178}]
+*/
+func topHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := parseLogQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n := 10
+	if r.URL.Query().Has("n") {
+		n, err = strconv.Atoi(r.URL.Query().Get("n"))
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid n, expected a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	if level := r.URL.Query().Get("level"); level != "" {
+		query.predicates = append(query.predicates, func(entry LogEntry) bool {
+			return strings.EqualFold(entry.Level, level)
+		})
+	}
+
+	var patterns []*messagePatternGroup
+	byPattern := make(map[string]*messagePatternGroup)
+	truncated := false
+	query.each(func(entries []LogEntry) {
+		for _, entry := range entries {
+			pattern := messagePattern(entry.Message)
+			group, ok := byPattern[pattern]
+			if !ok {
+				if len(byPattern) >= maxDistinctGroups {
+					truncated = true
+					continue
+				}
+				group = &messagePatternGroup{Pattern: pattern, FirstTs: entry.Timestamp, LastTs: entry.Timestamp}
+				byPattern[pattern] = group
+				patterns = append(patterns, group)
+			}
+			group.add(entry)
+		}
+	})
+	sort.SliceStable(patterns, func(i, j int) bool {
+		return patterns[i].Count > patterns[j].Count
+	})
+	if len(patterns) > n {
+		patterns = patterns[:n]
+	}
+	if patterns == nil {
+		patterns = []*messagePatternGroup{}
+	}
+
+	if truncated {
+		w.Header().Set("X-Query-Truncated", "true")
+	}
+	query.setResponseHeaders(w)
+
+	responseData, err := marshalResponse(r, patterns)
+	if err != nil {
+		http.Error(w, "Error marshalling response data", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseData)
+}
+
+// Number of distinct example messages kept per pattern by /top
+const maxPatternExamples = 3
+
+type messagePatternGroup struct {
+	Pattern  string   `json:"pattern"`
+	Count    int      `json:"count"`
+	Examples []string `json:"examples"`
+	FirstTs  int64    `json:"first_ts"`
+	LastTs   int64    `json:"last_ts"`
+}
+
+func (g *messagePatternGroup) add(entry LogEntry) {
+	g.Count++
+	if entry.Timestamp < g.FirstTs {
+		g.FirstTs = entry.Timestamp
+	}
+	if entry.Timestamp > g.LastTs {
+		g.LastTs = entry.Timestamp
+	}
+	if len(g.Examples) >= maxPatternExamples {
+		return
+	}
+	for _, example := range g.Examples {
+		if example == entry.Message {
+			return
+		}
+	}
+	g.Examples = append(g.Examples, entry.Message)
+}
+
+var (
+	uuidPattern   = regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`)
+	hexPattern    = regexp.MustCompile(`(?i)\b(?:0x[0-9a-f]+|[0-9a-f]{8,})\b`)
+	numberPattern = regexp.MustCompile(`\b\d+(?:[.:]\d+)*`)
+)
+
+/*
+messagePattern normalizes a message so that messages differing only in ids and values group together:
+UUIDs become {uuid}, 0x-prefixed hex and hex strings of at least 8 characters mixing digits and letters {hex}, and numbers {n},
+e.g. "user 42 took 1.5ms" and "user 7 took 20ms" are both "user {n} took {n}ms".
+*/
+func messagePattern(message string) string {
+	pattern := uuidPattern.ReplaceAllString(message, "{uuid}")
+	pattern = hexPattern.ReplaceAllStringFunc(pattern, func(s string) string {
+		if strings.HasPrefix(strings.ToLower(s), "0x") || strings.ContainsAny(s, "0123456789") && strings.ContainsAny(strings.ToLower(s), "abcdef") {
+			return "{hex}"
+		}
+		return s
+	})
+	return numberPattern.ReplaceAllString(pattern, "{n}")
+}
+
+/*
+getS3ObjectByKey returns the content of the object of a minute, falling back to the keys written before S3_DAY_PREFIX
+was set and to the extension-less keys written before S3_KEY_SUFFIX, and then to the same keys under the S3_READ_PREFIXES.
+With keys, only the keys it lists are fetched, so that a missing minute costs no request. Without, every key is tried in turn.
+*/
+func getS3ObjectByKey(ctx context.Context, bucketName, key string, keys *objectKeyIndex) ([]byte, error) {
+	client := getS3Client()
+
+	// The S3_READ_PREFIXES are tried in order once the minute isn't found under the prefix
+	var resp *s3.GetObjectOutput
+	var err error = awserr.New(s3.ErrCodeNoSuchKey, fmt.Sprintf("no object listed for %s", key), nil)
+	requested := false
+	for _, prefix := range readPrefixes() {
+		existing, listed := keys.existing(ctx, prefix, key)
+		for _, candidate := range objectKeyCandidates(prefix, key) {
+			if listed && !existing[candidate] {
+				continue
+			}
+			requested = true
+			resp, err = client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+				Bucket: aws.String(bucketName),
+				Key:    aws.String(candidate),
+			})
+			if !isNoSuchKey(err) {
+				break
+			}
+		}
+		if !isNoSuchKey(err) {
+			break
+		}
+	}
+	if requested && ctx.Err() == nil {
+		s3Breaker.record(err == nil || isNoSuchKey(err))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting object from S3: %w", err)
+	}
+	defer resp.Body.Close()
+
+	objectContent, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading object content: %v", err)
+	}
+
+	return decompressObjectContent(objectContent)
+}
+
+/*
+objectKeyIndex records the keys that exist, listed once per prefix and day, the listing prefix shared by all keys
+objectKeyCandidates returns for the minutes of a day (and by their parts and the compacted hours). A query listing
+a day before fetching its minutes saves the 2-3 GETs per prefix a missing minute otherwise costs.
+Objects uploaded after a day was listed are only found by later queries, until then their entries are in the in-memory buffer.
+It isn't safe for concurrent use, like the logQuery holding it.
+*/
+type objectKeyIndex struct {
+	listed map[string]map[string]bool // by listing prefix, nil when the listing failed
+}
+
+// existing returns the listed keys of the day of minute under prefix, listed is false when the keys couldn't be listed
+func (x *objectKeyIndex) existing(ctx context.Context, prefix, minute string) (keys map[string]bool, listed bool) {
+	if x == nil {
+		return nil, false
+	}
+	dir, name := path.Split(minute)
+	listingPrefix := prefix + minute
+	if len(name) >= len("2006-01-02") {
+		listingPrefix = prefix + dir + dayOfMinute(name)
+	}
+	if keys, ok := x.listed[listingPrefix]; ok {
+		return keys, keys != nil
+	}
+
+	keys = make(map[string]bool)
+	err := getS3Client().ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucketName),
+		Prefix: aws.String(listingPrefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			keys[*obj.Key] = true
+		}
+		return !lastPage
+	})
+	if ctx.Err() != nil {
+		// Listed again by the next page of the query
+		return nil, false
+	}
+	s3Breaker.record(err == nil)
+	if err != nil {
+		log.Printf("Error listing %s, fetching its minutes without the listing: %v", listingPrefix, err)
+		keys = nil
+	}
+	x.listed[listingPrefix] = keys
+	return keys, keys != nil
+}
+
+/*
+getMinuteEntries returns the entries of a minute and the number of parts they were read from, 0 for a single object.
+
+A minute uploaded with more than MAX_ENTRIES_PER_OBJECT entries has no object of its own but parts
+minute-0001, minute-0002, ..., which are read in order until the first missing one.
+Parts are only looked up while MAX_ENTRIES_PER_OBJECT is set. keys, if any, resolves the existing keys, see getS3ObjectByKey.
+*/
+func getMinuteEntries(ctx context.Context, minute string, keys *objectKeyIndex) ([]LogEntry, int, error) {
+	objectContent, err := getS3ObjectByKey(ctx, bucketName, minute, keys)
+	if err == nil {
+		logEntries, err := decodeObjectEntries(objectContent)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error unmarshalling object content: %v", err)
+		}
+		return logEntries, 0, nil
+	}
+	if !isNoSuchKey(err) || maxEntriesPerObject <= 0 {
+		return nil, 0, err
+	}
+
+	var logEntries []LogEntry
+	parts := 0
+	for {
+		partContent, partErr := getS3ObjectByKey(ctx, bucketName, partMinute(minute, parts+1), keys)
+		if isNoSuchKey(partErr) {
+			break
+		}
+		if partErr != nil {
+			return nil, 0, partErr
+		}
+		partEntries, err := decodeObjectEntries(partContent)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error unmarshalling part %d: %v", parts+1, err)
+		}
+		logEntries = append(logEntries, partEntries...)
+		parts++
+	}
+	if parts == 0 {
+		return nil, 0, err
+	}
+	return logEntries, parts, nil
+}
+
+/*
+Minute objects are written in format OBJECT_FORMAT_VERSION and every known version is read:
+
+v0  a bare JSON array of entries: [{"time":1685426738,"log":"test"}]
+v1  an envelope carrying the version: {"version":1,"entries":[{"time":1685426738,"log":"test"}]}
+*/
+const latestObjectFormatVersion = 1
+
+type objectEnvelope struct {
+	Version int        `json:"version"`
+	Entries []LogEntry `json:"entries"`
+}
+
+// decodeObjectEntries returns the entries of (decompressed) minute object content of any known format version
+func decodeObjectEntries(objectContent []byte) ([]LogEntry, error) {
+	content := bytes.TrimLeft(objectContent, " \t\r\n")
+	if len(content) > 0 && content[0] == '{' {
+		var envelope objectEnvelope
+		if err := json.Unmarshal(content, &envelope); err != nil {
+			return nil, err
+		}
+		if envelope.Version < 1 || envelope.Version > latestObjectFormatVersion {
+			return nil, fmt.Errorf("unsupported object format version %d", envelope.Version)
+		}
+		return envelope.Entries, nil
+	}
+
+	var logEntries []LogEntry
+	if err := json.Unmarshal(content, &logEntries); err != nil {
+		return nil, err
+	}
+	return logEntries, nil
+}
+
+// encodeObjectEntries returns the content of a minute object in OBJECT_FORMAT_VERSION
+func encodeObjectEntries(logEntries []LogEntry) ([]byte, error) {
+	if objectFormatVersion == 0 {
+		return json.Marshal(logEntries)
+	}
+	if logEntries == nil {
+		logEntries = []LogEntry{}
+	}
+	return json.Marshal(objectEnvelope{Version: objectFormatVersion, Entries: logEntries})
+}
+
+// partMinute returns the key of the part-th object of a split minute, e.g. 2024-03-02-05-07-0001
+func partMinute(minute string, part int) string {
+	return fmt.Sprintf("%s-%04d", minute, part)
+}
+
+/*
+Parses S3_OBJECT_TAGS, e.g. "team=platform,cost-center=1234", into the URL encoded form expected by PutObjectInput.Tagging
+*/
+func parseObjectTags(value string) (string, error) {
+	tags := url.Values{}
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		key, value, found := strings.Cut(tag, "=")
+		if !found || key == "" {
+			return "", fmt.Errorf("expected key=value in %q", tag)
+		}
+		tags.Set(key, value)
+	}
+	return tags.Encode(), nil
+}
+
+// objectKey returns the S3 key of the object holding a minute
+func objectKey(minute string) string {
+	return minuteKey(minute) + s3KeySuffix
+}
+
+/*
+minuteKey returns the key of a minute without S3_KEY_SUFFIX. With S3_DAY_PREFIX the minute is placed in the
+directory of its day, keeping the number of keys per listing prefix bounded:
+
+mihir_joshi/2024-03-02/2024-03-02-05-07, mihir_joshi/errors/2024-03-02/2024-03-02-05-07
+*/
+func minuteKey(minute string) string {
+	return minuteKeyIn(s3ObjectKeysPrefix, minute)
+}
+
+// minuteKeyIn returns the key of a minute under prefix, the prefix or one of the S3_READ_PREFIXES
+func minuteKeyIn(prefix, minute string) string {
+	if s3DayPrefix {
+		dir, name := path.Split(minute)
+		if len(name) >= len("2006-01-02") {
+			return prefix + dir + dayOfMinute(name) + "/" + name
+		}
+	}
+	return prefix + minute
+}
+
+/*
+objectKeyCandidates returns the keys the object of a minute may have under prefix, in the order they are tried:
+the current key, the key without the day directory of S3_DAY_PREFIX and the key without S3_KEY_SUFFIX
+*/
+func objectKeyCandidates(prefix, minute string) []string {
+	keys := []string{minuteKeyIn(prefix, minute) + s3KeySuffix}
+	if s3DayPrefix {
+		keys = append(keys, prefix+minute+s3KeySuffix)
+	}
+	if s3KeySuffix != "" {
+		keys = append(keys, prefix+minute)
+	}
+	return keys
+}
+
+// readPrefixes returns the prefixes queried, the prefix followed by the S3_READ_PREFIXES
+func readPrefixes() []string {
+	return append([]string{s3ObjectKeysPrefix}, s3ReadPrefixes...)
+}
+
+// dayKeyPrefix returns the prefix shared by the keys of the minutes of a day under prefix
+func dayKeyPrefix(prefix, day string) string {
+	if s3DayPrefix {
+		return prefix + day + "/"
+	}
+	return prefix + day
+}
+
+/*
+formatMinute returns the minute label of t used in object keys and file names, in KEY_TIMEZONE.
+
+All components are zero-padded and fixed width (the year to 4 digits), so labels sort lexically in
+chronological order, which the StartAfter listings rely on. With KEY_TIMEZONE=UTC this also holds across DST changes.
+*/
+func formatMinute(t time.Time) string {
+	return t.In(keyLocation).Format("2006-01-02-15-04")
+}
+
+// parseMinute parses a minute label as written by formatMinute
+func parseMinute(minute string) (time.Time, error) {
+	return time.ParseInLocation("2006-01-02-15-04", minute, keyLocation)
+}
+
+// minuteFromKey returns the minute of an object key, for both suffixed and extension-less keys and for parts of split minutes
+func minuteFromKey(key string) string {
+	// The longest matching prefix is trimmed, in case one of the prefixes is nested in another
+	trimmed := key
+	for _, prefix := range readPrefixes() {
+		if rest, found := strings.CutPrefix(key, prefix); found && len(rest) < len(trimmed) {
+			trimmed = rest
+		}
+	}
+	minute := strings.TrimSuffix(trimmed, s3KeySuffix)
+	// Day directories are dropped whether or not S3_DAY_PREFIX is set, so that both layouts can be read
+	if dir, name := path.Split(minute); len(name) >= len("2006-01-02") && strings.HasSuffix(dir, dayOfMinute(name)+"/") {
+		minute = strings.TrimSuffix(dir, dayOfMinute(name)+"/") + name
+	}
+	if len(minute) == len("2006-01-02-15-04-0001") && minute[len("2006-01-02-15-04")] == '-' {
+		minute = minute[:len("2006-01-02-15-04")]
+	}
+	return minute
+}
+
+func isNoSuchKey(err error) bool {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound"
+	}
+	return false
+}
+
+/*
+decompressObjectContent sniffs the magic bytes of an object and decompresses gzip and bzip2 content, plain JSON is returned as is.
+Content decompressing to more than MAX_DECOMPRESSED_BYTES is an error, so that a corrupt or hostile object can't exhaust memory.
+*/
+func decompressObjectContent(objectContent []byte) ([]byte, error) {
+	var reader io.Reader
+	switch {
+	case bytes.HasPrefix(objectContent, []byte{0x1f, 0x8b}):
+		gzipReader, err := gzip.NewReader(bytes.NewReader(objectContent))
+		if err != nil {
+			return nil, fmt.Errorf("error opening gzip object content: %v", err)
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	case bytes.HasPrefix(objectContent, []byte("BZh")):
+		reader = bzip2.NewReader(bytes.NewReader(objectContent))
+	default:
+		return objectContent, nil
+	}
+
+	if maxDecompressedBytes > 0 {
+		reader = io.LimitReader(reader, maxDecompressedBytes+1)
+	}
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing object content: %v", err)
+	}
+	if maxDecompressedBytes > 0 && int64(len(decompressed)) > maxDecompressedBytes {
+		return nil, fmt.Errorf("error decompressing object content: more than %d bytes", maxDecompressedBytes)
+	}
+	return decompressed, nil
+}
+
+func getS3Client() *s3.S3 {
+	if s3Client == nil {
+		s3Client = s3.New(newAWSSession())
+	}
+	return s3Client
+}
+
+func newAWSSession() *session.Session {
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String(region),
+		Credentials: credentials.NewStaticCredentials(accessKeyID, secretAccessKey, ""),
+	})
+	if err != nil {
+		log.Fatalf("Error creating AWS session: %v", err)
+	}
+	return sess
+}
+
+/*
+Reports, per minute in the range, whether its object has been uploaded, whether a local file is still pending upload,
+and whether the minute is sealed: past its end plus LATE_GRACE, uploaded, and with nothing left locally.
+Results for sealed minutes are final and can be cached by clients.
+
+GET http://localhost:8080/availability?start=1685426738&end=1685426799
+
+[{"minute":"2023-05-30-11-35","uploaded":true,"pending_local":false,"sealed":true}]
+*/
+func availabilityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query, err := parseLogQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var minutes []string
+	seen := make(map[string]bool)
+	for _, timestamp := range query.minutes() {
+		if !seen[timestamp] {
+			seen[timestamp] = true
+			minutes = append(minutes, timestamp)
+		}
+	}
+
+	uploaded := make(map[string]bool)
+	if len(minutes) > 0 && manifestPrefix != "" {
+		uploaded, err = uploadedMinutesFromManifests(minutes[0], minutes[len(minutes)-1])
+	} else if len(minutes) > 0 {
+		uploaded, err = listUploadedMinutes(minutes[0], minutes[len(minutes)-1])
+	}
+	if err != nil {
+		log.Printf("Error listing uploaded minutes: %v", err)
+		http.Error(w, "Error listing uploaded minutes", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	availability := make([]minuteAvailability, 0, len(minutes))
+	for _, minute := range minutes {
+		_, err := os.Stat(filepath.Join(logsDirectory, minute+".txt"))
+		pendingLocal := err == nil
+
+		sealed := false
+		if minuteStart, err := parseMinute(minute); err == nil {
+			sealed = now.After(minuteStart.Add(time.Minute).Add(lateGrace)) && uploaded[minute] && !pendingLocal
+		}
+
+		availability = append(availability, minuteAvailability{
+			Minute:       minute,
+			Uploaded:     uploaded[minute],
+			PendingLocal: pendingLocal,
+			Sealed:       sealed,
+		})
+	}
+
+	responseData, err := json.Marshal(availability)
+	if err != nil {
+		http.Error(w, "Error marshalling response data", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseData)
+}
+
+type minuteAvailability struct {
+	Minute       string `json:"minute"`
+	Uploaded     bool   `json:"uploaded"`
+	PendingLocal bool   `json:"pending_local"`
+	Sealed       bool   `json:"sealed"`
+}
+
+// listingPrefix returns the prefix to list the minutes from first to last under prefix with, the directory of their day with S3_DAY_PREFIX
+func listingPrefix(prefix, first, last string) string {
+	if s3DayPrefix && dayOfMinute(first) == dayOfMinute(last) {
+		return dayKeyPrefix(prefix, dayOfMinute(first))
+	}
+	return prefix
+}
+
+// listUploadedMinutes returns the set of minutes between first and last (inclusive) that have an object in S3
+func listUploadedMinutes(first, last string) (map[string]bool, error) {
+	client := getS3Client()
+
+	uploaded := make(map[string]bool)
+	err := client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:     aws.String(bucketName),
+		Prefix:     aws.String(listingPrefix(s3ObjectKeysPrefix, first, last)),
+		StartAfter: aws.String(minuteKey(first)),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			minute := minuteFromKey(*obj.Key)
+			if minute > last {
+				return false
+			}
+			uploaded[minute] = true
+		}
+		return !lastPage
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// StartAfter is exclusive, so an extension-less object of the first minute is checked separately
+	if !uploaded[first] {
+		_, err = client.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(s3ObjectKeysPrefix + first),
+		})
+		uploaded[first] = err == nil
+	}
+	return uploaded, nil
+}
+
+/*
+Exposes the metrics in the Prometheus text format
+
+GET http://localhost:8080/metrics
+*/
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	metrics.write(w)
+}
+
+// metricsRegistry holds counters, gauges and histograms, series are named name or name{label="value"}
+type metricsRegistry struct {
+	mu     sync.Mutex
+	kinds  map[string]string
+	values map[string]float64
+}
+
+func (m *metricsRegistry) record(series, kind string, update func(float64) float64) {
+	name, _, _ := strings.Cut(series, "{")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.kinds[name] = kind
+	m.values[series] = update(m.values[series])
+}
+
+// Upper bounds of the buckets of the histograms
+var (
+	latencyBuckets      = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	queryObjectsBuckets = []float64{0, 1, 5, 10, 30, 60, 120, 360, 720, 1440}
+	driftBuckets        = []float64{-3600, -300, -60, -10, -1, 0, 1, 10, 60, 300, 3600}
+)
+
+/*
+observe adds value to a histogram, kept as its cumulative series name_bucket{le="..."}, name_sum and name_count.
+The labels of series, e.g. name{source="s3"}, are kept on all of them.
+*/
+func (m *metricsRegistry) observe(series string, value float64, buckets []float64) {
+	m.observeAll(series, []float64{value}, buckets)
+}
+
+// observeAll adds values to a histogram like observe, taking the lock once
+func (m *metricsRegistry) observeAll(series string, values []float64, buckets []float64) {
+	name, labels, _ := strings.Cut(series, "{")
+	labels = strings.TrimSuffix(labels, "}")
+	totalLabels, bucketLabels := "", ""
+	if labels != "" {
+		totalLabels, bucketLabels = "{"+labels+"}", labels+","
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.kinds[name] = "histogram"
+	for _, bound := range buckets {
+		bucket := fmt.Sprintf("%s_bucket{%sle=\"%v\"}", name, bucketLabels, bound)
+		count := m.values[bucket]
+		for _, value := range values {
+			if value <= bound {
+				count++
+			}
+		}
+		m.values[bucket] = count
+	}
+	m.values[fmt.Sprintf("%s_bucket{%sle=\"+Inf\"}", name, bucketLabels)] += float64(len(values))
+	for _, value := range values {
+		m.values[name+"_sum"+totalLabels] += value
+	}
+	m.values[name+"_count"+totalLabels] += float64(len(values))
+}
+
+// add increments a counter
+func (m *metricsRegistry) add(series string, delta float64) {
+	m.record(series, "counter", func(value float64) float64 { return value + delta })
+}
+
+// set sets a gauge
+func (m *metricsRegistry) set(series string, value float64) {
+	m.record(series, "gauge", func(float64) float64 { return value })
+}
+
+func (m *metricsRegistry) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	series := make([]string, 0, len(m.values))
+	for s := range m.values {
+		series = append(series, s)
+	}
+	sort.Strings(series)
+
+	lastName := ""
+	for _, s := range series {
+		name, _, _ := strings.Cut(s, "{")
+		// The series of a histogram share the TYPE line of its name
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if family := strings.TrimSuffix(name, suffix); family != name && m.kinds[family] == "histogram" {
+				name = family
+			}
+		}
+		if name != lastName {
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, m.kinds[name])
+			lastName = name
+		}
+		fmt.Fprintf(w, "%s %v\n", s, m.values[s])
+	}
+}
+
+/*
+GET http://localhost:8080/admin/readonly
+POST http://localhost:8080/admin/readonly?enabled=true
+
+Reports or toggles read-only mode, requires API_KEY. In read-only mode ingestion is rejected with 503 and uploads are paused,
+while queries keep being served.
+
+{"read_only":true}
+*/
+func readOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, scopeAdmin) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			http.Error(w, "Invalid enabled, expected true or false", http.StatusBadRequest)
+			return
+		}
+		readOnly.Store(enabled)
+		log.Printf("Read-only mode set to %t", enabled)
+		audit(r, "readonly", fmt.Sprintf("read_only=%t", enabled))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "{\"read_only\":%t}", readOnly.Load())
+}
+
+// timeBoundsMetadata returns the min-ts / max-ts object metadata of entries
+func timeBoundsMetadata(logEntries []LogEntry) map[string]*string {
+	minTs, maxTs := logEntries[0].Timestamp, logEntries[0].Timestamp
+	for _, entry := range logEntries {
+		if entry.Timestamp < minTs {
+			minTs = entry.Timestamp
+		}
+		if entry.Timestamp > maxTs {
+			maxTs = entry.Timestamp
+		}
+	}
+	return map[string]*string{
+		"Min-Ts": aws.String(strconv.FormatInt(minTs, 10)),
+		"Max-Ts": aws.String(strconv.FormatInt(maxTs, 10)),
+	}
+}
+
+// backfillJob adds the time bounds metadata to objects uploaded before it was written, see runBackfill
+type backfillJob struct {
+	mu      sync.Mutex
+	Running bool   `json:"running"`
+	Scanned int    `json:"scanned"`
+	Updated int    `json:"updated"`
+	Failed  int    `json:"failed"`
+	LastKey string `json:"last_key"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (b *backfillJob) status() backfillJob {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return backfillJob{Running: b.Running, Scanned: b.Scanned, Updated: b.Updated, Failed: b.Failed, LastKey: b.LastKey, Error: b.Error}
+}
+
+/*
+Starts (POST) the metadata backfill job or reports (GET) its progress, requires API_KEY. The job rewrites objects,
+so it isn't started in read-only mode, see runBackfill.
+
+POST http://localhost:8080/admin/backfill
+
+{"running":true,"scanned":120,"updated":118,"failed":0,"last_key":"mihir_joshi/2024-03-02-05-07.json"}
+*/
+func backfillHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, scopeAdmin) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if readOnly.Load() {
+			http.Error(w, "Uploads are paused, the service is in read-only mode", http.StatusServiceUnavailable)
+			return
+		}
+		backfill.mu.Lock()
+		started := !backfill.Running
+		if started {
+			backfill.Running = true
+			backfill.Error = ""
+			go runBackfill()
+		}
+		backfill.mu.Unlock()
+		audit(r, "backfill", fmt.Sprintf("started=%t", started))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	responseData, err := json.Marshal(backfill.status())
+	if err != nil {
+		http.Error(w, "Error marshalling response data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseData)
+}
+
+// loadTestJob reports a load test run by loadTestHandler, entries are counted by outcome of their ingest request
+type loadTestJob struct {
+	mu               sync.Mutex
+	Running          bool    `json:"running"`
+	Rate             int     `json:"rate"`
+	Batch            int     `json:"batch"`
+	Duration         string  `json:"duration"`
+	Sent             int     `json:"sent"`
+	Accepted         int     `json:"accepted"`
+	Dropped          int     `json:"dropped"`
+	Rejected         int     `json:"rejected"`
+	Elapsed          string  `json:"elapsed"`
+	EntriesPerSecond float64 `json:"entries_per_second"`
+	LastError        string  `json:"last_error,omitempty"`
+}
+
+func (l *loadTestJob) status() loadTestJob {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return loadTestJob{Running: l.Running, Rate: l.Rate, Batch: l.Batch, Duration: l.Duration, Sent: l.Sent, Accepted: l.Accepted,
+		Dropped: l.Dropped, Rejected: l.Rejected, Elapsed: l.Elapsed, EntriesPerSecond: l.EntriesPerSecond, LastError: l.LastError}
+}
+
+/*
+Starts (POST) a load test or reports (GET) its progress, requires API_KEY and LOADTEST_ENABLED=true.
+Synthetic entries are sent through /ingest at rate entries per second (1000 by default) for duration (10s), in batches of batch entries (100),
+to size FLUSH_*, MAX_UPLOAD_INFLIGHT_BYTES and the other ingest and upload settings for the hardware. The entries carry fields.source=loadtest.
+
+POST http://localhost:8080/admin/loadtest?rate=5000&duration=30s&batch=200
+
+{"running":false,"rate":5000,"batch":200,"duration":"30s","sent":150000,"accepted":149800,"dropped":0,"rejected":200,"elapsed":"30.01s","entries_per_second":4991.7,"last_error":"503: Under memory pressure, retry later"}
+*/
+func loadTestHandler(w http.ResponseWriter, r *http.Request) {
+	if !loadTestEnabled {
+		http.Error(w, "Load testing is disabled, set LOADTEST_ENABLED=true", http.StatusNotFound)
+		return
+	}
+	if !authorized(r, scopeAdmin) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		values := r.URL.Query()
+		rate, batch, duration := 1000, 100, 10*time.Second
+		var err error
+		if values.Has("rate") {
+			if rate, err = strconv.Atoi(values.Get("rate")); err != nil || rate < 1 {
+				http.Error(w, "Invalid rate, expected a positive number of entries per second", http.StatusBadRequest)
+				return
+			}
+		}
+		if values.Has("batch") {
+			if batch, err = strconv.Atoi(values.Get("batch")); err != nil || batch < 1 {
+				http.Error(w, "Invalid batch, expected a positive number of entries", http.StatusBadRequest)
+				return
+			}
+		}
+		if values.Has("duration") {
+			if duration, err = time.ParseDuration(values.Get("duration")); err != nil || duration <= 0 {
+				http.Error(w, "Invalid duration", http.StatusBadRequest)
+				return
+			}
+		}
+
+		loadTest.mu.Lock()
+		started := !loadTest.Running
+		if started {
+			loadTest.Running, loadTest.Rate, loadTest.Batch, loadTest.Duration = true, rate, batch, duration.String()
+			loadTest.Sent, loadTest.Accepted, loadTest.Dropped, loadTest.Rejected = 0, 0, 0, 0
+			loadTest.Elapsed, loadTest.EntriesPerSecond, loadTest.LastError = "", 0, ""
+			go runLoadTest(rate, batch, duration)
+		}
+		loadTest.mu.Unlock()
+		audit(r, "loadtest", fmt.Sprintf("started=%t rate=%d batch=%d duration=%s", started, rate, batch, duration))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	responseData, err := json.Marshal(loadTest.status())
+	if err != nil {
+		http.Error(w, "Error marshalling response data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseData)
+}
+
+/*
+runLoadTest hands batches of synthetic entries to ingestHandler, the path of real requests minus the network, until rate * duration
+entries are sent. Batches are paced evenly, a batch that takes longer delays the next ones so that the achieved rate shows the limit.
+Entries of batches answered 202 (DISK_FULL_POLICY=drop) count as dropped, of other failed requests as rejected.
+*/
+func runLoadTest(rate, batch int, duration time.Duration) {
+	total := int(float64(rate) * duration.Seconds())
+	interval := time.Duration(float64(time.Second) * float64(batch) / float64(rate))
+	started := time.Now()
+
+	for sent := 0; sent < total; {
+		n := batch
+		if total-sent < n {
+			n = total - sent
+		}
+		entries := make([]LogEntry, n)
+		now := time.Now()
+		for i := range entries {
+			entries[i] = LogEntry{
+				Timestamp: now.Unix(),
+				Message:   fmt.Sprintf("load test entry %d of %d", sent+i+1, total),
+				Level:     "INFO",
+				Fields:    map[string]string{"source": "loadtest"},
+			}
+		}
+		body, _ := json.Marshal(entries)
+		request := httptest.NewRequest("POST", "/ingest", bytes.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		ingestHandler(recorder, request)
+		sent += n
+
+		loadTest.mu.Lock()
+		loadTest.Sent = sent
+		switch code := recorder.Code; {
+		case code == http.StatusAccepted:
+			loadTest.Dropped += n
+		case code == http.StatusOK || code == http.StatusCreated || code == http.StatusUnprocessableEntity:
+			// Entries rejected by an ingest policy are listed in the response
+			var response ingestResponse
+			if json.Unmarshal(recorder.Body.Bytes(), &response) == nil && len(response.Rejected) > 0 {
+				loadTest.Accepted += response.Accepted
+				loadTest.Rejected += len(response.Rejected)
+			} else {
+				loadTest.Accepted += n
+			}
+		default:
+			loadTest.Rejected += n
+			loadTest.LastError = fmt.Sprintf("%d: %s", code, strings.TrimSpace(recorder.Body.String()))
+		}
+		elapsed := time.Since(started)
+		loadTest.Elapsed = elapsed.Round(10 * time.Millisecond).String()
+		loadTest.EntriesPerSecond = math.Round(float64(sent)/elapsed.Seconds()*10) / 10
+		loadTest.mu.Unlock()
+
+		if wait := time.Until(started.Add(time.Duration(sent/batch) * interval)); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+
+	loadTest.mu.Lock()
+	loadTest.Running = false
+	log.Printf("Load test done, %d entries sent, %d accepted, %d dropped, %d rejected, %.1f entries/s",
+		loadTest.Sent, loadTest.Accepted, loadTest.Dropped, loadTest.Rejected, loadTest.EntriesPerSecond)
+	loadTest.mu.Unlock()
+}
+
+/*
+runBackfill lists the minute objects and copies every one lacking min-ts / max-ts metadata onto itself with the metadata added.
+
+At most BACKFILL_RATE objects are processed per second. The last processed key is persisted to BACKFILL_STATE_FILE,
+so that a restarted job resumes after it, the state file is removed once all objects are done.
+The job stops before the next object once read-only mode is enabled, and resumes after the last one when started again.
+*/
+func runBackfill() {
+	startAfter := ""
+	if data, err := os.ReadFile(backfillStateFile); err == nil {
+		var state backfillJob
+		if err := json.Unmarshal(data, &state); err == nil {
+			startAfter = state.LastKey
+		}
+	}
+
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucketName),
+		Prefix: aws.String(s3ObjectKeysPrefix),
+	}
+	if startAfter != "" {
+		input.StartAfter = aws.String(startAfter)
+	}
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / backfillRate))
+	defer ticker.Stop()
+
+	stopped := false
+	err := getS3Client().ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			key := *obj.Key
+			if _, err := parseMinute(minuteFromKey(key)); err != nil {
+				continue
+			}
+			<-ticker.C
+			if readOnly.Load() {
+				stopped = true
+				return false
+			}
+
+			updated, err := backfillObject(key)
+			backfill.mu.Lock()
+			backfill.Scanned++
+			if err != nil {
+				backfill.Failed++
+				log.Printf("Error backfilling metadata of %s: %v", key, err)
+			} else if updated {
+				backfill.Updated++
+			}
+			backfill.LastKey = key
+			state, _ := json.Marshal(backfillJob{LastKey: key})
+			backfill.mu.Unlock()
+
+			if err := os.WriteFile(backfillStateFile, state, 0644); err != nil {
+				log.Printf("Error saving backfill state: %v", err)
+			}
+		}
+		return !lastPage
+	})
+
+	backfill.mu.Lock()
+	defer backfill.mu.Unlock()
+	backfill.Running = false
+	if err != nil {
+		backfill.Error = err.Error()
+		log.Printf("Error listing objects for backfill, it resumes after %s: %v", backfill.LastKey, err)
+		return
+	}
+	if stopped {
+		backfill.Error = "stopped, the service is in read-only mode"
+		log.Printf("Metadata backfill stopped in read-only mode, it resumes after %s", backfill.LastKey)
+		return
+	}
+	os.Remove(backfillStateFile)
+	log.Printf("Metadata backfill done, %d objects scanned, %d updated", backfill.Scanned, backfill.Updated)
+}
+
+// backfillObject adds the time bounds metadata to key if it lacks it, reporting whether the object was updated
+func backfillObject(key string) (bool, error) {
+	client := getS3Client()
+	head, err := client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return false, err
+	}
+	if head.Metadata["Min-Ts"] != nil && head.Metadata["Max-Ts"] != nil {
+		return false, nil
+	}
+
+	resp, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return false, err
+	}
+	objectContent, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return false, fmt.Errorf("error reading object content: %v", err)
+	}
+	objectContent, err = decompressObjectContent(objectContent)
+	if err != nil {
+		return false, err
+	}
+	logEntries, err := decodeObjectEntries(objectContent)
+	if err != nil {
+		return false, fmt.Errorf("error unmarshalling object content: %v", err)
+	}
+	if len(logEntries) == 0 {
+		return false, nil
+	}
+
+	metadata := timeBoundsMetadata(logEntries)
+	for name, value := range head.Metadata {
+		if _, ok := metadata[name]; !ok {
+			metadata[name] = value
+		}
+	}
+	_, err = client.CopyObject(&s3.CopyObjectInput{
+		Bucket:            aws.String(bucketName),
+		Key:               aws.String(key),
+		CopySource:        aws.String(url.PathEscape(bucketName + "/" + key)),
+		Metadata:          metadata,
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+		ContentType:       head.ContentType,
+		ContentEncoding:   head.ContentEncoding,
+		CacheControl:      head.CacheControl,
+		TaggingDirective:  aws.String(s3.TaggingDirectiveCopy),
+	})
+	return err == nil, err
+}
+
+/*
+Re-uploads the minutes of a range from the local archive kept with KEEP_LOCAL, e.g. after an S3 incident, requires API_KEY.
+Archived entries are merged into the minute objects unless already present, so repeating a repair changes nothing.
+
+POST http://localhost:8080/admin/repair?start=1685426738&end=1685430338
+
+{"minutes_checked":61,"archived":12,"repaired":2,"entries_added":340}
+*/
+func repairHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(r, scopeAdmin) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if readOnly.Load() {
+		http.Error(w, "Uploads are paused, the service is in read-only mode", http.StatusServiceUnavailable)
+		return
+	}
+
+	query, err := parseLogQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var result repairResult
+	seen := make(map[string]bool)
+	for _, minute := range query.minutes() {
+		if seen[minute] {
+			continue
+		}
+		seen[minute] = true
+		result.MinutesChecked++
+
+		fileName := filepath.Join(keepLocalDirectory, minute+".txt")
+		if _, err := os.Stat(fileName); err != nil {
+			continue
+		}
+		result.Archived++
+		logEntries, _, err := readLocalFile(fileName)
+		if err != nil {
+			log.Printf("Error repairing minute %s: %v", minute, err)
+			http.Error(w, fmt.Sprintf("Error reading archive of minute %s", minute), http.StatusInternalServerError)
+			return
+		}
+
+		uploadMu.Lock()
+		added, err := storeMinute(minute, logEntries, true)
+		uploadMu.Unlock()
+		if err != nil {
+			log.Printf("Error repairing minute %s: %v", minute, err)
+			http.Error(w, fmt.Sprintf("Error repairing minute %s", minute), http.StatusBadGateway)
+			return
+		}
+		if added > 0 {
+			result.Repaired++
+			result.EntriesAdded += added
+			log.Printf("Repaired minute %s from the archive, %d entries added", minute, added)
+		}
+	}
+	audit(r, "repair", fmt.Sprintf("repaired=%d entries_added=%d", result.Repaired, result.EntriesAdded))
+
+	responseData, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, "Error marshalling response data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseData)
+}
+
+type repairResult struct {
+	MinutesChecked int `json:"minutes_checked"`
+	Archived       int `json:"archived"`
+	Repaired       int `json:"repaired"`
+	EntriesAdded   int `json:"entries_added"`
+}
+
+/*
+Finds the minutes of a range stored more than once, under the prefix and the S3_READ_PREFIXES or under the older
+key layouts (without S3_KEY_SUFFIX or the day directory of S3_DAY_PREFIX), requires API_KEY. Queries only read the
+first object found for a minute, so the entries of the others are hidden. The entries of the other objects are merged
+into the object of the minute under the prefix, unless already present, and the other objects are deleted. Objects
+that couldn't be deleted are listed in failed_keys and counted in failed_deletes, a later repair deletes them.
+Split minutes and the error store aren't repaired. With dry_run=true the duplicates are only reported.
+
+POST http://localhost:8080/admin/repair-duplicates?start=1685426738&end=1685430338&dry_run=true
+
+{"dry_run":true,"minutes_checked":61,"duplicates":[{"minute":"2023-05-30-06-05","keys":["old/2023-05-30-06-05.json"],"entries_added":12}],"entries_added":12,"deleted":0,"failed_deletes":0}
+*/
+func repairDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(r, scopeAdmin) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	if readOnly.Load() && !dryRun {
+		http.Error(w, "Uploads are paused, the service is in read-only mode", http.StatusServiceUnavailable)
+		return
+	}
+
+	query, err := parseLogQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	first, last := query.timestamps[0], query.timestamps[len(query.timestamps)-1]
+	keysByMinute, err := listMinuteObjects(first, last)
+	if err != nil {
+		log.Printf("Error listing objects for the duplicate repair: %v", err)
+		http.Error(w, "Error listing objects", http.StatusBadGateway)
+		return
+	}
+	minutes := make([]string, 0, len(keysByMinute))
+	for minute := range keysByMinute {
+		minutes = append(minutes, minute)
+	}
+	sort.Strings(minutes)
+
+	result := duplicateRepairResult{DryRun: dryRun, MinutesChecked: len(minutes), Duplicates: []duplicateMinute{}}
+	uploadMu.Lock()
+	defer uploadMu.Unlock()
+	for _, minute := range minutes {
+		keys := keysByMinute[minute]
+		if len(keys) < 2 {
+			continue
+		}
+		duplicate, err := repairDuplicateMinute(minute, keys, dryRun)
+		if err != nil {
+			log.Printf("Error repairing the duplicates of minute %s: %v", minute, err)
+			http.Error(w, fmt.Sprintf("Error repairing minute %s", minute), http.StatusBadGateway)
+			return
+		}
+		result.Duplicates = append(result.Duplicates, duplicate)
+		result.EntriesAdded += duplicate.EntriesAdded
+		if !dryRun {
+			deleted := len(duplicate.Keys) - len(duplicate.FailedKeys)
+			result.Deleted += deleted
+			result.FailedDeletes += len(duplicate.FailedKeys)
+			log.Printf("Merged %d duplicate objects of minute %s, %d entries added, %d deleted", len(duplicate.Keys), minute, duplicate.EntriesAdded, deleted)
+		}
+	}
+	audit(r, "repair_duplicates", fmt.Sprintf("dry_run=%t duplicates=%d entries_added=%d deleted=%d failed_deletes=%d",
+		dryRun, len(result.Duplicates), result.EntriesAdded, result.Deleted, result.FailedDeletes))
+
+	responseData, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, "Error marshalling response data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseData)
+}
+
+type duplicateRepairResult struct {
+	DryRun         bool              `json:"dry_run"`
+	MinutesChecked int               `json:"minutes_checked"`
+	Duplicates     []duplicateMinute `json:"duplicates"`
+	EntriesAdded   int               `json:"entries_added"`
+	Deleted        int               `json:"deleted"`
+	FailedDeletes  int               `json:"failed_deletes"`
+}
+
+// duplicateMinute lists the objects of a minute besides the one under the prefix, the entries they add to it and the objects that couldn't be deleted
+type duplicateMinute struct {
+	Minute       string   `json:"minute"`
+	Keys         []string `json:"keys"`
+	EntriesAdded int      `json:"entries_added"`
+	FailedKeys   []string `json:"failed_keys,omitempty"`
+}
+
+/*
+repairDuplicateMinute merges the objects at keys into the object of minute under the prefix and deletes them,
+uploadMu must be held. Without an object under the prefix, the merged entries are written as its single object.
+*/
+func repairDuplicateMinute(minute string, keys []string, dryRun bool) (duplicateMinute, error) {
+	canonical := objectKey(minute)
+	duplicate := duplicateMinute{Minute: minute}
+	var merged []LogEntry
+	existed := false
+	for _, key := range keys {
+		if key == canonical {
+			existed = true
+			continue
+		}
+		duplicate.Keys = append(duplicate.Keys, key)
+	}
+	if existed {
+		var err error
+		if merged, err = getObjectEntries(canonical); err != nil {
+			return duplicate, err
+		}
+	}
+	present := len(merged)
+	for _, key := range duplicate.Keys {
+		logEntries, err := getObjectEntries(key)
+		if err != nil {
+			return duplicate, err
+		}
+		merged = append(merged, missingEntries(merged, logEntries)...)
+	}
+	duplicate.EntriesAdded = len(merged) - present
+	if dryRun {
+		return duplicate, nil
+	}
+
+	var err error
+	switch {
+	case !existed:
+		err = putMinuteObject(minute, merged)
+	case duplicate.EntriesAdded > 0:
+		_, err = storeMinute(minute, merged[present:], true)
+	}
+	if err != nil {
+		return duplicate, err
+	}
+	// The entries are merged already, so a failed delete only leaves a duplicate for the next repair
+	for _, key := range duplicate.Keys {
+		if err := deleteObject(key); err != nil {
+			duplicate.FailedKeys = append(duplicate.FailedKeys, key)
+		}
+	}
+	return duplicate, nil
+}
+
+// getObjectEntries returns the entries of the object at key
+func getObjectEntries(key string) ([]LogEntry, error) {
+	resp, err := getS3Client().GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting object %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	objectContent, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading object %s: %v", key, err)
+	}
+	if objectContent, err = decompressObjectContent(objectContent); err != nil {
+		return nil, err
+	}
+	logEntries, err := decodeObjectEntries(objectContent)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling object %s: %v", key, err)
+	}
+	return logEntries, nil
+}
+
+/*
+listMinuteObjects lists the single objects of the minutes between first and last under the prefix and the S3_READ_PREFIXES,
+by minute. Only keys a minute may be read from are listed (see objectKeyCandidates), parts of split minutes are left out.
+*/
+func listMinuteObjects(first, last string) (map[string][]string, error) {
+	keysByMinute := make(map[string][]string)
+	listed := make(map[string]bool)
+	for _, prefix := range readPrefixes() {
+		err := getS3Client().ListObjectsV2Pages(&s3.ListObjectsV2Input{
+			Bucket: aws.String(bucketName),
+			Prefix: aws.String(listingPrefix(prefix, first, last)),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				key := *obj.Key
+				minute := minuteFromKey(key)
+				if listed[key] || minute < first || minute > last {
+					continue
+				}
+				// A prefix nested in another is listed twice
+				listed[key] = true
+				for _, candidatePrefix := range readPrefixes() {
+					if slices.Contains(objectKeyCandidates(candidatePrefix, minute), key) {
+						keysByMinute[minute] = append(keysByMinute[minute], key)
+						break
+					}
+				}
+			}
+			return !lastPage
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keysByMinute, nil
+}
+
+/*
+Writes the in-memory buffer to S3 right away, merged into the objects of the minutes of its entries, requires API_KEY.
+Meant for when the upload loop is stuck, the persisted entries are skipped when their local files are uploaded later.
+Entries already present in their minute are not added again, so repeating the call changes nothing.
+
+POST http://localhost:8080/admin/persist-buffer
+
+{"minutes":3,"persisted":120,"entries_added":118}
+*/
+func persistBufferHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(r, scopeAdmin) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if readOnly.Load() {
+		http.Error(w, "Uploads are paused, the service is in read-only mode", http.StatusServiceUnavailable)
+		return
+	}
+
+	bufferMu.RLock()
+	snapshot := append([]LogEntry(nil), inMemorySearchBuffer...)
+	bufferMu.RUnlock()
+
+	// Grouped like the sinks store them, error entries also (or only) go to the error store
+	byMinute := make(map[string][]LogEntry)
+	for _, entry := range snapshot {
+		minute := formatMinute(time.Unix(entry.Timestamp, 0))
+		if errorStoreLevel != "" && isErrorEntry(entry) {
+			byMinute["errors/"+minute] = append(byMinute["errors/"+minute], entry)
+			if errorStoreMode == "move" {
+				continue
+			}
+		}
+		byMinute[minute] = append(byMinute[minute], entry)
+	}
+	minutes := make([]string, 0, len(byMinute))
+	for minute := range byMinute {
+		minutes = append(minutes, minute)
+	}
+	sort.Strings(minutes)
+
+	var result persistResult
+	for _, minute := range minutes {
+		logEntries := byMinute[minute]
+		uploadMu.Lock()
+		added, err := storeMinute(minute, logEntries, true)
+		uploadMu.Unlock()
+		if err != nil {
+			log.Printf("Error persisting the buffer entries of minute %s: %v", minute, err)
+			http.Error(w, fmt.Sprintf("Error persisting minute %s", minute), http.StatusBadGateway)
+			return
+		}
+		markPersisted(strings.TrimSuffix(minute, path.Base(minute)), logEntries)
+		result.Minutes++
+		result.Persisted += len(logEntries)
+		result.EntriesAdded += added
+	}
+	log.Printf("Persisted %d buffered entries to %d minutes, %d entries added", result.Persisted, result.Minutes, result.EntriesAdded)
+	audit(r, "persist_buffer", fmt.Sprintf("persisted=%d entries_added=%d", result.Persisted, result.EntriesAdded))
+
+	responseData, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, "Error marshalling response data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseData)
+}
+
+/*
+Removes the entries of a minute, or of the minutes of a range given with the start and end parameters of /query,
+from the in-memory buffer, e.g. after a bad ingest, requires API_KEY. Only the buffer is changed, entries already
+written to the local files or S3 are still returned by queries.
+
+POST http://localhost:8080/admin/evict-buffer?minute=2023-05-30-06-05
+POST http://localhost:8080/admin/evict-buffer?start=1685426738&end=1685430338
+
+{"minutes":1,"evicted":120,"remaining":3400}
+*/
+func evictBufferHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(r, scopeAdmin) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var minutes []string
+	if minute := r.URL.Query().Get("minute"); minute != "" {
+		if _, err := parseMinute(minute); err != nil {
+			http.Error(w, "Invalid minute, expected 2006-01-02-15-04", http.StatusBadRequest)
+			return
+		}
+		minutes = []string{minute}
+	} else if r.URL.Query().Get("start") != "" && r.URL.Query().Get("end") != "" {
+		query, err := parseLogQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// The query widens its range by a second on each side to filter inclusively, which can reach the minutes around it
+		first, last := formatMinute(query.startTime.Add(time.Second)), formatMinute(query.endTime.Add(-time.Second))
+		for _, minute := range query.timestamps {
+			if minute >= first && minute <= last {
+				minutes = append(minutes, minute)
+			}
+		}
+	} else {
+		http.Error(w, "Expected a minute or start and end", http.StatusBadRequest)
+		return
+	}
+	evict := make(map[string]bool, len(minutes))
+	for _, minute := range minutes {
+		evict[minute] = true
+	}
+
+	bufferMu.Lock()
+	kept := make([]LogEntry, 0, len(inMemorySearchBuffer))
+	for _, entry := range inMemorySearchBuffer {
+		if !evict[formatMinute(time.Unix(entry.Timestamp, 0))] {
+			kept = append(kept, entry)
+		}
+	}
+	result := evictResult{Minutes: len(evict), Evicted: len(inMemorySearchBuffer) - len(kept), Remaining: len(kept)}
+	resetBuffer(kept)
+	bufferMu.Unlock()
+
+	log.Printf("Evicted %d entries of %d minutes from the buffer", result.Evicted, result.Minutes)
+	audit(r, "evict_buffer", fmt.Sprintf("minutes=%d evicted=%d", result.Minutes, result.Evicted))
+
+	responseData, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, "Error marshalling response data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseData)
+}
+
+type evictResult struct {
+	Minutes   int `json:"minutes"`
+	Evicted   int `json:"evicted"`
+	Remaining int `json:"remaining"`
+}
+
+type persistResult struct {
+	Minutes      int `json:"minutes"`
+	Persisted    int `json:"persisted"`
+	EntriesAdded int `json:"entries_added"`
+}
+
+// markPersisted records logEntries of store as persisted, as many times as each of them is in logEntries
+func markPersisted(store string, logEntries []LogEntry) {
+	counts := make(map[string]int)
+	for _, entry := range logEntries {
+		counts[store+entryDedupKey(entry)]++
+	}
+	persistedMu.Lock()
+	defer persistedMu.Unlock()
+	for key, count := range counts {
+		if count > persistedEntries[key] {
+			persistedEntries[key] = count
+		}
+	}
+}
+
+// skipPersisted returns logEntries of store without the entries already persisted from the buffer
+func skipPersisted(store string, logEntries []LogEntry) []LogEntry {
+	persistedMu.Lock()
+	defer persistedMu.Unlock()
+	if len(persistedEntries) == 0 {
+		return logEntries
+	}
+	var remaining []LogEntry
+	for _, entry := range logEntries {
+		key := store + entryDedupKey(entry)
+		if persistedEntries[key] > 0 {
+			persistedEntries[key]--
+			if persistedEntries[key] == 0 {
+				delete(persistedEntries, key)
+			}
+			continue
+		}
+		remaining = append(remaining, entry)
+	}
+	return remaining
+}
+
+/*
+Returns the current state of the ingestion pipeline
+
+GET http://localhost:8080/stats
+
+{"read_only":false,"channel_length":0,"channel_capacity":100000,"buffer_entries":120,"local_disk_bytes":8123,"memory_pressure":false,"heap_alloc_bytes":4194304}
+*/
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	responseData, err := json.Marshal(currentStats())
+	if err != nil {
+		http.Error(w, "Error marshalling response data", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseData)
+}
+
+type stats struct {
+	ReadOnly        bool   `json:"read_only"`
+	ChannelLength   int    `json:"channel_length"`
+	ChannelCapacity int    `json:"channel_capacity"`
+	BufferEntries   int    `json:"buffer_entries"`
+	LocalDiskBytes  int64  `json:"local_disk_bytes"`
+	DiskFreeBytes   int64  `json:"disk_free_bytes"`
+	DiskFreeInodes  int64  `json:"disk_free_inodes"`
+	MemoryPressure  bool   `json:"memory_pressure"`
+	SinksFailing    int    `json:"sinks_failing"`
+	HeapAllocBytes  uint64 `json:"heap_alloc_bytes"`
+
+	PendingCompactionHours   int `json:"pending_compaction_hours,omitempty"`
+	PendingCompactionObjects int `json:"pending_compaction_objects,omitempty"`
+}
+
+func currentStats() stats {
+	bufferMu.RLock()
+	bufferEntries := len(inMemorySearchBuffer)
+	bufferMu.RUnlock()
+
+	pendingHours, pendingObjects := pendingCompactions()
+	return stats{
+		ReadOnly:        readOnly.Load(),
+		ChannelLength:   len(logChannel),
+		ChannelCapacity: cap(logChannel),
+		BufferEntries:   bufferEntries,
+		LocalDiskBytes:  localDiskUsage.Load(),
+		DiskFreeBytes:   localDiskFreeBytes.Load(),
+		DiskFreeInodes:  localFreeInodes.Load(),
+		MemoryPressure:  memoryPressure.Load(),
+		SinksFailing:    int(failingSinks.Load()),
+		HeapAllocBytes:  heapAlloc.Load(),
+
+		PendingCompactionHours:   pendingHours,
+		PendingCompactionObjects: pendingObjects,
+	}
+}
+
+/*
+Returns the effective configuration, after .env, environment and defaults are resolved, requires API_KEY.
+Credentials and keys are only reported as set or not.
+
+GET http://localhost:8080/admin/config
+
+{"API_KEY":"[redacted]","AWS_REGION":"eu-west-1","MAX_RESULT_ENTRIES":0,"S3_BUCKET_NAME":"logs",...}
+*/
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(r, scopeAdmin) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	responseData, err := json.Marshal(resolvedConfig())
+	if err != nil {
+		http.Error(w, "Error marshalling response data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseData)
+}
+
+// redacted hides a secret setting, reporting only whether it is set
+func redacted(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
+func resolvedConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"AWS_ACCESS_KEY_ID":             redacted(accessKeyID),
+		"AWS_SECRET_ACCESS_KEY":         redacted(secretAccessKey),
+		"API_KEY":                       redacted(apiKey),
+		"API_KEYS":                      redacted(os.Getenv("API_KEYS")),
+		"API_KEYS_FILE":                 os.Getenv("API_KEYS_FILE"),
+		"MAX_CONCURRENT_REQUESTS":       os.Getenv("MAX_CONCURRENT_REQUESTS"),
+		"AWS_REGION":                    region,
+		"S3_BUCKET_NAME":                bucketName,
+		"S3_KEY_SUFFIX":                 s3KeySuffix,
+		"S3_DAY_PREFIX":                 s3DayPrefix,
+		"S3_READ_PREFIXES":              s3ReadPrefixes,
+		"INSTANCE_ID":                   instanceID,
+		"S3_OBJECT_TAGS":                s3ObjectTags,
+		"KEY_TIMEZONE":                  keyLocation.String(),
+		"OBJECT_FORMAT_VERSION":         objectFormatVersion,
+		"MAX_DECOMPRESSED_BYTES":        maxDecompressedBytes,
+		"READ_ONLY":                     readOnly.Load(),
+		"MEMORY_HIGH_WATERMARK_BYTES":   memoryHighWatermark,
+		"MEMORY_CHECK_INTERVAL":         memoryCheckInterval.String(),
+		"EXPORT_PREFIX":                 exportPrefix,
+		"EXPORT_TTL":                    exportTTL.String(),
+		"KEEP_LOCAL":                    keepLocal,
+		"QUERY_COMPACTED_HOURS":         queryCompactedHours,
+		"COMPACTION_INTERVAL":           compactionInterval.String(),
+		"COMPACT_AFTER":                 compactAfter.String(),
+		"COMPACT_MAX_OBJECTS":           compactMaxObjects,
+		"QUERY_LOCAL_FALLBACK":          queryLocalFallback,
+		"DISABLE_BUFFER":                bufferDisabled,
+		"S3_BREAKER_THRESHOLD":          s3Breaker.threshold,
+		"S3_BREAKER_COOLDOWN":           s3Breaker.cooldown.String(),
+		"KEEP_LOCAL_DIRECTORY":          keepLocalDirectory,
+		"AUDIT_LOG_FILE":                auditLogFile,
+		"AUDIT_PREFIX":                  auditPrefix,
+		"MANIFEST_PREFIX":               manifestPrefix,
+		"CANARY_INTERVAL":               canaryInterval.String(),
+		"CANARY_TAG":                    canaryTag,
+		"CANARY_TIMEOUT":                canaryTimeout.String(),
+		"BACKFILL_STATE_FILE":           backfillStateFile,
+		"BACKFILL_RATE":                 backfillRate,
+		"LOADTEST_ENABLED":              loadTestEnabled,
+		"LATE_GRACE":                    lateGrace.String(),
+		"DEFAULT_QUERY_LAST":            defaultQueryLast.String(),
+		"DEFAULT_QUERY_TEXT":            defaultQueryText,
+		"MAX_QUERY_OBJECTS":             maxQueryObjects,
+		"MAX_RESULT_ENTRIES":            maxResultEntries,
+		"SORT_BUFFER_OBJECTS":           sortBufferObjects,
+		"MAX_DISTINCT_GROUPS":           maxDistinctGroups,
+		"MULTIPART_THRESHOLD_BYTES":     multipartThreshold,
+		"CONDITIONAL_WRITES":            conditionalWrites,
+		"MULTIPART_PART_SIZE":           multipartPartSize,
+		"MULTIPART_CONCURRENCY":         multipartConcurrency,
+		"MAX_ENTRIES_PER_OBJECT":        maxEntriesPerObject,
+		"MAX_LOCAL_DISK_BYTES":          maxLocalDiskBytes,
+		"MIN_FREE_DISK_BYTES":           minFreeDiskBytes,
+		"MIN_FREE_INODES":               minFreeInodes,
+		"DISK_FULL_POLICY":              diskFullPolicy,
+		"UPLOAD_RETRY_INITIAL_INTERVAL": uploadRetryInitialInterval.String(),
+		"UPLOAD_RETRY_MAX_INTERVAL":     uploadRetryMaxInterval.String(),
+		"UPLOAD_RETRY_JITTER":           uploadRetryJitter,
+		"UPLOAD_MAX_ELAPSED":            uploadMaxElapsed.String(),
+		"UPLOAD_CONCURRENCY":            uploadConcurrency,
+		"MAX_UPLOAD_INFLIGHT_BYTES":     uploadInflightBytes.limit,
+		"DEAD_LETTER_DIRECTORY":         deadLetterDirectory,
+		"STDOUT_SINK":                   stdoutSinkEnabled,
+		"RESPONSE_NEWLINE":              responseNewline,
+		"STREAM_THRESHOLD":              streamThreshold,
+		"ERROR_STORE_LEVEL":             errorStoreLevel,
+		"ERROR_STORE_MODE":              errorStoreMode,
+		"FLUSH_SORT":                    flushSort,
+		"FLUSH_MAX_DELAY":               flushMaxDelay.String(),
+		"FLUSH_MAX_ENTRIES":             flushMaxEntries,
+		"FLUSH_MAX_BYTES":               flushMaxBytes,
+		"BACKPRESSURE_THRESHOLD":        backpressureThreshold,
+		"SHUTDOWN_TIMEOUT":              shutdownTimeout.String(),
+		"SINK_RETRY_ATTEMPTS":           sinkRetryAttempts,
+		"SINK_RETRY_INITIAL_INTERVAL":   sinkRetryInitialInterval.String(),
+		"SINK_RETRY_MAX_INTERVAL":       sinkRetryMaxInterval.String(),
+		"MAX_INGEST_BODY_BYTES":         maxIngestBodyBytes,
+		"MAX_INGEST_ENTRIES":            maxIngestEntries,
+		"INGEST_REQUEST_TIMEOUT":        ingestRequestTimeout.String(),
+		"MAX_CLOCK_SKEW":                maxClockSkew.String(),
+		"CLOCK_SKEW_POLICY":             clockSkewPolicy,
+		"CLOCK_DRIFT_WARNING":           clockDriftWarning.String(),
+		"EMBEDDED_JSON_POLICY":          embeddedJSONPolicy,
+		"RETENTION":                     retention.String(),
+		"REJECT_BEYOND_RETENTION":       rejectBeyondRetention,
+		"MANAGE_LIFECYCLE":              manageLifecycle,
+		"LIFECYCLE_TRANSITION_IA_DAYS":  lifecycleTransitionIADays,
+		"REDACT":                        os.Getenv("REDACT"),
+		"REDACTION_RULES_FILE":          os.Getenv("REDACTION_RULES_FILE"),
+		"REDACTION_PLACEHOLDER":         redactionPlaceholder,
+		"SOURCE_NAME":                   sourceName,
+		"SYSLOG_ADDR":                   syslogAddr,
+		"GELF_ADDR":                     gelfAddr,
+		"FORWARD_ADDR":                  forwardAddr,
+		"GRPC_ADDR":                     grpcAddr,
+		"SOURCE_CLIENT_IP":              sourceClientIP,
+		"LEVEL_NUMERIC_MAP":             levelNumericMap,
+		"DEDUP_TTL":                     ingestDedup.ttl.String(),
+		"DEDUP_MAX_KEYS":                ingestDedup.maxKeys,
+		"DEDUP_STORE_PATH":              ingestDedup.path,
+		"DEDUP_ENTRIES":                 dedupEntries,
+		"TENANT_RATE_LIMIT":             tenantQuotas.defaults.rate,
+		"TENANT_RATE_BURST":             tenantQuotas.defaults.burst,
+		"TENANT_DAILY_QUOTA_BYTES":      tenantQuotas.defaults.quotaBytes,
+		"TENANT_DAILY_QUOTA_ENTRIES":    tenantQuotas.defaults.quotaEntries,
+		"TENANT_LIMITS":                 os.Getenv("TENANT_LIMITS"),
+		"TENANT_QUOTA_FILE":             tenantQuotaFile,
+		"NOTIFY_TOPIC_ARN":              os.Getenv("NOTIFY_TOPIC_ARN"),
+		"NOTIFY_QUEUE_URL":              os.Getenv("NOTIFY_QUEUE_URL"),
+	}
+}
+
+/*
+Describes the features and limits of this instance, so that clients can adapt to its configuration
+
+GET http://localhost:8080/capabilities
+
+{"ingest_formats":["json","map","protobuf"],"query_params":["start","end","text",...],"limits":{"max_result_entries":0,...},"storage":{"backend":"s3",...},"auth":true,"tenancy":{...},"read_only":false}
+*/
+func capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	responseData, err := json.Marshal(currentCapabilities())
+	if err != nil {
+		http.Error(w, "Error marshalling response data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseData)
+}
+
+type capabilities struct {
+	IngestFormats   []string          `json:"ingest_formats"`
+	IngestEncodings []string          `json:"ingest_encodings"`
+	QueryParams     []string          `json:"query_params"`
+	Limits          capabilityLimits  `json:"limits"`
+	Storage         capabilityStorage `json:"storage"`
+	Auth            bool              `json:"auth"`
+	Tenancy         capabilityTenancy `json:"tenancy"`
+	Dedup           bool              `json:"dedup"`
+	ReadOnly        bool              `json:"read_only"`
+	Notifications   []string          `json:"notifications,omitempty"`
+	Inputs          []string          `json:"inputs,omitempty"`
+	Defaults        map[string]string `json:"defaults,omitempty"`
+}
+
+// Limits are 0 when unlimited
+type capabilityLimits struct {
+	MaxQueryObjects     int   `json:"max_query_objects"`
+	MaxResultEntries    int   `json:"max_result_entries"`
+	MaxDistinctGroups   int   `json:"max_distinct_groups"`
+	SortBufferObjects   int   `json:"sort_buffer_objects"`
+	MaxIngestBodyBytes  int64 `json:"max_ingest_body_bytes"`
+	MaxIngestEntries    int   `json:"max_ingest_entries"`
+	MaxEntriesPerObject int   `json:"max_entries_per_object"`
+	MaxLocalDiskBytes   int64 `json:"max_local_disk_bytes"`
+}
+
+type capabilityStorage struct {
+	Backend      string   `json:"backend"`
+	Prefix       string   `json:"prefix"`
+	KeySuffix    string   `json:"key_suffix"`
+	DayPrefix    bool     `json:"day_prefix"`
+	ReadPrefixes []string `json:"read_prefixes,omitempty"`
+	Compression  string   `json:"compression,omitempty"`
+}
+
+type capabilityTenancy struct {
+	Header        string `json:"header"`
+	DefaultTenant string `json:"default_tenant"`
+	RateLimited   bool   `json:"rate_limited"`
+	Quotas        bool   `json:"quotas"`
+}
+
+func currentCapabilities() capabilities {
+	c := capabilities{
+		IngestFormats:   []string{"json", "ndjson", "map", "protobuf", "otlp", "otlp_json", "loki", "loki_json", "hec"},
+		IngestEncodings: []string{"gzip"},
+		QueryParams: []string{"start", "end", "text", "exclude", "regex", "field", "pick", "distinct", "sort",
+			"cursor", "key_glob", "timeout", "strict", "output", "pretty", "trim", "fields"},
+		Limits: capabilityLimits{
+			MaxQueryObjects:     maxQueryObjects,
+			MaxResultEntries:    maxResultEntries,
+			MaxDistinctGroups:   maxDistinctGroups,
+			SortBufferObjects:   sortBufferObjects,
+			MaxIngestBodyBytes:  maxIngestBodyBytes,
+			MaxIngestEntries:    maxIngestEntries,
+			MaxEntriesPerObject: maxEntriesPerObject,
+			MaxLocalDiskBytes:   maxLocalDiskBytes,
+		},
+		Storage: capabilityStorage{
+			Backend:      "s3",
+			Prefix:       s3ObjectKeysPrefix,
+			KeySuffix:    s3KeySuffix,
+			DayPrefix:    s3DayPrefix,
+			ReadPrefixes: s3ReadPrefixes,
+		},
+		Auth: apiKey != "" || len(scopedKeys) > 0,
+		Tenancy: capabilityTenancy{
+			Header:        "X-Tenant-ID",
+			DefaultTenant: defaultTenant,
+		},
+		Dedup:    ingestDedup.enabled(),
+		ReadOnly: readOnly.Load(),
+	}
+	if strings.HasSuffix(s3KeySuffix, ".gz") {
+		c.Storage.Compression = "gzip"
+	}
+
+	limits := []tenantLimits{tenantQuotas.defaults}
+	for _, override := range tenantQuotas.overrides {
+		limits = append(limits, override)
+	}
+	for _, l := range limits {
+		c.Tenancy.RateLimited = c.Tenancy.RateLimited || l.rate > 0
+		c.Tenancy.Quotas = c.Tenancy.Quotas || l.quotaBytes > 0 || l.quotaEntries > 0
+	}
+
+	for _, publisher := range uploadPublishers {
+		switch publisher.(type) {
+		case *snsPublisher:
+			c.Notifications = append(c.Notifications, "sns")
+		case *sqsPublisher:
+			c.Notifications = append(c.Notifications, "sqs")
+		}
+	}
+
+	if syslogAddr != "" {
+		c.Inputs = append(c.Inputs, "syslog")
+	}
+	if gelfAddr != "" {
+		c.Inputs = append(c.Inputs, "gelf")
+	}
+	if forwardAddr != "" {
+		c.Inputs = append(c.Inputs, "forward")
+	}
+	if grpcAddr != "" {
+		c.Inputs = append(c.Inputs, "grpc")
+	}
+
+	if defaultQueryLast > 0 || defaultQueryText != "" {
+		c.Defaults = make(map[string]string)
+		if defaultQueryLast > 0 {
+			c.Defaults["last"] = defaultQueryLast.String()
+		}
+		if defaultQueryText != "" {
+			c.Defaults["text"] = defaultQueryText
+		}
+	}
+	return c
+}
+
+/*
+GET http://localhost:8080/list
+
+Returns a list of all the S3 keys created by this project, or those of one day with day=2024-03-02,
+read from its manifest when MANIFEST_PREFIX is set.
+With details=true every key is returned with its size, last modification and the instance that wrote it,
+which takes a HEAD request per object, e.g. to find which instances wrote a duplicated minute.
+
+GET http://localhost:8080/list?day=2024-03-02&details=true
+
+[{"key":"mihir_joshi/2024-03-02-10-37.json","size":5120,"last_modified":"2024-03-02T10:38:01Z","instance_id":"ingester-1"}]
+*/
+func listHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	client := getS3Client()
+
+	var keys []string
+
+	day := r.URL.Query().Get("day")
+	if day != "" {
+		if _, err := time.Parse("2006-01-02", day); err != nil {
+			http.Error(w, "Invalid day, expected 2006-01-02", http.StatusBadRequest)
+			return
+		}
+	}
+	if day != "" && manifestPrefix != "" {
+		var err error
+		keys, err = manifestKeys(day)
+		if err != nil {
+			log.Printf("Error reading manifest of %s: %v", day, err)
+			http.Error(w, "Error reading manifest", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		// The objects under the S3_READ_PREFIXES are listed after those under the prefix
+		for _, prefix := range readPrefixes() {
+			if day != "" {
+				prefix = dayKeyPrefix(prefix, day)
+			}
+			err := client.ListObjectsPages(&s3.ListObjectsInput{
+				Prefix: aws.String(prefix),
+				Bucket: aws.String(bucketName),
+			}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+				for _, obj := range page.Contents {
+					keys = append(keys, *obj.Key)
+				}
+				return !lastPage
+			})
+			if err != nil {
+				log.Fatalf("error listing bucket objects: %v", err)
+				return
+			}
+		}
+	}
+
+	var response interface{} = keys
+	if r.URL.Query().Get("details") == "true" {
+		details := make([]objectDetails, 0, len(keys))
+		for _, key := range keys {
+			head, err := client.HeadObject(&s3.HeadObjectInput{
+				Bucket: aws.String(bucketName),
+				Key:    aws.String(key),
+			})
+			if err != nil {
+				log.Printf("Error reading metadata of %s: %v", key, err)
+				http.Error(w, fmt.Sprintf("Error reading metadata of %s", key), http.StatusBadGateway)
+				return
+			}
+			detail := objectDetails{Key: key, Size: aws.Int64Value(head.ContentLength), LastModified: aws.TimeValue(head.LastModified)}
+			if id := head.Metadata["Instance-Id"]; id != nil {
+				detail.InstanceID = *id
+			}
+			details = append(details, detail)
+		}
+		response = details
+	}
+
+	keysJSON, err := marshalResponse(r, response)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error marshalling keys to JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(keysJSON)
+	if err != nil {
+		log.Printf("error writing response: %v", err)
+	}
+}
+
+// objectDetails describes an object listed with details=true, InstanceID is empty for objects written before INSTANCE_ID
+type objectDetails struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	InstanceID   string    `json:"instance_id,omitempty"`
+}
+
+// periodicallyWriteToStorage flushes logChannel every 500ms until shutdownStorage is closed, flushing one last time before it returns
+func periodicallyWriteToStorage() {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	defer close(storageStopped)
+
+	for {
+		select {
+		case <-ticker.C:
+			if flushMaxDelay > 0 {
+				accumulateLogChannel(time.Now())
+			} else {
+				flushLogChannel()
+			}
+		case <-shutdownStorage:
+			flushLogChannel()
+			return
+		}
+	}
+}
+
+/*
+flushLogChannel drains logChannel and hands what it drained to the sinks, together with the entries accumulated
+by earlier ticks, returning the number of entries flushed.
+It is safe to call directly (graceful shutdown, /flush), concurrent flushes are serialized.
+*/
+func flushLogChannel() int {
+	flushMu.Lock()
+	defer flushMu.Unlock()
+
+	drainLogChannel()
+	return writeAccumulated()
+}
+
+/*
+accumulateLogChannel drains logChannel like flushLogChannel but only hands the entries to the sinks once
+FLUSH_MAX_DELAY has passed since the oldest of them was drained, FLUSH_MAX_ENTRIES or FLUSH_MAX_BYTES are reached,
+or the minute has changed, so that low volumes don't write to the local files on every tick.
+Accumulated entries are queryable from the in-memory buffer right away.
+*/
+func accumulateLogChannel(now time.Time) {
+	flushMu.Lock()
+	defer flushMu.Unlock()
+
+	drainLogChannel()
+	if len(accumulated) == 0 {
+		if failingSinks.Load() > 0 {
+			writeAccumulated()
+		}
+		return
+	}
+	if now.Sub(accumulatedSince) >= flushMaxDelay ||
+		(flushMaxEntries > 0 && len(accumulated) >= flushMaxEntries) ||
+		(flushMaxBytes > 0 && accumulatedBytes >= flushMaxBytes) ||
+		formatMinute(now) != formatMinute(accumulatedSince) {
+		writeAccumulated()
+	}
+}
+
+// drainLogChannel moves the entries waiting in logChannel to accumulated and the in-memory buffer, flushMu must be held
+func drainLogChannel() {
+	for {
+		select {
+		case logEntry := <-logChannel:
+			if len(accumulated) == 0 {
+				accumulatedSince = time.Now()
+			}
+			accumulated = append(accumulated, logEntry)
+			accumulatedBytes += approximateEntrySize(logEntry)
+			if !bufferDisabled {
+				logEntry.Bucket = ""
+				bufferMu.Lock()
+				appendToBuffer(logEntry)
+				bufferMu.Unlock()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// writeAccumulated hands the accumulated entries to the sinks and returns their number, flushMu must be held
+func writeAccumulated() int {
+	logs := accumulated
+	accumulated, accumulatedBytes = nil, 0
+
+	// Sinks holding entries that failed to be written are retried even without new entries
+	if len(logs) > 0 || failingSinks.Load() > 0 {
+		// logChannel delivers entries in arrival order, so ingest and none leave the batch as is
+		if flushSort == "timestamp" {
+			sort.SliceStable(logs, func(i, j int) bool {
+				return logs[i].Timestamp < logs[j].Timestamp
+			})
+		}
+
+		writeToSinks(logs)
+	}
+	return len(logs)
+}
+
+// approximateEntrySize estimates the bytes an entry takes once written, without marshalling it
+func approximateEntrySize(entry LogEntry) int64 {
+	size := int64(len(entry.Message) + len(entry.Level) + 32)
+	for name, value := range entry.Fields {
+		size += int64(len(name) + len(value) + 6)
+	}
+	return size
+}
+
+/*
+POST http://localhost:8080/flush
+
+Writes the entries waiting in the ingest channel to the sinks right away, requires API_KEY
+
+{"flushed":42}
+*/
+func flushHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(r, scopeAdmin) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	flushed := flushLogChannel()
+	audit(r, "flush", fmt.Sprintf("flushed=%d", flushed))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "{\"flushed\":%d}", flushed)
+}
+
+// Sink receives every batch of log entries flushed from logChannel
+type Sink interface {
+	Write(batch []LogEntry) error
+}
+
+type registeredSink struct {
+	name string
+	sink Sink
+
+	// Entries that failed to be written, retried once retryAt has passed. Only used by writeToSinks, under flushMu
+	held    []LogEntry
+	retryAt time.Time
+	backoff time.Duration
+}
+
+var sinks []*registeredSink
+
+// registerSink adds a sink that receives every flushed batch, it must be called before the storage goroutine is started
+func registerSink(name string, sink Sink) {
+	sinks = append(sinks, &registeredSink{name: name, sink: sink})
+}
+
+/*
+writeToSinks hands batch to every registered sink concurrently, a failing or panicking sink doesn't affect the others.
+A sink failing after sinkRetryAttempts holds on to its entries and gets them again, with the next batches, once its backoff
+has passed, so that a persistently failing disk is neither retried in a tight loop nor loses entries.
+*/
+func writeToSinks(batch []LogEntry) {
+	var wg sync.WaitGroup
+	for _, s := range sinks {
+		wg.Add(1)
+		go func(s *registeredSink) {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Sink %s panicked: %v", s.name, r)
+				}
+			}()
+
+			// Entries already held are retried once per backoff, new ones get all attempts.
+			// batch is shared by the sinks, only this sink's copy of the slice is replaced
+			entries := batch
+			attempts := sinkRetryAttempts
+			if len(s.held) > 0 {
+				attempts = 1
+				s.held = append(s.held, entries...)
+				metrics.set(fmt.Sprintf("sink_held_entries{sink=%q}", s.name), float64(len(s.held)))
+				// On shutdown the held entries get a last chance regardless of the backoff
+				if time.Now().Before(s.retryAt) && ingestAccepting.Load() {
+					return
+				}
+				entries = s.held
+			}
+			if len(entries) == 0 {
+				return
+			}
+
+			backoff := sinkRetryInitialInterval
+			for attempt := 1; ; attempt++ {
+				err := s.sink.Write(entries)
+				if err == nil {
+					s.recovered()
+					return
+				}
+				metrics.add(fmt.Sprintf("sink_write_errors_total{sink=%q}", s.name), 1)
+				if attempt >= attempts {
+					s.hold(entries, err)
+					return
+				}
+				log.Printf("Error writing log entries to sink %s (attempt %d), retrying in %s: %v", s.name, attempt, backoff, err)
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+// hold keeps the entries of a sink that failed all attempts, to be retried after a backoff doubled on every failed retry
+func (s *registeredSink) hold(batch []LogEntry, err error) {
+	if len(s.held) == 0 {
+		failingSinks.Add(1)
+		metrics.set(fmt.Sprintf("sink_failing{sink=%q}", s.name), 1)
+		s.backoff = sinkRetryInitialInterval
+		log.Printf("ALERT: sink %s is failing, holding %d log entries and rejecting ingestion until it recovers: %v", s.name, len(batch), err)
+	} else {
+		log.Printf("Error writing %d held log entries to sink %s, retrying in %s: %v", len(batch), s.name, s.backoff, err)
+	}
+	s.held = batch
+	s.retryAt = time.Now().Add(s.backoff)
+	s.backoff *= 2
+	if s.backoff > sinkRetryMaxInterval {
+		s.backoff = sinkRetryMaxInterval
+	}
+	metrics.set(fmt.Sprintf("sink_held_entries{sink=%q}", s.name), float64(len(s.held)))
+}
+
+func (s *registeredSink) recovered() {
+	if len(s.held) == 0 {
+		return
+	}
+	log.Printf("Sink %s recovered, wrote %d held log entries", s.name, len(s.held))
+	s.held = nil
+	failingSinks.Add(-1)
+	metrics.set(fmt.Sprintf("sink_failing{sink=%q}", s.name), 0)
+	metrics.set(fmt.Sprintf("sink_held_entries{sink=%q}", s.name), 0)
+}
+
+/*
+s3Sink is the reference Sink: it appends each batch to the current minute's file in directory,
+which periodicallyUploadToS3 uploads to S3 once the file is no longer written to.
+*/
+type s3Sink struct {
+	directory string
+}
+
+func (s *s3Sink) Write(batch []LogEntry) error {
+	currentTime := time.Now()
+
+	// Entries go to the file of the current minute, unless their bucket names another minute
+	currentMinute := formatMinute(currentTime)
+	var minutes []string
+	byMinute := make(map[string][]LogEntry)
+	for _, entry := range batch {
+		minute := currentMinute
+		if entry.Bucket != "" {
+			minute, entry.Bucket = entry.Bucket, ""
+		}
+		if _, ok := byMinute[minute]; !ok {
+			minutes = append(minutes, minute)
+		}
+		byMinute[minute] = append(byMinute[minute], entry)
+	}
+	for _, minute := range minutes {
+		if err := s.appendToFile(filepath.Join(s.directory, minute+".txt"), byMinute[minute]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *s3Sink) appendToFile(fileName string, batch []LogEntry) error {
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening log file %s: %v", fileName, err)
+	}
+	defer f.Close()
+
+	for _, entry := range batch {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("error marshalling log entry: %v", err)
+		}
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("error writing log to file: %v", err)
+		}
+	}
+	return nil
+}
+
+// filteredSink hands the entries of a batch accepted by keep to sink
+type filteredSink struct {
+	sink Sink
+	keep func(entry LogEntry) bool
+}
+
+func (s *filteredSink) Write(batch []LogEntry) error {
+	var kept []LogEntry
+	for _, entry := range batch {
+		if s.keep(entry) {
+			kept = append(kept, entry)
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return s.sink.Write(kept)
+}
+
+// levelSeverities ranks the level names understood by ERROR_STORE_LEVEL, compared case-insensitively
+var levelSeverities = map[string]int{
+	"TRACE": 0, "DEBUG": 1, "INFO": 2, "NOTICE": 3, "WARN": 4, "WARNING": 4,
+	"ERR": 5, "ERROR": 5, "CRIT": 6, "CRITICAL": 6, "FATAL": 6, "ALERT": 7, "EMERG": 8,
+}
+
+// isErrorEntry reports whether entry belongs to the error store, i.e. its level is at or above ERROR_STORE_LEVEL
+func isErrorEntry(entry LogEntry) bool {
+	severity, ok := levelSeverities[strings.ToUpper(entry.Level)]
+	return ok && severity >= levelSeverities[errorStoreLevel]
+}
+
+// stdoutSink echoes every entry as one JSON line, for log collectors reading the output of the process
+type stdoutSink struct {
+	w io.Writer
+}
+
+func (s *stdoutSink) Write(batch []LogEntry) error {
+	// The batch is written at once, so that a retried batch never repeats a partial write
+	var lines bytes.Buffer
+	encoder := json.NewEncoder(&lines)
+	for _, entry := range batch {
+		entry.Bucket = ""
+		if err := encoder.Encode(entry); err != nil {
+			return fmt.Errorf("error marshalling log entry: %v", err)
+		}
+	}
+	if _, err := s.w.Write(lines.Bytes()); err != nil {
+		return fmt.Errorf("error writing to stdout: %v", err)
+	}
+	return nil
+}
+
+/*
+periodicallyCheckMemory reads the heap size every memoryCheckInterval. Above memoryHighWatermark ingestion is shed
+and the oldest half of the in-memory buffer is dropped on every check, those entries remain queryable once uploaded.
+*/
+func periodicallyCheckMemory() {
+	ticker := time.NewTicker(memoryCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		checkMemory()
+	}
+}
+
+func checkMemory() {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	heapAlloc.Store(memStats.HeapAlloc)
+	metrics.set("heap_alloc_bytes", float64(memStats.HeapAlloc))
+
+	pressure := memStats.HeapAlloc > memoryHighWatermark
+	if pressure != memoryPressure.Swap(pressure) {
+		log.Printf("Memory pressure changed to %t, heap is %d bytes", pressure, memStats.HeapAlloc)
+	}
+	if pressure {
+		metrics.set("memory_pressure", 1)
+		bufferMu.Lock()
+		resetBuffer(inMemorySearchBuffer[len(inMemorySearchBuffer)/2:])
+		bufferMu.Unlock()
+	} else {
+		metrics.set("memory_pressure", 0)
+	}
+}
+
+// periodicallyRunCanary runs the canary every CANARY_INTERVAL and reports its outcome in the canary_* metrics
+func periodicallyRunCanary() {
+	for {
+		time.Sleep(canaryInterval)
+		if readOnly.Load() {
+			continue
+		}
+		latency, err := runCanary()
+		if err != nil {
+			metrics.add("canary_failures_total", 1)
+			metrics.set("canary_up", 0)
+			log.Printf("ALERT: canary failed: %v", err)
+			continue
+		}
+		metrics.set("canary_up", 1)
+		metrics.set("canary_round_trip_seconds", latency.Seconds())
+		log.Printf("Canary round trip took %v", latency)
+	}
+}
+
+/*
+runCanary ingests a synthetic entry tagged with CANARY_TAG and waits until it can be read back from S3,
+returning the round-trip latency. It fails when the entry isn't uploaded within CANARY_TIMEOUT, or right away
+when logChannel is full, as a canary waiting for room would hide the ingest outage it is meant to report.
+
+The entry stays queryable like any other, e.g. with field=canary~ or text=CANARY_TAG.
+*/
+func runCanary() (time.Duration, error) {
+	start := time.Now()
+	id := strconv.FormatInt(start.UnixNano(), 10)
+	select {
+	case logChannel <- LogEntry{
+		Timestamp: start.Unix(),
+		Message:   canaryTag + " " + id,
+		Level:     "INFO",
+		Fields:    map[string]string{"canary": id},
+	}:
+	default:
+		return 0, fmt.Errorf("entry %s not ingested, log channel full", id)
+	}
+
+	// Entries are stored in the object of the minute they were flushed in, which may be the next one
+	minute := formatMinute(start)
+	nextMinute := formatMinute(start.Add(time.Minute))
+	for time.Since(start) < canaryTimeout {
+		time.Sleep(canaryPollInterval)
+		for _, m := range []string{minute, nextMinute} {
+			logEntries, _, err := getMinuteEntries(context.Background(), m, nil)
+			if err != nil {
+				continue
+			}
+			for _, entry := range logEntries {
+				if entry.Fields["canary"] == id {
+					return time.Since(start), nil
+				}
+			}
+		}
+	}
+	return 0, fmt.Errorf("entry %s not readable from S3 after %v", id, canaryTimeout)
+}
+
+// periodicallyMeasureLocalDisk keeps localDiskUsage up to date with the size of logsDirectory
+func periodicallyMeasureLocalDisk() {
+	for {
+		usage, err := directorySize(logsDirectory)
+		if err != nil {
+			log.Printf("Error measuring size of %s: %v", logsDirectory, err)
+		} else {
+			localDiskUsage.Store(usage)
+			metrics.set("local_disk_usage_bytes", float64(usage))
+		}
+		measureLocalFilesystem()
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// measureLocalFilesystem keeps the free bytes and inodes of the filesystem of logsDirectory up to date
+func measureLocalFilesystem() {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(logsDirectory, &fs); err != nil {
+		log.Printf("Error measuring free space of %s: %v", logsDirectory, err)
+		return
+	}
+	localDiskFreeBytes.Store(int64(fs.Bavail) * int64(fs.Bsize))
+	localFreeInodes.Store(int64(fs.Ffree))
+	metrics.set("local_disk_free_bytes", float64(localDiskFreeBytes.Load()))
+	metrics.set("local_disk_free_inodes", float64(localFreeInodes.Load()))
+
+	reasons := notReadyReasons()
+	if low := len(reasons) > 0; low != localDiskLow.Swap(low) {
+		if low {
+			log.Printf("ALERT: not ready, %s", strings.Join(reasons, ", "))
+		} else {
+			log.Printf("Ready again, %d bytes and %d inodes free in %s", localDiskFreeBytes.Load(), localFreeInodes.Load(), logsDirectory)
+		}
+	}
+}
+
+// notReadyReasons returns why the instance shouldn't receive traffic, none when it is ready
+func notReadyReasons() []string {
+	var reasons []string
+	if minFreeDiskBytes > 0 && localDiskFreeBytes.Load() < minFreeDiskBytes {
+		reasons = append(reasons, fmt.Sprintf("%d bytes free in %s, below MIN_FREE_DISK_BYTES", localDiskFreeBytes.Load(), logsDirectory))
+	}
+	if minFreeInodes > 0 && localFreeInodes.Load() < minFreeInodes {
+		reasons = append(reasons, fmt.Sprintf("%d inodes free in %s, below MIN_FREE_INODES", localFreeInodes.Load(), logsDirectory))
+	}
+	return reasons
+}
+
+type readiness struct {
+	Ready          bool     `json:"ready"`
+	Reasons        []string `json:"reasons,omitempty"`
+	DiskFreeBytes  int64    `json:"disk_free_bytes"`
+	DiskFreeInodes int64    `json:"disk_free_inodes"`
+}
+
+/*
+Reports whether the instance is ready to receive traffic, for load balancer and orchestrator health checks.
+Answers 503 while the filesystem of the local files has less than MIN_FREE_DISK_BYTES or MIN_FREE_INODES free,
+as writes of the local files fail once either runs out.
+
+GET http://localhost:8080/ready
+
+{"ready":true,"disk_free_bytes":52428800000,"disk_free_inodes":3276800}
+*/
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reasons := notReadyReasons()
+	responseData, err := json.Marshal(readiness{
+		Ready:          len(reasons) == 0,
+		Reasons:        reasons,
+		DiskFreeBytes:  localDiskFreeBytes.Load(),
+		DiskFreeInodes: localFreeInodes.Load(),
+	})
+	if err != nil {
+		http.Error(w, "Error marshalling response data", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(reasons) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.Write(responseData)
+}
+
+func directorySize(directory string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(directory, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+/*
+periodicallyUploadToS3 uploads the local files that are no longer written to, up to UPLOAD_CONCURRENCY at a time.
+
+Uploads run in the background and the directory is rescanned every second, so a huge file only ties up its own
+worker. Pending files are dispatched alternating between the oldest and the newest minute, so that recent minutes
+keep reaching S3 promptly while a backlog drains.
+*/
+func periodicallyUploadToS3() {
+	slots := make(chan struct{}, uploadConcurrency)
 	for {
-		files, err := os.ReadDir(logsDirectory)
+		if readOnly.Load() {
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
+		files, err := listLocalFiles()
 		if err != nil {
 			log.Printf("Error reading directory: %v", err)
+			time.Sleep(1 * time.Second)
 			continue
 		}
 
 		currentTime := time.Now()
 
-		for _, file := range files {
-			fileInfo, err := file.Info()
-			if err != nil {
-				log.Printf("Error reading file info: %v", err)
-				continue
-			}
+		var pending []string
+		uploadStateMu.Lock()
+		for _, file := range files {
+			diff := currentTime.Sub(file.modTime).Seconds()
+
+			// Since we create files per minute, if the file is older than a minute, we can upload it since it will not be used again
+			if diff >= 5 { // allowing for a 5-second delay in file update
+				fileName := file.name
+
+				// Files that are backing off are skipped so that the others keep getting uploaded
+				retry := uploadRetries[fileName]
+				if retry != nil && currentTime.Before(retry.nextAttempt) {
+					continue
+				}
+				if !uploadsInFlight[fileName] {
+					pending = append(pending, fileName)
+				}
+			}
+		}
+
+		// listLocalFiles returns the files sorted by minute
+		dispatchUploads(pending, slots)
+		uploadStateMu.Unlock()
+
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// dispatchUploads starts the uploads of pending, sorted by minute, alternating between the oldest and the newest
+// while slots are free. uploadStateMu must be held
+func dispatchUploads(pending []string, slots chan struct{}) {
+	for i := 0; i < len(pending); i++ {
+		fileName := pending[i/2]
+		if i%2 == 1 {
+			fileName = pending[len(pending)-1-i/2]
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			return
+		}
+		uploadsInFlight[fileName] = true
+		go uploadInBackground(fileName, slots)
+	}
+}
+
+func uploadInBackground(fileName string, slots chan struct{}) {
+	defer func() { <-slots }()
+
+	// Waiting for the budget before the file is read bounds the memory of concurrent uploads
+	var size int64
+	if info, err := os.Stat(fileName); err == nil {
+		size = info.Size()
+	}
+	uploadInflightBytes.acquire(size)
+	defer uploadInflightBytes.release(size)
+
+	uploadMu.RLock()
+	err := uploadToS3WithPrefix(fileName)
+	uploadMu.RUnlock()
+
+	uploadStateMu.Lock()
+	delete(uploadsInFlight, fileName)
+	if err != nil {
+		handleUploadFailure(fileName, err)
+	} else {
+		delete(uploadRetries, fileName)
+	}
+	uploadStateMu.Unlock()
+
+	if err == nil {
+		bufferMu.Lock()
+		resetBuffer(nil)
+		bufferMu.Unlock()
+	}
+}
+
+/*
+byteBudget bounds the bytes held at once by its holders to limit, 0 being unlimited. A single acquisition
+larger than limit is let through once nothing else is held, so that oversized files are still uploaded.
+*/
+type byteBudget struct {
+	limit int64
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	used int64
+}
+
+func (b *byteBudget) acquire(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cond == nil {
+		b.cond = sync.NewCond(&b.mu)
+	}
+	for b.limit > 0 && b.used > 0 && b.used+n > b.limit {
+		b.cond.Wait()
+	}
+	b.used += n
+	metrics.set("upload_inflight_bytes", float64(b.used))
+}
+
+func (b *byteBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	metrics.set("upload_inflight_bytes", float64(b.used))
+	if b.cond != nil {
+		b.cond.Broadcast()
+	}
+}
+
+type localFile struct {
+	name    string
+	modTime time.Time
+}
+
+// listLocalFiles returns the files waiting for upload in logsDirectory and, with the error store, in errorStoreDirectory, sorted by minute
+func listLocalFiles() ([]localFile, error) {
+	directories := []string{logsDirectory}
+	if errorStoreLevel != "" {
+		directories = append(directories, errorStoreDirectory)
+	}
+
+	var files []localFile
+	for _, directory := range directories {
+		entries, err := os.ReadDir(directory)
+		if err != nil {
+			if directory != logsDirectory && os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				log.Printf("Error reading file info: %v", err)
+				continue
+			}
+			files = append(files, localFile{name: filepath.Join(directory, entry.Name()), modTime: info.ModTime()})
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return filepath.Base(files[i].name) < filepath.Base(files[j].name)
+	})
+	return files, nil
+}
+
+/*
+localFileMinute returns the minute label of a local file, prefixed with its directory within logsDirectory:
+logs/2024-03-02-05-07.txt is stored as 2024-03-02-05-07, logs/errors/2024-03-02-05-07.txt as errors/2024-03-02-05-07
+*/
+func localFileMinute(fileName string) string {
+	minute := strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+	if rel, err := filepath.Rel(logsDirectory, filepath.Dir(fileName)); err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+		minute = filepath.ToSlash(rel) + "/" + minute
+	}
+	return minute
+}
+
+/*
+uploadAllLocalFiles uploads every file in logsDirectory right away, regardless of its age.
+Used on shutdown, a minute that is still open is merged with the entries written to it after a restart.
+*/
+func uploadAllLocalFiles() {
+	uploadMu.Lock()
+	defer uploadMu.Unlock()
+
+	files, err := listLocalFiles()
+	if err != nil {
+		log.Printf("Error reading directory: %v", err)
+		return
+	}
+
+	for _, file := range files {
+		fileName := file.name
+		if err := uploadToS3WithPrefix(fileName); err != nil {
+			log.Printf("Error uploading %s on shutdown, it will be uploaded after the next start: %v", fileName, err)
+			continue
+		}
+		uploadStateMu.Lock()
+		delete(uploadRetries, fileName)
+		uploadStateMu.Unlock()
+	}
+}
+
+// uploadNotification is published to NOTIFY_TOPIC_ARN / NOTIFY_QUEUE_URL after every successful upload
+type uploadNotification struct {
+	Key     string `json:"key"`
+	Size    int    `json:"size"`
+	Entries int    `json:"entries"`
+	MinTs   int64  `json:"min_ts"`
+	MaxTs   int64  `json:"max_ts"`
+}
+
+type uploadPublisher interface {
+	Publish(message string) error
+}
+
+type snsPublisher struct {
+	client   *sns.SNS
+	topicArn string
+}
+
+func (p *snsPublisher) Publish(message string) error {
+	_, err := p.client.Publish(&sns.PublishInput{
+		TopicArn: aws.String(p.topicArn),
+		Message:  aws.String(message),
+	})
+	return err
+}
+
+type sqsPublisher struct {
+	client   *sqs.SQS
+	queueURL string
+}
+
+func (p *sqsPublisher) Publish(message string) error {
+	_, err := p.client.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:    aws.String(p.queueURL),
+		MessageBody: aws.String(message),
+	})
+	return err
+}
+
+// notifyUpload publishes notification in the background, a failing publisher is logged and never fails the upload
+func notifyUpload(notification uploadNotification) {
+	if len(uploadPublishers) == 0 {
+		return
+	}
+	message, err := json.Marshal(notification)
+	if err != nil {
+		log.Printf("Error marshalling upload notification: %v", err)
+		return
+	}
+
+	for _, publisher := range uploadPublishers {
+		go func(publisher uploadPublisher) {
+			if err := publisher.Publish(string(message)); err != nil {
+				metrics.add("upload_notification_failures_total", 1)
+				log.Printf("Error publishing upload notification for %s: %v", notification.Key, err)
+				return
+			}
+			metrics.add("upload_notifications_total", 1)
+		}(publisher)
+	}
+}
+
+// handleUploadFailure schedules the next upload attempt of fileName, or dead-letters it once uploadMaxElapsed is exceeded
+func handleUploadFailure(fileName string, err error) {
+	now := time.Now()
+	retry := uploadRetries[fileName]
+	if retry == nil {
+		retry = &uploadRetry{firstFailure: now}
+		uploadRetries[fileName] = retry
+	}
+	retry.attempts++
+
+	if now.Sub(retry.firstFailure) >= uploadMaxElapsed {
+		log.Printf("Giving up on uploading %s after %d attempts: %v", fileName, retry.attempts, err)
+		delete(uploadRetries, fileName)
+		deadLetterFile(fileName)
+		return
+	}
+
+	backoff := uploadRetryBackoff(retry.attempts)
+	retry.nextAttempt = now.Add(backoff)
+	log.Printf("Error uploading %s (attempt %d), retrying in %s: %v", fileName, retry.attempts, backoff, err)
+}
+
+// uploadRetryBackoff returns the jittered exponential delay before the next attempt
+func uploadRetryBackoff(attempts int) time.Duration {
+	backoff := uploadRetryInitialInterval
+	for i := 1; i < attempts && backoff < uploadRetryMaxInterval; i++ {
+		backoff *= 2
+	}
+	if backoff > uploadRetryMaxInterval {
+		backoff = uploadRetryMaxInterval
+	}
+	return backoff - time.Duration(uploadRetryJitter*rand.Float64()*float64(backoff))
+}
+
+// deadLetterFile moves a local log file that could not be uploaded out of logsDirectory
+func deadLetterFile(fileName string) {
+	if err := os.MkdirAll(deadLetterDirectory, 0755); err != nil {
+		log.Printf("Error creating dead letter directory %s: %v", deadLetterDirectory, err)
+		return
+	}
+
+	deadLetterName := filepath.Join(deadLetterDirectory, filepath.FromSlash(localFileMinute(fileName))+filepath.Ext(fileName))
+	if err := os.MkdirAll(filepath.Dir(deadLetterName), 0755); err != nil {
+		log.Printf("Error creating dead letter directory %s: %v", filepath.Dir(deadLetterName), err)
+		return
+	}
+	if err := os.Rename(fileName, deadLetterName); err != nil {
+		log.Printf("Error moving %s to dead letter directory: %v", fileName, err)
+		return
+	}
+	log.Printf("Moved %s to %s", fileName, deadLetterName)
+}
+
+func uploadToS3WithPrefix(fileName string) error {
+	logEntries, partial, err := readLocalFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	minute := localFileMinute(fileName)
+	logEntries = skipPersisted(strings.TrimSuffix(minute, path.Base(minute)), logEntries)
+	if _, err := storeMinute(minute, logEntries, false); err != nil {
+		return err
+	}
+
+	log.Printf("Log entries from file %s uploaded to S3 successfully", fileName)
+	// Files are no longer written to once uploaded, an unterminated last line is what an interrupted write left behind
+	if partial > 0 {
+		log.Printf("Skipped the incomplete last line of %s (%d bytes), the write was interrupted", fileName, partial)
+		metrics.add("upload_partial_line_bytes_total", float64(partial))
+		metrics.add("upload_recovered_entries_total", float64(len(logEntries)))
+	}
+
+	if keepLocal {
+		archiveLocalFile(fileName)
+		return nil
+	}
+	err = os.Remove(fileName)
+	if err != nil {
+		log.Printf("Error deleting local file %s: %v", fileName, err)
+	}
+	return nil
+}
+
+/*
+readLocalFile parses a local file of JSON lines as written by s3Sink, skipping unparsable lines.
+A last line without newline is still being written, or was cut short by a crash. It is skipped without
+being parsed and its length is returned as partial.
+*/
+func readLocalFile(fileName string) (logEntries []LogEntry, partial int, err error) {
+	fileLines, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading file: %v", err)
+	}
+	if end := bytes.LastIndexByte(fileLines, '\n') + 1; end < len(fileLines) {
+		partial = len(fileLines) - end
+		fileLines = fileLines[:end]
+	}
+
+	for _, line := range strings.Split(string(fileLines), "\n") {
+		var entry LogEntry
+		if line == "" {
+			continue
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			log.Printf("Error parsing log entry: %v", err)
+			continue
+		}
+		logEntries = append(logEntries, entry)
+	}
+	return logEntries, partial, nil
+}
+
+/*
+storeMinute merges logEntries into the object (or parts) of minute and returns the number of entries added.
+
+The minute may already have been uploaded (an earlier file of the same minute, or an upload on shutdown).
+With onlyMissing, entries already present in the minute are not added again, as when repairing it from the archive,
+and nothing is written when all of them are present.
+*/
+func storeMinute(minute string, logEntries []LogEntry, onlyMissing bool) (int, error) {
+	if !conditionalWrites {
+		return storeMinuteIfMatch(minute, logEntries, onlyMissing, "")
+	}
+
+	// Another instance sharing the prefix may write the minute between our read and write, the merge is then redone
+	for attempt := 1; ; attempt++ {
+		etag, err := minuteObjectETag(minute)
+		if err != nil {
+			return 0, fmt.Errorf("error reading existing object for merge: %v", err)
+		}
+		added, err := storeMinuteIfMatch(minute, logEntries, onlyMissing, etag)
+		if !errors.Is(err, errWriteConflict) || attempt == conditionalWriteAttempts {
+			return added, err
+		}
+		metrics.add("upload_write_conflicts_total", 1)
+		log.Printf("Minute %s was written concurrently, merging again (attempt %d)", minute, attempt)
+	}
+}
+
+// minuteObjectETag returns the ETag of the object of minute, "*" when there is none
+func minuteObjectETag(minute string) (string, error) {
+	head, err := getS3Client().HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(objectKey(minute)),
+	})
+	if isNoSuchKey(err) {
+		return "*", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(head.ETag), nil
+}
 
-			diff := currentTime.Sub(fileInfo.ModTime()).Seconds()
+/*
+storeMinuteIfMatch is storeMinute, replacing the single object of minute only while its ETag is still etag
+("*" while it doesn't exist), unconditionally when etag is empty. Split minutes and multipart uploads are
+written unconditionally.
+*/
+func storeMinuteIfMatch(minute string, logEntries []LogEntry, onlyMissing bool, etag string) (int, error) {
+	existingEntries, existingParts, err := getMinuteEntries(context.Background(), minute, nil)
+	if err != nil && !isNoSuchKey(err) {
+		return 0, fmt.Errorf("error reading existing object for merge: %v", err)
+	}
+	existed := err == nil
+	if onlyMissing && existed {
+		logEntries = missingEntries(existingEntries, logEntries)
+	}
+	added := len(logEntries)
+	if added == 0 {
+		return 0, nil
+	}
+	if existed {
+		logEntries = append(existingEntries, logEntries...)
+		if flushSort == "timestamp" {
+			sort.SliceStable(logEntries, func(i, j int) bool {
+				return logEntries[i].Timestamp < logEntries[j].Timestamp
+			})
+		}
+	}
 
-			// Since we create files per minute, if the file is older than a minute, we can upload it since it will not be used again
-			if diff >= 5 { // allowing for a 5-second delay in file update
-				uploadToS3WithPrefix(filepath.Join(logsDirectory, file.Name()))
-				inMemorySearchBuffer = nil
+	if maxEntriesPerObject <= 0 || len(logEntries) <= maxEntriesPerObject {
+		if existingParts > 0 {
+			etag = ""
+		}
+		if err := putMinuteObjectIfMatch(minute, logEntries, etag); err != nil {
+			return 0, err
+		}
+		deleteMinuteParts(minute, 1, existingParts)
+	} else {
+		parts := 0
+		for start := 0; start < len(logEntries); start += maxEntriesPerObject {
+			end := start + maxEntriesPerObject
+			if end > len(logEntries) {
+				end = len(logEntries)
+			}
+			parts++
+			if err := putMinuteObject(partMinute(minute, parts), logEntries[start:end]); err != nil {
+				return 0, err
 			}
 		}
-
-		time.Sleep(1 * time.Second)
+		// The parts replace the minute's single object, and any parts of an earlier split beyond the new ones
+		if existed && existingParts == 0 {
+			deleteObject(objectKey(minute))
+		}
+		deleteMinuteParts(minute, parts+1, existingParts)
 	}
+	return added, nil
 }
 
-func uploadToS3WithPrefix(fileName string) {
-	fileLines, err := os.ReadFile(fileName)
-	if err != nil {
-		log.Printf("Error reading file: %v", err)
-		return
+// missingEntries returns the entries of logEntries not in existing, counted per entryDedupKey so that identical entries are only matched once each
+func missingEntries(existing, logEntries []LogEntry) []LogEntry {
+	present := make(map[string]int)
+	for _, entry := range existing {
+		present[entryDedupKey(entry)]++
 	}
-
-	var logEntries []LogEntry
-	for _, line := range strings.Split(string(fileLines), "\n") {
-		var entry LogEntry
-		if line == "" {
+	var missing []LogEntry
+	for _, entry := range logEntries {
+		key := entryDedupKey(entry)
+		if present[key] > 0 {
+			present[key]--
 			continue
 		}
-		if err := json.Unmarshal([]byte(line), &entry); err != nil {
-			log.Printf("Error parsing log entry: %v", err)
-			continue
+		missing = append(missing, entry)
+	}
+	return missing
+}
+
+// archiveLocalFile appends an uploaded local file to the archive file of its minute in KEEP_LOCAL_DIRECTORY (of its store)
+func archiveLocalFile(fileName string) {
+	archiveName := filepath.Join(keepLocalDirectory, filepath.FromSlash(localFileMinute(fileName))+".txt")
+	content, err := os.ReadFile(fileName)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(archiveName), 0755)
+	}
+	if err == nil {
+		var f *os.File
+		f, err = os.OpenFile(archiveName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = f.Write(content)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
 		}
-		logEntries = append(logEntries, entry)
 	}
+	// The file is removed either way, it is uploaded already and would be merged into the minute again
+	if err != nil {
+		log.Printf("Error archiving local file %s: %v", fileName, err)
+	}
+	if err := os.Remove(fileName); err != nil {
+		log.Printf("Error deleting local file %s: %v", fileName, err)
+	}
+}
 
-	jsonData, err := json.Marshal(logEntries)
+// putMinuteObject uploads entries as the object of minute (or of a part) and notifies about it
+func putMinuteObject(minute string, logEntries []LogEntry) error {
+	return putMinuteObjectIfMatch(minute, logEntries, "")
+}
+
+// putMinuteObjectIfMatch is putMinuteObject conditional on etag as in storeMinuteIfMatch, errWriteConflict when it doesn't match
+func putMinuteObjectIfMatch(minute string, logEntries []LogEntry, etag string) error {
+	jsonData, err := encodeObjectEntries(logEntries)
 	if err != nil {
-		log.Printf("Error marshalling log entries: %v", err)
-		return
+		return fmt.Errorf("error marshalling log entries: %v", err)
+	}
+
+	// A .gz suffix stores the object gzip compressed, getS3ObjectByKey decompresses it when reading
+	if strings.HasSuffix(s3KeySuffix, ".gz") {
+		var compressed bytes.Buffer
+		gzipWriter := gzip.NewWriter(&compressed)
+		if _, err := gzipWriter.Write(jsonData); err != nil {
+			return fmt.Errorf("error compressing log entries: %v", err)
+		}
+		if err := gzipWriter.Close(); err != nil {
+			return fmt.Errorf("error compressing log entries: %v", err)
+		}
+		jsonData = compressed.Bytes()
 	}
 
 	client := getS3Client()
 
-	logKey := s3ObjectKeysPrefix + strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
-	_, err = client.PutObject(&s3.PutObjectInput{
+	logKey := objectKey(minute)
+	input := &s3.PutObjectInput{
 		Bucket: aws.String(bucketName),
 		Key:    aws.String(logKey),
 		Body:   bytes.NewReader(jsonData),
+	}
+	if s3ObjectTags != "" {
+		input.Tagging = aws.String(s3ObjectTags)
+	}
+	if len(logEntries) > 0 {
+		input.Metadata = timeBoundsMetadata(logEntries)
+		input.Metadata["Format-Version"] = aws.String(strconv.Itoa(objectFormatVersion))
+	} else {
+		input.Metadata = make(map[string]*string)
+	}
+	input.Metadata["Instance-Id"] = aws.String(instanceID)
+	if len(jsonData) > multipartThreshold {
+		err = multipartUpload(input)
+	} else if etag != "" {
+		req, _ := client.PutObjectRequest(input)
+		if etag == "*" {
+			req.HTTPRequest.Header.Set("If-None-Match", "*")
+		} else {
+			req.HTTPRequest.Header.Set("If-Match", etag)
+		}
+		err = req.Send()
+		var failure awserr.RequestFailure
+		if errors.As(err, &failure) && (failure.StatusCode() == http.StatusPreconditionFailed || failure.StatusCode() == http.StatusConflict) {
+			return fmt.Errorf("error uploading file to S3: %w", errWriteConflict)
+		}
+	} else {
+		_, err = client.PutObject(input)
+	}
+	if err != nil {
+		return fmt.Errorf("error uploading file to S3: %v", err)
+	}
+
+	notification := uploadNotification{Key: logKey, Size: len(jsonData), Entries: len(logEntries)}
+	for i, entry := range logEntries {
+		if i == 0 || entry.Timestamp < notification.MinTs {
+			notification.MinTs = entry.Timestamp
+		}
+		if i == 0 || entry.Timestamp > notification.MaxTs {
+			notification.MaxTs = entry.Timestamp
+		}
+	}
+	notifyUpload(notification)
+	markPendingCompaction(minute, logKey)
+	updateManifest(minute, logKey, &manifestObject{Size: len(jsonData), Entries: len(logEntries), MinTs: notification.MinTs, MaxTs: notification.MaxTs})
+	return nil
+}
+
+// multipartUpload uploads the object of input in MULTIPART_PART_SIZE parts, MULTIPART_CONCURRENCY at a time
+func multipartUpload(input *s3.PutObjectInput) error {
+	uploader := s3manager.NewUploaderWithClient(getS3Client(), func(u *s3manager.Uploader) {
+		u.PartSize = multipartPartSize
+		u.Concurrency = multipartConcurrency
+	})
+	_, err := uploader.Upload(&s3manager.UploadInput{
+		Bucket:   input.Bucket,
+		Key:      input.Key,
+		Body:     input.Body,
+		Tagging:  input.Tagging,
+		Metadata: input.Metadata,
+	})
+	return err
+}
+
+// deleteMinuteParts deletes the parts from..to of a split minute
+func deleteMinuteParts(minute string, from, to int) {
+	for part := from; part <= to; part++ {
+		deleteObject(objectKey(partMinute(minute, part)))
+	}
+}
+
+func deleteObject(key string) error {
+	_, err := getS3Client().DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
 	})
 	if err != nil {
-		log.Printf("Error uploading file to S3: %v", err)
+		log.Printf("Error deleting object %s: %v", key, err)
+		return err
+	}
+	updateManifest(minuteFromKey(key), key, nil)
+	return nil
+}
+
+/*
+dayManifest lists the objects of the main store written on a day, so that /availability and /list?day= read one
+small object instead of listing the prefix. It is stored gzipped at MANIFEST_PREFIX{day}.json.gz and updated with
+every object written or deleted by this instance. A missing manifest is rebuilt from a listing of the day,
+without the entries and time bounds of its objects.
+
+{"day":"2024-03-02","objects":{"logs/2024-03-02-05-07.json":{"size":2048,"entries":12,"min_ts":1709355960,"max_ts":1709356019}}}
+*/
+type dayManifest struct {
+	Day     string                     `json:"day"`
+	Objects map[string]*manifestObject `json:"objects"`
+}
+
+type manifestObject struct {
+	Size    int   `json:"size"`
+	Entries int   `json:"entries,omitempty"`
+	MinTs   int64 `json:"min_ts,omitempty"`
+	MaxTs   int64 `json:"max_ts,omitempty"`
+}
+
+// At most this many manifests are cached, the oldest days are evicted first
+const maxCachedManifests = 7
+
+// dayOfMinute returns the day of a minute, the name of its manifest: 2024-03-02 for 2024-03-02-05-07
+func dayOfMinute(minute string) string {
+	return minute[:len("2006-01-02")]
+}
+
+// updateManifest records object as the object at key of minute in the manifest of its day, a nil object removes it
+func updateManifest(minute, key string, object *manifestObject) {
+	// Only the main store is listed, the minutes of other stores are prefixed with their directory
+	if manifestPrefix == "" || strings.Contains(minute, "/") || len(minute) < len("2006-01-02") {
 		return
 	}
 
-	log.Printf("Log entries from file %s uploaded to S3 successfully", fileName)
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	manifest, err := loadManifest(dayOfMinute(minute))
+	if err != nil {
+		log.Printf("Error loading manifest of %s, %s is not recorded: %v", dayOfMinute(minute), key, err)
+		return
+	}
+	if object == nil {
+		delete(manifest.Objects, key)
+	} else {
+		manifest.Objects[key] = object
+	}
+	// The cached manifest keeps the update when writing fails, and is written again with the next one
+	if err := saveManifest(manifest); err != nil {
+		log.Printf("Error writing manifest of %s: %v", manifest.Day, err)
+	}
+}
 
-	err = os.Remove(fileName)
+// loadManifest returns the manifest of day, rebuilding it when it doesn't exist yet, manifestMu must be held
+func loadManifest(day string) (*dayManifest, error) {
+	if manifest, ok := manifests[day]; ok {
+		return manifest, nil
+	}
+
+	manifest := &dayManifest{Day: day, Objects: make(map[string]*manifestObject)}
+	resp, err := getS3Client().GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(manifestPrefix + day + ".json.gz"),
+	})
+	switch {
+	case err == nil:
+		defer resp.Body.Close()
+		content, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading manifest: %v", err)
+		}
+		if content, err = decompressObjectContent(content); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(content, manifest); err != nil {
+			return nil, fmt.Errorf("error unmarshalling manifest: %v", err)
+		}
+	case isNoSuchKey(err):
+		err := getS3Client().ListObjectsV2Pages(&s3.ListObjectsV2Input{
+			Bucket: aws.String(bucketName),
+			Prefix: aws.String(dayKeyPrefix(s3ObjectKeysPrefix, day)),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				if _, err := parseMinute(minuteFromKey(*obj.Key)); err == nil {
+					manifest.Objects[*obj.Key] = &manifestObject{Size: int(*obj.Size)}
+				}
+			}
+			return !lastPage
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error listing objects to rebuild manifest: %v", err)
+		}
+		if err := saveManifest(manifest); err != nil {
+			return nil, err
+		}
+		log.Printf("Rebuilt manifest of %s, %d objects", day, len(manifest.Objects))
+	default:
+		return nil, fmt.Errorf("error getting manifest: %v", err)
+	}
+
+	if len(manifests) >= maxCachedManifests {
+		oldest := ""
+		for cached := range manifests {
+			if oldest == "" || cached < oldest {
+				oldest = cached
+			}
+		}
+		delete(manifests, oldest)
+	}
+	manifests[day] = manifest
+	return manifest, nil
+}
+
+func saveManifest(manifest *dayManifest) error {
+	data, err := json.Marshal(manifest)
 	if err != nil {
-		log.Printf("Error deleting local file %s: %v", fileName, err)
+		return fmt.Errorf("error marshalling manifest: %v", err)
+	}
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	if _, err := gzipWriter.Write(data); err != nil {
+		return fmt.Errorf("error compressing manifest: %v", err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return fmt.Errorf("error compressing manifest: %v", err)
+	}
+
+	_, err = getS3Client().PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(bucketName),
+		Key:         aws.String(manifestPrefix + manifest.Day + ".json.gz"),
+		Body:        bytes.NewReader(compressed.Bytes()),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("error writing manifest: %v", err)
 	}
+	return nil
+}
+
+// manifestKeys returns the sorted keys of the objects in the manifest of day
+func manifestKeys(day string) ([]string, error) {
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	manifest, err := loadManifest(day)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(manifest.Objects))
+	for key := range manifest.Objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// uploadedMinutesFromManifests is listUploadedMinutes answered from the manifests of the days between first and last
+func uploadedMinutesFromManifests(first, last string) (map[string]bool, error) {
+	uploaded := make(map[string]bool)
+	firstDay, err := parseMinute(first)
+	if err != nil {
+		return nil, err
+	}
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	for day := firstDay; dayOfMinute(formatMinute(day)) <= dayOfMinute(last); day = day.AddDate(0, 0, 1) {
+		manifest, err := loadManifest(dayOfMinute(formatMinute(day)))
+		if err != nil {
+			return nil, err
+		}
+		for key := range manifest.Objects {
+			if minute := minuteFromKey(key); minute >= first && minute <= last {
+				uploaded[minute] = true
+			}
+		}
+	}
+	return uploaded, nil
 }
 
 func init() {
@@ -396,18 +9461,422 @@ func init() {
 	secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
 	region = os.Getenv("AWS_REGION")
 	bucketName = os.Getenv("S3_BUCKET_NAME")
+	apiKey = os.Getenv("API_KEY")
+	concurrencyLimits, err = parseConcurrencyLimits(os.Getenv("MAX_CONCURRENT_REQUESTS"))
+	if err != nil {
+		log.Fatalf("Invalid MAX_CONCURRENT_REQUESTS: %v", err)
+	}
+	scopedKeys, err = parseScopedKeys(strings.Split(os.Getenv("API_KEYS"), ";"))
+	if err != nil {
+		log.Fatalf("Invalid API_KEYS: %v", err)
+	}
+	if keysFile := os.Getenv("API_KEYS_FILE"); keysFile != "" {
+		content, err := os.ReadFile(keysFile)
+		if err != nil {
+			log.Fatalf("Error reading API_KEYS_FILE: %v", err)
+		}
+		fileKeys, err := parseScopedKeys(strings.Split(string(content), "\n"))
+		if err != nil {
+			log.Fatalf("Invalid API_KEYS_FILE %s: %v", keysFile, err)
+		}
+		scopedKeys = append(scopedKeys, fileKeys...)
+	}
+	readOnly.Store(os.Getenv("READ_ONLY") == "true")
+	memoryHighWatermark = uint64(getEnvInt64("MEMORY_HIGH_WATERMARK_BYTES", 0))
+	memoryCheckInterval = getEnvDuration("MEMORY_CHECK_INTERVAL", memoryCheckInterval)
+	if suffix, ok := os.LookupEnv("S3_KEY_SUFFIX"); ok {
+		s3KeySuffix = suffix
+	}
+	s3DayPrefix = os.Getenv("S3_DAY_PREFIX") == "true"
+	for _, prefix := range strings.Split(os.Getenv("S3_READ_PREFIXES"), ",") {
+		prefix = strings.TrimSpace(prefix)
+		if prefix == "" {
+			continue
+		}
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		if prefix != s3ObjectKeysPrefix {
+			s3ReadPrefixes = append(s3ReadPrefixes, prefix)
+		}
+	}
+	s3ObjectTags, err = parseObjectTags(os.Getenv("S3_OBJECT_TAGS"))
+	if err != nil {
+		log.Fatalf("Invalid S3_OBJECT_TAGS: %v", err)
+	}
+
+	if timezone := os.Getenv("KEY_TIMEZONE"); timezone != "" {
+		keyLocation, err = time.LoadLocation(timezone)
+		if err != nil {
+			log.Fatalf("Invalid KEY_TIMEZONE: %v", err)
+		}
+	}
+	exportPrefix = getEnvString("EXPORT_PREFIX", exportPrefix)
+	instanceID = os.Getenv("INSTANCE_ID")
+	if instanceID == "" {
+		instanceID, err = os.Hostname()
+		if err != nil || instanceID == "" {
+			instanceID = fmt.Sprintf("instance-%x", rand.Uint32())
+		}
+	}
+	keepLocal = os.Getenv("KEEP_LOCAL") == "true"
+	responseNewline = os.Getenv("RESPONSE_NEWLINE") == "true"
+	streamThreshold = getEnvInt64("STREAM_THRESHOLD", streamThreshold)
+	queryCompactedHours = os.Getenv("QUERY_COMPACTED_HOURS") == "true"
+	compactionInterval = getEnvDuration("COMPACTION_INTERVAL", compactionInterval)
+	compactAfter = getEnvDuration("COMPACT_AFTER", compactAfter)
+	compactMaxObjects = int(getEnvInt64("COMPACT_MAX_OBJECTS", int64(compactMaxObjects)))
+	queryLocalFallback = os.Getenv("QUERY_LOCAL_FALLBACK") != "false"
+	bufferDisabled = os.Getenv("DISABLE_BUFFER") == "true"
+	s3Breaker.threshold = int(getEnvInt64("S3_BREAKER_THRESHOLD", int64(s3Breaker.threshold)))
+	s3Breaker.cooldown = getEnvDuration("S3_BREAKER_COOLDOWN", s3Breaker.cooldown)
+	keepLocalDirectory = getEnvString("KEEP_LOCAL_DIRECTORY", keepLocalDirectory)
+	auditLogFile = getEnvString("AUDIT_LOG_FILE", auditLogFile)
+	auditPrefix = os.Getenv("AUDIT_PREFIX")
+	manifestPrefix = os.Getenv("MANIFEST_PREFIX")
+	canaryInterval = getEnvDuration("CANARY_INTERVAL", canaryInterval)
+	canaryTag = getEnvString("CANARY_TAG", canaryTag)
+	canaryTimeout = getEnvDuration("CANARY_TIMEOUT", canaryTimeout)
+	backfillStateFile = getEnvString("BACKFILL_STATE_FILE", backfillStateFile)
+	loadTestEnabled = os.Getenv("LOADTEST_ENABLED") == "true"
+	backfillRate = getEnvFloat("BACKFILL_RATE", backfillRate)
+	if backfillRate <= 0 {
+		log.Fatalf("Invalid BACKFILL_RATE %v, expected a positive number of objects per second", backfillRate)
+	}
+	exportTTL = getEnvDuration("EXPORT_TTL", exportTTL)
+	lateGrace = getEnvDuration("LATE_GRACE", lateGrace)
+	defaultQueryLast = getEnvDuration("DEFAULT_QUERY_LAST", defaultQueryLast)
+	defaultQueryText = os.Getenv("DEFAULT_QUERY_TEXT")
+	maxQueryObjects = int(getEnvInt64("MAX_QUERY_OBJECTS", int64(maxQueryObjects)))
+	maxResultEntries = int(getEnvInt64("MAX_RESULT_ENTRIES", int64(maxResultEntries)))
+	sortBufferObjects = int(getEnvInt64("SORT_BUFFER_OBJECTS", int64(sortBufferObjects)))
+	if sortBufferObjects < 1 {
+		sortBufferObjects = 1
+	}
+	maxDistinctGroups = int(getEnvInt64("MAX_DISTINCT_GROUPS", int64(maxDistinctGroups)))
+	maxDecompressedBytes = getEnvInt64("MAX_DECOMPRESSED_BYTES", maxDecompressedBytes)
+	objectFormatVersion = int(getEnvInt64("OBJECT_FORMAT_VERSION", int64(objectFormatVersion)))
+	if objectFormatVersion < 0 || objectFormatVersion > latestObjectFormatVersion {
+		log.Fatalf("Invalid OBJECT_FORMAT_VERSION %d, expected 0 to %d", objectFormatVersion, latestObjectFormatVersion)
+	}
+	multipartThreshold = int(getEnvInt64("MULTIPART_THRESHOLD_BYTES", int64(multipartThreshold)))
+	conditionalWrites = os.Getenv("CONDITIONAL_WRITES") == "true"
+	multipartPartSize = getEnvInt64("MULTIPART_PART_SIZE", multipartPartSize)
+	if multipartPartSize < s3manager.MinUploadPartSize {
+		log.Fatalf("Invalid MULTIPART_PART_SIZE %d, S3 requires at least %d bytes", multipartPartSize, s3manager.MinUploadPartSize)
+	}
+	multipartConcurrency = int(getEnvInt64("MULTIPART_CONCURRENCY", int64(multipartConcurrency)))
+	if multipartConcurrency < 1 {
+		multipartConcurrency = 1
+	}
+	maxEntriesPerObject = int(getEnvInt64("MAX_ENTRIES_PER_OBJECT", int64(maxEntriesPerObject)))
+
+	maxLocalDiskBytes = getEnvInt64("MAX_LOCAL_DISK_BYTES", maxLocalDiskBytes)
+	minFreeDiskBytes = getEnvInt64("MIN_FREE_DISK_BYTES", minFreeDiskBytes)
+	minFreeInodes = getEnvInt64("MIN_FREE_INODES", minFreeInodes)
+	diskFullPolicy = getEnvString("DISK_FULL_POLICY", diskFullPolicy)
+	if diskFullPolicy != "reject" && diskFullPolicy != "drop" {
+		log.Fatalf("Invalid DISK_FULL_POLICY %q, expected reject or drop", diskFullPolicy)
+	}
+
+	uploadRetryInitialInterval = getEnvDuration("UPLOAD_RETRY_INITIAL_INTERVAL", uploadRetryInitialInterval)
+	uploadRetryMaxInterval = getEnvDuration("UPLOAD_RETRY_MAX_INTERVAL", uploadRetryMaxInterval)
+	uploadRetryJitter = getEnvFloat("UPLOAD_RETRY_JITTER", uploadRetryJitter)
+	uploadMaxElapsed = getEnvDuration("UPLOAD_MAX_ELAPSED", uploadMaxElapsed)
+	deadLetterDirectory = getEnvString("DEAD_LETTER_DIRECTORY", deadLetterDirectory)
+	stdoutSinkEnabled = os.Getenv("STDOUT_SINK") == "true"
+	errorStoreLevel = strings.ToUpper(os.Getenv("ERROR_STORE_LEVEL"))
+	if _, ok := levelSeverities[errorStoreLevel]; errorStoreLevel != "" && !ok {
+		log.Fatalf("Invalid ERROR_STORE_LEVEL %q", errorStoreLevel)
+	}
+	errorStoreMode = getEnvString("ERROR_STORE_MODE", errorStoreMode)
+	if errorStoreMode != "copy" && errorStoreMode != "move" {
+		log.Fatalf("Invalid ERROR_STORE_MODE %q, expected copy or move", errorStoreMode)
+	}
+	flushSort = getEnvString("FLUSH_SORT", flushSort)
+	if flushSort != "timestamp" && flushSort != "ingest" && flushSort != "none" {
+		log.Fatalf("Invalid FLUSH_SORT %q, expected timestamp, ingest or none", flushSort)
+	}
+	flushMaxDelay = getEnvDuration("FLUSH_MAX_DELAY", flushMaxDelay)
+	flushMaxEntries = int(getEnvInt64("FLUSH_MAX_ENTRIES", int64(flushMaxEntries)))
+	flushMaxBytes = getEnvInt64("FLUSH_MAX_BYTES", flushMaxBytes)
+	uploadConcurrency = int(getEnvInt64("UPLOAD_CONCURRENCY", int64(uploadConcurrency)))
+	uploadInflightBytes.limit = getEnvInt64("MAX_UPLOAD_INFLIGHT_BYTES", 0)
+	if uploadConcurrency < 1 {
+		uploadConcurrency = 1
+	}
+	backpressureThreshold = getEnvFloat("BACKPRESSURE_THRESHOLD", backpressureThreshold)
+	shutdownTimeout = getEnvDuration("SHUTDOWN_TIMEOUT", shutdownTimeout)
+	sinkRetryAttempts = int(getEnvInt64("SINK_RETRY_ATTEMPTS", int64(sinkRetryAttempts)))
+	sinkRetryInitialInterval = getEnvDuration("SINK_RETRY_INITIAL_INTERVAL", sinkRetryInitialInterval)
+	sinkRetryMaxInterval = getEnvDuration("SINK_RETRY_MAX_INTERVAL", sinkRetryMaxInterval)
+
+	maxIngestBodyBytes = getEnvInt64("MAX_INGEST_BODY_BYTES", maxIngestBodyBytes)
+	maxIngestEntries = int(getEnvInt64("MAX_INGEST_ENTRIES", int64(maxIngestEntries)))
+	ingestRequestTimeout = getEnvDuration("INGEST_REQUEST_TIMEOUT", ingestRequestTimeout)
+	maxClockSkew = getEnvDuration("MAX_CLOCK_SKEW", maxClockSkew)
+	clockSkewPolicy = getEnvString("CLOCK_SKEW_POLICY", clockSkewPolicy)
+	clockDriftWarning = getEnvDuration("CLOCK_DRIFT_WARNING", clockDriftWarning)
+	if clockSkewPolicy != "accept" && clockSkewPolicy != "reject" && clockSkewPolicy != "restamp" {
+		log.Fatalf("Invalid CLOCK_SKEW_POLICY %q, expected accept, reject or restamp", clockSkewPolicy)
+	}
+	embeddedJSONPolicy = getEnvString("EMBEDDED_JSON_POLICY", embeddedJSONPolicy)
+	if embeddedJSONPolicy != "off" && embeddedJSONPolicy != "flag" && embeddedJSONPolicy != "reject" {
+		log.Fatalf("Invalid EMBEDDED_JSON_POLICY %q, expected off, flag or reject", embeddedJSONPolicy)
+	}
+	retention = getEnvDuration("RETENTION", retention)
+	rejectBeyondRetention = os.Getenv("REJECT_BEYOND_RETENTION") != "false"
+	manageLifecycle = os.Getenv("MANAGE_LIFECYCLE") == "true"
+	lifecycleTransitionIADays = getEnvInt64("LIFECYCLE_TRANSITION_IA_DAYS", lifecycleTransitionIADays)
+	if lifecycleTransitionIADays != 0 && lifecycleTransitionIADays < 30 {
+		log.Fatalf("Invalid LIFECYCLE_TRANSITION_IA_DAYS %d, S3 requires at least 30", lifecycleTransitionIADays)
+	}
+	var redactionLines []string
+	if rulesFile := os.Getenv("REDACTION_RULES_FILE"); rulesFile != "" {
+		content, err := os.ReadFile(rulesFile)
+		if err != nil {
+			log.Fatalf("Error reading REDACTION_RULES_FILE: %v", err)
+		}
+		redactionLines = strings.Split(string(content), "\n")
+	}
+	redactionRules, err = parseRedactionRules(os.Getenv("REDACT"), redactionLines)
+	if err != nil {
+		log.Fatalf("Invalid redaction rules: %v", err)
+	}
+	redactionPlaceholder = getEnvString("REDACTION_PLACEHOLDER", redactionPlaceholder)
+	sourceName = os.Getenv("SOURCE_NAME")
+	syslogAddr = os.Getenv("SYSLOG_ADDR")
+	gelfAddr = os.Getenv("GELF_ADDR")
+	forwardAddr = os.Getenv("FORWARD_ADDR")
+	grpcAddr = os.Getenv("GRPC_ADDR")
+	sourceClientIP = os.Getenv("SOURCE_CLIENT_IP") == "true"
+	levelNumericMap, err = parseLevelNumericMap(os.Getenv("LEVEL_NUMERIC_MAP"))
+	if err != nil {
+		log.Fatalf("Invalid LEVEL_NUMERIC_MAP: %v", err)
+	}
+
+	ingestDedup.ttl = getEnvDuration("DEDUP_TTL", 0)
+	ingestDedup.maxKeys = int(getEnvInt64("DEDUP_MAX_KEYS", 100000))
+	ingestDedup.path = os.Getenv("DEDUP_STORE_PATH")
+	dedupEntries = os.Getenv("DEDUP_ENTRIES") == "true"
+	if ingestDedup.enabled() && ingestDedup.path != "" {
+		if err := ingestDedup.load(); err != nil {
+			log.Fatalf("Error loading dedup store %s: %v", ingestDedup.path, err)
+		}
+	}
+
+	tenantQuotas.defaults = tenantLimits{
+		rate:         getEnvFloat("TENANT_RATE_LIMIT", 0),
+		burst:        getEnvFloat("TENANT_RATE_BURST", 0),
+		quotaBytes:   getEnvInt64("TENANT_DAILY_QUOTA_BYTES", 0),
+		quotaEntries: getEnvInt64("TENANT_DAILY_QUOTA_ENTRIES", 0),
+	}
+	if tenantQuotas.defaults.burst < tenantQuotas.defaults.rate {
+		tenantQuotas.defaults.burst = tenantQuotas.defaults.rate
+	}
+	tenantQuotas.overrides, err = parseTenantLimits(os.Getenv("TENANT_LIMITS"), tenantQuotas.defaults)
+	if err != nil {
+		log.Fatalf("Invalid TENANT_LIMITS: %v", err)
+	}
+	tenantQuotaFile = os.Getenv("TENANT_QUOTA_FILE")
+	if tenantQuotaFile != "" {
+		if err := tenantQuotas.load(tenantQuotaFile); err != nil {
+			log.Fatalf("Error loading tenant quotas from %s: %v", tenantQuotaFile, err)
+		}
+	}
+}
+
+func getEnvString(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return d
+}
+
+func getEnvInt64(key string, fallback int64) int64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return i
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return f
 }
 
 func main() {
+	if errorStoreLevel != "" && errorStoreMode == "move" {
+		registerSink("s3", &filteredSink{sink: &s3Sink{directory: logsDirectory}, keep: func(entry LogEntry) bool {
+			return !isErrorEntry(entry)
+		}})
+	} else {
+		registerSink("s3", &s3Sink{directory: logsDirectory})
+	}
+	if errorStoreLevel != "" {
+		if err := os.MkdirAll(errorStoreDirectory, 0755); err != nil {
+			log.Fatalf("Error creating error store directory %s: %v", errorStoreDirectory, err)
+		}
+		registerSink("errors", &filteredSink{sink: &s3Sink{directory: errorStoreDirectory}, keep: isErrorEntry})
+	}
+	if stdoutSinkEnabled {
+		registerSink("stdout", &stdoutSink{w: os.Stdout})
+	}
+	if topicArn := os.Getenv("NOTIFY_TOPIC_ARN"); topicArn != "" {
+		uploadPublishers = append(uploadPublishers, &snsPublisher{client: sns.New(newAWSSession()), topicArn: topicArn})
+	}
+	if queueURL := os.Getenv("NOTIFY_QUEUE_URL"); queueURL != "" {
+		uploadPublishers = append(uploadPublishers, &sqsPublisher{client: sqs.New(newAWSSession()), queueURL: queueURL})
+	}
+
+	if manageLifecycle {
+		if err := ensureLifecycleRule(); err != nil {
+			log.Printf("Error managing the lifecycle rule of %s: %v", s3ObjectKeysPrefix, err)
+		}
+	}
+
 	go periodicallyWriteToStorage()
 	go periodicallyUploadToS3()
+	measureLocalFilesystem()
+	go periodicallyMeasureLocalDisk()
+	if memoryHighWatermark > 0 {
+		go periodicallyCheckMemory()
+	}
+	if tenantQuotaFile != "" {
+		go periodicallySaveTenantQuotas()
+	}
+	if canaryInterval > 0 {
+		go periodicallyRunCanary()
+	}
+	if compactionInterval > 0 {
+		go periodicallyCompact()
+	}
+
+	http.HandleFunc("/ingest", requireScope(scopeWrite, ingestHandler))
+	http.HandleFunc("/v1/logs", requireScope(scopeWrite, otlpLogsHandler))
+	http.HandleFunc("/loki/api/v1/push", requireScope(scopeWrite, lokiPushHandler))
+	for _, path := range []string{"/services/collector", "/services/collector/event", "/services/collector/event/1.0"} {
+		http.HandleFunc(path, requireScope(scopeWrite, hecEventHandler))
+	}
+	http.HandleFunc("/services/collector/health", hecHealthHandler)
+	http.HandleFunc("/services/collector/health/1.0", hecHealthHandler)
+	http.HandleFunc("/query", requireScope(scopeRead, limitConcurrency("query", queryHandler)))
+	http.HandleFunc("/summary", requireScope(scopeRead, limitConcurrency("summary", summaryHandler)))
+	http.HandleFunc("/top", requireScope(scopeRead, limitConcurrency("top", topHandler)))
+	http.HandleFunc("/download", requireScope(scopeRead, limitConcurrency("download", downloadHandler)))
+	http.HandleFunc("/list", requireScope(scopeRead, limitConcurrency("list", listHandler)))
+	http.HandleFunc("/availability", requireScope(scopeRead, limitConcurrency("availability", availabilityHandler)))
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/ready", readyHandler)
+	http.HandleFunc("/flush", flushHandler)
+	http.HandleFunc("/stats", requireScope(scopeRead, statsHandler))
+	http.HandleFunc("/capabilities", capabilitiesHandler)
+	http.HandleFunc("/admin/readonly", readOnlyHandler)
+	http.HandleFunc("/admin/config", configHandler)
+	http.HandleFunc("/admin/backfill", backfillHandler)
+	http.HandleFunc("/admin/repair", repairHandler)
+	http.HandleFunc("/admin/repair-duplicates", repairDuplicatesHandler)
+	http.HandleFunc("/admin/persist-buffer", persistBufferHandler)
+	http.HandleFunc("/admin/evict-buffer", evictBufferHandler)
+	http.HandleFunc("/admin/loadtest", loadTestHandler)
+
+	ingestAccepting.Store(true)
+	if syslogAddr != "" {
+		if err := listenSyslog(syslogAddr); err != nil {
+			log.Fatalf("Error listening for syslog on %s: %v", syslogAddr, err)
+		}
+	}
+	if gelfAddr != "" {
+		if err := listenGELF(gelfAddr); err != nil {
+			log.Fatalf("Error listening for GELF on %s: %v", gelfAddr, err)
+		}
+	}
+	if forwardAddr != "" {
+		if err := listenForward(forwardAddr); err != nil {
+			log.Fatalf("Error listening for the forward protocol on %s: %v", forwardAddr, err)
+		}
+	}
+	if grpcAddr != "" {
+		if err := listenGRPC(grpcAddr); err != nil {
+			log.Fatalf("Error listening for gRPC on %s: %v", grpcAddr, err)
+		}
+	}
+	server := &http.Server{Addr: ":8080"}
+	go func() {
+		if stdoutSinkEnabled {
+			log.Println("Log Ingestion Started on port 8080")
+		} else {
+			fmt.Println("Log Ingestion Started on port 8080")
+		}
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	shutdown(server)
+}
+
+// shutdown stops accepting requests, writes out what is left in logChannel and uploads all local files without waiting for them to age
+func shutdown(server *http.Server) {
+	log.Printf("Shutting down")
 
-	http.HandleFunc("/ingest", ingestHandler)
-	http.HandleFunc("/query", queryHandler)
-	http.HandleFunc("/list", listHandler)
+	// Ingest requests answer 503 from now on, the ones sending already are waited for
+	ingestAccepting.Store(false)
+	ingestSendMu.Lock()
+	defer ingestSendMu.Unlock()
 
-	fmt.Println("Log Ingestion Started on port 8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		log.Fatal(err)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down HTTP server: %v", err)
+	}
+	if grpcServer != nil {
+		if err := grpcServer.Shutdown(ctx); err != nil {
+			log.Printf("Error shutting down gRPC server: %v", err)
+		}
+	}
+
+	close(shutdownStorage)
+	<-storageStopped
+
+	if readOnly.Load() {
+		log.Printf("Read-only mode, leaving local files for upload after the next start")
+	} else {
+		uploadAllLocalFiles()
+	}
+
+	if tenantQuotaFile != "" {
+		if err := tenantQuotas.save(tenantQuotaFile); err != nil {
+			log.Printf("Error saving tenant quotas to %s: %v", tenantQuotaFile, err)
+		}
 	}
+	log.Printf("Shutdown complete")
 }
@@ -0,0 +1,6376 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// fakeS3 is an in-memory S3 bucket serving the path-style requests of the SDK, good enough for the calls main.go makes
+type fakeS3 struct {
+	mu        sync.Mutex
+	objects   map[string]*fakeObject
+	lifecycle []byte
+	uploads   map[string]*fakeObject    // multipart uploads in progress by upload ID
+	parts     map[string]map[int][]byte // their parts by upload ID and part number
+	uploadIDs int
+	requests  map[string]int             // served requests by method, e.g. GET or HEAD
+	gets      map[string]int             // GET requests by object key
+	lists     int                        // served List requests
+	fail      func(r *http.Request) bool // requests for which fail returns true are answered 503
+	stall     func(r *http.Request) bool // requests for which stall returns true hang until the client gives up
+	before    func(r *http.Request)      // called with mu held before a request is served, e.g. to write concurrently
+}
+
+type fakeObject struct {
+	data     []byte
+	header   http.Header // Content-Type, Content-Encoding, Cache-Control and X-Amz-Meta-* as uploaded
+	tagging  string
+	modified time.Time
+}
+
+func (o *fakeObject) etag() string {
+	sum := md5.Sum(o.data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// newFakeS3 points the S3 client at a new fake bucket for the duration of the test
+func newFakeS3(t *testing.T) *fakeS3 {
+	t.Helper()
+	fake := &fakeS3{
+		objects:  make(map[string]*fakeObject),
+		uploads:  make(map[string]*fakeObject),
+		parts:    make(map[string]map[int][]byte),
+		requests: make(map[string]int),
+		gets:     make(map[string]int),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials("test", "test", ""),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	}))
+	override(t, &s3Client, s3.New(sess))
+	override(t, &bucketName, "test-bucket")
+	override(t, &s3Breaker, &circuitBreaker{threshold: 5, cooldown: 30 * time.Second})
+	override(t, &manifests, make(map[string]*dayManifest))
+	override(t, &pendingCompaction, make(map[string]*pendingHour))
+	return fake
+}
+
+// override sets *target to value until the end of the test
+func override[T any](t testing.TB, target *T, value T) {
+	t.Helper()
+	previous := *target
+	*target = value
+	t.Cleanup(func() { *target = previous })
+}
+
+// count returns the number of requests served with method
+func (f *fakeS3) count(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[method]
+}
+
+// fetched returns the number of times the object at key was read
+func (f *fakeS3) fetched(key string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.gets[key]
+}
+
+// listed returns the number of List requests served
+func (f *fakeS3) listed() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lists
+}
+
+// object returns the stored object at key, nil if there is none
+func (f *fakeS3) object(key string) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objects[key]
+}
+
+// put stores data at key as if uploaded by another writer
+func (f *fakeS3) put(key string, data []byte, metadata map[string]string) {
+	header := make(http.Header)
+	for name, value := range metadata {
+		header.Set("X-Amz-Meta-"+name, value)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key] = &fakeObject{data: data, header: header, modified: time.Now()}
+}
+
+// keys returns the sorted keys of the stored objects starting with prefix
+func (f *fakeS3) keys(prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.stall != nil && f.stall(r) {
+		<-r.Context().Done()
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests[r.Method]++
+	if f.before != nil {
+		f.before(r)
+	}
+	if f.fail != nil && f.fail(r) {
+		writeS3Error(w, http.StatusServiceUnavailable, "SlowDown")
+		return
+	}
+
+	// Path-style requests: /bucket or /bucket/key
+	_, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	values := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+
+	switch {
+	case key == "" && values.Has("lifecycle"):
+		f.serveLifecycle(w, r, body)
+	case key == "":
+		f.lists++
+		f.serveList(w, values)
+	case values.Has("uploads") || values.Has("uploadId"):
+		f.serveMultipart(w, r, key, body)
+	case r.Method == "GET" || r.Method == "HEAD":
+		object, ok := f.objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		for name, value := range object.header {
+			w.Header()[name] = value
+		}
+		w.Header().Set("ETag", object.etag())
+		w.Header().Set("Last-Modified", object.modified.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+		if object.tagging != "" {
+			tags, _ := url.ParseQuery(object.tagging)
+			w.Header().Set("X-Amz-Tagging-Count", strconv.Itoa(len(tags)))
+		}
+		w.WriteHeader(http.StatusOK)
+		if r.Method == "GET" {
+			f.gets[key]++
+			w.Write(object.data)
+		}
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+		f.serveCopy(w, r, key)
+	case r.Method == "PUT":
+		existing, exists := f.objects[key]
+		if match := r.Header.Get("If-None-Match"); match == "*" && exists {
+			writeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if match := r.Header.Get("If-Match"); match != "" && (!exists || existing.etag() != match) {
+			writeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		object := &fakeObject{data: body, header: storedHeader(r.Header), tagging: r.Header.Get("X-Amz-Tagging"), modified: time.Now()}
+		f.objects[key] = object
+		w.Header().Set("ETag", object.etag())
+		w.WriteHeader(http.StatusOK)
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// storedHeader returns the headers of an upload kept with the object
+func storedHeader(request http.Header) http.Header {
+	header := make(http.Header)
+	for name, value := range request {
+		if strings.HasPrefix(name, "X-Amz-Meta-") || name == "Content-Type" || name == "Content-Encoding" || name == "Cache-Control" {
+			header[name] = value
+		}
+	}
+	return header
+}
+
+func (f *fakeS3) serveCopy(w http.ResponseWriter, r *http.Request, key string) {
+	source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	_, sourceKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	original, ok := f.objects[sourceKey]
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	copied := &fakeObject{data: original.data, header: original.header, tagging: original.tagging, modified: time.Now()}
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		copied.header = storedHeader(r.Header)
+	}
+	if r.Header.Get("X-Amz-Tagging-Directive") == "REPLACE" {
+		copied.tagging = r.Header.Get("X-Amz-Tagging")
+	}
+	f.objects[key] = copied
+	fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag><LastModified>%s</LastModified></CopyObjectResult>",
+		copied.etag(), copied.modified.UTC().Format(time.RFC3339))
+}
+
+func (f *fakeS3) serveMultipart(w http.ResponseWriter, r *http.Request, key string, body []byte) {
+	values := r.URL.Query()
+	uploadID := values.Get("uploadId")
+	switch {
+	case r.Method == "POST" && values.Has("uploads"):
+		f.uploadIDs++
+		uploadID = strconv.Itoa(f.uploadIDs)
+		f.uploads[uploadID] = &fakeObject{header: storedHeader(r.Header), tagging: r.Header.Get("X-Amz-Tagging")}
+		f.parts[uploadID] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>",
+			bucketName, key, uploadID)
+	case r.Method == "PUT":
+		number, _ := strconv.Atoi(values.Get("partNumber"))
+		f.parts[uploadID][number] = body
+		sum := md5.Sum(body)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == "POST":
+		object := f.uploads[uploadID]
+		numbers := make([]int, 0, len(f.parts[uploadID]))
+		for number := range f.parts[uploadID] {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		for _, number := range numbers {
+			object.data = append(object.data, f.parts[uploadID][number]...)
+		}
+		object.modified = time.Now()
+		f.objects[key] = object
+		delete(f.uploads, uploadID)
+		delete(f.parts, uploadID)
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>",
+			bucketName, key, object.etag())
+	case r.Method == "DELETE":
+		delete(f.uploads, uploadID)
+		delete(f.parts, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeS3) serveLifecycle(w http.ResponseWriter, r *http.Request, body []byte) {
+	switch r.Method {
+	case "PUT":
+		f.lifecycle = body
+		w.WriteHeader(http.StatusOK)
+	case "GET":
+		if f.lifecycle == nil {
+			writeS3Error(w, http.StatusNotFound, "NoSuchLifecycleConfiguration")
+			return
+		}
+		w.Write(f.lifecycle)
+	}
+}
+
+// fakeListMaxKeys is the page size of listings, small so that tests exercise pagination
+const fakeListMaxKeys = 50
+
+func (f *fakeS3) serveList(w http.ResponseWriter, values url.Values) {
+	prefix := values.Get("prefix")
+	after := values.Get("start-after")
+	if token := values.Get("continuation-token"); token != "" {
+		after = token
+	}
+	if marker := values.Get("marker"); marker != "" {
+		after = marker
+	}
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	truncated := len(keys) > fakeListMaxKeys
+	if truncated {
+		keys = keys[:fakeListMaxKeys]
+	}
+
+	var out bytes.Buffer
+	out.WriteString(`<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">`)
+	fmt.Fprintf(&out, "<Name>%s</Name><Prefix>%s</Prefix><KeyCount>%d</KeyCount><MaxKeys>%d</MaxKeys><IsTruncated>%t</IsTruncated>",
+		bucketName, escapeXML(prefix), len(keys), fakeListMaxKeys, truncated)
+	if truncated {
+		last := escapeXML(keys[len(keys)-1])
+		fmt.Fprintf(&out, "<NextContinuationToken>%s</NextContinuationToken><NextMarker>%s</NextMarker>", last, last)
+	}
+	for _, key := range keys {
+		object := f.objects[key]
+		fmt.Fprintf(&out, "<Contents><Key>%s</Key><LastModified>%s</LastModified><ETag>%s</ETag><Size>%d</Size><StorageClass>STANDARD</StorageClass></Contents>",
+			escapeXML(key), object.modified.UTC().Format(time.RFC3339), escapeXML(object.etag()), len(object.data))
+	}
+	out.WriteString("</ListBucketResult>")
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(out.Bytes())
+}
+
+func escapeXML(s string) string {
+	var out bytes.Buffer
+	xml.EscapeText(&out, []byte(s))
+	return out.String()
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// useTempDirectories points the local directories and state files at a temporary directory for the duration of the test
+func useTempDirectories(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	override(t, &logsDirectory, filepath.Join(dir, "logs"))
+	override(t, &errorStoreDirectory, filepath.Join(dir, "logs", "errors"))
+	override(t, &deadLetterDirectory, filepath.Join(dir, "dead_letter"))
+	override(t, &keepLocalDirectory, filepath.Join(dir, "archive"))
+	override(t, &auditLogFile, filepath.Join(dir, "audit.log"))
+	override(t, &backfillStateFile, filepath.Join(dir, "backfill_state.json"))
+	if err := os.MkdirAll(logsDirectory, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// writeLocalFile writes entries to the local file of minute as s3Sink does, returning its name
+func writeLocalFile(t *testing.T, minute string, entries ...LogEntry) string {
+	t.Helper()
+	fileName := filepath.Join(logsDirectory, minute+".txt")
+	if err := (&s3Sink{directory: logsDirectory}).appendToFile(fileName, entries); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+// acceptIngest lets ingestHandler accept requests, as main does once started, and empties logChannel after the test
+func acceptIngest(t *testing.T) {
+	t.Helper()
+	ingestAccepting.Store(true)
+	t.Cleanup(func() {
+		ingestAccepting.Store(false)
+		drainTestChannel()
+	})
+}
+
+// drainTestChannel returns the entries sent to logChannel so far
+func drainTestChannel() []LogEntry {
+	var entries []LogEntry
+	for {
+		select {
+		case entry := <-logChannel:
+			entries = append(entries, entry)
+		default:
+			return entries
+		}
+	}
+}
+
+// postIngest sends body to ingestHandler with the given headers, e.g. X-Tenant-ID
+func postIngest(t *testing.T, target, body string, headers ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	request := httptest.NewRequest("POST", target, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		request.Header.Set(headers[i], headers[i+1])
+	}
+	recorder := httptest.NewRecorder()
+	ingestHandler(recorder, request)
+	return recorder
+}
+
+// storeTestMinute uploads entries as the object of minute like the upload loop does
+func storeTestMinute(t *testing.T, minute string, entries ...LogEntry) {
+	t.Helper()
+	if err := putMinuteObject(minute, entries); err != nil {
+		t.Fatalf("uploading minute %s: %v", minute, err)
+	}
+}
+
+// serveQuery runs queryHandler for the query string and returns the response
+func serveQuery(t *testing.T, query string) *httptest.ResponseRecorder {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	queryHandler(recorder, httptest.NewRequest("GET", "/query?"+query, nil))
+	return recorder
+}
+
+// decodeEntries unmarshals the JSON array of entries of a response
+func decodeEntries(t *testing.T, recorder *httptest.ResponseRecorder) []LogEntry {
+	t.Helper()
+	var entries []LogEntry
+	if err := json.Unmarshal(recorder.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("decoding response %q: %v", recorder.Body.String(), err)
+	}
+	return entries
+}
+
+// minuteAt returns the minute label and start of the minute offset minutes after the fixed time of the tests
+func minuteAt(offset int) (string, int64) {
+	start := time.Date(2024, 3, 2, 5, 0, 0, 0, time.Local).Add(time.Duration(offset) * time.Minute)
+	return formatMinute(start), start.Unix()
+}
+
+// useTestBuffer replaces the in-memory buffer with entries for the duration of the test
+func useTestBuffer(t testing.TB, entries ...LogEntry) {
+	t.Helper()
+	override(t, &inMemorySearchBuffer, nil)
+	override(t, &bufferIndex, make(map[int64][]LogEntry))
+	for _, entry := range entries {
+		appendToBuffer(entry)
+	}
+}
+
+func TestQueryPickFirstAndLast(t *testing.T) {
+	newFakeS3(t)
+	useTestBuffer(t)
+	m0, t0 := minuteAt(0)
+	m1, t1 := minuteAt(1)
+	m2, t2 := minuteAt(2)
+	m3, t3 := minuteAt(3)
+	_, t4 := minuteAt(4)
+
+	// Late entries are stored in the objects of later (or earlier) minutes than their own
+	storeTestMinute(t, m0, LogEntry{Timestamp: t0 + 10, Message: "boot ok"}, LogEntry{Timestamp: t0 + 20, Message: "request served"})
+	storeTestMinute(t, m1, LogEntry{Timestamp: t1 + 5, Message: "request served"}, LogEntry{Timestamp: t3 + 55, Message: "request served late"})
+	storeTestMinute(t, m2, LogEntry{Timestamp: t2 + 30, Message: "request served"}, LogEntry{Timestamp: t0 + 1, Message: "request served early"})
+	storeTestMinute(t, m3, LogEntry{Timestamp: t3 + 50, Message: "request served"})
+
+	for _, test := range []struct {
+		pick string
+		want LogEntry
+	}{
+		{"first", LogEntry{Timestamp: t0 + 1, Message: "request served early"}},
+		{"last", LogEntry{Timestamp: t3 + 55, Message: "request served late"}},
+	} {
+		recorder := serveQuery(t, fmt.Sprintf("start=%d&end=%d&text=request&pick=%s", t0, t4+59, test.pick))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("pick=%s: status %d: %s", test.pick, recorder.Code, recorder.Body.String())
+		}
+		entries := decodeEntries(t, recorder)
+		if len(entries) != 1 || entries[0].Timestamp != test.want.Timestamp || entries[0].Message != test.want.Message {
+			t.Errorf("pick=%s returned %+v, want only %+v", test.pick, entries, test.want)
+		}
+	}
+}
+
+func TestQueryPickSkipsObjectsOutsideCandidate(t *testing.T) {
+	fake := newFakeS3(t)
+	useTestBuffer(t)
+	m0, t0 := minuteAt(0)
+	m1, t1 := minuteAt(1)
+	storeTestMinute(t, m0, LogEntry{Timestamp: t0 + 10, Message: "first"})
+	storeTestMinute(t, m1, LogEntry{Timestamp: t1 + 10, Message: "second"})
+
+	recorder := serveQuery(t, fmt.Sprintf("start=%d&end=%d&pick=first", t0, t1+59))
+	if entries := decodeEntries(t, recorder); len(entries) != 1 || entries[0].Message != "first" {
+		t.Fatalf("pick=first returned %+v", entries)
+	}
+	// The time bounds of the second object can't beat the candidate of the first, so it is never read
+	if n := fake.fetched(objectKey(m1)); n != 0 {
+		t.Errorf("object of %s read %d times, want 0", m1, n)
+	}
+}
+
+func TestUploadDeadLettersFileAfterMaxElapsed(t *testing.T) {
+	fake := newFakeS3(t)
+	useTempDirectories(t)
+	override(t, &uploadRetries, make(map[string]*uploadRetry))
+	override(t, &uploadsInFlight, make(map[string]bool))
+	override(t, &uploadRetryInitialInterval, 10*time.Millisecond)
+	override(t, &uploadRetryMaxInterval, 40*time.Millisecond)
+	override(t, &uploadMaxElapsed, 100*time.Millisecond)
+	fake.fail = func(r *http.Request) bool { return true }
+
+	minute, ts := minuteAt(0)
+	fileName := writeLocalFile(t, minute, LogEntry{Timestamp: ts, Message: "never uploaded"})
+	slots := make(chan struct{}, 1)
+	upload := func() {
+		slots <- struct{}{}
+		uploadInBackground(fileName, slots)
+	}
+
+	upload()
+	retry := uploadRetries[fileName]
+	if retry == nil || retry.attempts != 1 {
+		t.Fatalf("after the first failure the retry is %+v, want 1 attempt", retry)
+	}
+	// The jittered backoff is at most the initial interval and at least (1 - UPLOAD_RETRY_JITTER) of it
+	if backoff := retry.nextAttempt.Sub(retry.firstFailure); backoff > uploadRetryInitialInterval || backoff < uploadRetryInitialInterval/2 {
+		t.Errorf("first backoff %s, want between %s and %s", backoff, uploadRetryInitialInterval/2, uploadRetryInitialInterval)
+	}
+	if _, err := os.Stat(fileName); err != nil {
+		t.Fatalf("file is gone before the elapsed budget: %v", err)
+	}
+
+	time.Sleep(uploadMaxElapsed)
+	upload()
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		t.Errorf("file still in %s after the elapsed budget: %v", logsDirectory, err)
+	}
+	if _, err := os.Stat(filepath.Join(deadLetterDirectory, minute+".txt")); err != nil {
+		t.Errorf("file not dead-lettered: %v", err)
+	}
+	if _, ok := uploadRetries[fileName]; ok {
+		t.Errorf("retry state kept for the dead-lettered file")
+	}
+}
+
+func TestSummaryOverKnownDataset(t *testing.T) {
+	newFakeS3(t)
+	m0, t0 := minuteAt(0)
+	m1, t1 := minuteAt(1)
+	storeTestMinute(t, m0,
+		LogEntry{Timestamp: t0 + 5, Message: "GET /health 200"},
+		LogEntry{Timestamp: t0 + 7, Message: "GET /orders 500"},
+		LogEntry{Timestamp: t0 + 9, Message: "cache warmed"})
+	storeTestMinute(t, m1, LogEntry{Timestamp: t1 + 30, Message: "GET /health 200"})
+	// Entries not uploaded yet are summarized from the buffer
+	useTestBuffer(t, LogEntry{Timestamp: t1 + 45, Message: "GET /orders 200"})
+
+	recorder := httptest.NewRecorder()
+	summaryHandler(recorder, httptest.NewRequest("GET", fmt.Sprintf("/summary?start=%d&end=%d&text=GET", t0, t1+59), nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var summary querySummary
+	if err := json.Unmarshal(recorder.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	want := querySummary{
+		Count:     4,
+		Unique:    3,
+		MinTs:     t0 + 5,
+		MaxTs:     t1 + 45,
+		FirstSeen: time.Unix(t0+5, 0).UTC().Format(time.RFC3339),
+		LastSeen:  time.Unix(t1+45, 0).UTC().Format(time.RFC3339),
+	}
+	if summary != want {
+		t.Errorf("summary %+v, want %+v", summary, want)
+	}
+}
+
+func TestSummaryWithoutMatches(t *testing.T) {
+	newFakeS3(t)
+	useTestBuffer(t)
+	_, t0 := minuteAt(0)
+
+	recorder := httptest.NewRecorder()
+	summaryHandler(recorder, httptest.NewRequest("GET", fmt.Sprintf("/summary?start=%d&end=%d", t0, t0+59), nil))
+	if body := strings.TrimSpace(recorder.Body.String()); body != `{"count":0,"unique":0}` {
+		t.Errorf("summary of an empty range is %s", body)
+	}
+}
+
+// bzip2Object is the bzip2 compressed minute object [{"time":1709355605,"log":"from bzip2"}], the standard library can't write bzip2
+const bzip2Object = "QlpoOTFBWSZTWYXL714AAAqbgFAEe7AAChOm1BogADFGhoAAACk2oyYm1PU9IM2qdr0cWpxY4/IaSchI5Qq64YEWWEBsBD8XckU4UJCFy+9e"
+
+func TestQueryReadsCompressedObjects(t *testing.T) {
+	fake := newFakeS3(t)
+	useTestBuffer(t)
+	ts := int64(1709355605)
+	minute := formatMinute(time.Unix(ts, 0))
+
+	var gzipped bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipped)
+	gzipWriter.Write([]byte(fmt.Sprintf(`[{"time":%d,"log":"from gzip"}]`, ts)))
+	gzipWriter.Close()
+	bzipped, err := base64.StdEncoding.DecodeString(bzip2Object)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		content []byte
+		want    string
+	}{
+		{"plain", []byte(fmt.Sprintf(`[{"time":%d,"log":"from plain JSON"}]`, ts)), "from plain JSON"},
+		{"gzip", gzipped.Bytes(), "from gzip"},
+		{"bzip2", bzipped, "from bzip2"},
+	} {
+		// Whatever the key suffix, the content is sniffed
+		fake.put(objectKey(minute), test.content, nil)
+		entries := decodeEntries(t, serveQuery(t, fmt.Sprintf("start=%d&end=%d", ts, ts)))
+		if len(entries) != 1 || entries[0].Message != test.want {
+			t.Errorf("%s object queried as %+v, want %q", test.name, entries, test.want)
+		}
+	}
+}
+
+func TestQueryGzipRoundTripThroughUpload(t *testing.T) {
+	fake := newFakeS3(t)
+	useTestBuffer(t)
+	override(t, &s3KeySuffix, ".json.gz")
+	minute, ts := minuteAt(0)
+	storeTestMinute(t, minute, LogEntry{Timestamp: ts + 1, Message: "stored compressed"})
+
+	if content := fake.object(objectKey(minute)).data; !bytes.HasPrefix(content, []byte{0x1f, 0x8b}) {
+		t.Fatalf("object isn't gzip compressed: %q", content)
+	}
+	entries := decodeEntries(t, serveQuery(t, fmt.Sprintf("start=%d&end=%d", ts, ts+59)))
+	if len(entries) != 1 || entries[0].Message != "stored compressed" {
+		t.Errorf("query returned %+v", entries)
+	}
+}
+
+func TestQueryRejectsObjectsBeyondMaxDecompressedBytes(t *testing.T) {
+	fake := newFakeS3(t)
+	useTestBuffer(t)
+	override(t, &maxDecompressedBytes, 1024)
+	minute, ts := minuteAt(0)
+
+	// A few hundred bytes inflating to 64 KiB
+	var gzipped bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipped)
+	gzipWriter.Write([]byte(fmt.Sprintf(`[{"time":%d,"log":"%s"}]`, ts, strings.Repeat("a", 64*1024))))
+	gzipWriter.Close()
+	fake.put(objectKey(minute), gzipped.Bytes(), nil)
+
+	if _, err := decompressObjectContent(gzipped.Bytes()); err == nil {
+		t.Fatal("decompressing beyond MAX_DECOMPRESSED_BYTES succeeded")
+	}
+	recorder := serveQuery(t, fmt.Sprintf("start=%d&end=%d", ts, ts+59))
+	if got := recorder.Header().Get("X-Query-Unreadable"); got != minute {
+		t.Errorf("X-Query-Unreadable is %q, want %q", got, minute)
+	}
+}
+
+func TestTenantRateLimit(t *testing.T) {
+	acceptIngest(t)
+	override(t, &tenantQuotas, &tenantQuotaTracker{
+		overrides: map[string]tenantLimits{"acme": {rate: 0.001, burst: 2}},
+		usage:     make(map[string]*tenantUsage),
+	})
+	body := `[{"time":1709355605,"log":"hello"}]`
+
+	for i, want := range []int{http.StatusCreated, http.StatusCreated, http.StatusTooManyRequests} {
+		recorder := postIngest(t, "/ingest", body, "X-Tenant-ID", "acme")
+		if recorder.Code != want {
+			t.Errorf("request %d of acme answered %d, want %d", i+1, recorder.Code, want)
+		}
+		if want == http.StatusTooManyRequests && recorder.Header().Get("Retry-After") == "" {
+			t.Errorf("rate limited response without Retry-After")
+		}
+	}
+	// Other tenants have their own bucket, without a default rate they aren't limited
+	for i := 0; i < 5; i++ {
+		if recorder := postIngest(t, "/ingest", body, "X-Tenant-ID", "globex"); recorder.Code != http.StatusCreated {
+			t.Fatalf("request %d of globex answered %d", i+1, recorder.Code)
+		}
+	}
+	if n := len(drainTestChannel()); n != 7 {
+		t.Errorf("%d entries sent to logChannel, want 7", n)
+	}
+}
+
+func TestTenantDailyQuota(t *testing.T) {
+	acceptIngest(t)
+	override(t, &tenantQuotas, &tenantQuotaTracker{
+		overrides: map[string]tenantLimits{"acme": {quotaEntries: 3}},
+		usage:     make(map[string]*tenantUsage),
+	})
+	twoEntries := `[{"time":1709355605,"log":"one"},{"time":1709355606,"log":"two"}]`
+
+	recorder := postIngest(t, "/ingest", twoEntries, "X-Tenant-ID", "acme")
+	if recorder.Code != http.StatusCreated || recorder.Header().Get("X-Quota-Remaining-Entries") != "1" {
+		t.Fatalf("first request answered %d with %q entries remaining", recorder.Code, recorder.Header().Get("X-Quota-Remaining-Entries"))
+	}
+	// The second batch doesn't fit into the remaining quota and is rejected as a whole
+	recorder = postIngest(t, "/ingest", twoEntries, "X-Tenant-ID", "acme")
+	if recorder.Code != http.StatusForbidden || recorder.Header().Get("X-Quota-Remaining-Entries") != "1" {
+		t.Errorf("second request answered %d with %q entries remaining", recorder.Code, recorder.Header().Get("X-Quota-Remaining-Entries"))
+	}
+	if recorder := postIngest(t, "/ingest", twoEntries, "X-Tenant-ID", "globex"); recorder.Code != http.StatusCreated {
+		t.Errorf("tenant without quota answered %d", recorder.Code)
+	}
+	if n := len(drainTestChannel()); n != 4 {
+		t.Errorf("%d entries sent to logChannel, want 4", n)
+	}
+}
+
+func TestQueryExportToS3(t *testing.T) {
+	fake := newFakeS3(t)
+	useTestBuffer(t)
+	override(t, &apiKey, "secret")
+	override(t, &exportLifecycleReady, false)
+	m0, t0 := minuteAt(0)
+	m1, t1 := minuteAt(1)
+	storeTestMinute(t, m0, LogEntry{Timestamp: t0 + 1, Message: "export me"}, LogEntry{Timestamp: t0 + 2, Message: "skip me"})
+	storeTestMinute(t, m1, LogEntry{Timestamp: t1 + 1, Message: "export me too"})
+
+	target := fmt.Sprintf("/query?start=%d&end=%d&text=export&output=s3", t0, t1+59)
+	recorder := httptest.NewRecorder()
+	queryHandler(recorder, httptest.NewRequest("GET", target, nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("export without a key answered %d", recorder.Code)
+	}
+
+	request := httptest.NewRequest("GET", target, nil)
+	request.Header.Set("X-API-Key", "secret")
+	recorder = httptest.NewRecorder()
+	queryHandler(recorder, request)
+	var export struct {
+		Key string `json:"key"`
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &export); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("export answered %d %q", recorder.Code, recorder.Body.String())
+	}
+	if !strings.HasPrefix(export.Key, exportPrefix) || !strings.Contains(export.URL, "X-Amz-Signature=") {
+		t.Errorf("export %+v isn't a pre-signed URL to an object under %s", export, exportPrefix)
+	}
+	// By default exports are kept apart from the minute objects and their lifecycle rule
+	if strings.HasPrefix(export.Key, s3ObjectKeysPrefix) {
+		t.Errorf("export %s is stored under the object prefix %s", export.Key, s3ObjectKeysPrefix)
+	}
+
+	object := fake.object(export.Key)
+	if object == nil {
+		t.Fatalf("export object %s not written", export.Key)
+	}
+	var entries []LogEntry
+	if err := json.Unmarshal(object.data, &entries); err != nil {
+		t.Fatalf("export object %q: %v", object.data, err)
+	}
+	if len(entries) != 2 || entries[0].Message != "export me" || entries[1].Message != "export me too" {
+		t.Errorf("export object holds %+v", entries)
+	}
+}
+
+func TestQueryExportStopsFetchingOnceUploadFails(t *testing.T) {
+	fake := newFakeS3(t)
+	useTestBuffer(t)
+	override(t, &apiKey, "secret")
+	override(t, &exportLifecycleReady, true)
+	// 20 minutes of about 1 MiB each, the upload fails once its first 5 MiB part is read
+	message := strings.Repeat("x", 16<<10)
+	var keys []string
+	for offset := 0; offset < 20; offset++ {
+		minute, t0 := minuteAt(offset)
+		entries := make([]LogEntry, 64)
+		for i := range entries {
+			entries[i] = LogEntry{Timestamp: t0 + int64(i%60), Message: message}
+		}
+		storeTestMinute(t, minute, entries...)
+		keys = append(keys, objectKey(minute))
+	}
+	fake.fail = func(r *http.Request) bool {
+		return strings.Contains(r.URL.Path, "/"+exportPrefix)
+	}
+	fetches := func() int {
+		total := 0
+		for _, key := range keys {
+			total += fake.fetched(key)
+		}
+		return total
+	}
+
+	_, t0 := minuteAt(0)
+	request := httptest.NewRequest("GET", fmt.Sprintf("/query?start=%d&end=%d&output=s3", t0, t0+20*60-1), nil)
+	request.Header.Set("X-API-Key", "secret")
+	recorder := httptest.NewRecorder()
+	queryHandler(recorder, request)
+	if recorder.Code != http.StatusInternalServerError {
+		t.Fatalf("failed export answered %d %q", recorder.Code, recorder.Body.String())
+	}
+	if n := fetches(); n >= len(keys) {
+		t.Errorf("all %d minutes fetched after the upload failed", n)
+	}
+}
+
+func TestQueryExportPutsLifecycleRule(t *testing.T) {
+	newFakeS3(t)
+	useTestBuffer(t)
+	override(t, &apiKey, "secret")
+	override(t, &exportLifecycleReady, false)
+	override(t, &exportTTL, 36*time.Hour)
+
+	// Rules of other prefixes are kept
+	_, err := s3Client.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+		Bucket: aws.String(bucketName),
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: []*s3.LifecycleRule{{
+			ID:         aws.String("other"),
+			Status:     aws.String(s3.ExpirationStatusEnabled),
+			Filter:     &s3.LifecycleRuleFilter{Prefix: aws.String("other/")},
+			Expiration: &s3.LifecycleExpiration{Days: aws.Int64(90)},
+		}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, t0 := minuteAt(0)
+	for i := 0; i < 2; i++ {
+		request := httptest.NewRequest("GET", fmt.Sprintf("/query?start=%d&end=%d&output=s3", t0, t0+59), nil)
+		request.Header.Set("X-API-Key", "secret")
+		recorder := httptest.NewRecorder()
+		queryHandler(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("export answered %d %q", recorder.Code, recorder.Body.String())
+		}
+	}
+
+	lifecycle, err := s3Client.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(bucketName)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expirations := make(map[string]int64)
+	for _, rule := range lifecycle.Rules {
+		expirations[aws.StringValue(rule.Filter.Prefix)] = aws.Int64Value(rule.Expiration.Days)
+	}
+	// 36h are rounded up to 2 days
+	if len(lifecycle.Rules) != 2 || expirations[exportPrefix] != 2 || expirations["other/"] != 90 {
+		t.Errorf("lifecycle rules expire after %v days, want 2 for %s and 90 for other/", expirations, exportPrefix)
+	}
+}
+
+func TestRepairDuplicatesMergesMinutesAcrossPrefixes(t *testing.T) {
+	fake := newFakeS3(t)
+	useTempDirectories(t)
+	useTestBuffer(t)
+	override(t, &apiKey, "secret")
+	override(t, &s3ReadPrefixes, []string{"old/"})
+	m0, t0 := minuteAt(0)
+	m1, t1 := minuteAt(1)
+	m2, t2 := minuteAt(2)
+
+	// m0 is duplicated under the old prefix, m1 only exists there and m2 isn't duplicated
+	storeTestMinute(t, m0, LogEntry{Timestamp: t0 + 1, Message: "current"}, LogEntry{Timestamp: t0 + 2, Message: "both"})
+	oldEntries, _ := json.Marshal([]LogEntry{{Timestamp: t0 + 2, Message: "both"}, {Timestamp: t0 + 3, Message: "old only"}})
+	fake.put("old/"+m0+s3KeySuffix, oldEntries, nil)
+	oldEntries, _ = json.Marshal([]LogEntry{{Timestamp: t1 + 1, Message: "old minute"}})
+	fake.put("old/"+m1+s3KeySuffix, oldEntries, nil)
+	storeTestMinute(t, m2, LogEntry{Timestamp: t2 + 1, Message: "single"})
+
+	repair := func(dryRun bool) duplicateRepairResult {
+		t.Helper()
+		request := httptest.NewRequest("POST", fmt.Sprintf("/admin/repair-duplicates?start=%d&end=%d&dry_run=%t", t0, t2+59, dryRun), nil)
+		request.Header.Set("X-API-Key", "secret")
+		recorder := httptest.NewRecorder()
+		repairDuplicatesHandler(recorder, request)
+		var result duplicateRepairResult
+		if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil || recorder.Code != http.StatusOK {
+			t.Fatalf("repair answered %d %q", recorder.Code, recorder.Body.String())
+		}
+		return result
+	}
+
+	result := repair(true)
+	if result.MinutesChecked != 3 || len(result.Duplicates) != 1 || result.Duplicates[0].Minute != m0 ||
+		result.EntriesAdded != 1 || result.Deleted != 0 {
+		t.Fatalf("dry run reported %+v", result)
+	}
+	if fake.object("old/"+m0+s3KeySuffix) == nil {
+		t.Fatal("dry run deleted the duplicate")
+	}
+	if entries := decodeEntries(t, serveQuery(t, fmt.Sprintf("start=%d&end=%d", t0, t0+59))); len(entries) != 2 {
+		t.Errorf("dry run changed minute %s: %+v", m0, entries)
+	}
+
+	result = repair(false)
+	if len(result.Duplicates) != 1 || result.EntriesAdded != 1 || result.Deleted != 1 {
+		t.Fatalf("repair reported %+v", result)
+	}
+	if fake.object("old/"+m0+s3KeySuffix) != nil {
+		t.Error("duplicate not deleted")
+	}
+	if fake.object("old/"+m1+s3KeySuffix) == nil {
+		t.Error("minute only stored under the old prefix was deleted")
+	}
+	var messages []string
+	for _, entry := range decodeEntries(t, serveQuery(t, fmt.Sprintf("start=%d&end=%d", t0, t2+59))) {
+		messages = append(messages, entry.Message)
+	}
+	sort.Strings(messages)
+	if strings.Join(messages, ",") != "both,current,old minute,old only,single" {
+		t.Errorf("query after the repair returned %v", messages)
+	}
+
+	if result = repair(false); len(result.Duplicates) != 0 {
+		t.Errorf("second repair found %+v", result.Duplicates)
+	}
+}
+
+func TestRepairDuplicatesReportsFailedDeletes(t *testing.T) {
+	fake := newFakeS3(t)
+	useTempDirectories(t)
+	useTestBuffer(t)
+	override(t, &apiKey, "secret")
+	override(t, &s3ReadPrefixes, []string{"old/", "older/"})
+	m0, t0 := minuteAt(0)
+	storeTestMinute(t, m0, LogEntry{Timestamp: t0 + 1, Message: "current"})
+	fake.put("old/"+m0+s3KeySuffix, []byte(fmt.Sprintf(`[{"time":%d,"log":"old"}]`, t0+2)), nil)
+	fake.put("older/"+m0+s3KeySuffix, []byte(fmt.Sprintf(`[{"time":%d,"log":"older"}]`, t0+3)), nil)
+	fake.fail = func(r *http.Request) bool {
+		return r.Method == "DELETE" && strings.Contains(r.URL.Path, "/old/")
+	}
+
+	request := httptest.NewRequest("POST", fmt.Sprintf("/admin/repair-duplicates?start=%d&end=%d", t0, t0+59), nil)
+	request.Header.Set("X-API-Key", "secret")
+	recorder := httptest.NewRecorder()
+	repairDuplicatesHandler(recorder, request)
+	var result duplicateRepairResult
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("repair answered %d %q", recorder.Code, recorder.Body.String())
+	}
+	// Only the delete that succeeded is counted, the other key is reported
+	if result.Deleted != 1 || result.FailedDeletes != 1 || len(result.Duplicates) != 1 ||
+		!reflect.DeepEqual(result.Duplicates[0].FailedKeys, []string{"old/" + m0 + s3KeySuffix}) {
+		t.Errorf("repair reported %+v", result)
+	}
+	if fake.object("old/"+m0+s3KeySuffix) == nil || fake.object("older/"+m0+s3KeySuffix) != nil {
+		t.Errorf("objects left after the repair: %v", fake.keys(""))
+	}
+	if entries := decodeEntries(t, serveQuery(t, fmt.Sprintf("start=%d&end=%d", t0, t0+59))); len(entries) != 3 {
+		t.Errorf("minute %s holds %+v after the repair", m0, entries)
+	}
+	if records := readAuditLog(t); len(records) != 1 || !strings.Contains(records[0].Result, "deleted=1 failed_deletes=1") {
+		t.Errorf("audit log holds %+v", records)
+	}
+
+	// Once the delete succeeds, a later repair deletes the duplicate it left without adding entries
+	fake.fail = nil
+	request = httptest.NewRequest("POST", request.URL.String(), nil)
+	request.Header.Set("X-API-Key", "secret")
+	recorder = httptest.NewRecorder()
+	repairDuplicatesHandler(recorder, request)
+	result = duplicateRepairResult{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil || result.Deleted != 1 || result.FailedDeletes != 0 || result.EntriesAdded != 0 {
+		t.Errorf("second repair answered %d %q", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestAvailabilitySealsMinuteAfterGraceAndUpload(t *testing.T) {
+	newFakeS3(t)
+	useTempDirectories(t)
+	override(t, &uploadRetries, make(map[string]*uploadRetry))
+	override(t, &uploadsInFlight, make(map[string]bool))
+	override(t, &lateGrace, time.Hour)
+
+	// The previous minute, which is over but still within the grace period
+	start := time.Now().Truncate(time.Minute).Add(-time.Minute)
+	minute := formatMinute(start)
+	fileName := writeLocalFile(t, minute, LogEntry{Timestamp: start.Unix(), Message: "almost final"})
+
+	availability := func() minuteAvailability {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		availabilityHandler(recorder, httptest.NewRequest("GET", fmt.Sprintf("/availability?start=%d&end=%d", start.Unix(), start.Unix()+59), nil))
+		var minutes []minuteAvailability
+		if err := json.Unmarshal(recorder.Body.Bytes(), &minutes); err != nil {
+			t.Fatalf("availability answered %d %q", recorder.Code, recorder.Body.String())
+		}
+		// The neighbouring minutes late entries may be stored in are reported too
+		for _, availability := range minutes {
+			if availability.Minute == minute {
+				return availability
+			}
+		}
+		t.Fatalf("minute %s not in %+v", minute, minutes)
+		return minuteAvailability{}
+	}
+
+	if got := availability(); got.Sealed || got.Uploaded || !got.PendingLocal {
+		t.Errorf("before the upload %+v", got)
+	}
+	slots := make(chan struct{}, 1)
+	slots <- struct{}{}
+	uploadInBackground(fileName, slots)
+	if got := availability(); got.Sealed || !got.Uploaded || got.PendingLocal {
+		t.Errorf("uploaded within the grace period %+v", got)
+	}
+	lateGrace = 0
+	if got := availability(); !got.Sealed {
+		t.Errorf("uploaded after the grace period %+v", got)
+	}
+	// A late entry written locally again unseals the minute until it is uploaded
+	writeLocalFile(t, minute, LogEntry{Timestamp: start.Unix() + 1, Message: "late"})
+	if got := availability(); got.Sealed || !got.PendingLocal {
+		t.Errorf("with a pending local file %+v", got)
+	}
+}
+
+// memorySink keeps the batches it receives, failing while fail is set
+type memorySink struct {
+	mu      sync.Mutex
+	batches [][]LogEntry
+	fail    bool
+}
+
+func (s *memorySink) Write(batch []LogEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		return fmt.Errorf("memory sink unavailable")
+	}
+	s.batches = append(s.batches, append([]LogEntry(nil), batch...))
+	return nil
+}
+
+func TestCustomSinkReceivesFlushedBatches(t *testing.T) {
+	useTestBuffer(t)
+	override(t, &sinks, nil)
+	override(t, &accumulated, nil)
+	override(t, &sinkRetryAttempts, 1)
+	override(t, &sinkRetryInitialInterval, time.Millisecond)
+	t.Cleanup(func() { failingSinks.Store(0) })
+
+	healthy, broken := &memorySink{}, &memorySink{fail: true}
+	registerSink("memory", healthy)
+	registerSink("broken", broken)
+
+	_, t0 := minuteAt(0)
+	logChannel <- LogEntry{Timestamp: t0, Message: "first"}
+	logChannel <- LogEntry{Timestamp: t0 + 1, Message: "second"}
+	if flushed := flushLogChannel(); flushed != 2 {
+		t.Fatalf("flushed %d entries, want 2", flushed)
+	}
+	logChannel <- LogEntry{Timestamp: t0 + 2, Message: "third"}
+	flushLogChannel()
+
+	// The failing sink doesn't keep the healthy one from receiving every batch
+	if len(healthy.batches) != 2 || len(healthy.batches[0]) != 2 || healthy.batches[1][0].Message != "third" {
+		t.Errorf("healthy sink received %+v", healthy.batches)
+	}
+	if failingSinks.Load() != 1 || len(sinks[1].held) != 3 {
+		t.Fatalf("failing sink holds %d entries, %d sinks failing", len(sinks[1].held), failingSinks.Load())
+	}
+
+	// Once it recovers, the held entries are written without new ones arriving
+	broken.mu.Lock()
+	broken.fail = false
+	broken.mu.Unlock()
+	sinks[1].retryAt = time.Time{}
+	flushLogChannel()
+	if len(broken.batches) != 1 || len(broken.batches[0]) != 3 || failingSinks.Load() != 0 {
+		t.Errorf("recovered sink received %+v, %d sinks failing", broken.batches, failingSinks.Load())
+	}
+	if len(healthy.batches) != 2 {
+		t.Errorf("healthy sink received the held entries again: %+v", healthy.batches)
+	}
+}
+
+func TestIngestTimestampMap(t *testing.T) {
+	acceptIngest(t)
+
+	body := `{"1709355607":"third","1709355605":"first","1709355606":"second"}`
+	if recorder := postIngest(t, "/ingest?format=map", body); recorder.Code != http.StatusCreated {
+		t.Fatalf("map answered %d %q", recorder.Code, recorder.Body.String())
+	}
+	entries := drainTestChannel()
+	want := []LogEntry{{Timestamp: 1709355605, Message: "first"}, {Timestamp: 1709355606, Message: "second"}, {Timestamp: 1709355607, Message: "third"}}
+	if len(entries) != len(want) {
+		t.Fatalf("map decoded into %+v", entries)
+	}
+	for i := range want {
+		if entries[i].Timestamp != want[i].Timestamp || entries[i].Message != want[i].Message {
+			t.Errorf("entry %d is %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+
+	for _, body := range []string{`{"yesterday":"not an epoch"}`, `{"1709355605.5":"fractional"}`, `["not","a","map"]`} {
+		if recorder := postIngest(t, "/ingest?format=map", body); recorder.Code != http.StatusBadRequest {
+			t.Errorf("map %s answered %d", body, recorder.Code)
+		}
+	}
+	if entries := drainTestChannel(); len(entries) != 0 {
+		t.Errorf("invalid maps sent %+v to logChannel", entries)
+	}
+}
+
+// metricValue returns the current value of a metrics series
+func metricValue(series string) float64 {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	return metrics.values[series]
+}
+
+func TestIngestBackpressureAtLocalDiskCap(t *testing.T) {
+	useTempDirectories(t)
+	acceptIngest(t)
+	override(t, &maxLocalDiskBytes, 4096)
+	override(t, &diskFullPolicy, "reject")
+	t.Cleanup(func() { localDiskUsage.Store(0) })
+	body := `[{"time":1709355605,"log":"hello"}]`
+
+	// Measured like periodicallyMeasureLocalDisk does
+	measure := func() {
+		t.Helper()
+		usage, err := directorySize(logsDirectory)
+		if err != nil {
+			t.Fatal(err)
+		}
+		localDiskUsage.Store(usage)
+	}
+	measure()
+	if recorder := postIngest(t, "/ingest", body); recorder.Code != http.StatusCreated {
+		t.Fatalf("below the cap ingest answered %d", recorder.Code)
+	}
+
+	// Uploads are stalled, the local files grow until they reach the cap
+	minute, ts := minuteAt(0)
+	for i := 0; localDiskUsage.Load() < maxLocalDiskBytes; i++ {
+		writeLocalFile(t, minute, LogEntry{Timestamp: ts, Message: strings.Repeat("x", 200) + strconv.Itoa(i)})
+		measure()
+	}
+	drainTestChannel()
+
+	rejected := metricValue(`ingest_disk_backpressure_total{policy="reject"}`)
+	recorder := postIngest(t, "/ingest", body)
+	if recorder.Code != http.StatusInsufficientStorage {
+		t.Errorf("at the cap ingest answered %d", recorder.Code)
+	}
+	if recorder.Header().Get("X-Ingest-Advice") != "slow-down" {
+		t.Errorf("rejected response without X-Ingest-Advice")
+	}
+	if metricValue(`ingest_disk_backpressure_total{policy="reject"}`) != rejected+1 {
+		t.Errorf("backpressure metric not incremented")
+	}
+
+	diskFullPolicy = "drop"
+	if recorder := postIngest(t, "/ingest", body); recorder.Code != http.StatusAccepted {
+		t.Errorf("at the cap with the drop policy ingest answered %d", recorder.Code)
+	}
+	if entries := drainTestChannel(); len(entries) != 0 {
+		t.Errorf("%d entries enqueued at the cap", len(entries))
+	}
+}
+
+func TestQueryDistinctMessages(t *testing.T) {
+	newFakeS3(t)
+	m0, t0 := minuteAt(0)
+	m1, t1 := minuteAt(1)
+	storeTestMinute(t, m0,
+		LogEntry{Timestamp: t0 + 1, Message: "disk full"},
+		LogEntry{Timestamp: t0 + 2, Message: "retrying upload"},
+		LogEntry{Timestamp: t0 + 3, Message: "disk full"},
+		LogEntry{Timestamp: t0 + 4, Message: "user logged in"})
+	storeTestMinute(t, m1, LogEntry{Timestamp: t1 + 1, Message: "retrying upload"}, LogEntry{Timestamp: t1 + 2, Message: "disk full"})
+	useTestBuffer(t, LogEntry{Timestamp: t1 + 30, Message: "disk full"})
+
+	// The filters apply before the messages are grouped
+	recorder := serveQuery(t, fmt.Sprintf("start=%d&end=%d&distinct=true&exclude=logged", t0, t1+59))
+	var groups []distinctMessage
+	if err := json.Unmarshal(recorder.Body.Bytes(), &groups); err != nil {
+		t.Fatalf("distinct answered %d %q", recorder.Code, recorder.Body.String())
+	}
+	want := []distinctMessage{
+		{Message: "disk full", Count: 4, FirstTs: t0 + 1, LastTs: t1 + 30},
+		{Message: "retrying upload", Count: 2, FirstTs: t0 + 2, LastTs: t1 + 1},
+	}
+	if len(groups) != len(want) || groups[0] != want[0] || groups[1] != want[1] {
+		t.Errorf("distinct returned %+v, want %+v", groups, want)
+	}
+
+	override(t, &maxDistinctGroups, 1)
+	recorder = serveQuery(t, fmt.Sprintf("start=%d&end=%d&distinct=true", t0, t1+59))
+	if err := json.Unmarshal(recorder.Body.Bytes(), &groups); err != nil || len(groups) != 1 || recorder.Header().Get("X-Query-Truncated") != "true" {
+		t.Errorf("capped distinct returned %+v, truncated %q", groups, recorder.Header().Get("X-Query-Truncated"))
+	}
+}
+
+func TestObjectKeySuffixWithLegacyKeys(t *testing.T) {
+	fake := newFakeS3(t)
+	useTestBuffer(t)
+	override(t, &s3KeySuffix, ".json")
+	override(t, &s3ReadPrefixes, []string{"old/"})
+	m0, t0 := minuteAt(0)
+	m1, t1 := minuteAt(1)
+	m2, t2 := minuteAt(2)
+
+	storeTestMinute(t, m0, LogEntry{Timestamp: t0 + 1, Message: "with suffix"})
+	if fake.object(s3ObjectKeysPrefix+m0+".json") == nil {
+		t.Fatalf("object stored as %v, want the key to carry the suffix", fake.keys(s3ObjectKeysPrefix))
+	}
+	// Objects written before the suffix, under the prefix and an earlier one
+	legacy, _ := json.Marshal([]LogEntry{{Timestamp: t1 + 1, Message: "without suffix"}})
+	fake.put(s3ObjectKeysPrefix+m1, legacy, nil)
+	legacy, _ = json.Marshal([]LogEntry{{Timestamp: t2 + 1, Message: "earlier prefix"}})
+	fake.put("old/"+m2, legacy, nil)
+
+	requests := fake.count("GET")
+	_, t9 := minuteAt(9)
+	var messages []string
+	for _, entry := range decodeEntries(t, serveQuery(t, fmt.Sprintf("start=%d&end=%d", t0, t9+59))) {
+		messages = append(messages, entry.Message)
+	}
+	if strings.Join(messages, ",") != "with suffix,without suffix,earlier prefix" {
+		t.Errorf("query returned %v", messages)
+	}
+	// One listing of the day per prefix and one GET per existing object, the 7 missing minutes cost nothing
+	if n := fake.count("GET") - requests; n != 2+3 {
+		t.Errorf("query made %d GET requests, want 5", n)
+	}
+}
+
+func TestShutdownUploadsCurrentMinute(t *testing.T) {
+	fake := newFakeS3(t)
+	useTempDirectories(t)
+	useTestBuffer(t)
+	acceptIngest(t)
+	override(t, &sinks, nil)
+	override(t, &accumulated, nil)
+	override(t, &shutdownStorage, make(chan struct{}))
+	override(t, &storageStopped, make(chan struct{}))
+	override(t, &uploadRetries, make(map[string]*uploadRetry))
+	registerSink("s3", &s3Sink{directory: logsDirectory})
+	go periodicallyWriteToStorage()
+
+	// The current minute, still written to and already uploaded once
+	now := time.Now()
+	minute := formatMinute(now)
+	storeTestMinute(t, minute, LogEntry{Timestamp: now.Unix(), Message: "uploaded earlier"})
+	writeLocalFile(t, minute, LogEntry{Timestamp: now.Unix(), Message: "flushed"})
+	logChannel <- LogEntry{Timestamp: now.Unix(), Message: "still in the channel", Bucket: minute}
+
+	// The gRPC server is shut down with the HTTP server
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &grpcServer, newGRPCServer())
+	served := make(chan error, 1)
+	go func() { served <- grpcServer.Serve(listener) }()
+
+	shutdown(&http.Server{})
+
+	select {
+	case err := <-served:
+		if err != http.ErrServerClosed {
+			t.Errorf("gRPC server stopped with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("gRPC server still serving after shutdown")
+	}
+	if files, err := listLocalFiles(); err != nil || len(files) != 0 {
+		t.Errorf("local files left after shutdown: %+v %v", files, err)
+	}
+	object := fake.object(objectKey(minute))
+	if object == nil {
+		t.Fatalf("minute %s not uploaded", minute)
+	}
+	entries, err := decodeObjectEntries(object.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages []string
+	for _, entry := range entries {
+		messages = append(messages, entry.Message)
+	}
+	sort.Strings(messages)
+	if strings.Join(messages, ",") != "flushed,still in the channel,uploaded earlier" {
+		t.Errorf("object of the current minute holds %v", messages)
+	}
+}
+
+func TestQueryObjectCapReturnsCursor(t *testing.T) {
+	newFakeS3(t)
+	override(t, &maxQueryObjects, 2)
+	var start, end int64
+	for i := 0; i < 5; i++ {
+		minute, ts := minuteAt(i)
+		storeTestMinute(t, minute, LogEntry{Timestamp: ts + 1, Message: "minute " + strconv.Itoa(i)})
+		// Bounds within the first and last minute, so that the range spans exactly the 5 minutes
+		if i == 0 {
+			start = ts + 1
+		}
+		end = ts + 58
+	}
+	useTestBuffer(t, LogEntry{Timestamp: end - 1, Message: "buffered"})
+
+	var messages, cursors []string
+	cursor := ""
+	for page := 0; page < 5; page++ {
+		recorder := serveQuery(t, fmt.Sprintf("start=%d&end=%d&cursor=%s", start, end, cursor))
+		for _, entry := range decodeEntries(t, recorder) {
+			messages = append(messages, entry.Message)
+		}
+		if recorder.Header().Get("X-Query-Truncated") != "true" {
+			break
+		}
+		cursor = recorder.Header().Get("X-Query-Next")
+		cursors = append(cursors, cursor)
+	}
+
+	m2, _ := minuteAt(2)
+	m4, _ := minuteAt(4)
+	if strings.Join(cursors, ",") != m2+","+m4 {
+		t.Fatalf("cursors %v, want %s and %s", cursors, m2, m4)
+	}
+	// Every minute once, and the buffer only with the last page
+	if strings.Join(messages, ",") != "minute 0,minute 1,minute 2,minute 3,minute 4,buffered" {
+		t.Errorf("pages returned %v", messages)
+	}
+}
+
+func TestIdempotencyKeySurvivesRestart(t *testing.T) {
+	acceptIngest(t)
+	path := filepath.Join(t.TempDir(), "dedup.jsonl")
+	override(t, &ingestDedup, &dedupStore{ttl: time.Hour, maxKeys: 100, path: path, expiry: make(map[string]time.Time)})
+	if err := ingestDedup.load(); err != nil {
+		t.Fatal(err)
+	}
+	body := `[{"time":1709355605,"log":"charged card"}]`
+
+	if recorder := postIngest(t, "/ingest", body, "Idempotency-Key", "payment-1"); recorder.Code != http.StatusCreated {
+		t.Fatalf("first request answered %d", recorder.Code)
+	}
+
+	// A new process loads the keys persisted by the previous one
+	ingestDedup.file.Close()
+	ingestDedup = &dedupStore{ttl: time.Hour, maxKeys: 100, path: path, expiry: make(map[string]time.Time)}
+	if err := ingestDedup.load(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ingestDedup.file.Close() })
+	if recorder := postIngest(t, "/ingest", body, "Idempotency-Key", "payment-1"); recorder.Code != http.StatusOK {
+		t.Errorf("retry after the restart answered %d", recorder.Code)
+	}
+	if recorder := postIngest(t, "/ingest", body, "Idempotency-Key", "payment-2"); recorder.Code != http.StatusCreated {
+		t.Errorf("request with another key answered %d", recorder.Code)
+	}
+	if n := len(drainTestChannel()); n != 2 {
+		t.Errorf("%d entries sent to logChannel, want 2", n)
+	}
+}
+
+func TestIdempotencyKeyReservedUntilRequestSucceeds(t *testing.T) {
+	acceptIngest(t)
+	override(t, &ingestDedup, &dedupStore{ttl: time.Hour, maxKeys: 100, expiry: make(map[string]time.Time)})
+	override(t, &tenantQuotas, &tenantQuotaTracker{
+		overrides: map[string]tenantLimits{"acme": {quotaEntries: 1}},
+		usage:     make(map[string]*tenantUsage),
+	})
+	twoEntries := `[{"time":1709355605,"log":"one"},{"time":1709355606,"log":"two"}]`
+
+	// A request in flight holds its key, a concurrent retry isn't ingested twice
+	if err := ingestDedup.reserve("request:batch-1"); err != nil {
+		t.Fatal(err)
+	}
+	if recorder := postIngest(t, "/ingest", twoEntries, "Idempotency-Key", "batch-1"); recorder.Code != http.StatusConflict {
+		t.Errorf("retry while in flight answered %d", recorder.Code)
+	}
+	ingestDedup.release("request:batch-1")
+
+	// A request failing on its quota releases the key, its retry is ingested once the quota allows
+	if recorder := postIngest(t, "/ingest", twoEntries, "Idempotency-Key", "batch-2", "X-Tenant-ID", "acme"); recorder.Code != http.StatusForbidden {
+		t.Fatalf("request over the quota answered %d", recorder.Code)
+	}
+	if recorder := postIngest(t, "/ingest", twoEntries, "Idempotency-Key", "batch-2"); recorder.Code != http.StatusCreated {
+		t.Errorf("retry of the failed request answered %d", recorder.Code)
+	}
+	if recorder := postIngest(t, "/ingest", twoEntries, "Idempotency-Key", "batch-2"); recorder.Code != http.StatusOK {
+		t.Errorf("retry of the ingested request answered %d", recorder.Code)
+	}
+
+	// Concurrent requests with the same key, exactly one of them is ingested
+	var wg sync.WaitGroup
+	codes := make(chan int, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- postIngest(t, "/ingest", twoEntries, "Idempotency-Key", "batch-3").Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	created := 0
+	for code := range codes {
+		if code == http.StatusCreated {
+			created++
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d concurrent requests with the same key ingested, want 1", created)
+	}
+	if n := len(drainTestChannel()); n != 4 {
+		t.Errorf("%d entries sent to logChannel, want 4", n)
+	}
+}
+
+func TestQueryDefaultsApplyOnlyWithoutParams(t *testing.T) {
+	newFakeS3(t)
+	override(t, &defaultQueryLast, 10*time.Minute)
+	override(t, &defaultQueryText, "ERROR")
+	now := time.Now().Unix()
+	useTestBuffer(t,
+		LogEntry{Timestamp: now - 2*3600, Message: "ERROR hours ago"},
+		LogEntry{Timestamp: now - 60, Message: "ERROR disk full"},
+		LogEntry{Timestamp: now - 30, Message: "INFO all good"})
+
+	for _, test := range []struct {
+		query string
+		want  string
+	}{
+		{"", "ERROR disk full"},
+		{"text=INFO", "INFO all good"},
+		{"text=", "ERROR disk full,INFO all good"},
+		{fmt.Sprintf("start=%d", now-3*3600), "ERROR hours ago,ERROR disk full"},
+		// Without start, the range is DEFAULT_QUERY_LAST up to the end given
+		{fmt.Sprintf("end=%d", now-2*3600+60), "ERROR hours ago"},
+		{fmt.Sprintf("start=%d&end=%d&text=", now-3*3600, now), "ERROR hours ago,ERROR disk full,INFO all good"},
+	} {
+		var messages []string
+		for _, entry := range decodeEntries(t, serveQuery(t, test.query)) {
+			messages = append(messages, entry.Message)
+		}
+		if got := strings.Join(messages, ","); got != test.want {
+			t.Errorf("query %q returned %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestDownloadStreamsSortedEntries(t *testing.T) {
+	newFakeS3(t)
+	m0, t0 := minuteAt(0)
+	m1, t1 := minuteAt(1)
+	m2, t2 := minuteAt(2)
+	// A late entry of m0 stored with m1, and an entry before the range stored with m0
+	storeTestMinute(t, m0, LogEntry{Timestamp: t0 + 30, Message: "b"}, LogEntry{Timestamp: t0 + 10, Message: "a"}, LogEntry{Timestamp: t0 - 30, Message: "before"})
+	storeTestMinute(t, m1, LogEntry{Timestamp: t1 + 5, Message: "d"}, LogEntry{Timestamp: t0 + 50, Message: "c"})
+	storeTestMinute(t, m2, LogEntry{Timestamp: t2 + 1, Message: "f"})
+	useTestBuffer(t, LogEntry{Timestamp: t1 + 40, Message: "e"})
+
+	recorder := httptest.NewRecorder()
+	downloadHandler(recorder, httptest.NewRequest("GET", fmt.Sprintf("/download?start=%d&end=%d", t0, t2+59), nil))
+	if recorder.Code != http.StatusOK || !strings.HasPrefix(recorder.Header().Get("Content-Disposition"), "attachment;") {
+		t.Fatalf("download answered %d with Content-Disposition %q", recorder.Code, recorder.Header().Get("Content-Disposition"))
+	}
+
+	var messages []string
+	var last int64
+	for _, line := range strings.Split(strings.TrimSpace(recorder.Body.String()), "\n") {
+		var entry LogEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		if entry.Timestamp < last {
+			t.Errorf("entry %+v out of order", entry)
+		}
+		last = entry.Timestamp
+		messages = append(messages, entry.Message)
+	}
+	if strings.Join(messages, ",") != "a,b,c,d,e,f" {
+		t.Errorf("download returned %v", messages)
+	}
+}
+
+func TestClockSkewPolicies(t *testing.T) {
+	acceptIngest(t)
+	override(t, &maxClockSkew, time.Hour)
+	now := time.Now().Unix()
+	skewed := now - 3*24*3600
+	body := fmt.Sprintf(`[{"time":%d,"log":"on time"},{"time":%d,"log":"skewed"}]`, now, skewed)
+
+	override(t, &clockSkewPolicy, "reject")
+	recorder := postIngest(t, "/ingest", body)
+	var response ingestResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || recorder.Code != http.StatusCreated {
+		t.Fatalf("reject policy answered %d %q", recorder.Code, recorder.Body.String())
+	}
+	if response.Accepted != 1 || len(response.Rejected) != 1 || response.Rejected[0].Entry.Message != "skewed" {
+		t.Errorf("reject policy answered %+v", response)
+	}
+	if entries := drainTestChannel(); len(entries) != 1 || entries[0].Message != "on time" {
+		t.Errorf("reject policy enqueued %+v", entries)
+	}
+
+	clockSkewPolicy = "restamp"
+	before := time.Now().Unix()
+	if recorder := postIngest(t, "/ingest", body); recorder.Code != http.StatusCreated {
+		t.Fatalf("restamp policy answered %d", recorder.Code)
+	}
+	entries := drainTestChannel()
+	if len(entries) != 2 || entries[0].ClientTimestamp != 0 || entries[0].Timestamp != now {
+		t.Fatalf("restamp policy enqueued %+v", entries)
+	}
+	// The skewed entry lands in the server's minute, the original timestamp is kept in client_ts
+	if entries[1].ClientTimestamp != skewed || entries[1].Timestamp < before || entries[1].Timestamp > time.Now().Unix() {
+		t.Errorf("restamped entry %+v, want client_ts %d and the server time", entries[1], skewed)
+	}
+
+	clockSkewPolicy = "accept"
+	postIngest(t, "/ingest", body)
+	if entries := drainTestChannel(); len(entries) != 2 || entries[1].Timestamp != skewed || entries[1].ClientTimestamp != 0 {
+		t.Errorf("accept policy enqueued %+v", entries)
+	}
+}
+
+// ingestPayload returns a JSON array (or NDJSON) body of n entries
+func ingestPayload(n int, ndjson bool) string {
+	var body strings.Builder
+	if !ndjson {
+		body.WriteString("[")
+	}
+	for i := 0; i < n; i++ {
+		if i > 0 && !ndjson {
+			body.WriteString(",")
+		}
+		fmt.Fprintf(&body, `{"time":%d,"log":"GET /orders/%d 200","level":"INFO","fields":{"host":"web-1"}}`, 1709355605+i, i)
+		if ndjson {
+			body.WriteString("\n")
+		}
+	}
+	if !ndjson {
+		body.WriteString("]")
+	}
+	return body.String()
+}
+
+func TestIngestPooledDecoding(t *testing.T) {
+	acceptIngest(t)
+	override(t, &maxIngestBodyBytes, 16*1024)
+
+	// Bodies of different sizes reuse the pooled readers, each is decoded and counted on its own
+	for _, n := range []int{150, 1, 40} {
+		array, ndjson := ingestPayload(n, false), ingestPayload(n, true)
+		if recorder := postIngest(t, "/ingest", array); recorder.Code != http.StatusCreated {
+			t.Fatalf("array of %d entries answered %d %q", n, recorder.Code, recorder.Body.String())
+		}
+		fromArray := drainTestChannel()
+		if recorder := postIngest(t, "/ingest", ndjson, "Content-Type", "application/x-ndjson"); recorder.Code != http.StatusCreated {
+			t.Fatalf("NDJSON of %d entries answered %d %q", n, recorder.Code, recorder.Body.String())
+		}
+		fromNDJSON := drainTestChannel()
+		if len(fromArray) != n || len(fromNDJSON) != n {
+			t.Fatalf("%d entries decoded from the array and %d from NDJSON, want %d", len(fromArray), len(fromNDJSON), n)
+		}
+		last := fromArray[n-1]
+		if last.Timestamp != 1709355605+int64(n-1) || last.Message != fmt.Sprintf("GET /orders/%d 200", n-1) || last.Fields["host"] != "web-1" {
+			t.Errorf("last entry decoded as %+v", last)
+		}
+	}
+
+	// The body limit still applies while decoding from the stream
+	oversized := ingestPayload(400, false)
+	if recorder := postIngest(t, "/ingest", oversized); recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("body of %d bytes answered %d", len(oversized), recorder.Code)
+	}
+	if entries := drainTestChannel(); len(entries) != 0 {
+		t.Errorf("oversized body enqueued %d entries", len(entries))
+	}
+	for _, body := range []string{`[{"time":1709355605,"log":"a"}`, `[{"time":1709355605,"log":"a"}] trailing`} {
+		if recorder := postIngest(t, "/ingest", body); recorder.Code != http.StatusBadRequest {
+			t.Errorf("body %q answered %d", body, recorder.Code)
+		}
+	}
+}
+
+// BenchmarkIngestDecode compares reading the whole body before unmarshalling it with decoding from the pooled reader
+func BenchmarkIngestDecode(b *testing.B) {
+	payload := ingestPayload(500, false)
+	b.Run("readall", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			data, err := io.ReadAll(strings.NewReader(payload))
+			if err != nil {
+				b.Fatal(err)
+			}
+			var entries []LogEntry
+			if err := json.Unmarshal(data, &entries); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			body := ingestBodyPool.Get().(*ingestBody)
+			body.reset(strings.NewReader(payload))
+			if _, err := decodeLogEntries("", body); err != nil {
+				b.Fatal(err)
+			}
+			ingestBodyPool.Put(body)
+		}
+	})
+}
+
+func TestQueryKeyGlobSelectsMinutes(t *testing.T) {
+	fake := newFakeS3(t)
+	useTestBuffer(t)
+	var start, end int64
+	for i := 0; i <= 30; i++ {
+		minute, ts := minuteAt(i)
+		storeTestMinute(t, minute, LogEntry{Timestamp: ts + 1, Message: minute})
+		if i == 0 {
+			start = ts
+		}
+		end = ts + 59
+	}
+	m5, _ := minuteAt(5)
+	m15, _ := minuteAt(15)
+	m25, _ := minuteAt(25)
+
+	for _, query := range []string{
+		fmt.Sprintf("start=%d&end=%d&key_glob=*-?5", start, end),
+		// Without a range, the glob selects across all time
+		"key_glob=2024-03-02-05-?5",
+	} {
+		var messages []string
+		for _, entry := range decodeEntries(t, serveQuery(t, query)) {
+			messages = append(messages, entry.Message)
+		}
+		if strings.Join(messages, ",") != m5+","+m15+","+m25 {
+			t.Errorf("query %q returned %v", query, messages)
+		}
+	}
+	// Only the selected objects are read
+	if m6, _ := minuteAt(6); fake.fetched(objectKey(m6)) != 0 || fake.fetched(objectKey(m15)) != 2 {
+		t.Errorf("%s read %d times and %s %d times", m6, fake.fetched(objectKey(m6)), m15, fake.fetched(objectKey(m15)))
+	}
+
+	if recorder := serveQuery(t, "key_glob=[2024"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("invalid glob answered %d", recorder.Code)
+	}
+}
+
+func TestFlushWritesAccumulatedEntries(t *testing.T) {
+	useTestBuffer(t)
+	useTempDirectories(t)
+	override(t, &apiKey, "secret")
+	override(t, &sinks, nil)
+	override(t, &accumulated, nil)
+	override(t, &flushMaxDelay, time.Hour)
+	sink := &memorySink{}
+	registerSink("memory", sink)
+	_, t0 := minuteAt(0)
+
+	// Drained entries wait for FLUSH_MAX_DELAY, they are queryable but not written yet
+	logChannel <- LogEntry{Timestamp: t0, Message: "drained"}
+	accumulateLogChannel(time.Now())
+	if len(sink.batches) != 0 || len(accumulated) != 1 {
+		t.Fatalf("accumulated %d entries, sink received %+v", len(accumulated), sink.batches)
+	}
+
+	logChannel <- LogEntry{Timestamp: t0 + 1, Message: "waiting"}
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/flush", nil)
+	request.Header.Set("X-API-Key", "secret")
+	flushHandler(recorder, request)
+	if body := recorder.Body.String(); recorder.Code != http.StatusOK || body != `{"flushed":2}` {
+		t.Errorf("flush answered %d %s", recorder.Code, body)
+	}
+	if len(sink.batches) != 1 || len(sink.batches[0]) != 2 {
+		t.Errorf("sink received %+v", sink.batches)
+	}
+
+	// Closing shutdownStorage forces a final flush of the entries still in the channel
+	override(t, &shutdownStorage, make(chan struct{}))
+	override(t, &storageStopped, make(chan struct{}))
+	go periodicallyWriteToStorage()
+	logChannel <- LogEntry{Timestamp: t0 + 2, Message: "at shutdown"}
+	close(shutdownStorage)
+	<-storageStopped
+	if len(sink.batches) != 2 || sink.batches[1][0].Message != "at shutdown" {
+		t.Errorf("sink received %+v after shutdown", sink.batches)
+	}
+}
+
+func TestUploadedObjectsCarryTags(t *testing.T) {
+	fake := newFakeS3(t)
+	useTempDirectories(t)
+	tags, err := parseObjectTags("team=platform, cost-center=1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &s3ObjectTags, tags)
+
+	minute, ts := minuteAt(0)
+	fileName := writeLocalFile(t, minute, LogEntry{Timestamp: ts, Message: "tagged"})
+	if err := uploadToS3WithPrefix(fileName); err != nil {
+		t.Fatal(err)
+	}
+	object := fake.object(objectKey(minute))
+	if object == nil {
+		t.Fatalf("minute %s not uploaded", minute)
+	}
+	applied, _ := url.ParseQuery(object.tagging)
+	if len(applied) != 2 || applied.Get("team") != "platform" || applied.Get("cost-center") != "1234" {
+		t.Errorf("object tagged %q", object.tagging)
+	}
+
+	for _, value := range []string{"team", "=platform", "team=platform,cost-center"} {
+		if _, err := parseObjectTags(value); err == nil {
+			t.Errorf("S3_OBJECT_TAGS=%s accepted", value)
+		}
+	}
+}
+
+func TestReadOnlyModeBlocksIngestAndServesQueries(t *testing.T) {
+	newFakeS3(t)
+	useTempDirectories(t)
+	useTestBuffer(t)
+	acceptIngest(t)
+	override(t, &apiKey, "secret")
+	t.Cleanup(func() { readOnly.Store(false) })
+	m0, t0 := minuteAt(0)
+	storeTestMinute(t, m0, LogEntry{Timestamp: t0 + 1, Message: "stored before"})
+
+	toggle := func(method, enabled string) string {
+		t.Helper()
+		request := httptest.NewRequest(method, "/admin/readonly?enabled="+enabled, nil)
+		request.Header.Set("X-API-Key", "secret")
+		recorder := httptest.NewRecorder()
+		readOnlyHandler(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s /admin/readonly answered %d", method, recorder.Code)
+		}
+		return recorder.Body.String()
+	}
+	recorder := httptest.NewRecorder()
+	readOnlyHandler(recorder, httptest.NewRequest("POST", "/admin/readonly?enabled=true", nil))
+	if recorder.Code != http.StatusUnauthorized || readOnly.Load() {
+		t.Fatalf("toggle without a key answered %d", recorder.Code)
+	}
+	if body := toggle("POST", "true"); body != `{"read_only":true}` {
+		t.Errorf("enabling answered %s", body)
+	}
+
+	if recorder := postIngest(t, "/ingest", `[{"time":1709355605,"log":"rejected"}]`); recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("ingest in read-only mode answered %d", recorder.Code)
+	}
+	if entries := decodeEntries(t, serveQuery(t, fmt.Sprintf("start=%d&end=%d", t0, t0+59))); len(entries) != 1 {
+		t.Errorf("query in read-only mode returned %+v", entries)
+	}
+	recorder = httptest.NewRecorder()
+	listHandler(recorder, httptest.NewRequest("GET", "/list", nil))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), objectKey(m0)) {
+		t.Errorf("list in read-only mode answered %d %q", recorder.Code, recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	statsHandler(recorder, httptest.NewRequest("GET", "/stats", nil))
+	if !strings.Contains(recorder.Body.String(), `"read_only":true`) {
+		t.Errorf("stats in read-only mode %s", recorder.Body.String())
+	}
+
+	if body := toggle("POST", "false"); body != `{"read_only":false}` {
+		t.Errorf("disabling answered %s", body)
+	}
+	if recorder := postIngest(t, "/ingest", `[{"time":1709355605,"log":"accepted"}]`); recorder.Code != http.StatusCreated {
+		t.Errorf("ingest after read-only mode answered %d", recorder.Code)
+	}
+	if body := toggle("GET", ""); body != `{"read_only":false}` {
+		t.Errorf("state reported as %s", body)
+	}
+}
+
+func TestQueryCombinesPredicates(t *testing.T) {
+	newFakeS3(t)
+	m0, t0 := minuteAt(0)
+	web := map[string]string{"host": "web-1.eu"}
+	storeTestMinute(t, m0,
+		LogEntry{Timestamp: t0 + 1, Message: "timeout calling payments", Level: "ERROR", Fields: web},
+		LogEntry{Timestamp: t0 + 2, Message: "timeout calling payments", Level: "WARN", Fields: web},
+		LogEntry{Timestamp: t0 + 3, Message: "timeout calling payments", Level: "ERROR", Fields: map[string]string{"host": "db-1.eu"}},
+		LogEntry{Timestamp: t0 + 4, Message: "request served", Level: "ERROR", Fields: web},
+		LogEntry{Timestamp: t0 + 5, Message: "timeout calling search", Level: "ERROR", Fields: web})
+	useTestBuffer(t)
+	query := func(filters string) []int64 {
+		t.Helper()
+		var timestamps []int64
+		for _, entry := range decodeEntries(t, serveQuery(t, fmt.Sprintf("start=%d&end=%d&%s", t0, t0+59, filters))) {
+			timestamps = append(timestamps, entry.Timestamp-t0)
+		}
+		return timestamps
+	}
+
+	// The message contains X, the level equals Y and the host contains Z
+	if got := query("text=timeout&field=level:ERROR&field=host~web"); fmt.Sprint(got) != "[1 5]" {
+		t.Errorf("text, field: and field~ matched %v", got)
+	}
+	if got := query("regex=^timeout.*pay&exclude=search&field=host~web"); fmt.Sprint(got) != "[1 2]" {
+		t.Errorf("regex, exclude and field~ matched %v", got)
+	}
+	// A single text keeps matching as a substring of the message
+	if got := query("text=calling"); fmt.Sprint(got) != "[1 2 3 5]" {
+		t.Errorf("text matched %v", got)
+	}
+	if recorder := serveQuery(t, fmt.Sprintf("start=%d&end=%d&field=level", t0, t0+59)); recorder.Code != http.StatusBadRequest {
+		t.Errorf("field without an operator answered %d", recorder.Code)
+	}
+}
+
+func TestSortedQueryMergesObjects(t *testing.T) {
+	newFakeS3(t)
+	override(t, &sortBufferObjects, 3)
+	_, start := minuteAt(0)
+	want := 0
+	for i := 0; i < 12; i++ {
+		minute, ts := minuteAt(i)
+		// Each object is sorted and holds late entries of the two minutes before it, interleaving with their objects
+		var entries []LogEntry
+		for back := 2; back >= 0; back-- {
+			if i-back >= 0 {
+				entries = append(entries, LogEntry{Timestamp: ts - int64(back)*60 + int64(10*i%50+back), Message: minute})
+			}
+		}
+		storeTestMinute(t, minute, entries...)
+		want += len(entries)
+	}
+	_, end := minuteAt(11)
+	// The buffer holds the entries not uploaded yet, of the last minutes
+	_, recent := minuteAt(10)
+	useTestBuffer(t, LogEntry{Timestamp: recent + 30, Message: "buffered"})
+	want++
+
+	entries := decodeEntries(t, serveQuery(t, fmt.Sprintf("start=%d&end=%d&sort=time", start, end+59)))
+	if len(entries) != want {
+		t.Fatalf("sorted query returned %d entries, want %d", len(entries), want)
+	}
+	if !sort.SliceIsSorted(entries, func(i, j int) bool { return entries[i].Timestamp < entries[j].Timestamp }) {
+		t.Errorf("entries not globally sorted: %+v", entries)
+	}
+}
+
+func TestMemoryPressureShedsIngest(t *testing.T) {
+	acceptIngest(t)
+	override(t, &memoryHighWatermark, 1)
+	t.Cleanup(func() { memoryPressure.Store(false) })
+	_, t0 := minuteAt(0)
+	var buffered []LogEntry
+	for i := 0; i < 10; i++ {
+		buffered = append(buffered, LogEntry{Timestamp: t0 + int64(i), Message: "buffered " + strconv.Itoa(i)})
+	}
+	useTestBuffer(t, buffered...)
+	body := `[{"time":1709355605,"log":"hello"}]`
+
+	// Any heap exceeds a watermark of 1 byte
+	checkMemory()
+	recorder := postIngest(t, "/ingest", body)
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("ingest under memory pressure answered %d with Retry-After %q", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+	// The oldest half of the buffer is dropped
+	if len(inMemorySearchBuffer) != 5 || inMemorySearchBuffer[0].Message != "buffered 5" {
+		t.Errorf("buffer holds %+v under memory pressure", inMemorySearchBuffer)
+	}
+	if stats := currentStats(); !stats.MemoryPressure || stats.HeapAllocBytes == 0 {
+		t.Errorf("stats %+v under memory pressure", stats)
+	}
+
+	memoryHighWatermark = 1 << 62
+	checkMemory()
+	if recorder := postIngest(t, "/ingest", body); recorder.Code != http.StatusCreated {
+		t.Errorf("ingest once memory is released answered %d", recorder.Code)
+	}
+	if currentStats().MemoryPressure || len(inMemorySearchBuffer) != 5 {
+		t.Errorf("pressure still reported, buffer holds %d entries", len(inMemorySearchBuffer))
+	}
+}
+
+// recordingPublisher collects the published messages on a channel, failing every publish with err
+type recordingPublisher struct {
+	messages chan string
+	err      error
+}
+
+func (p *recordingPublisher) Publish(message string) error {
+	p.messages <- message
+	return p.err
+}
+
+func TestUploadPublishesNotification(t *testing.T) {
+	fake := newFakeS3(t)
+	useTempDirectories(t)
+	healthy := &recordingPublisher{messages: make(chan string, 4)}
+	failing := &recordingPublisher{messages: make(chan string, 4), err: fmt.Errorf("topic unavailable")}
+	override(t, &uploadPublishers, []uploadPublisher{failing, healthy})
+
+	for i := 0; i < 2; i++ {
+		minute, ts := minuteAt(i)
+		fileName := writeLocalFile(t, minute, LogEntry{Timestamp: ts + 5, Message: "first"}, LogEntry{Timestamp: ts + 50, Message: "last"})
+		// A failing publisher doesn't fail the upload
+		if err := uploadToS3WithPrefix(fileName); err != nil {
+			t.Fatalf("upload of %s failed: %v", minute, err)
+		}
+
+		for _, publisher := range []*recordingPublisher{healthy, failing} {
+			var notification uploadNotification
+			select {
+			case message := <-publisher.messages:
+				if err := json.Unmarshal([]byte(message), &notification); err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no notification published for %s", minute)
+			}
+			object := fake.object(objectKey(minute))
+			want := uploadNotification{Key: objectKey(minute), Size: len(object.data), Entries: 2, MinTs: ts + 5, MaxTs: ts + 50}
+			if notification != want {
+				t.Errorf("notification %+v, want %+v", notification, want)
+			}
+		}
+	}
+	select {
+	case message := <-healthy.messages:
+		t.Errorf("extra notification %s", message)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestQueryTimeoutReturnsPartialResult(t *testing.T) {
+	fake := newFakeS3(t)
+	m0, t0 := minuteAt(0)
+	m1, t1 := minuteAt(1)
+	m2, t2 := minuteAt(2)
+	storeTestMinute(t, m0, LogEntry{Timestamp: t0 + 1, Message: "fast"})
+	storeTestMinute(t, m1, LogEntry{Timestamp: t1 + 1, Message: "fast too"})
+	storeTestMinute(t, m2, LogEntry{Timestamp: t2 + 1, Message: "slow"})
+	_, t4 := minuteAt(4)
+	useTestBuffer(t, LogEntry{Timestamp: t4 + 1, Message: "buffered"})
+	// The handler of the stalled request may still be running when the stall is lifted
+	var stalling atomic.Bool
+	stalling.Store(true)
+	fake.stall = func(r *http.Request) bool {
+		return stalling.Load() && r.Method == "GET" && strings.HasSuffix(r.URL.Path, objectKey(m2))
+	}
+
+	started := time.Now()
+	recorder := serveQuery(t, fmt.Sprintf("start=%d&end=%d&timeout=200ms", t0+1, t4+58))
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("query took %s, the stalled fetch wasn't cancelled", elapsed)
+	}
+	if recorder.Code != http.StatusOK || recorder.Header().Get("X-Query-Partial") != "true" {
+		t.Fatalf("query answered %d with X-Query-Partial %q", recorder.Code, recorder.Header().Get("X-Query-Partial"))
+	}
+	// The minutes read so far are returned, the next page resumes at the stalled one
+	var messages []string
+	for _, entry := range decodeEntries(t, recorder) {
+		messages = append(messages, entry.Message)
+	}
+	if strings.Join(messages, ",") != "fast,fast too" || recorder.Header().Get("X-Query-Next") != m2 {
+		t.Errorf("partial query returned %v, next %q", messages, recorder.Header().Get("X-Query-Next"))
+	}
+
+	stalling.Store(false)
+	recorder = serveQuery(t, fmt.Sprintf("start=%d&end=%d&timeout=5s&cursor=%s", t0+1, t4+58, m2))
+	if entries := decodeEntries(t, recorder); len(entries) != 2 || entries[0].Message != "slow" || entries[1].Message != "buffered" ||
+		recorder.Header().Get("X-Query-Partial") != "" {
+		t.Errorf("resumed query returned %+v", entries)
+	}
+}
+
+// protobufBatch encodes entries as a LogBatch of log_entry.proto, each entry followed by a field unknown to the schema
+func protobufBatch(entries ...LogEntry) []byte {
+	var batch []byte
+	for _, entry := range entries {
+		var encoded []byte
+		encoded = protowire.AppendTag(encoded, 1, protowire.VarintType)
+		encoded = protowire.AppendVarint(encoded, uint64(entry.Timestamp))
+		encoded = protowire.AppendTag(encoded, 2, protowire.BytesType)
+		encoded = protowire.AppendString(encoded, entry.Message)
+		if entry.Level != "" {
+			encoded = protowire.AppendTag(encoded, 3, protowire.BytesType)
+			encoded = protowire.AppendString(encoded, entry.Level)
+		}
+		for name, value := range entry.Fields {
+			var field []byte
+			field = protowire.AppendTag(field, 1, protowire.BytesType)
+			field = protowire.AppendString(field, name)
+			field = protowire.AppendTag(field, 2, protowire.BytesType)
+			field = protowire.AppendString(field, value)
+			encoded = protowire.AppendTag(encoded, 4, protowire.BytesType)
+			encoded = protowire.AppendBytes(encoded, field)
+		}
+		encoded = protowire.AppendTag(encoded, 15, protowire.VarintType)
+		encoded = protowire.AppendVarint(encoded, 7)
+		batch = protowire.AppendTag(batch, 1, protowire.BytesType)
+		batch = protowire.AppendBytes(batch, encoded)
+	}
+	return batch
+}
+
+func TestIngestProtobufBatch(t *testing.T) {
+	acceptIngest(t)
+	want := []LogEntry{
+		{Timestamp: 1709355605, Message: "from protobuf", Level: "WARN", Fields: map[string]string{"host": "web-1", "region": "eu"}},
+		{Timestamp: 1709355606, Message: "minimal"},
+	}
+	body := protobufBatch(want...)
+
+	if recorder := postIngest(t, "/ingest", string(body), "Content-Type", "application/x-protobuf"); recorder.Code != http.StatusCreated {
+		t.Fatalf("protobuf batch answered %d %q", recorder.Code, recorder.Body.String())
+	}
+	entries := drainTestChannel()
+	if len(entries) != 2 {
+		t.Fatalf("protobuf batch enqueued %+v", entries)
+	}
+	for i := range want {
+		got := entries[i]
+		if got.Timestamp != want[i].Timestamp || got.Message != want[i].Message || got.Level != want[i].Level ||
+			len(got.Fields) != len(want[i].Fields) || got.Fields["host"] != want[i].Fields["host"] || got.Fields["region"] != want[i].Fields["region"] {
+			t.Errorf("entry %d decoded as %+v, want %+v", i, got, want[i])
+		}
+	}
+
+	// format=protobuf selects the decoder without the content type, truncated batches are rejected
+	if recorder := postIngest(t, "/ingest?format=protobuf", string(body)); recorder.Code != http.StatusCreated {
+		t.Errorf("format=protobuf answered %d", recorder.Code)
+	}
+	if recorder := postIngest(t, "/ingest", string(body[:len(body)-3]), "Content-Type", "application/x-protobuf"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("truncated batch answered %d", recorder.Code)
+	}
+	if n := len(drainTestChannel()); n != 2 {
+		t.Errorf("%d entries enqueued after the first batch, want 2", n)
+	}
+}
+
+func TestLargeMinuteSplitsIntoParts(t *testing.T) {
+	fake := newFakeS3(t)
+	useTempDirectories(t)
+	useTestBuffer(t)
+	override(t, &maxEntriesPerObject, 10)
+	minute, ts := minuteAt(0)
+	upload := func(from, to int) {
+		t.Helper()
+		var entries []LogEntry
+		for i := from; i < to; i++ {
+			entries = append(entries, LogEntry{Timestamp: ts + int64(i%60), Message: "entry " + strconv.Itoa(i)})
+		}
+		if err := uploadToS3WithPrefix(writeLocalFile(t, minute, entries...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	partSizes := func() []int {
+		var sizes []int
+		for part := 1; ; part++ {
+			object := fake.object(objectKey(partMinute(minute, part)))
+			if object == nil {
+				return sizes
+			}
+			entries, _ := decodeObjectEntries(object.data)
+			sizes = append(sizes, len(entries))
+		}
+	}
+	queried := func() int {
+		t.Helper()
+		seen := make(map[string]bool)
+		for _, entry := range decodeEntries(t, serveQuery(t, fmt.Sprintf("start=%d&end=%d", ts, ts+59))) {
+			seen[entry.Message] = true
+		}
+		return len(seen)
+	}
+
+	upload(0, 25)
+	if sizes := partSizes(); fmt.Sprint(sizes) != "[10 10 5]" || fake.object(objectKey(minute)) != nil {
+		t.Fatalf("minute of 25 entries stored as parts %v", sizes)
+	}
+	if n := queried(); n != 25 {
+		t.Errorf("query returned %d distinct entries, want 25", n)
+	}
+
+	// A later upload of the minute is merged into its parts
+	upload(25, 32)
+	if sizes := partSizes(); fmt.Sprint(sizes) != "[10 10 10 2]" {
+		t.Errorf("minute of 32 entries stored as parts %v", sizes)
+	}
+	if n := queried(); n != 32 {
+		t.Errorf("query returned %d distinct entries, want 32", n)
+	}
+}
+
+// readAuditLog returns the records of the local audit log
+func readAuditLog(t *testing.T) []auditRecord {
+	t.Helper()
+	data, err := os.ReadFile(auditLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []auditRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var record auditRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("audit line %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestAuditRecordForDeletingRepair(t *testing.T) {
+	fake := newFakeS3(t)
+	useTempDirectories(t)
+	useTestBuffer(t)
+	override(t, &scopedKeys, []scopedKey{{name: "ops", key: "ops-key", scopes: map[string]bool{scopeAdmin: true}}})
+	override(t, &s3ReadPrefixes, []string{"old/"})
+	m0, t0 := minuteAt(0)
+	storeTestMinute(t, m0, LogEntry{Timestamp: t0 + 1, Message: "current"})
+	fake.put("old/"+m0+s3KeySuffix, []byte(`[{"time":1709355601,"log":"current"}]`), nil)
+
+	// The duplicate object is deleted by the repair, which is recorded with its actor, parameters and result
+	target := fmt.Sprintf("/admin/repair-duplicates?start=%d&end=%d", t0, t0+59)
+	request := httptest.NewRequest("POST", target, nil)
+	request.Header.Set("X-API-Key", "ops-key")
+	recorder := httptest.NewRecorder()
+	repairDuplicatesHandler(recorder, request)
+	if recorder.Code != http.StatusOK || fake.object("old/"+m0+s3KeySuffix) != nil {
+		t.Fatalf("repair answered %d %q", recorder.Code, recorder.Body.String())
+	}
+	records := readAuditLog(t)
+	if len(records) != 1 {
+		t.Fatalf("audit log holds %+v", records)
+	}
+	record := records[0]
+	if record.Operation != "repair_duplicates" || record.Actor != "ops" || record.Params["start"] != strconv.FormatInt(t0, 10) ||
+		!strings.Contains(record.Result, "deleted=1") || record.Time == "" {
+		t.Errorf("audit record %+v", record)
+	}
+
+	// With AUDIT_PREFIX, records are written as objects instead
+	override(t, &auditPrefix, "audit/")
+	t.Cleanup(func() { readOnly.Store(false) })
+	request = httptest.NewRequest("POST", "/admin/readonly?enabled=true", nil)
+	request.Header.Set("X-API-Key", "ops-key")
+	readOnlyHandler(httptest.NewRecorder(), request)
+	keys := fake.keys("audit/")
+	if len(keys) != 1 || !strings.HasSuffix(keys[0], "-readonly.json") {
+		t.Fatalf("audit objects %v", keys)
+	}
+	if err := json.Unmarshal(fake.object(keys[0]).data, &record); err != nil || record.Actor != "ops" || record.Result != "read_only=true" {
+		t.Errorf("audit object holds %+v %v", record, err)
+	}
+	if n := len(readAuditLog(t)); n != 1 {
+		t.Errorf("audit log holds %d records with AUDIT_PREFIX set", n)
+	}
+}
+
+func TestQueryReportsUnreadableObjects(t *testing.T) {
+	fake := newFakeS3(t)
+	useTestBuffer(t)
+	m0, t0 := minuteAt(0)
+	m1, _ := minuteAt(1)
+	storeTestMinute(t, m0, LogEntry{Timestamp: t0 + 1, Message: "readable"})
+	fake.put(objectKey(m1), []byte(`[{"time":`), nil)
+	target := fmt.Sprintf("start=%d&end=%d", t0, t0+119)
+
+	// By default the readable entries are returned and the corrupt minute is listed
+	recorder := serveQuery(t, target)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("X-Query-Unreadable") != m1 {
+		t.Fatalf("lenient query answered %d with X-Query-Unreadable %q", recorder.Code, recorder.Header().Get("X-Query-Unreadable"))
+	}
+	if entries := decodeEntries(t, recorder); len(entries) != 1 || entries[0].Message != "readable" {
+		t.Errorf("lenient query returned %+v", entries)
+	}
+
+	// strict=true fails the query instead
+	recorder = serveQuery(t, target+"&strict=true")
+	if recorder.Code != http.StatusInternalServerError || !strings.Contains(recorder.Body.String(), m1) {
+		t.Errorf("strict query answered %d %q", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestBackfillAddsTimeBoundsToLegacyObject(t *testing.T) {
+	fake := newFakeS3(t)
+	m0, t0 := minuteAt(0)
+	key := objectKey(m0)
+	fake.put(key, []byte(fmt.Sprintf(`[{"time":%d,"log":"late"},{"time":%d,"log":"early"}]`, t0+40, t0+3)), map[string]string{"Source": "legacy"})
+	fake.mu.Lock()
+	fake.objects[key].header.Set("Content-Type", "application/json")
+	fake.objects[key].header.Set("Cache-Control", "max-age=3600")
+	fake.objects[key].tagging = "retention=30d"
+	fake.mu.Unlock()
+
+	updated, err := backfillObject(key)
+	if err != nil || !updated {
+		t.Fatalf("backfill returned %t %v", updated, err)
+	}
+	object := fake.object(key)
+	if min, max := object.header.Get("X-Amz-Meta-Min-Ts"), object.header.Get("X-Amz-Meta-Max-Ts"); min != strconv.FormatInt(t0+3, 10) || max != strconv.FormatInt(t0+40, 10) {
+		t.Errorf("backfilled time bounds %s-%s", min, max)
+	}
+	// The copy in place keeps everything else about the object
+	if object.header.Get("X-Amz-Meta-Source") != "legacy" || object.header.Get("Content-Type") != "application/json" ||
+		object.header.Get("Cache-Control") != "max-age=3600" || object.tagging != "retention=30d" {
+		t.Errorf("backfilled object lost its headers or tags: %v %q", object.header, object.tagging)
+	}
+
+	// An object with the metadata isn't copied again
+	if updated, err := backfillObject(key); updated || err != nil {
+		t.Errorf("second backfill returned %t %v", updated, err)
+	}
+}
+
+func TestBackfillStopsInReadOnlyMode(t *testing.T) {
+	fake := newFakeS3(t)
+	useTempDirectories(t)
+	override(t, &apiKey, "secret")
+	override(t, &backfill, &backfillJob{})
+	override(t, &backfillRate, 1000.0)
+	t.Cleanup(func() { readOnly.Store(false) })
+	var keys []string
+	for offset := 0; offset < 3; offset++ {
+		minute, t0 := minuteAt(offset)
+		keys = append(keys, objectKey(minute))
+		fake.put(objectKey(minute), []byte(fmt.Sprintf(`[{"time":%d,"log":"legacy"}]`, t0+1)), nil)
+	}
+	backfilled := func(key string) bool {
+		return fake.object(key).header.Get("X-Amz-Meta-Min-Ts") != ""
+	}
+
+	post := func() int {
+		request := httptest.NewRequest("POST", "/admin/backfill", nil)
+		request.Header.Set("X-API-Key", "secret")
+		recorder := httptest.NewRecorder()
+		backfillHandler(recorder, request)
+		return recorder.Code
+	}
+	readOnly.Store(true)
+	if code := post(); code != http.StatusServiceUnavailable || backfill.status().Running {
+		t.Fatalf("backfill in read-only mode answered %d, %+v", code, backfill.status())
+	}
+	readOnly.Store(false)
+
+	// Read-only mode is enabled while the first object is copied, the job stops before the next one
+	fake.before = func(r *http.Request) {
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			readOnly.Store(true)
+		}
+	}
+	run := func() backfillJob {
+		t.Helper()
+		if code := post(); code != http.StatusOK {
+			t.Fatalf("backfill answered %d", code)
+		}
+		for deadline := time.Now().Add(5 * time.Second); backfill.status().Running; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("backfill still running")
+			}
+		}
+		return backfill.status()
+	}
+	status := run()
+	if status.Running || status.Updated != 1 || status.LastKey != keys[0] || !strings.Contains(status.Error, "read-only") {
+		t.Errorf("stopped backfill reports %+v", &status)
+	}
+	if !backfilled(keys[0]) || backfilled(keys[1]) || backfilled(keys[2]) {
+		t.Error("backfill went on in read-only mode")
+	}
+	if _, err := os.Stat(backfillStateFile); err != nil {
+		t.Errorf("stopped backfill left no state: %v", err)
+	}
+
+	// Started again, it resumes after the last object it processed
+	fake.before = nil
+	readOnly.Store(false)
+	if status := run(); status.Updated != 3 || status.Scanned != 3 || status.Error != "" {
+		t.Errorf("resumed backfill reports %+v", &status)
+	}
+	if !backfilled(keys[1]) || !backfilled(keys[2]) {
+		t.Error("resumed backfill left objects without time bounds")
+	}
+	if _, err := os.Stat(backfillStateFile); !os.IsNotExist(err) {
+		t.Errorf("state of the finished backfill: %v", err)
+	}
+}
+
+func TestFlushSortModes(t *testing.T) {
+	newFakeS3(t)
+	useTestBuffer(t)
+	useTempDirectories(t)
+	override(t, &accumulated, nil)
+	override(t, &sinks, nil)
+	registerSink("s3", &s3Sink{directory: logsDirectory})
+	m0, t0 := minuteAt(0)
+
+	for mode, want := range map[string]string{"timestamp": "[3 7 9]", "ingest": "[9 3 7]", "none": "[9 3 7]"} {
+		override(t, &flushSort, mode)
+		os.Remove(filepath.Join(logsDirectory, m0+".txt"))
+		for _, offset := range []int64{9, 3, 7} {
+			logChannel <- LogEntry{Timestamp: t0 + offset, Message: "entry", Bucket: m0}
+		}
+		flushLogChannel()
+		entries, _, err := readLocalFile(filepath.Join(logsDirectory, m0+".txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var offsets []int64
+		for _, entry := range entries {
+			offsets = append(offsets, entry.Timestamp-t0)
+		}
+		if fmt.Sprint(offsets) != want {
+			t.Errorf("FLUSH_SORT=%s wrote %v, want %s", mode, offsets, want)
+		}
+	}
+
+	// Objects uploaded in arrival order are still sorted by sort=time queries
+	m1, t1 := minuteAt(1)
+	storeTestMinute(t, m1, LogEntry{Timestamp: t1 + 9}, LogEntry{Timestamp: t1 + 3}, LogEntry{Timestamp: t1 + 7})
+	entries := decodeEntries(t, serveQuery(t, fmt.Sprintf("start=%d&end=%d&sort=time", t1, t1+59)))
+	if len(entries) != 3 || !sort.SliceIsSorted(entries, func(i, j int) bool { return entries[i].Timestamp < entries[j].Timestamp }) {
+		t.Errorf("sort=time returned %+v", entries)
+	}
+}
+
+func TestCapabilitiesReflectConfig(t *testing.T) {
+	override(t, &apiKey, "")
+	override(t, &scopedKeys, nil)
+	override(t, &maxResultEntries, 500)
+	override(t, &s3KeySuffix, ".json.gz")
+	override(t, &syslogAddr, "")
+	capabilitiesOf := func() capabilities {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		capabilitiesHandler(recorder, httptest.NewRequest("GET", "/capabilities", nil))
+		var c capabilities
+		if err := json.Unmarshal(recorder.Body.Bytes(), &c); err != nil || recorder.Code != http.StatusOK {
+			t.Fatalf("capabilities answered %d %q: %v", recorder.Code, recorder.Body.String(), err)
+		}
+		return c
+	}
+
+	c := capabilitiesOf()
+	if c.Auth || c.Limits.MaxResultEntries != 500 || c.Storage.Compression != "gzip" || c.Storage.KeySuffix != ".json.gz" || len(c.Inputs) != 0 {
+		t.Errorf("capabilities %+v", c)
+	}
+	if !slices.Contains(c.IngestFormats, "protobuf") || !slices.Contains(c.QueryParams, "cursor") {
+		t.Errorf("capabilities list formats %v and params %v", c.IngestFormats, c.QueryParams)
+	}
+
+	// Enabling auth and an input shows up without a restart
+	override(t, &apiKey, "secret")
+	override(t, &syslogAddr, ":5514")
+	if c := capabilitiesOf(); !c.Auth || fmt.Sprint(c.Inputs) != "[syslog]" {
+		t.Errorf("capabilities auth=%t inputs=%v", c.Auth, c.Inputs)
+	}
+	recorder := httptest.NewRecorder()
+	capabilitiesHandler(recorder, httptest.NewRequest("POST", "/capabilities", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST answered %d", recorder.Code)
+	}
+}
+
+func TestIngestAdvisesSlowDownUnderBacklog(t *testing.T) {
+	override(t, &logChannel, make(chan LogEntry, 10))
+	acceptIngest(t)
+	override(t, &maxLocalDiskBytes, 0)
+	_, t0 := minuteAt(0)
+	body := fmt.Sprintf(`[{"time":%d,"log":"entry"}]`, t0)
+
+	recorder := postIngest(t, "/ingest", body)
+	if recorder.Code != http.StatusCreated || recorder.Header().Get("X-Ingest-Backlog") != "0" || recorder.Header().Get("X-Ingest-Advice") != "" {
+		t.Fatalf("idle ingest answered %d with headers %v", recorder.Code, recorder.Header())
+	}
+
+	// Beyond BACKPRESSURE_THRESHOLD of the channel, accepted requests are advised to slow down
+	for i := 0; i < 7; i++ {
+		logChannel <- LogEntry{Timestamp: t0}
+	}
+	before := metricValue("ingest_slow_down_advised_total")
+	recorder = postIngest(t, "/ingest", body)
+	if recorder.Code != http.StatusCreated || recorder.Header().Get("X-Ingest-Backlog") != "8" || recorder.Header().Get("X-Ingest-Advice") != "slow-down" {
+		t.Errorf("busy ingest answered %d with headers %v", recorder.Code, recorder.Header())
+	}
+	if metricValue("ingest_slow_down_advised_total") != before+1 {
+		t.Errorf("slow-down advice not counted")
+	}
+}
+
+func TestLimitCursorPagesWithoutGapsOrDuplicates(t *testing.T) {
+	newFakeS3(t)
+	useTempDirectories(t)
+	m0, t0 := minuteAt(0)
+	m1, t1 := minuteAt(1)
+	m2, t2 := minuteAt(2)
+	entry := func(ts int64, message string) LogEntry { return LogEntry{Timestamp: ts, Message: message} }
+	storeTestMinute(t, m0, entry(t0+9, "a"), entry(t0+2, "b"), entry(t0+5, "c"), entry(t0+5, "d"), entry(t0+7, "e"))
+	storeTestMinute(t, m1, entry(t1+1, "f"), entry(t1+3, "g"), entry(t1+3, "g"))
+	// m2 was partly uploaded, the rest waits in its local file and the buffer
+	storeTestMinute(t, m2, entry(t2+20, "h"))
+	pending := []LogEntry{entry(t2+30, "i"), entry(t2+10, "j"), entry(t2+40, "k"), entry(t2+35, "l")}
+	localFile := writeLocalFile(t, m2, pending...)
+	useTestBuffer(t, pending...)
+
+	seen := make(map[string]int)
+	var cursors []string
+	cursor := ""
+	for page := 0; page < 10; page++ {
+		recorder := serveQuery(t, fmt.Sprintf("start=%d&end=%d&limit=3&cursor=%s", t0, t2+58, url.QueryEscape(cursor)))
+		entries := decodeEntries(t, recorder)
+		if len(entries) > 3 {
+			t.Errorf("page %d returned %d entries", page, len(entries))
+		}
+		for _, entry := range entries {
+			seen[entry.Message]++
+		}
+		if recorder.Header().Get("X-Query-Truncated") != "true" {
+			break
+		}
+		cursor = recorder.Header().Get("X-Query-Next")
+		cursors = append(cursors, cursor)
+
+		switch page {
+		case 0:
+			// Late entries are merged into the partly returned m0, which is sorted again
+			storeTestMinute(t, m0, entry(t0+1, "late before"), entry(t0+2, "b"), entry(t0+5, "c"), entry(t0+5, "d"),
+				entry(t0+7, "e"), entry(t0+8, "late after"), entry(t0+9, "a"))
+		case 3:
+			// The buffer is uploaded to m2 while its entries are being paged
+			storeTestMinute(t, m2, append([]LogEntry{entry(t2+20, "h")}, pending...)...)
+			os.Remove(localFile)
+			bufferMu.Lock()
+			resetBuffer(nil)
+			bufferMu.Unlock()
+		}
+	}
+
+	want := map[string]int{"a": 1, "b": 1, "c": 1, "d": 1, "e": 1, "late after": 1, "f": 1, "g": 2, "h": 1, "i": 1, "j": 1, "k": 1, "l": 1}
+	if fmt.Sprint(seen) != fmt.Sprint(want) {
+		t.Errorf("pages returned %v, want %v", seen, want)
+	}
+	if len(cursors) < 4 || !strings.HasPrefix(cursors[0], m0+":") || !strings.HasPrefix(cursors[len(cursors)-1], "tail:"+m2+":") {
+		t.Errorf("cursors %v", cursors)
+	}
+
+	// A cursor must carry a minute and a complete position
+	for _, invalid := range []string{m0 + ":12", m0 + ":x:abc", "tail:"} {
+		if recorder := serveQuery(t, fmt.Sprintf("start=%d&end=%d&limit=3&cursor=%s", t0, t2+58, invalid)); recorder.Code != http.StatusBadRequest {
+			t.Errorf("cursor %q answered %d", invalid, recorder.Code)
+		}
+	}
+}
+
+func TestNumericLevelsMappedAtIngest(t *testing.T) {
+	newFakeS3(t)
+	useTestBuffer(t)
+	acceptIngest(t)
+	levels, err := parseLevelNumericMap("syslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &levelNumericMap, levels)
+	m0, t0 := minuteAt(0)
+	body := fmt.Sprintf(`[{"time":%d,"log":"disk failed","level":"3"},{"time":%d,"log":"restarted","level":" 6 "},`+
+		`{"time":%d,"log":"symbolic","level":"ERR"},{"time":%d,"log":"unknown","level":"42"}]`, t0+1, t0+2, t0+3, t0+4)
+	if recorder := postIngest(t, "/ingest", body); recorder.Code != http.StatusCreated {
+		t.Fatalf("ingest answered %d %q", recorder.Code, recorder.Body.String())
+	}
+	entries := drainTestChannel()
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.Level)
+	}
+	if strings.Join(got, ",") != "ERR,INFO,ERR,42" {
+		t.Fatalf("ingested levels %v", got)
+	}
+
+	// Mapped levels match the same level filter as symbolic ones
+	storeTestMinute(t, m0, entries...)
+	var messages []string
+	for _, entry := range decodeEntries(t, serveQuery(t, fmt.Sprintf("start=%d&end=%d&field=level:ERR", t0, t0+59))) {
+		messages = append(messages, entry.Message)
+	}
+	if strings.Join(messages, ",") != "disk failed,symbolic" {
+		t.Errorf("level filter matched %v", messages)
+	}
+
+	// A custom mapping must name numeric levels
+	if levels, err := parseLevelNumericMap("10=DEBUG,40=ERROR"); err != nil || levels["40"] != "ERROR" {
+		t.Errorf("custom mapping parsed to %v %v", levels, err)
+	}
+	if _, err := parseLevelNumericMap("warn=WARN"); err == nil {
+		t.Errorf("non-numeric level accepted")
+	}
+}
+
+func TestCanaryRoundTrip(t *testing.T) {
+	newFakeS3(t)
+	override(t, &logChannel, make(chan LogEntry, 1))
+	override(t, &canaryPollInterval, 10*time.Millisecond)
+	override(t, &canaryTimeout, 2*time.Second)
+	type outcome struct {
+		latency time.Duration
+		err     error
+	}
+	runInBackground := func() chan outcome {
+		done := make(chan outcome, 1)
+		go func() {
+			latency, err := runCanary()
+			done <- outcome{latency, err}
+		}()
+		return done
+	}
+
+	// The canary succeeds once its entry is readable from the object of its minute
+	done := runInBackground()
+	entry := <-logChannel
+	if entry.Fields["canary"] == "" || !strings.HasPrefix(entry.Message, canaryTag+" ") {
+		t.Fatalf("canary ingested %+v", entry)
+	}
+	storeTestMinute(t, formatMinute(time.Unix(entry.Timestamp, 0)), entry)
+	if result := <-done; result.err != nil || result.latency <= 0 {
+		t.Errorf("canary returned %v %v", result.latency, result.err)
+	}
+
+	// An entry that is never uploaded fails the canary after CANARY_TIMEOUT
+	override(t, &canaryTimeout, 50*time.Millisecond)
+	done = runInBackground()
+	<-logChannel
+	if result := <-done; result.err == nil || !strings.Contains(result.err.Error(), "not readable") {
+		t.Errorf("canary without upload returned %v", result.err)
+	}
+
+	// A full channel fails it right away instead of blocking
+	logChannel <- LogEntry{Timestamp: 1}
+	override(t, &canaryTimeout, time.Hour)
+	select {
+	case result := <-runInBackground():
+		if result.err == nil || !strings.Contains(result.err.Error(), "channel full") {
+			t.Errorf("canary with a full channel returned %v", result.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("canary blocked on a full channel")
+	}
+}
+
+func TestMinuteLabelsSortChronologically(t *testing.T) {
+	override(t, &keyLocation, time.UTC)
+	var times []time.Time
+	for _, boundary := range []time.Time{
+		time.Date(999, 12, 31, 23, 58, 0, 0, time.UTC),  // 4-digit year
+		time.Date(2023, 12, 31, 23, 58, 0, 0, time.UTC), // year
+		time.Date(2024, 1, 9, 9, 58, 0, 0, time.UTC),    // single-digit month, day and hour
+		time.Date(2024, 2, 29, 23, 58, 0, 0, time.UTC),  // leap day into March
+		time.Date(2024, 9, 30, 23, 58, 0, 0, time.UTC),  // month 9 into 10
+		time.Date(2024, 10, 9, 19, 58, 0, 0, time.UTC),  // day 9 into 10, hour 19 into 20
+	} {
+		for i := 0; i < 4; i++ {
+			times = append(times, boundary.Add(time.Duration(i)*time.Minute))
+		}
+	}
+
+	labels := make([]string, len(times))
+	for i, ts := range times {
+		labels[i] = formatMinute(ts)
+		if len(labels[i]) != len("2006-01-02-15-04") {
+			t.Errorf("label %q of %v isn't fixed width", labels[i], ts)
+		}
+		if parsed, err := parseMinute(labels[i]); err != nil || !parsed.Equal(ts) {
+			t.Errorf("label %q parsed to %v %v, want %v", labels[i], parsed, err, ts)
+		}
+	}
+	if !sort.StringsAreSorted(labels) {
+		t.Errorf("labels not in lexical order: %v", labels)
+	}
+	if labels[8] != "2024-01-09-09-58" {
+		t.Errorf("label %q, want zero-padded components", labels[8])
+	}
+}
+
+func TestIngestStampsSource(t *testing.T) {
+	newFakeS3(t)
+	useTestBuffer(t)
+	acceptIngest(t)
+	override(t, &sourceName, "pod-7")
+	override(t, &sourceClientIP, false)
+	m0, t0 := minuteAt(0)
+	body := fmt.Sprintf(`[{"time":%d,"log":"stamped"},{"time":%d,"log":"own","fields":{"source":"batch-job"}}]`, t0+1, t0+2)
+	if recorder := postIngest(t, "/ingest", body); recorder.Code != http.StatusCreated {
+		t.Fatalf("ingest answered %d", recorder.Code)
+	}
+	entries := drainTestChannel()
+	if len(entries) != 2 || entries[0].Fields["source"] != "pod-7" || entries[1].Fields["source"] != "batch-job" {
+		t.Fatalf("ingested %+v", entries)
+	}
+
+	// The source is stored with the entry and can be filtered on
+	storeTestMinute(t, m0, entries...)
+	result := decodeEntries(t, serveQuery(t, fmt.Sprintf("start=%d&end=%d&field=source:pod-7", t0, t0+59)))
+	if len(result) != 1 || result[0].Message != "stamped" {
+		t.Errorf("source filter matched %+v", result)
+	}
+
+	// With SOURCE_CLIENT_IP, entries are stamped with the client address instead
+	override(t, &sourceName, "")
+	override(t, &sourceClientIP, true)
+	postIngest(t, "/ingest", fmt.Sprintf(`[{"time":%d,"log":"from client"}]`, t0+3))
+	if entries := drainTestChannel(); len(entries) != 1 || entries[0].Fields["source"] != "192.0.2.1" {
+		t.Errorf("ingested %+v", entries)
+	}
+}
+
+func TestRepairRangeFromLocalArchive(t *testing.T) {
+	fake := newFakeS3(t)
+	useTempDirectories(t)
+	override(t, &apiKey, "secret")
+	m0, t0 := minuteAt(0)
+	m1, t1 := minuteAt(1)
+	archive := func(minute string, entries ...LogEntry) {
+		t.Helper()
+		if err := os.MkdirAll(keepLocalDirectory, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := (&s3Sink{}).appendToFile(filepath.Join(keepLocalDirectory, minute+".txt"), entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// m0 lost an entry in S3, m1 is missing entirely
+	archive(m0, LogEntry{Timestamp: t0 + 1, Message: "kept"}, LogEntry{Timestamp: t0 + 2, Message: "lost"})
+	archive(m1, LogEntry{Timestamp: t1 + 1, Message: "missing minute"})
+	storeTestMinute(t, m0, LogEntry{Timestamp: t0 + 1, Message: "kept"})
+
+	repair := func(key string) (int, repairResult) {
+		t.Helper()
+		request := httptest.NewRequest("POST", fmt.Sprintf("/admin/repair?start=%d&end=%d", t0, t1+58), nil)
+		request.Header.Set("X-API-Key", key)
+		recorder := httptest.NewRecorder()
+		repairHandler(recorder, request)
+		var result repairResult
+		json.Unmarshal(recorder.Body.Bytes(), &result)
+		return recorder.Code, result
+	}
+	if code, _ := repair("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("repair without the key answered %d", code)
+	}
+	code, result := repair("secret")
+	if code != http.StatusOK || result.Archived != 2 || result.Repaired != 2 || result.EntriesAdded != 2 {
+		t.Fatalf("repair answered %d %+v", code, result)
+	}
+	for minute, want := range map[string]int{m0: 2, m1: 1} {
+		entries, _, err := getMinuteEntries(context.Background(), minute, nil)
+		if err != nil || len(entries) != want {
+			t.Errorf("minute %s holds %+v %v after the repair, want %d entries", minute, entries, err, want)
+		}
+	}
+	if len(fake.keys("")) != 2 {
+		t.Errorf("bucket holds %v", fake.keys(""))
+	}
+
+	// Repeating the repair changes nothing
+	if code, result := repair("secret"); code != http.StatusOK || result.Repaired != 0 || result.EntriesAdded != 0 {
+		t.Errorf("second repair answered %d %+v", code, result)
+	}
+}
+
+func TestUploadsInterleaveOldAndNewMinutes(t *testing.T) {
+	fake := newFakeS3(t)
+	useTempDirectories(t)
+	useTestBuffer(t)
+	var minutes, pending []string
+	for i := 0; i < 4; i++ {
+		minute, ts := minuteAt(i)
+		entries := []LogEntry{{Timestamp: ts, Message: "small"}}
+		if i == 0 {
+			// The oldest minute of the backlog is huge
+			entries = make([]LogEntry, 5000)
+			for j := range entries {
+				entries[j] = LogEntry{Timestamp: ts, Message: strings.Repeat("x", 100)}
+			}
+		}
+		minutes = append(minutes, minute)
+		pending = append(pending, writeLocalFile(t, minute, entries...))
+	}
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	releaseAll := func() { releaseOnce.Do(func() { close(release) }) }
+	t.Cleanup(releaseAll)
+	fake.stall = func(r *http.Request) bool {
+		if r.Method == "PUT" && strings.HasSuffix(r.URL.Path, objectKey(minutes[0])) {
+			<-release
+		}
+		return false
+	}
+	slots := make(chan struct{}, 2)
+	uploaded := func(minute string) bool { return fake.object(objectKey(minute)) != nil }
+	// waitFor waits until minute is uploaded and busy workers are left
+	waitFor := func(minute string, busy int) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !uploaded(minute) || len(slots) != busy; time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("minute %s not uploaded, %d workers busy", minute, len(slots))
+			}
+		}
+	}
+	dispatch := func() {
+		uploadStateMu.Lock()
+		defer uploadStateMu.Unlock()
+		var waiting []string
+		for _, fileName := range pending {
+			if _, err := os.Stat(fileName); err == nil && !uploadsInFlight[fileName] {
+				waiting = append(waiting, fileName)
+			}
+		}
+		dispatchUploads(waiting, slots)
+	}
+
+	// With two workers the huge oldest minute and the newest one start together
+	dispatch()
+	waitFor(minutes[3], 1)
+	if uploaded(minutes[1]) || uploaded(minutes[2]) {
+		t.Errorf("middle minutes dispatched before the newest")
+	}
+	// The freed worker takes the next minutes while the huge one is still uploading
+	dispatch()
+	waitFor(minutes[1], 1)
+	dispatch()
+	waitFor(minutes[2], 1)
+	if uploaded(minutes[0]) {
+		t.Fatalf("huge minute finished before the others")
+	}
+	releaseAll()
+	// Taking every slot waits for the workers to finish
+	for i := 0; i < cap(slots); i++ {
+		slots <- struct{}{}
+	}
+	if !uploaded(minutes[0]) {
+		t.Errorf("huge minute not uploaded")
+	}
+}
+
+func TestStdoutSinkWritesNDJSON(t *testing.T) {
+	useTestBuffer(t)
+	acceptIngest(t)
+	override(t, &sinks, nil)
+	override(t, &accumulated, nil)
+	override(t, &stdoutSinkEnabled, true)
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &os.Stdout, writer)
+	registerSink("stdout", &stdoutSink{w: os.Stdout})
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		output <- string(data)
+	}()
+
+	_, t0 := minuteAt(0)
+	body := fmt.Sprintf(`[{"time":%d,"log":"first","level":"INFO"},{"time":%d,"log":"quoted \"second\"","fields":{"host":"web-1"}}]`, t0, t0+1)
+	if recorder := postIngest(t, "/ingest", body); recorder.Code != http.StatusCreated {
+		t.Fatalf("ingest answered %d", recorder.Code)
+	}
+	logChannel <- LogEntry{Timestamp: t0 + 2, Message: "backfilled", Bucket: "2024-03-02-05-00"}
+	flushLogChannel()
+	writer.Close()
+
+	// Only the entries are written, one JSON object per line, without the debug prints or buckets
+	lines := strings.Split(strings.TrimSuffix(<-output, "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("stdout holds %q", lines)
+	}
+	for i, want := range []string{"first", `quoted "second"`, "backfilled"} {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(lines[i]), &entry); err != nil || entry["log"] != want {
+			t.Errorf("line %d %q: %v", i, lines[i], err)
+		}
+		if _, ok := entry["bucket"]; ok {
+			t.Errorf("line %d carries the bucket: %q", i, lines[i])
+		}
+	}
+}
+
+func TestQueryContextAroundMatches(t *testing.T) {
+	newFakeS3(t)
+	m0, t0 := minuteAt(0)
+	m1, t1 := minuteAt(1)
+	storeTestMinute(t, m0, LogEntry{Timestamp: t0 + 50, Message: "e"}, LogEntry{Timestamp: t0 + 10, Message: "a"},
+		LogEntry{Timestamp: t0 + 20, Message: "b error"}, LogEntry{Timestamp: t0 + 30, Message: "c"}, LogEntry{Timestamp: t0 + 40, Message: "d error"})
+	storeTestMinute(t, m1, LogEntry{Timestamp: t1 + 10, Message: "f"}, LogEntry{Timestamp: t1 + 20, Message: "g"},
+		LogEntry{Timestamp: t1 + 30, Message: "h error"})
+	useTestBuffer(t, LogEntry{Timestamp: t1 + 40, Message: "i"}, LogEntry{Timestamp: t1 + 50, Message: "j"})
+	query := func(params string) string {
+		t.Helper()
+		var messages []string
+		for _, entry := range decodeEntries(t, serveQuery(t, fmt.Sprintf("start=%d&end=%d&%s", t0, t1+59, params))) {
+			messages = append(messages, entry.Message)
+		}
+		return strings.Join(messages, ",")
+	}
+
+	// Overlapping context is returned once, in time order, across objects and the buffer
+	if got := query("text=error&context=1"); got != "a,b error,c,d error,e,g,h error,i" {
+		t.Errorf("context=1 returned %s", got)
+	}
+	if got := query("text=error&context=2"); got != "a,b error,c,d error,e,f,g,h error,i,j" {
+		t.Errorf("context=2 returned %s", got)
+	}
+	if got := query("text=error&context=0"); got != "b error,d error,h error" {
+		t.Errorf("context=0 returned %s", got)
+	}
+	if recorder := serveQuery(t, fmt.Sprintf("start=%d&end=%d&text=error&context=-1", t0, t1+59)); recorder.Code != http.StatusBadRequest {
+		t.Errorf("negative context answered %d", recorder.Code)
+	}
+}
+
+func TestLargeObjectUploadedInParts(t *testing.T) {
+	fake := newFakeS3(t)
+	override(t, &multipartThreshold, 1024*1024)
+	override(t, &multipartPartSize, int64(5*1024*1024))
+	override(t, &multipartConcurrency, 2)
+	m0, t0 := minuteAt(0)
+	m1, t1 := minuteAt(1)
+	entries := make([]LogEntry, 60000)
+	for i := range entries {
+		entries[i] = LogEntry{Timestamp: t0 + int64(i%60), Message: fmt.Sprintf("%05d %s", i, strings.Repeat("x", 100))}
+	}
+
+	storeTestMinute(t, m0, entries...)
+	fake.mu.Lock()
+	multipartUploads, pending := fake.uploadIDs, len(fake.uploads)
+	fake.mu.Unlock()
+	if multipartUploads != 1 || pending != 0 || fake.count("PUT") < 2 {
+		t.Fatalf("%d multipart uploads (%d pending), %d PUT requests", multipartUploads, pending, fake.count("PUT"))
+	}
+	object := fake.object(objectKey(m0))
+	if object == nil || len(object.data) <= int(multipartPartSize) || object.header.Get("X-Amz-Meta-Max-Ts") != strconv.FormatInt(t0+59, 10) {
+		t.Fatalf("multipart object %d bytes with headers %v", len(object.data), object.header)
+	}
+	read, _, err := getMinuteEntries(context.Background(), m0, nil)
+	if err != nil || len(read) != len(entries) || read[len(read)-1].Message != entries[len(entries)-1].Message {
+		t.Errorf("read %d entries back: %v", len(read), err)
+	}
+
+	// Small objects keep using a single PutObject
+	storeTestMinute(t, m1, LogEntry{Timestamp: t1, Message: "small"})
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.uploadIDs != 1 || fake.objects[objectKey(m1)] == nil {
+		t.Errorf("small object uploaded with %d multipart uploads", fake.uploadIDs)
+	}
+}
+
+func TestErrorEntriesStoredInBothStores(t *testing.T) {
+	fake := newFakeS3(t)
+	useTempDirectories(t)
+	useTestBuffer(t)
+	override(t, &accumulated, nil)
+	override(t, &sinks, nil)
+	override(t, &errorStoreLevel, "ERROR")
+	override(t, &errorStoreMode, "copy")
+	if err := os.MkdirAll(errorStoreDirectory, 0755); err != nil {
+		t.Fatal(err)
+	}
+	registerSink("s3", &s3Sink{directory: logsDirectory})
+	registerSink("errors", &filteredSink{sink: &s3Sink{directory: errorStoreDirectory}, keep: isErrorEntry})
+	m0, t0 := minuteAt(0)
+	for _, entry := range []LogEntry{
+		{Timestamp: t0 + 1, Message: "served", Level: "INFO"},
+		{Timestamp: t0 + 2, Message: "failed", Level: "error"},
+		{Timestamp: t0 + 3, Message: "crashed", Level: "FATAL"},
+	} {
+		entry.Bucket = m0
+		logChannel <- entry
+	}
+	flushLogChannel()
+
+	files, err := listLocalFiles()
+	if err != nil || len(files) != 2 {
+		t.Fatalf("local files %+v %v", files, err)
+	}
+	for _, file := range files {
+		if err := uploadToS3WithPrefix(file.name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fake.object(objectKey(m0)) == nil || fake.object(objectKey("errors/"+m0)) == nil {
+		t.Fatalf("bucket holds %v", fake.keys(""))
+	}
+
+	// The main store has every entry, the error store those at or above ERROR_STORE_LEVEL
+	useTestBuffer(t)
+	query := func(params string) string {
+		t.Helper()
+		var messages []string
+		for _, entry := range decodeEntries(t, serveQuery(t, fmt.Sprintf("start=%d&end=%d%s", t0, t0+59, params))) {
+			messages = append(messages, entry.Message)
+		}
+		return strings.Join(messages, ",")
+	}
+	if got := query(""); got != "served,failed,crashed" {
+		t.Errorf("main store returned %s", got)
+	}
+	if got := query("&store=errors"); got != "failed,crashed" {
+		t.Errorf("error store returned %s", got)
+	}
+}
+
+func TestIngestRejectsEntriesBeyondRetention(t *testing.T) {
+	acceptIngest(t)
+	override(t, &retention, 24*time.Hour)
+	override(t, &rejectBeyondRetention, true)
+	override(t, &maxClockSkew, 1000*time.Hour)
+	now := time.Now().Unix()
+	body := fmt.Sprintf(`[{"time":%d,"log":"recent"},{"time":%d,"log":"expired"}]`, now-2*3600, now-48*3600)
+	before := metricValue(`ingest_rejected_entries_total{reason="retention"}`)
+
+	recorder := postIngest(t, "/ingest", body)
+	var response ingestResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || recorder.Code != http.StatusCreated {
+		t.Fatalf("ingest answered %d %q", recorder.Code, recorder.Body.String())
+	}
+	if response.Accepted != 1 || len(response.Rejected) != 1 || response.Rejected[0].Entry.Message != "expired" ||
+		!strings.Contains(response.Rejected[0].Reason, "retention") {
+		t.Errorf("ingest response %+v", response)
+	}
+	if entries := drainTestChannel(); len(entries) != 1 || entries[0].Message != "recent" {
+		t.Errorf("enqueued %+v", entries)
+	}
+	if metricValue(`ingest_rejected_entries_total{reason="retention"}`) != before+1 {
+		t.Errorf("rejection not counted")
+	}
+
+	// REJECT_BEYOND_RETENTION=false accepts them
+	override(t, &rejectBeyondRetention, false)
+	if recorder := postIngest(t, "/ingest", body); recorder.Code != http.StatusCreated || len(drainTestChannel()) != 2 {
+		t.Errorf("ingest without the check answered %d %q", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestObjectFormatVersionsReadAlike(t *testing.T) {
+	fake := newFakeS3(t)
+	m0, t0 := minuteAt(0)
+	m1, _ := minuteAt(1)
+	m2, _ := minuteAt(2)
+	entries := []LogEntry{
+		{Timestamp: t0 + 1, Message: "plain"},
+		{Timestamp: t0 + 2, Message: "detailed", Level: "WARN", Fields: map[string]string{"host": "web-1"}},
+	}
+	override(t, &objectFormatVersion, 0)
+	storeTestMinute(t, m0, entries...)
+	override(t, &objectFormatVersion, 1)
+	storeTestMinute(t, m1, entries...)
+
+	if data := fake.object(objectKey(m0)).data; data[0] != '[' {
+		t.Errorf("v0 object starts with %q", data[:1])
+	}
+	if header := fake.object(objectKey(m1)).header; !bytes.HasPrefix(fake.object(objectKey(m1)).data, []byte(`{"version":1,`)) ||
+		header.Get("X-Amz-Meta-Format-Version") != "1" {
+		t.Errorf("v1 object %q with headers %v", fake.object(objectKey(m1)).data, header)
+	}
+	for _, minute := range []string{m0, m1} {
+		read, _, err := getMinuteEntries(context.Background(), minute, nil)
+		if err != nil || fmt.Sprint(read) != fmt.Sprint(entries) {
+			t.Errorf("minute %s read as %+v %v", minute, read, err)
+		}
+	}
+
+	// Versions newer than this build are refused instead of being misread
+	fake.put(objectKey(m2), []byte(`{"version":2,"entries":[]}`), nil)
+	if _, _, err := getMinuteEntries(context.Background(), m2, nil); err == nil || !strings.Contains(err.Error(), "version 2") {
+		t.Errorf("unknown version read with %v", err)
+	}
+}
+
+func TestQueryGroupsEntriesIntoWindows(t *testing.T) {
+	newFakeS3(t)
+	useTestBuffer(t)
+	m0, t0 := minuteAt(0) // t0 is a multiple of 5 minutes
+	m5, _ := minuteAt(5)
+	m15, _ := minuteAt(15)
+	storeTestMinute(t, m0, LogEntry{Timestamp: t0 + 10, Message: "a"}, LogEntry{Timestamp: t0 + 59, Message: "b"})
+	storeTestMinute(t, m5, LogEntry{Timestamp: t0 + 299, Message: "c"}, LogEntry{Timestamp: t0 + 300, Message: "d"})
+	storeTestMinute(t, m15, LogEntry{Timestamp: t0 + 900, Message: "e"})
+	windows := func(params string) string {
+		t.Helper()
+		recorder := serveQuery(t, fmt.Sprintf("start=%d&end=%d&%s", t0, t0+959, params))
+		var result []timeWindow
+		if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+			t.Fatalf("window query answered %d %q", recorder.Code, recorder.Body.String())
+		}
+		var groups []string
+		for _, window := range result {
+			var messages []string
+			for _, entry := range window.Entries {
+				messages = append(messages, entry.Message)
+			}
+			groups = append(groups, fmt.Sprintf("%d:%d:%s", window.WindowStart-t0, window.Count, strings.Join(messages, "")))
+		}
+		return strings.Join(groups, " ")
+	}
+
+	// The last second of a window belongs to it, empty windows are left out
+	if got := windows("window=5m"); got != "0:3:abc 300:1:d 900:1:e" {
+		t.Errorf("window=5m grouped %s", got)
+	}
+	if got := windows("window=5m&per_window=1"); got != "0:3:a 300:1:d 900:1:e" {
+		t.Errorf("per_window=1 grouped %s", got)
+	}
+	if got := windows("window=1h"); got != "0:5:abcde" {
+		t.Errorf("window=1h grouped %s", got)
+	}
+	for _, invalid := range []string{"window=500ms", "window=5m&per_window=0"} {
+		if recorder := serveQuery(t, fmt.Sprintf("start=%d&end=%d&%s", t0, t0+959, invalid)); recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s answered %d", invalid, recorder.Code)
+		}
+	}
+}
+
+func TestIngestDuringShutdownAnswers503(t *testing.T) {
+	fake := newFakeS3(t)
+	useTempDirectories(t)
+	useTestBuffer(t)
+	acceptIngest(t)
+	override(t, &sinks, nil)
+	override(t, &accumulated, nil)
+	override(t, &shutdownStorage, make(chan struct{}))
+	override(t, &storageStopped, make(chan struct{}))
+	override(t, &uploadRetries, make(map[string]*uploadRetry))
+	registerSink("s3", &s3Sink{directory: logsDirectory})
+	go periodicallyWriteToStorage()
+
+	// Clients keep ingesting until they are refused by the shutdown
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := make(map[string]bool)
+	started := make(chan struct{}, 8)
+	for client := 0; client < 8; client++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			for i := 0; i < 100000; i++ {
+				message := fmt.Sprintf("client %d entry %d", client, i)
+				recorder := postIngest(t, "/ingest", fmt.Sprintf(`[{"time":%d,"log":%q}]`, time.Now().Unix(), message))
+				switch recorder.Code {
+				case http.StatusCreated:
+					mu.Lock()
+					accepted[message] = true
+					mu.Unlock()
+					if i == 0 {
+						started <- struct{}{}
+					}
+				case http.StatusServiceUnavailable:
+					return
+				default:
+					t.Errorf("ingest answered %d %q", recorder.Code, recorder.Body.String())
+					return
+				}
+			}
+			t.Errorf("client %d was never refused", client)
+		}(client)
+	}
+	for client := 0; client < 8; client++ {
+		<-started
+	}
+	shutdown(&http.Server{})
+	wg.Wait()
+	// Every accepted entry was written out by the shutdown
+	stored := 0
+	for _, key := range fake.keys("") {
+		entries, err := decodeObjectEntries(fake.object(key).data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if !accepted[entry.Message] {
+				t.Errorf("stored entry %q wasn't accepted", entry.Message)
+			}
+			stored++
+		}
+	}
+	if stored != len(accepted) {
+		t.Errorf("%d entries stored, %d accepted", stored, len(accepted))
+	}
+	if recorder := postIngest(t, "/ingest", `[{"time":1709355600,"log":"late"}]`); recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("ingest after shutdown answered %d", recorder.Code)
+	}
+}
+
+func TestAdminConfigRedactsSecrets(t *testing.T) {
+	override(t, &apiKey, "api-secret-value")
+	override(t, &accessKeyID, "AKIATESTKEY")
+	override(t, &secretAccessKey, "aws-secret-value")
+	override(t, &bucketName, "logs-bucket")
+	override(t, &maxResultEntries, 250)
+	t.Setenv("API_KEYS", "ops:scoped-secret-value:admin")
+	get := func(key string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("GET", "/admin/config", nil)
+		request.Header.Set("X-API-Key", key)
+		recorder := httptest.NewRecorder()
+		configHandler(recorder, request)
+		return recorder
+	}
+	if recorder := get("wrong"); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("config without the key answered %d", recorder.Code)
+	}
+
+	recorder := get("api-secret-value")
+	body := recorder.Body.String()
+	for _, secret := range []string{"api-secret-value", "AKIATESTKEY", "aws-secret-value", "scoped-secret-value"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("config leaks %q", secret)
+		}
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &config); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("config answered %d %q", recorder.Code, body)
+	}
+	for name, want := range map[string]interface{}{
+		"API_KEY": "[redacted]", "AWS_SECRET_ACCESS_KEY": "[redacted]", "API_KEYS": "[redacted]",
+		"S3_BUCKET_NAME": "logs-bucket", "MAX_RESULT_ENTRIES": float64(250), "FLUSH_SORT": flushSort,
+	} {
+		if config[name] != want {
+			t.Errorf("config reports %s=%v, want %v", name, config[name], want)
+		}
+	}
+}
+
+func TestQueryMultipleRangesGroupsResults(t *testing.T) {
+	newFakeS3(t)
+	useTestBuffer(t)
+	m0, t0 := minuteAt(0)
+	m1, t1 := minuteAt(1)
+	m60, t60 := minuteAt(60)
+	storeTestMinute(t, m0, LogEntry{Timestamp: t0 + 5, Message: "a"})
+	storeTestMinute(t, m1, LogEntry{Timestamp: t1 + 5, Message: "b"})
+	storeTestMinute(t, m60, LogEntry{Timestamp: t60 + 5, Message: "c"}, LogEntry{Timestamp: t60 + 6, Message: "d"})
+	body := fmt.Sprintf(`{"ranges":[{"start":%d,"end":%d},{"start":%d,"end":%d}]}`, t60, t60+58, t0, t1+58)
+	ranges := func(query string) (*httptest.ResponseRecorder, string) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		queryHandler(recorder, httptest.NewRequest("POST", "/query?"+query, strings.NewReader(body)))
+		var results []rangeResult
+		if err := json.Unmarshal(recorder.Body.Bytes(), &results); err != nil {
+			return recorder, ""
+		}
+		var groups []string
+		for _, result := range results {
+			var messages []string
+			for _, entry := range result.Entries {
+				messages = append(messages, entry.Message)
+			}
+			groups = append(groups, fmt.Sprintf("%d:%s:%t", result.Start-t0, strings.Join(messages, ""), result.Truncated))
+		}
+		return recorder, strings.Join(groups, " ")
+	}
+
+	// Results come back in the order of the ranges of the request, not in time order
+	if recorder, got := ranges(""); got != "3600:cd:false 0:ab:false" {
+		t.Errorf("ranges answered %d grouped %q", recorder.Code, got)
+	}
+
+	// The object budget is shared, the two objects the first range reads use it up and the second one comes back empty
+	override(t, &maxQueryObjects, 2)
+	recorder, got := ranges("")
+	if got != "3600:cd:false 0::true" {
+		t.Errorf("shared budget grouped %q", got)
+	}
+	if recorder.Header().Get("X-Query-Truncated") != "true" {
+		t.Error("truncated range did not set X-Query-Truncated")
+	}
+
+	for _, invalid := range []string{fmt.Sprintf("start=%d", t0), "limit=1", "cursor=" + m0} {
+		if recorder, _ := ranges(invalid); recorder.Code != http.StatusBadRequest {
+			t.Errorf("ranges with %s answered %d", invalid, recorder.Code)
+		}
+	}
+}
+
+func TestQueryServesCompactedHourFromOneObject(t *testing.T) {
+	fake := newFakeS3(t)
+	useTestBuffer(t)
+	override(t, &queryCompactedHours, true)
+	m0, t0 := minuteAt(0)
+	m30, t30 := minuteAt(30)
+	m60, t60 := minuteAt(60)
+	m90, t90 := minuteAt(90)
+	storeTestMinute(t, m0, LogEntry{Timestamp: t0 + 1, Message: "a"})
+	storeTestMinute(t, m30, LogEntry{Timestamp: t30 + 1, Message: "b"})
+	storeTestMinute(t, m60, LogEntry{Timestamp: t60 + 1, Message: "c"})
+	storeTestMinute(t, m90, LogEntry{Timestamp: t90 + 1, Message: "d"})
+	hour := hourOfMinute(m0)
+	if err := compactHour(hour); err != nil {
+		t.Fatalf("compacting hour %s: %v", hour, err)
+	}
+	compactionReads := fake.fetched(objectKey(m0))
+	messages := func(start, end int64) string {
+		t.Helper()
+		var got []string
+		for _, entry := range decodeEntries(t, serveQuery(t, fmt.Sprintf("start=%d&end=%d", start, end))) {
+			got = append(got, entry.Message)
+		}
+		return strings.Join(got, "")
+	}
+
+	// The compacted hour is read from its hourly object, none of its minutes are fetched
+	if got := messages(t0, t60-2); got != "ab" {
+		t.Errorf("compacted hour returned %q", got)
+	}
+	if fetched := fake.fetched(objectKey(hour)); fetched != 1 {
+		t.Errorf("hourly object fetched %d times", fetched)
+	}
+	for _, minute := range []string{m0, m30} {
+		if fetched := fake.fetched(objectKey(minute)) - compactionReads; fetched != 0 {
+			t.Errorf("minute %s of the compacted hour fetched %d times by the query", minute, fetched)
+		}
+	}
+
+	// The next hour isn't compacted, its minutes are read instead
+	if got := messages(t60, t60+3598); got != "cd" {
+		t.Errorf("uncompacted hour returned %q", got)
+	}
+	if fetched := fake.fetched(objectKey(m90)); fetched != 1 {
+		t.Errorf("minute %s of the uncompacted hour fetched %d times", m90, fetched)
+	}
+}
+
+func TestIngestSlowBodyTimesOut(t *testing.T) {
+	acceptIngest(t)
+	override(t, &ingestRequestTimeout, 100*time.Millisecond)
+	server := httptest.NewServer(http.HandlerFunc(ingestHandler))
+	t.Cleanup(server.Close)
+	timeouts := metricValue("ingest_timeouts_total")
+
+	// The client sends the start of the batch and then stalls
+	body, writer := io.Pipe()
+	t.Cleanup(func() { writer.Close() })
+	go writer.Write([]byte(`[{"message":"slow"`))
+	request, _ := http.NewRequest("POST", server.URL+"/ingest", body)
+	request.ContentLength = 1 << 10
+	start := time.Now()
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatalf("slow ingest failed: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("slow ingest answered %d", response.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("slow ingest answered after %s", elapsed)
+	}
+	if got := metricValue("ingest_timeouts_total") - timeouts; got != 1 {
+		t.Errorf("ingest_timeouts_total grew by %v", got)
+	}
+	if entries := drainTestChannel(); len(entries) != 0 {
+		t.Errorf("timed out batch enqueued %d entries", len(entries))
+	}
+}
+
+func TestPersistBufferWritesBufferedEntries(t *testing.T) {
+	newFakeS3(t)
+	useTempDirectories(t)
+	override(t, &apiKey, "secret")
+	override(t, &persistedEntries, make(map[string]int))
+	m0, t0 := minuteAt(0)
+	m1, t1 := minuteAt(1)
+	storeTestMinute(t, m0, LogEntry{Timestamp: t0 + 1, Message: "uploaded"})
+	useTestBuffer(t,
+		LogEntry{Timestamp: t0 + 2, Message: "a"},
+		LogEntry{Timestamp: t1 + 1, Message: "b"},
+		LogEntry{Timestamp: t1 + 2, Message: "c"},
+	)
+	persist := func(key string) (int, persistResult) {
+		t.Helper()
+		request := httptest.NewRequest("POST", "/admin/persist-buffer", nil)
+		request.Header.Set("X-API-Key", key)
+		recorder := httptest.NewRecorder()
+		persistBufferHandler(recorder, request)
+		var result persistResult
+		json.Unmarshal(recorder.Body.Bytes(), &result)
+		return recorder.Code, result
+	}
+
+	if code, _ := persist("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("persisting with a wrong key answered %d", code)
+	}
+	code, result := persist("secret")
+	if code != http.StatusOK || result != (persistResult{Minutes: 2, Persisted: 3, EntriesAdded: 3}) {
+		t.Fatalf("persisting answered %d %+v", code, result)
+	}
+
+	// The buffered entries are merged into the objects of their minutes, next to what was uploaded before
+	for minute, want := range map[string]string{m0: "uploaded a", m1: "b c"} {
+		entries, _, err := getMinuteEntries(context.Background(), minute, nil)
+		if err != nil {
+			t.Fatalf("reading minute %s: %v", minute, err)
+		}
+		var messages []string
+		for _, entry := range entries {
+			messages = append(messages, entry.Message)
+		}
+		if got := strings.Join(messages, " "); got != want {
+			t.Errorf("minute %s holds %q, want %q", minute, got, want)
+		}
+	}
+
+	// Repeating the call persists the same entries without adding them again
+	if code, result := persist("secret"); code != http.StatusOK || result.Persisted != 3 || result.EntriesAdded != 0 {
+		t.Errorf("persisting again answered %d %+v", code, result)
+	}
+	if entries := readAuditLog(t); len(entries) != 2 {
+		t.Errorf("persisting wrote %d audit records", len(entries))
+	}
+}
+
+func TestPrettyResponsesAreIndented(t *testing.T) {
+	newFakeS3(t)
+	useTestBuffer(t)
+	m0, t0 := minuteAt(0)
+	storeTestMinute(t, m0, LogEntry{Timestamp: t0 + 1, Message: "a"})
+	serveList := func(query string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		listHandler(recorder, httptest.NewRequest("GET", "/list?"+query, nil))
+		return recorder
+	}
+	responses := map[string]func(query string) *httptest.ResponseRecorder{
+		"query": func(query string) *httptest.ResponseRecorder {
+			return serveQuery(t, fmt.Sprintf("start=%d&end=%d&%s", t0, t0+58, query))
+		},
+		"list": serveList,
+	}
+
+	for name, serve := range responses {
+		compact := serve("").Body.Bytes()
+		if bytes.HasSuffix(compact, []byte("\n")) || !json.Valid(compact) {
+			t.Errorf("compact %s response %q", name, compact)
+		}
+
+		// The indented response holds the same value as the compact one
+		pretty := serve("pretty=true").Body.Bytes()
+		if !bytes.HasSuffix(pretty, []byte("\n")) || !bytes.Contains(pretty, []byte("\n  ")) {
+			t.Errorf("pretty %s response isn't indented: %q", name, pretty)
+		}
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, compact, "", "  "); err != nil || indented.String()+"\n" != string(pretty) {
+			t.Errorf("pretty %s response %q doesn't match the compact one %q", name, pretty, compact)
+		}
+	}
+
+	// RESPONSE_NEWLINE only adds the newline, the response stays compact
+	override(t, &responseNewline, true)
+	if body := serveList("").Body.String(); !strings.HasSuffix(body, "]\n") || strings.Contains(body, "\n  ") {
+		t.Errorf("RESPONSE_NEWLINE list response %q", body)
+	}
+}
+
+func TestQueryFetchesEndMinuteOnce(t *testing.T) {
+	fake := newFakeS3(t)
+	useTestBuffer(t)
+	m1, t1 := minuteAt(1)
+	m2, t2 := minuteAt(2)
+	storeTestMinute(t, m1, LogEntry{Timestamp: t1 + 40, Message: "a"})
+	storeTestMinute(t, m2, LogEntry{Timestamp: t2, Message: "b"})
+
+	// The end is the first second of minute 2, which both the loop over the range and its end minute reach
+	for i, start := range []int64{t1, t1 + 30} {
+		before := fake.fetched(objectKey(m2))
+		entries := decodeEntries(t, serveQuery(t, fmt.Sprintf("start=%d&end=%d", start, t2)))
+		if fetched := fake.fetched(objectKey(m2)) - before; fetched != 1 {
+			t.Errorf("query %d fetched the end minute %d times", i, fetched)
+		}
+		var messages []string
+		for _, entry := range entries {
+			messages = append(messages, entry.Message)
+		}
+		if got := strings.Join(messages, ""); got != "ab" {
+			t.Errorf("query %d returned %q", i, got)
+		}
+	}
+}
+
+func TestQueryTrimsSearchTerms(t *testing.T) {
+	newFakeS3(t)
+	_, t0 := minuteAt(0)
+	useTestBuffer(t, LogEntry{Timestamp: t0 + 1, Message: "took 5 ms"}, LogEntry{Timestamp: t0 + 2, Message: "took 5ms"})
+	matched := func(params string) string {
+		t.Helper()
+		var messages []string
+		for _, entry := range decodeEntries(t, serveQuery(t, fmt.Sprintf("start=%d&end=%d&%s", t0, t0+58, params))) {
+			messages = append(messages, entry.Message)
+		}
+		return strings.Join(messages, ",")
+	}
+
+	for params, want := range map[string]string{
+		"text=%20ms":                           "took 5 ms,took 5ms",
+		"text=%20ms&trim=false":                "took 5 ms",
+		"exclude=%20ms%20":                     "",
+		"exclude=%205ms&trim=false":            "took 5 ms",
+		"regex=%20%5Etook%205ms%24%0A":         "took 5ms",
+		"regex=%5Etook%205ms%24%20&trim=false": "",
+	} {
+		if got := matched(params); got != want {
+			t.Errorf("%s matched %q, want %q", params, got, want)
+		}
+	}
+}
+
+func TestDayManifestTracksWrittenMinutes(t *testing.T) {
+	fake := newFakeS3(t)
+	useTempDirectories(t)
+	override(t, &manifestPrefix, "manifests/")
+	override(t, &manifests, make(map[string]*dayManifest))
+	m0, t0 := minuteAt(0)
+	m1, t1 := minuteAt(1)
+	day := dayOfMinute(m0)
+	storeTestMinute(t, m0, LogEntry{Timestamp: t0 + 3, Message: "a"}, LogEntry{Timestamp: t0 + 9, Message: "b"})
+	storeTestMinute(t, m1, LogEntry{Timestamp: t1 + 1, Message: "c"})
+
+	// The stored manifest lists both minutes with their entries and time bounds
+	stored := fake.object(manifestPrefix + day + ".json.gz")
+	if stored == nil {
+		t.Fatalf("no manifest stored for %s", day)
+	}
+	content, err := decompressObjectContent(stored.data)
+	if err != nil {
+		t.Fatalf("decompressing manifest: %v", err)
+	}
+	var manifest dayManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		t.Fatalf("decoding manifest %q: %v", content, err)
+	}
+	if object := manifest.Objects[objectKey(m0)]; object == nil || object.Entries != 2 || object.MinTs != t0+3 || object.MaxTs != t0+9 {
+		t.Errorf("manifest records %s as %+v", m0, object)
+	}
+	if object := manifest.Objects[objectKey(m1)]; object == nil || object.Entries != 1 {
+		t.Errorf("manifest records %s as %+v", m1, object)
+	}
+
+	// A restarted instance answers availability from the stored manifest without listing the bucket
+	override(t, &manifests, make(map[string]*dayManifest))
+	lists := fake.listed()
+	recorder := httptest.NewRecorder()
+	availabilityHandler(recorder, httptest.NewRequest("GET", fmt.Sprintf("/availability?start=%d&end=%d", t0, t1+58), nil))
+	var availability []minuteAvailability
+	if err := json.Unmarshal(recorder.Body.Bytes(), &availability); err != nil {
+		t.Fatalf("availability answered %d %q", recorder.Code, recorder.Body.String())
+	}
+	uploaded := map[string]bool{}
+	for _, minute := range availability {
+		uploaded[minute.Minute] = minute.Uploaded
+	}
+	if !uploaded[m0] || !uploaded[m1] {
+		t.Errorf("availability from the manifest %+v", availability)
+	}
+	if got := fake.listed() - lists; got != 0 {
+		t.Errorf("availability listed the bucket %d times", got)
+	}
+
+	// A missing manifest is rebuilt from one listing of the day
+	override(t, &manifests, make(map[string]*dayManifest))
+	fake.mu.Lock()
+	delete(fake.objects, manifestPrefix+day+".json.gz")
+	fake.mu.Unlock()
+	lists = fake.listed()
+	recorder = httptest.NewRecorder()
+	listHandler(recorder, httptest.NewRequest("GET", "/list?day="+day, nil))
+	var keys []string
+	json.Unmarshal(recorder.Body.Bytes(), &keys)
+	if want := []string{objectKey(m0), objectKey(m1)}; !slices.Equal(keys, want) {
+		t.Errorf("list from the rebuilt manifest returned %q, want %q", keys, want)
+	}
+	if got := fake.listed() - lists; got != 1 {
+		t.Errorf("rebuilding the manifest listed the bucket %d times", got)
+	}
+	if fake.object(manifestPrefix+day+".json.gz") == nil {
+		t.Error("rebuilt manifest wasn't stored")
+	}
+}
+
+func TestScopedKeysEnforcedPerEndpoint(t *testing.T) {
+	newFakeS3(t)
+	useTempDirectories(t)
+	useTestBuffer(t)
+	acceptIngest(t)
+	override(t, &persistedEntries, make(map[string]int))
+	keys, err := parseScopedKeys(strings.Split("# keys of the tests\nshipper:write-key:write\n\ndashboard:read-key:read\nops:ops-key:read,admin\n", "\n"))
+	if err != nil {
+		t.Fatalf("parsing keys: %v", err)
+	}
+	override(t, &scopedKeys, keys)
+	_, t0 := minuteAt(0)
+	endpoints := []struct {
+		name    string
+		target  string
+		body    string
+		handler http.HandlerFunc
+	}{
+		{"ingest", "/ingest", `[{"message":"a"}]`, requireScope(scopeWrite, ingestHandler)},
+		{"query", fmt.Sprintf("/query?start=%d&end=%d", t0, t0+58), "", requireScope(scopeRead, queryHandler)},
+		{"list", "/list", "", requireScope(scopeRead, listHandler)},
+		{"persist", "/admin/persist-buffer", "", persistBufferHandler},
+	}
+	serve := func(name, key string) int {
+		t.Helper()
+		for _, endpoint := range endpoints {
+			if endpoint.name != name {
+				continue
+			}
+			method := "GET"
+			if endpoint.body != "" || strings.HasPrefix(endpoint.target, "/admin/") {
+				method = "POST"
+			}
+			request := httptest.NewRequest(method, endpoint.target, strings.NewReader(endpoint.body))
+			if key != "" {
+				request.Header.Set("Authorization", "Bearer "+key)
+			}
+			recorder := httptest.NewRecorder()
+			endpoint.handler(recorder, request)
+			return recorder.Code
+		}
+		t.Fatalf("no endpoint %s", name)
+		return 0
+	}
+
+	for _, test := range []struct {
+		endpoint, key string
+		want          int
+	}{
+		{"ingest", "write-key", http.StatusCreated},
+		{"ingest", "read-key", http.StatusForbidden},
+		{"ingest", "", http.StatusUnauthorized},
+		{"query", "read-key", http.StatusOK},
+		{"query", "write-key", http.StatusForbidden},
+		{"query", "unknown-key", http.StatusUnauthorized},
+		{"list", "ops-key", http.StatusOK},
+		{"list", "write-key", http.StatusForbidden},
+		{"persist", "ops-key", http.StatusOK},
+		{"persist", "read-key", http.StatusUnauthorized},
+		{"persist", "write-key", http.StatusUnauthorized},
+	} {
+		if got := serve(test.endpoint, test.key); got != test.want {
+			t.Errorf("%s with key %q answered %d, want %d", test.endpoint, test.key, got, test.want)
+		}
+	}
+
+	if _, err := parseScopedKeys([]string{"shipper:write-key:delete"}); err == nil {
+		t.Error("unknown scope accepted")
+	}
+	if _, err := parseScopedKeys([]string{"write-key"}); err == nil || strings.Contains(err.Error(), "write-key") {
+		t.Errorf("malformed entry gave error %v", err)
+	}
+}
+
+func TestQueryFallsBackToLocalDataWhileS3IsDown(t *testing.T) {
+	fake := newFakeS3(t)
+	useTempDirectories(t)
+	m0, t0 := minuteAt(0)
+	m1, t1 := minuteAt(1)
+	_, t2 := minuteAt(2)
+	storeTestMinute(t, m0, LogEntry{Timestamp: t0 + 1, Message: "uploaded"})
+	writeLocalFile(t, m1, LogEntry{Timestamp: t1 + 1, Message: "local"})
+	useTestBuffer(t, LogEntry{Timestamp: t2 + 1, Message: "buffered"})
+	fake.fail = func(r *http.Request) bool { return true }
+	query := fmt.Sprintf("start=%d&end=%d", t0, t2+58)
+
+	// Failed reads open the breaker, the buffer is still searched meanwhile
+	for i := 0; !s3Breaker.isOpen(); i++ {
+		if i == 10 {
+			t.Fatal("failing S3 reads didn't open the breaker")
+		}
+		serveQuery(t, query)
+	}
+
+	gets := fake.count("GET")
+	recorder := serveQuery(t, query)
+	var messages []string
+	for _, entry := range decodeEntries(t, recorder) {
+		messages = append(messages, entry.Message)
+	}
+	if got := strings.Join(messages, ","); got != "local,buffered" {
+		t.Errorf("degraded query returned %q", got)
+	}
+	if recorder.Header().Get("X-Query-Degraded") != "true" {
+		t.Error("degraded query isn't marked with X-Query-Degraded")
+	}
+	if got := fake.count("GET") - gets; got != 0 {
+		t.Errorf("degraded query sent %d GET requests", got)
+	}
+
+	// Strict queries keep reading S3
+	gets = fake.count("GET")
+	if recorder := serveQuery(t, query+"&strict=true"); recorder.Header().Get("X-Query-Degraded") != "" {
+		t.Error("strict query was degraded")
+	}
+	if fake.count("GET") == gets {
+		t.Error("strict query didn't read S3")
+	}
+}
+
+func TestQueryObservesLatencyPerSource(t *testing.T) {
+	newFakeS3(t)
+	useTempDirectories(t)
+	m0, t0 := minuteAt(0)
+	m1, t1 := minuteAt(1)
+	storeTestMinute(t, m0, LogEntry{Timestamp: t0 + 1, Message: "a"})
+	writeLocalFile(t, m1, LogEntry{Timestamp: t1 + 1, Message: "b"})
+	useTestBuffer(t, LogEntry{Timestamp: t1 + 2, Message: "c"})
+	source := func(name string) float64 {
+		return metricValue(fmt.Sprintf("query_source_duration_seconds_count{source=%q}", name))
+	}
+	query := fmt.Sprintf("start=%d&end=%d", t0, t0+58)
+
+	// The range reads the object of the minute before it and that of m0, then scans the buffer
+	s3Reads, bufferScans, localReads := source("s3"), source("buffer"), source("local")
+	queries, fetched := metricValue("query_objects_fetched_count"), metricValue("query_objects_fetched_sum")
+	serveQuery(t, query)
+	if got := source("s3") - s3Reads; got != 2 {
+		t.Errorf("s3 source observed %v times", got)
+	}
+	if got := source("buffer") - bufferScans; got != 1 {
+		t.Errorf("buffer source observed %v times", got)
+	}
+	if got := source("local") - localReads; got != 0 {
+		t.Errorf("local source observed %v times with the buffer", got)
+	}
+	if got := metricValue("query_objects_fetched_count") - queries; got != 1 {
+		t.Errorf("query_objects_fetched observed %v times", got)
+	}
+	if got := metricValue("query_objects_fetched_sum") - fetched; got != 2 {
+		t.Errorf("query_objects_fetched grew by %v objects", got)
+	}
+
+	// Without the buffer the local files are read instead
+	override(t, &bufferDisabled, true)
+	localReads = source("local")
+	serveQuery(t, query)
+	if got := source("local") - localReads; got != 1 {
+		t.Errorf("local source observed %v times without the buffer", got)
+	}
+
+	recorder := httptest.NewRecorder()
+	metricsHandler(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	for _, series := range []string{
+		`query_source_duration_seconds_bucket{source="s3",le="+Inf"}`,
+		`query_source_duration_seconds_count{source="local"}`,
+		"# TYPE query_objects_fetched histogram",
+	} {
+		if !strings.Contains(recorder.Body.String(), series) {
+			t.Errorf("/metrics lacks %s", series)
+		}
+	}
+}
+
+func TestUploadsStayWithinInflightBytes(t *testing.T) {
+	fake := newFakeS3(t)
+	useTempDirectories(t)
+	useTestBuffer(t)
+	var pending []string
+	keys := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		minute, ts := minuteAt(i)
+		entries := make([]LogEntry, 2000)
+		for j := range entries {
+			entries[j] = LogEntry{Timestamp: ts, Message: strings.Repeat("x", 100)}
+		}
+		pending = append(pending, writeLocalFile(t, minute, entries...))
+		keys[objectKey(minute)] = true
+	}
+	info, err := os.Stat(pending[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two of the files fit in the budget, a third one doesn't
+	budget := &byteBudget{limit: info.Size()*5/2 + 1}
+	override(t, &uploadInflightBytes, budget)
+
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	releaseAll := func() { releaseOnce.Do(func() { close(release) }) }
+	t.Cleanup(releaseAll)
+	var stalled atomic.Int32
+	var peak atomic.Int64
+	fake.stall = func(r *http.Request) bool {
+		if r.Method == "PUT" && keys[strings.TrimPrefix(r.URL.Path, "/test-bucket/")] {
+			budget.mu.Lock()
+			if budget.used > peak.Load() {
+				peak.Store(budget.used)
+			}
+			budget.mu.Unlock()
+			stalled.Add(1)
+			<-release
+		}
+		return false
+	}
+
+	slots := make(chan struct{}, len(pending))
+	uploadStateMu.Lock()
+	dispatchUploads(pending, slots)
+	uploadStateMu.Unlock()
+
+	// Every file has a worker, only two of them read their file and upload it
+	for deadline := time.Now().Add(5 * time.Second); stalled.Load() < 2; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d uploads started", stalled.Load())
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := stalled.Load(); got != 2 {
+		t.Errorf("%d uploads in flight with a budget of two files", got)
+	}
+	if got := metricValue("upload_inflight_bytes"); got != float64(2*info.Size()) {
+		t.Errorf("upload_inflight_bytes is %v with two files of %d bytes in flight", got, info.Size())
+	}
+
+	releaseAll()
+	// Taking every slot waits for the workers to finish
+	for i := 0; i < cap(slots); i++ {
+		slots <- struct{}{}
+	}
+	for key := range keys {
+		if fake.object(key) == nil {
+			t.Errorf("%s not uploaded", key)
+		}
+	}
+	if got := peak.Load(); got > budget.limit {
+		t.Errorf("%d bytes in flight, above the budget of %d", got, budget.limit)
+	}
+	if budget.used != 0 {
+		t.Errorf("%d bytes still held after the uploads", budget.used)
+	}
+}
+
+func TestEmbeddedJSONFlaggedOrRejected(t *testing.T) {
+	useTestBuffer(t)
+	acceptIngest(t)
+	now := time.Now()
+	messages := []string{`{"user":"a","ok":true}`, ` [1,2,3] `, `{"user":"a",`, `[1,2`, `{not json}`, `plain {text}`}
+	entries := make([]LogEntry, len(messages))
+	for i, message := range messages {
+		entries[i] = LogEntry{Timestamp: now.Unix(), Message: message, Fields: map[string]string{"host": "web-1"}}
+	}
+
+	// flag keeps every entry, marking the malformed ones
+	override(t, &embeddedJSONPolicy, "flag")
+	body, _ := json.Marshal(entries)
+	if recorder := postIngest(t, "/ingest", string(body)); recorder.Code != http.StatusCreated {
+		t.Fatalf("ingest answered %d %q", recorder.Code, recorder.Body.String())
+	}
+	var flagged []string
+	for _, entry := range drainTestChannel() {
+		if entry.Fields["invalid_json"] == "true" {
+			flagged = append(flagged, entry.Message)
+		}
+		if entry.Fields["host"] != "web-1" {
+			t.Errorf("flagging %q lost its fields %v", entry.Message, entry.Fields)
+		}
+	}
+	if got := strings.Join(flagged, " "); got != `{"user":"a", [1,2 {not json}` {
+		t.Errorf("flagged %q", got)
+	}
+
+	// reject drops the malformed ones
+	override(t, &embeddedJSONPolicy, "reject")
+	accepted, rejected := admitLogEntries(entries, now)
+	if len(accepted) != 3 || len(rejected) != 3 {
+		t.Fatalf("reject accepted %d and rejected %d entries", len(accepted), len(rejected))
+	}
+	for _, entry := range rejected {
+		if entry.Reason != "message is malformed JSON" || validEmbeddedJSON(entry.Entry.Message) {
+			t.Errorf("rejected %q: %s", entry.Entry.Message, entry.Reason)
+		}
+	}
+
+	// off, the default, checks nothing
+	override(t, &embeddedJSONPolicy, "off")
+	if accepted, _ := admitLogEntries(entries, now); len(accepted) != len(entries) || accepted[2].Fields["invalid_json"] != "" {
+		t.Errorf("off accepted %d entries %+v", len(accepted), accepted)
+	}
+}
+
+func TestLifecycleRuleMergedIntoBucketRules(t *testing.T) {
+	fake := newFakeS3(t)
+	override(t, &s3ObjectKeysPrefix, "logs/")
+	override(t, &retention, 10*24*time.Hour+time.Hour)
+	override(t, &lifecycleTransitionIADays, int64(30))
+	rules := func() map[string]*s3.LifecycleRule {
+		t.Helper()
+		lifecycle, err := s3Client.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(bucketName)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		byID := make(map[string]*s3.LifecycleRule)
+		for _, rule := range lifecycle.Rules {
+			byID[aws.StringValue(rule.ID)] = rule
+		}
+		return byID
+	}
+
+	// Without a lifecycle configuration the rule is created
+	if err := ensureLifecycleRule(); err != nil {
+		t.Fatalf("creating the lifecycle rule: %v", err)
+	}
+	rule := rules()["log-ingester-logs"]
+	if rule == nil || aws.StringValue(rule.Filter.Prefix) != "logs/" || aws.Int64Value(rule.Expiration.Days) != 11 ||
+		len(rule.Transitions) != 1 || aws.Int64Value(rule.Transitions[0].Days) != 30 ||
+		aws.StringValue(rule.Transitions[0].StorageClass) != s3.TransitionStorageClassStandardIa {
+		t.Fatalf("created lifecycle rule %v", rule)
+	}
+
+	// A changed retention replaces the rule and keeps the rules of other prefixes
+	_, err := s3Client.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+		Bucket: aws.String(bucketName),
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: []*s3.LifecycleRule{rule, {
+			ID:         aws.String("archive"),
+			Status:     aws.String(s3.ExpirationStatusEnabled),
+			Filter:     &s3.LifecycleRuleFilter{Prefix: aws.String("archive/")},
+			Expiration: &s3.LifecycleExpiration{Days: aws.Int64(365)},
+		}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &retention, 3*24*time.Hour)
+	if err := ensureLifecycleRule(); err != nil {
+		t.Fatalf("updating the lifecycle rule: %v", err)
+	}
+	merged := rules()
+	if len(merged) != 2 || aws.Int64Value(merged["log-ingester-logs"].Expiration.Days) != 3 ||
+		aws.Int64Value(merged["archive"].Expiration.Days) != 365 {
+		t.Errorf("merged lifecycle rules %v", merged)
+	}
+
+	// An up to date rule isn't written again
+	puts := fake.count("PUT")
+	if err := ensureLifecycleRule(); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.count("PUT") - puts; got != 0 {
+		t.Errorf("up to date rule written %d times", got)
+	}
+}
+
+func TestConcurrencyLimitsPerEndpoint(t *testing.T) {
+	limits, err := parseConcurrencyLimits("list=1, summary=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &concurrencyLimits, limits)
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	releaseAll := func() { releaseOnce.Do(func() { close(release) }) }
+	t.Cleanup(releaseAll)
+	var running atomic.Int32
+	blocking := func(w http.ResponseWriter, r *http.Request) {
+		running.Add(1)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}
+	handlers := map[string]http.HandlerFunc{
+		"list":    limitConcurrency("list", blocking),
+		"summary": limitConcurrency("summary", blocking),
+	}
+	serve := func(endpoint string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handlers[endpoint](recorder, httptest.NewRequest("GET", "/"+endpoint, nil))
+		return recorder
+	}
+
+	// Saturate both endpoints, each up to its own limit
+	var wg sync.WaitGroup
+	for _, endpoint := range []string{"list", "summary", "summary"} {
+		wg.Add(1)
+		go func(endpoint string) {
+			defer wg.Done()
+			if recorder := serve(endpoint); recorder.Code != http.StatusOK {
+				t.Errorf("admitted %s request answered %d", endpoint, recorder.Code)
+			}
+		}(endpoint)
+	}
+	for deadline := time.Now().Add(5 * time.Second); running.Load() < 3; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests admitted", running.Load())
+		}
+	}
+
+	for _, endpoint := range []string{"list", "summary"} {
+		rejections := metricValue(fmt.Sprintf("requests_rejected_total{endpoint=%q}", endpoint))
+		recorder := serve(endpoint)
+		if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != "1" {
+			t.Errorf("%s beyond its limit answered %d", endpoint, recorder.Code)
+		}
+		if got := metricValue(fmt.Sprintf("requests_rejected_total{endpoint=%q}", endpoint)) - rejections; got != 1 {
+			t.Errorf("requests_rejected_total of %s grew by %v", endpoint, got)
+		}
+	}
+
+	// Freed slots admit requests again
+	releaseAll()
+	wg.Wait()
+	for _, endpoint := range []string{"list", "summary"} {
+		if recorder := serve(endpoint); recorder.Code != http.StatusOK {
+			t.Errorf("%s after the release answered %d", endpoint, recorder.Code)
+		}
+	}
+
+	if _, err := parseConcurrencyLimits("count=1"); err == nil {
+		t.Error("limit of an unknown endpoint accepted")
+	}
+}
+
+func TestIngestBucketRoutesEntriesToNamedMinute(t *testing.T) {
+	newFakeS3(t)
+	useTempDirectories(t)
+	useTestBuffer(t)
+	acceptIngest(t)
+	m5, t5 := minuteAt(5)
+	m7, _ := minuteAt(7)
+	body := fmt.Sprintf(`[{"time":%d,"log":"own bucket","bucket":%q},{"time":%d,"log":"batch bucket"},`+
+		`{"time":%d,"log":"malformed","bucket":"2024-03-02 05:05"}]`, t5, m5, t5, t5)
+	recorder := postIngest(t, "/ingest", body, "X-Target-Minute", m7)
+	if recorder.Code >= 300 {
+		t.Fatalf("ingest answered %d %q", recorder.Code, recorder.Body.String())
+	}
+	if !strings.Contains(recorder.Body.String(), "invalid bucket") {
+		t.Errorf("malformed bucket not reported in %q", recorder.Body.String())
+	}
+	entries := drainTestChannel()
+	if len(entries) != 2 {
+		t.Fatalf("enqueued %d entries", len(entries))
+	}
+
+	// The sink writes each entry to the file of its bucket, which is uploaded as the object of that minute
+	if err := (&s3Sink{directory: logsDirectory}).Write(entries); err != nil {
+		t.Fatal(err)
+	}
+	for minute, want := range map[string]string{m5: "own bucket", m7: "batch bucket"} {
+		if err := uploadToS3WithPrefix(filepath.Join(logsDirectory, minute+".txt")); err != nil {
+			t.Fatalf("uploading minute %s: %v", minute, err)
+		}
+		stored, _, err := getMinuteEntries(context.Background(), minute, nil)
+		if err != nil {
+			t.Fatalf("reading minute %s: %v", minute, err)
+		}
+		if len(stored) != 1 || stored[0].Message != want || stored[0].Bucket != "" {
+			t.Errorf("minute %s holds %+v, want %q without its bucket", minute, stored, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(logsDirectory, formatMinute(time.Now())+".txt")); err == nil {
+		t.Error("entries with a bucket were written to the current minute")
+	}
+}
+
+func TestFailingDiskAppliesBackpressure(t *testing.T) {
+	useTempDirectories(t)
+	useTestBuffer(t)
+	acceptIngest(t)
+	override(t, &sinks, nil)
+	override(t, &accumulated, nil)
+	override(t, &sinkRetryAttempts, 3)
+	override(t, &sinkRetryInitialInterval, 10*time.Millisecond)
+	t.Cleanup(func() { failingSinks.Store(0) })
+
+	// The sink's directory is a regular file, so that opening the minute's file fails even as root
+	directory := filepath.Join(t.TempDir(), "disk")
+	if err := os.WriteFile(directory, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	registerSink("disk", &s3Sink{directory: directory})
+	writeErrors := func() float64 { return metricValue(`sink_write_errors_total{sink="disk"}`) }
+
+	_, t0 := minuteAt(0)
+	logChannel <- LogEntry{Timestamp: t0, Message: "kept"}
+	errorsBefore := writeErrors()
+	start := time.Now()
+	flushLogChannel()
+	if got := writeErrors() - errorsBefore; got != 3 {
+		t.Errorf("failing write attempted %v times", got)
+	}
+	// Attempts are 10ms and 20ms apart
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("attempts took %s, without backing off", elapsed)
+	}
+	if failingSinks.Load() != 1 || len(sinks[0].held) != 1 || metricValue(`sink_failing{sink="disk"}`) != 1 {
+		t.Fatalf("failing sink holds %d entries, %d sinks failing", len(sinks[0].held), failingSinks.Load())
+	}
+
+	// Ingestion is pushed back while the entries are held
+	rejections := metricValue("ingest_sink_backpressure_total")
+	recorder := postIngest(t, "/ingest", fmt.Sprintf(`[{"time":%d,"log":"later"}]`, t0+1))
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("ingest with a failing sink answered %d", recorder.Code)
+	}
+	if got := metricValue("ingest_sink_backpressure_total") - rejections; got != 1 {
+		t.Errorf("ingest_sink_backpressure_total grew by %v", got)
+	}
+
+	// Flushes within the backoff don't touch the disk
+	errorsBefore = writeErrors()
+	for i := 0; i < 20; i++ {
+		flushLogChannel()
+	}
+	if got := writeErrors() - errorsBefore; got != 0 {
+		t.Errorf("flushes within the backoff wrote %v times", got)
+	}
+
+	// Once the disk is writable again the held entry is written and ingestion resumes
+	if err := os.Remove(directory); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(directory, 0755); err != nil {
+		t.Fatal(err)
+	}
+	sinks[0].retryAt = time.Time{}
+	flushLogChannel()
+	if failingSinks.Load() != 0 || metricValue(`sink_failing{sink="disk"}`) != 0 {
+		t.Errorf("%d sinks failing after the disk recovered", failingSinks.Load())
+	}
+	files, _ := os.ReadDir(directory)
+	if len(files) != 1 {
+		t.Fatalf("recovered disk holds %d files", len(files))
+	}
+	written, _, err := readLocalFile(filepath.Join(directory, files[0].Name()))
+	if err != nil || len(written) != 1 || written[0].Message != "kept" {
+		t.Errorf("recovered disk holds %+v: %v", written, err)
+	}
+	if recorder := postIngest(t, "/ingest", fmt.Sprintf(`[{"time":%d,"log":"later"}]`, t0+1)); recorder.Code != http.StatusCreated {
+		t.Errorf("ingest after the recovery answered %d", recorder.Code)
+	}
+}
+
+func TestTopGroupsErrorsByPattern(t *testing.T) {
+	newFakeS3(t)
+	for message, want := range map[string]string{
+		"user 42 took 1.5ms": "user {n} took {n}ms",
+		"request 0b7f3c9e-1d2a-4e5f-8a9b-0c1d2e3f4a5b failed": "request {uuid} failed",
+		"bad pointer 0x7ffd and commit 3f9a27c1e0":            "bad pointer {hex} and commit {hex}",
+		"connection to 10.0.0.12:5432 refused":                "connection to {n} refused",
+		"deadbeefcafe stays a word, so does 'database'":       "deadbeefcafe stays a word, so does 'database'",
+	} {
+		if got := messagePattern(message); got != want {
+			t.Errorf("pattern of %q is %q, want %q", message, got, want)
+		}
+	}
+
+	m0, t0 := minuteAt(0)
+	useTestBuffer(t)
+	storeTestMinute(t, m0,
+		LogEntry{Timestamp: t0 + 1, Level: "ERROR", Message: "timeout calling 0b7f3c9e-1d2a-4e5f-8a9b-0c1d2e3f4a5b after 300ms"},
+		LogEntry{Timestamp: t0 + 2, Level: "error", Message: "timeout calling 1c8f3c9e-1d2a-4e5f-8a9b-0c1d2e3f4a5b after 5000ms"},
+		LogEntry{Timestamp: t0 + 3, Level: "ERROR", Message: "timeout calling 0b7f3c9e-1d2a-4e5f-8a9b-0c1d2e3f4a5b after 300ms"},
+		LogEntry{Timestamp: t0 + 4, Level: "ERROR", Message: "disk 3 full"},
+		LogEntry{Timestamp: t0 + 5, Level: "INFO", Message: "disk 4 full"},
+		LogEntry{Timestamp: t0 + 6, Level: "INFO", Message: "disk 5 full"},
+		LogEntry{Timestamp: t0 + 7, Level: "INFO", Message: "disk 6 full"},
+	)
+	top := func(params string) []messagePatternGroup {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		topHandler(recorder, httptest.NewRequest("GET", fmt.Sprintf("/top?start=%d&end=%d&%s", t0, t0+58, params), nil))
+		var patterns []messagePatternGroup
+		if err := json.Unmarshal(recorder.Body.Bytes(), &patterns); err != nil {
+			t.Fatalf("top answered %d %q", recorder.Code, recorder.Body.String())
+		}
+		return patterns
+	}
+
+	// Similar errors group together, most frequent first, with the distinct messages as examples
+	patterns := top("level=ERROR")
+	if len(patterns) != 2 {
+		t.Fatalf("top returned %+v", patterns)
+	}
+	if got := patterns[0]; got.Pattern != "timeout calling {uuid} after {n}ms" || got.Count != 3 || len(got.Examples) != 2 ||
+		got.FirstTs != t0+1 || got.LastTs != t0+3 {
+		t.Errorf("top pattern %+v", got)
+	}
+	if got := patterns[1]; got.Pattern != "disk {n} full" || got.Count != 1 {
+		t.Errorf("second pattern %+v", got)
+	}
+
+	// Without a level every entry counts, n keeps the most frequent patterns
+	if patterns := top("n=1"); len(patterns) != 1 || patterns[0].Pattern != "disk {n} full" || patterns[0].Count != 4 {
+		t.Errorf("top n=1 returned %+v", patterns)
+	}
+}
+
+// countingSink counts the batches written through it to sink
+type countingSink struct {
+	sink   Sink
+	writes int
+}
+
+func (s *countingSink) Write(batch []LogEntry) error {
+	s.writes++
+	return s.sink.Write(batch)
+}
+
+func TestAccumulatingTicksReducesFileWrites(t *testing.T) {
+	useTestBuffer(t)
+	useTempDirectories(t)
+	override(t, &sinks, nil)
+	override(t, &accumulated, nil)
+	disk := &countingSink{sink: &s3Sink{directory: logsDirectory}}
+	registerSink("disk", disk)
+	// The ticks of a run share a minute, so that only the thresholds end an accumulation
+	if now := time.Now(); now.Second() == 59 {
+		time.Sleep(time.Until(now.Truncate(time.Minute).Add(time.Minute)))
+	}
+	_, t0 := minuteAt(0)
+	// lowVolume sends one entry per tick for ten ticks, then flushes like the shutdown does
+	lowVolume := func(tick func()) int {
+		t.Helper()
+		disk.writes = 0
+		for i := 0; i < 10; i++ {
+			logChannel <- LogEntry{Timestamp: t0 + int64(i), Message: "tick"}
+			tick()
+		}
+		flushLogChannel()
+		return disk.writes
+	}
+
+	// Without FLUSH_MAX_DELAY every tick with entries writes the file
+	if writes := lowVolume(func() { flushLogChannel() }); writes != 10 {
+		t.Errorf("unbuffered ticks wrote %d times", writes)
+	}
+
+	// Accumulating up to 4 entries writes at the 4th and 8th tick and at the final flush
+	override(t, &flushMaxDelay, time.Hour)
+	override(t, &flushMaxEntries, 4)
+	if writes := lowVolume(func() { accumulateLogChannel(time.Now()) }); writes != 3 {
+		t.Errorf("accumulating ticks wrote %d times", writes)
+	}
+	if len(accumulated) != 0 {
+		t.Errorf("%d entries left accumulated after the final flush", len(accumulated))
+	}
+
+	// The delay bounds the latency of the accumulated entries
+	override(t, &flushMaxEntries, 0)
+	override(t, &flushMaxDelay, 2*time.Second)
+	disk.writes = 0
+	logChannel <- LogEntry{Timestamp: t0, Message: "late"}
+	accumulateLogChannel(time.Now())
+	accumulateLogChannel(accumulatedSince.Add(time.Second))
+	if disk.writes != 0 {
+		t.Errorf("entry written %d times before FLUSH_MAX_DELAY", disk.writes)
+	}
+	accumulateLogChannel(accumulatedSince.Add(2 * time.Second))
+	if disk.writes != 1 {
+		t.Errorf("entry written %d times once FLUSH_MAX_DELAY passed", disk.writes)
+	}
+
+	written, _, err := readLocalFile(filepath.Join(logsDirectory, formatMinute(time.Now())+".txt"))
+	if err != nil || len(written) != 21 {
+		t.Errorf("local file holds %d entries: %v", len(written), err)
+	}
+}
+
+func TestRedactionAppliedBeforeStorage(t *testing.T) {
+	fake := newFakeS3(t)
+	useTempDirectories(t)
+	useTestBuffer(t)
+	acceptIngest(t)
+	rules, err := parseRedactionRules("email, bearer", []string{"# session tokens", `token=[a-z0-9]+`, ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &redactionRules, rules)
+	m0, t0 := minuteAt(0)
+	body := fmt.Sprintf(`[{"time":%d,"log":"login by jane.doe@example.com with Authorization: Bearer abc.DEF-123","bucket":%q,`+
+		`"fields":{"url":"/home?token=s3cr3t","host":"web-1"}},{"time":%d,"log":"nothing to hide","bucket":%q}]`, t0, m0, t0+1, m0)
+	redacted := metricValue("ingest_redacted_entries_total")
+	if recorder := postIngest(t, "/ingest", body); recorder.Code != http.StatusCreated {
+		t.Fatalf("ingest answered %d %q", recorder.Code, recorder.Body.String())
+	}
+	if got := metricValue("ingest_redacted_entries_total") - redacted; got != 1 {
+		t.Errorf("ingest_redacted_entries_total grew by %v", got)
+	}
+
+	entries := drainTestChannel()
+	if len(entries) != 2 {
+		t.Fatalf("enqueued %d entries", len(entries))
+	}
+	if got := entries[0].Message; got != "login by [redacted] with Authorization: [redacted]" {
+		t.Errorf("redacted message %q", got)
+	}
+	if got := entries[0].Fields; got["url"] != "/home?[redacted]" || got["host"] != "web-1" {
+		t.Errorf("redacted fields %v", got)
+	}
+	if entries[1].Message != "nothing to hide" {
+		t.Errorf("message without secrets changed to %q", entries[1].Message)
+	}
+
+	// Neither the local file nor the uploaded object ever hold the secrets
+	fileName := filepath.Join(logsDirectory, m0+".txt")
+	if err := (&s3Sink{directory: logsDirectory}).Write(entries); err != nil {
+		t.Fatal(err)
+	}
+	local, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := uploadToS3WithPrefix(fileName); err != nil {
+		t.Fatal(err)
+	}
+	stored := fake.object(objectKey(m0))
+	if stored == nil {
+		t.Fatalf("minute %s not uploaded", m0)
+	}
+	object, err := decompressObjectContent(stored.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"jane.doe@example.com", "abc.DEF-123", "s3cr3t"} {
+		if bytes.Contains(local, []byte(secret)) || bytes.Contains(object, []byte(secret)) {
+			t.Errorf("%s stored unredacted", secret)
+		}
+	}
+
+	if _, err := parseRedactionRules("phone", nil); err == nil {
+		t.Error("unknown built-in rule accepted")
+	}
+	if _, err := parseRedactionRules("", []string{"(unclosed"}); err == nil {
+		t.Error("invalid rule accepted")
+	}
+}
+
+func TestQueryExactTimestamps(t *testing.T) {
+	fake := newFakeS3(t)
+	useTestBuffer(t)
+	m0, t0 := minuteAt(0)
+	m10, t10 := minuteAt(10)
+	m30, t30 := minuteAt(30)
+	storeTestMinute(t, m0,
+		LogEntry{Timestamp: t0 + 1, Message: "payment failed"},
+		LogEntry{Timestamp: t0 + 1, Message: "payment retried"},
+		LogEntry{Timestamp: t0 + 2, Message: "payment failed"})
+	storeTestMinute(t, m10, LogEntry{Timestamp: t10 + 1, Message: "payment failed"})
+	storeTestMinute(t, m30, LogEntry{Timestamp: t30 + 5, Message: "payment failed"}, LogEntry{Timestamp: t30 + 6, Message: "payment failed"})
+	query := func(target, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		queryHandler(recorder, httptest.NewRequest("POST", target, strings.NewReader(body)))
+		return recorder
+	}
+
+	// Repeated timestamps and timestamps of the same minute read its object once, the minutes between aren't read
+	recorder := query("/query?text=failed", fmt.Sprintf(`{"timestamps":[%d,%d,%d,%d]}`, t30+5, t0+1, t0+1, t30+7))
+	var got []string
+	for _, entry := range decodeEntries(t, recorder) {
+		got = append(got, fmt.Sprintf("%d:%s", entry.Timestamp-t0, entry.Message))
+	}
+	if want := "1:payment failed 1805:payment failed"; strings.Join(got, " ") != want {
+		t.Errorf("exact timestamps returned %q, want %q", strings.Join(got, " "), want)
+	}
+	for minute, want := range map[string]int{m0: 1, m10: 0, m30: 1} {
+		if fetched := fake.fetched(objectKey(minute)); fetched != want {
+			t.Errorf("minute %s fetched %d times, want %d", minute, fetched, want)
+		}
+	}
+
+	if recorder := query("/query", fmt.Sprintf(`{"timestamps":[%d],"ranges":[{"start":%d,"end":%d}]}`, t0, t0, t0+58)); recorder.Code != http.StatusBadRequest {
+		t.Errorf("timestamps with ranges answered %d", recorder.Code)
+	}
+}
+
+func TestIngestRejectsOverCountBatch(t *testing.T) {
+	useTestBuffer(t)
+	acceptIngest(t)
+	override(t, &maxIngestEntries, 3)
+	lines := func(n int) []string {
+		var entries []string
+		for i := 0; i < n; i++ {
+			entries = append(entries, fmt.Sprintf(`{"log":"entry %d"}`, i))
+		}
+		return entries
+	}
+
+	for _, format := range []string{"", "ndjson"} {
+		batch := func(n int) string {
+			if format == "ndjson" {
+				return strings.Join(lines(n), "\n")
+			}
+			return "[" + strings.Join(lines(n), ",") + "]"
+		}
+		recorder := postIngest(t, "/ingest?format="+format, batch(4))
+		if recorder.Code != http.StatusRequestEntityTooLarge || !strings.Contains(recorder.Body.String(), "split the batch") {
+			t.Errorf("format=%s batch of 4 answered %d %q", format, recorder.Code, recorder.Body.String())
+		}
+		if entries := drainTestChannel(); len(entries) != 0 {
+			t.Errorf("rejected format=%s batch enqueued %d entries", format, len(entries))
+		}
+
+		// A batch at the limit is accepted whole
+		if recorder := postIngest(t, "/ingest?format="+format, batch(3)); recorder.Code != http.StatusCreated {
+			t.Errorf("format=%s batch of 3 answered %d %q", format, recorder.Code, recorder.Body.String())
+		}
+		if entries := drainTestChannel(); len(entries) != 3 {
+			t.Errorf("format=%s batch of 3 enqueued %d entries", format, len(entries))
+		}
+	}
+}
+
+func TestDayPrefixScopesListing(t *testing.T) {
+	fake := newFakeS3(t)
+	useTestBuffer(t)
+	override(t, &s3ObjectKeysPrefix, "logs/")
+	override(t, &s3DayPrefix, true)
+	m0, t0 := minuteAt(0)
+	m1, _ := minuteAt(1)
+	nextDay, tNextDay := minuteAt(24 * 60)
+	storeTestMinute(t, m0, LogEntry{Timestamp: t0, Message: "a"})
+	storeTestMinute(t, m1, LogEntry{Timestamp: t0 + 60, Message: "b"})
+	storeTestMinute(t, nextDay, LogEntry{Timestamp: tNextDay, Message: "c"})
+
+	// Objects are placed in the directory of their day
+	day := dayOfMinute(m0)
+	if want := "logs/" + day + "/" + m0 + s3KeySuffix; objectKey(m0) != want || fake.object(want) == nil {
+		t.Fatalf("minute %s stored at %s, want %s", m0, objectKey(m0), want)
+	}
+	if keys := fake.keys("logs/" + day + "/"); len(keys) != 2 {
+		t.Errorf("day directory holds %q", keys)
+	}
+
+	list := func(query string) []string {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		listHandler(recorder, httptest.NewRequest("GET", "/list?"+query, nil))
+		var keys []string
+		if err := json.Unmarshal(recorder.Body.Bytes(), &keys); err != nil {
+			t.Fatalf("list answered %d %q", recorder.Code, recorder.Body.String())
+		}
+		return keys
+	}
+	if got, want := list("day="+day), []string{objectKey(m0), objectKey(m1)}; !slices.Equal(got, want) {
+		t.Errorf("list of %s returned %q, want %q", day, got, want)
+	}
+	if got := list("day=" + dayOfMinute(nextDay)); !slices.Equal(got, []string{objectKey(nextDay)}) {
+		t.Errorf("list of the next day returned %q", got)
+	}
+	if got := list(""); len(got) != 3 {
+		t.Errorf("list of every day returned %q", got)
+	}
+
+	// Queries resolve the minutes of a range under their day directory
+	if entries := decodeEntries(t, serveQuery(t, fmt.Sprintf("start=%d&end=%d", t0, t0+118))); len(entries) != 2 {
+		t.Errorf("query across the day directory returned %+v", entries)
+	}
+}
+
+func TestLoadTestSendsRequestedEntries(t *testing.T) {
+	useTempDirectories(t)
+	useTestBuffer(t)
+	acceptIngest(t)
+	override(t, &apiKey, "secret")
+	loadTestRequest := func(method, query string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, "/admin/loadtest?"+query, nil)
+		request.Header.Set("X-API-Key", "secret")
+		recorder := httptest.NewRecorder()
+		loadTestHandler(recorder, request)
+		return recorder
+	}
+
+	// Disabled by default
+	if recorder := loadTestRequest("POST", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("disabled load test answered %d", recorder.Code)
+	}
+	override(t, &loadTestEnabled, true)
+	for _, invalid := range []string{"rate=0", "batch=-1", "duration=soon"} {
+		if recorder := loadTestRequest("POST", invalid); recorder.Code != http.StatusBadRequest {
+			t.Errorf("load test with %s answered %d", invalid, recorder.Code)
+		}
+	}
+
+	// 1000 entries per second for 250ms are 250 entries, in batches of 60 and a last one of 10
+	if recorder := loadTestRequest("POST", "rate=1000&duration=250ms&batch=60"); recorder.Code != http.StatusOK {
+		t.Fatalf("starting the load test answered %d %q", recorder.Code, recorder.Body.String())
+	}
+	var status struct {
+		Running                           bool
+		Sent, Accepted, Dropped, Rejected int
+		EntriesPerSecond                  float64 `json:"entries_per_second"`
+	}
+	var body string
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		body = loadTestRequest("GET", "").Body.String()
+		if err := json.Unmarshal([]byte(body), &status); err != nil {
+			t.Fatal(err)
+		}
+		if !status.Running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("load test still running: %s", body)
+		}
+	}
+	if status.Sent != 250 || status.Accepted != 250 || status.Dropped != 0 || status.Rejected != 0 || status.EntriesPerSecond <= 0 {
+		t.Errorf("load test finished with %s", body)
+	}
+
+	entries := drainTestChannel()
+	if len(entries) != 250 {
+		t.Fatalf("load test enqueued %d entries", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Fields["source"] != "loadtest" {
+			t.Fatalf("load test entry %+v lacks fields.source=loadtest", entry)
+		}
+	}
+}
+
+func TestUploadSkipsTruncatedLastLine(t *testing.T) {
+	fake := newFakeS3(t)
+	useTempDirectories(t)
+	useTestBuffer(t)
+	m0, t0 := minuteAt(0)
+	fileName := writeLocalFile(t, m0, LogEntry{Timestamp: t0, Message: "first"}, LogEntry{Timestamp: t0 + 1, Message: "second"})
+	// The process crashed while writing the third entry
+	cut := fmt.Sprintf(`{"time":%d,"log":"thi`, t0+2)
+	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(cut)
+	file.Close()
+
+	var logs bytes.Buffer
+	previous := log.Writer()
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(previous) })
+	partialBytes, recovered := metricValue("upload_partial_line_bytes_total"), metricValue("upload_recovered_entries_total")
+	if err := uploadToS3WithPrefix(fileName); err != nil {
+		t.Fatalf("uploading the interrupted file: %v", err)
+	}
+
+	entries, _, err := getMinuteEntries(context.Background(), m0, nil)
+	if err != nil || len(entries) != 2 || entries[1].Message != "second" {
+		t.Errorf("uploaded %+v: %v", entries, err)
+	}
+	if fake.object(objectKey(m0)) == nil {
+		t.Fatal("interrupted file not uploaded")
+	}
+	if got := metricValue("upload_partial_line_bytes_total") - partialBytes; got != float64(len(cut)) {
+		t.Errorf("upload_partial_line_bytes_total grew by %v, want %d", got, len(cut))
+	}
+	if got := metricValue("upload_recovered_entries_total") - recovered; got != 2 {
+		t.Errorf("upload_recovered_entries_total grew by %v", got)
+	}
+	// The cut line is reported once, not as a parse error
+	if strings.Contains(logs.String(), "Error parsing") || strings.Count(logs.String(), "incomplete last line") != 1 {
+		t.Errorf("uploading the interrupted file logged %q", logs.String())
+	}
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		t.Errorf("uploaded file kept: %v", err)
+	}
+}
+
+func TestQueryWithBufferDisabledReadsLocalFiles(t *testing.T) {
+	newFakeS3(t)
+	useTempDirectories(t)
+	useTestBuffer(t)
+	acceptIngest(t)
+	override(t, &bufferDisabled, true)
+	override(t, &sinks, nil)
+	override(t, &accumulated, nil)
+	registerSink("s3", &s3Sink{directory: logsDirectory})
+	now := time.Now().Unix()
+	previous := formatMinute(time.Unix(now-60, 0))
+	storeTestMinute(t, previous, LogEntry{Timestamp: now - 60, Message: "uploaded"})
+
+	body := fmt.Sprintf(`[{"time":%d,"log":"flushed"}]`, now)
+	if recorder := postIngest(t, "/ingest", body); recorder.Code != http.StatusCreated {
+		t.Fatalf("ingest answered %d %q", recorder.Code, recorder.Body.String())
+	}
+	flushLogChannel()
+	if len(inMemorySearchBuffer) != 0 {
+		t.Errorf("buffer holds %d entries", len(inMemorySearchBuffer))
+	}
+	// Entries not flushed to a local file yet aren't found
+	postIngest(t, "/ingest", fmt.Sprintf(`[{"time":%d,"log":"waiting"}]`, now))
+
+	var messages []string
+	for _, entry := range decodeEntries(t, serveQuery(t, fmt.Sprintf("start=%d&end=%d", now-60, now+60))) {
+		messages = append(messages, entry.Message)
+	}
+	if got := strings.Join(messages, ","); got != "uploaded,flushed" {
+		t.Errorf("query without the buffer returned %q", got)
+	}
+}
+
+func TestIngestAckListsObjectKeys(t *testing.T) {
+	fake := newFakeS3(t)
+	useTempDirectories(t)
+	useTestBuffer(t)
+	acceptIngest(t)
+	override(t, &accumulated, nil)
+	override(t, &sinks, nil)
+	override(t, &errorStoreLevel, "ERROR")
+	override(t, &errorStoreMode, "copy")
+	if err := os.MkdirAll(errorStoreDirectory, 0755); err != nil {
+		t.Fatal(err)
+	}
+	registerSink("s3", &s3Sink{directory: logsDirectory})
+	registerSink("errors", &filteredSink{sink: &s3Sink{directory: errorStoreDirectory}, keep: isErrorEntry})
+	m5, t5 := minuteAt(5)
+	now := time.Now().Unix()
+	body := fmt.Sprintf(`[{"time":%d,"log":"backfilled","bucket":%q},{"time":%d,"log":"failed","level":"ERROR","bucket":%q},`+
+		`{"time":%d,"log":"live"}]`, t5, m5, t5, m5, now)
+
+	before := formatMinute(time.Now())
+	recorder := postIngest(t, "/ingest?ack=keys", body)
+	after := formatMinute(time.Now())
+	var response ingestResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || recorder.Code != http.StatusCreated {
+		t.Fatalf("ingest answered %d %q", recorder.Code, recorder.Body.String())
+	}
+	// The live entry is pinned to the minute it arrived in, even if the flush happens in the next one
+	arrived := before
+	if !slices.Contains(response.Keys, objectKey(before)) {
+		arrived = after
+	}
+	want := []string{objectKey(m5), objectKey("errors/" + m5), objectKey(arrived)}
+	sort.Strings(want)
+	if !slices.Equal(response.Keys, want) || response.Accepted != 3 {
+		t.Fatalf("ingest acknowledged %+v, want keys %q", response, want)
+	}
+
+	flushLogChannel()
+	files, err := listLocalFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if err := uploadToS3WithPrefix(file.name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Every acknowledged key holds entries of the batch, and nothing was stored elsewhere
+	for _, key := range response.Keys {
+		if fake.object(key) == nil {
+			t.Errorf("acknowledged key %s not uploaded", key)
+		}
+	}
+	if stored := fake.keys(""); !slices.Equal(stored, response.Keys) {
+		t.Errorf("bucket holds %q, acknowledged %q", stored, response.Keys)
+	}
+
+	// Without ack=keys the response carries no keys
+	recorder = postIngest(t, "/ingest", fmt.Sprintf(`[{"time":%d,"log":"plain"}]`, now))
+	if strings.Contains(recorder.Body.String(), `"keys"`) {
+		t.Errorf("ingest without ack answered %q", recorder.Body.String())
+	}
+}
+
+func TestCompactionTriggeredByObjectCount(t *testing.T) {
+	fake := newFakeS3(t)
+	useTestBuffer(t)
+	override(t, &compactionInterval, time.Hour)
+	override(t, &compactAfter, time.Hour)
+	override(t, &compactMaxObjects, 3)
+	old, tOld := minuteAt(-120)
+	storeTestMinute(t, old, LogEntry{Timestamp: tOld, Message: "old"})
+	var minutes []string
+	for i := 0; i < 4; i++ {
+		minute, ts := minuteAt(i * 10)
+		minutes = append(minutes, minute)
+		if i < 3 {
+			storeTestMinute(t, minute, LogEntry{Timestamp: ts, Message: "recent"})
+		}
+	}
+	hour, oldHour := hourOfMinute(minutes[0]), hourOfMinute(old)
+	_, t0 := minuteAt(0)
+	// 10 minutes after the recent hour ended, it isn't due by age yet while the old one is
+	now := time.Unix(t0, 0).Add(70 * time.Minute)
+	pending := func() (int, int) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		statsHandler(recorder, httptest.NewRequest("GET", "/stats", nil))
+		var s stats
+		if err := json.Unmarshal(recorder.Body.Bytes(), &s); err != nil {
+			t.Fatalf("stats answered %d %q", recorder.Code, recorder.Body.String())
+		}
+		return s.PendingCompactionHours, s.PendingCompactionObjects
+	}
+	if hours, objects := pending(); hours != 2 || objects != 4 {
+		t.Errorf("stats report %d hours and %d objects pending", hours, objects)
+	}
+
+	compactDueHours(now)
+	if fake.object(objectKey(oldHour)) == nil {
+		t.Error("hour past COMPACT_AFTER not compacted")
+	}
+	if fake.object(objectKey(hour)) != nil {
+		t.Fatal("hour with 3 objects compacted")
+	}
+	if hours, objects := pending(); hours != 1 || objects != 3 {
+		t.Errorf("stats report %d hours and %d objects pending after the old hour", hours, objects)
+	}
+
+	// The 4th object crosses COMPACT_MAX_OBJECTS
+	storeTestMinute(t, minutes[3], LogEntry{Timestamp: t0 + 30*60, Message: "recent"})
+	compactDueHours(now)
+	if fake.object(objectKey(hour)) == nil {
+		t.Fatal("hour with 4 objects not compacted")
+	}
+	entries, _, err := getMinuteEntries(context.Background(), hour, nil)
+	if err != nil || len(entries) != 4 {
+		t.Errorf("compacted hour holds %d entries: %v", len(entries), err)
+	}
+	if hours, objects := pending(); hours != 0 || objects != 0 {
+		t.Errorf("stats report %d hours and %d objects pending after compacting", hours, objects)
+	}
+}
+
+func TestQueryReadsSecondaryPrefixes(t *testing.T) {
+	fake := newFakeS3(t)
+	useTestBuffer(t)
+	override(t, &s3ObjectKeysPrefix, "logs-v2/")
+	override(t, &s3ReadPrefixes, []string{"logs/", "archive/"})
+	m0, t0 := minuteAt(0)
+	m1, t1 := minuteAt(1)
+	m2, t2 := minuteAt(2)
+	// Minutes written before the migration, m1 was copied to the new prefix already
+	put := func(key string, entry LogEntry) {
+		content, _ := json.Marshal([]LogEntry{entry})
+		fake.put(key+s3KeySuffix, content, nil)
+	}
+	put("logs/"+m0, LogEntry{Timestamp: t0 + 1, Message: "old prefix"})
+	put("logs/"+m1, LogEntry{Timestamp: t1 + 1, Message: "stale copy"})
+	put("archive/"+m2, LogEntry{Timestamp: t2 + 1, Message: "older prefix"})
+	storeTestMinute(t, m1, LogEntry{Timestamp: t1 + 1, Message: "new prefix"})
+	if keys := fake.keys("logs-v2/"); !slices.Equal(keys, []string{"logs-v2/" + m1 + s3KeySuffix}) {
+		t.Errorf("writes went to %q", keys)
+	}
+
+	// The primary prefix is read first, a minute only found under a read prefix is read from there
+	var messages []string
+	for _, entry := range decodeEntries(t, serveQuery(t, fmt.Sprintf("start=%d&end=%d", t0, t2+58))) {
+		messages = append(messages, entry.Message)
+	}
+	if got := strings.Join(messages, ","); got != "old prefix,new prefix,older prefix" {
+		t.Errorf("query returned %q", got)
+	}
+
+	// Listings cover the primary prefix first, then the read prefixes
+	recorder := httptest.NewRecorder()
+	listHandler(recorder, httptest.NewRequest("GET", "/list", nil))
+	var keys []string
+	json.Unmarshal(recorder.Body.Bytes(), &keys)
+	want := []string{"logs-v2/" + m1 + s3KeySuffix, "logs/" + m0 + s3KeySuffix, "logs/" + m1 + s3KeySuffix, "archive/" + m2 + s3KeySuffix}
+	if !slices.Equal(keys, want) {
+		t.Errorf("list returned %q, want %q", keys, want)
+	}
+}
+
+func TestIngestObservesClockDrift(t *testing.T) {
+	useTestBuffer(t)
+	acceptIngest(t)
+	override(t, &clockDriftWarning, time.Minute)
+	resetDrift := func() {
+		clockDrift.mu.Lock()
+		clockDrift.samples, clockDrift.next, clockDrift.warning = nil, 0, false
+		clockDrift.mu.Unlock()
+	}
+	resetDrift()
+	t.Cleanup(resetDrift)
+	var logs bytes.Buffer
+	previous := log.Writer()
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(previous) })
+	ingest := func(drifts ...int64) {
+		t.Helper()
+		now := time.Now().Unix()
+		var entries []string
+		for _, drift := range drifts {
+			entries = append(entries, fmt.Sprintf(`{"time":%d,"log":"drifting"}`, now-drift))
+		}
+		if recorder := postIngest(t, "/ingest", "["+strings.Join(entries, ",")+"]"); recorder.Code != http.StatusCreated {
+			t.Fatalf("ingest answered %d %q", recorder.Code, recorder.Body.String())
+		}
+	}
+	bucket := func(le string) float64 {
+		return metricValue(fmt.Sprintf(`ingest_clock_drift_seconds_bucket{le="%s"}`, le))
+	}
+
+	// Three entries from a clock two minutes behind and one from a clock 30s ahead
+	count, behind, ahead := metricValue("ingest_clock_drift_seconds_count"), bucket("60"), bucket("-10")
+	ingest(120, 120, 120, -30)
+	if got := metricValue("ingest_clock_drift_seconds_count") - count; got != 4 {
+		t.Errorf("drift observed %v times", got)
+	}
+	// Only the entry ahead falls in the buckets up to -10s, the entries behind are above 60s
+	if got := bucket("-10") - ahead; got != 1 {
+		t.Errorf("%v entries observed at most 10s ahead", got)
+	}
+	if got := bucket("60") - behind; got != 1 {
+		t.Errorf("%v entries observed within 60s", got)
+	}
+	if got := metricValue("ingest_clock_drift_median_seconds"); got < 119 || got > 121 {
+		t.Errorf("median drift %v", got)
+	}
+	if strings.Count(logs.String(), "exceeding CLOCK_DRIFT_WARNING") != 1 {
+		t.Errorf("drift above the warning logged %q", logs.String())
+	}
+
+	// The warning isn't repeated, and clears once the median is back below it
+	ingest(120)
+	ingest(0, 0, 0, 0, 0, 0)
+	if strings.Count(logs.String(), "exceeding CLOCK_DRIFT_WARNING") != 1 || !strings.Contains(logs.String(), "is back to") {
+		t.Errorf("drift warnings logged %q", logs.String())
+	}
+}
+
+func TestEvictBufferLeavesOtherMinutes(t *testing.T) {
+	useTempDirectories(t)
+	override(t, &apiKey, "secret")
+	var entries []LogEntry
+	var starts []int64
+	for i := 0; i < 5; i++ {
+		_, start := minuteAt(i)
+		starts = append(starts, start)
+		entries = append(entries, LogEntry{Timestamp: start, Message: fmt.Sprintf("m%d", i)}, LogEntry{Timestamp: start + 59, Message: fmt.Sprintf("m%d", i)})
+	}
+	useTestBuffer(t, entries...)
+	evict := func(query string) (int, evictResult) {
+		t.Helper()
+		request := httptest.NewRequest("POST", "/admin/evict-buffer?"+query, nil)
+		request.Header.Set("X-API-Key", "secret")
+		recorder := httptest.NewRecorder()
+		evictBufferHandler(recorder, request)
+		var result evictResult
+		json.Unmarshal(recorder.Body.Bytes(), &result)
+		return recorder.Code, result
+	}
+	remaining := func() string {
+		bufferMu.RLock()
+		defer bufferMu.RUnlock()
+		seen := make(map[string]bool)
+		var minutes []string
+		for _, entry := range inMemorySearchBuffer {
+			if !seen[entry.Message] {
+				seen[entry.Message] = true
+				minutes = append(minutes, entry.Message)
+			}
+		}
+		return strings.Join(minutes, ",")
+	}
+
+	m1, _ := minuteAt(1)
+	if code, result := evict("minute=" + m1); code != http.StatusOK || result != (evictResult{Minutes: 1, Evicted: 2, Remaining: 8}) {
+		t.Errorf("evicting %s answered %d %+v", m1, code, result)
+	}
+	if got := remaining(); got != "m0,m2,m3,m4" {
+		t.Errorf("buffer holds %s after evicting m1", got)
+	}
+
+	// A range evicts the minutes from its start to its end, not those around it
+	code, result := evict(fmt.Sprintf("start=%d&end=%d", starts[3], starts[4]-1))
+	if code != http.StatusOK || result != (evictResult{Minutes: 1, Evicted: 2, Remaining: 6}) {
+		t.Errorf("evicting m3 answered %d %+v", code, result)
+	}
+	if got := remaining(); got != "m0,m2,m4" {
+		t.Errorf("buffer holds %s after evicting m3", got)
+	}
+	if got := readAuditLog(t); len(got) != 2 || got[0].Operation != "evict_buffer" {
+		t.Errorf("audit log holds %+v", got)
+	}
+
+	for _, invalid := range []string{"", "minute=2024-03-02", fmt.Sprintf("start=%d", starts[0])} {
+		if code, _ := evict(invalid); code != http.StatusBadRequest {
+			t.Errorf("evicting with %q answered %d", invalid, code)
+		}
+	}
+	request := httptest.NewRequest("POST", "/admin/evict-buffer?minute="+m1, nil)
+	recorder := httptest.NewRecorder()
+	evictBufferHandler(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("evicting without the key answered %d", recorder.Code)
+	}
+}
+
+// writeCountingRecorder records a response, counting the writes the handler makes to it
+type writeCountingRecorder struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (w *writeCountingRecorder) Write(data []byte) (int, error) {
+	w.writes++
+	return w.ResponseRecorder.Write(data)
+}
+
+func TestStreamThresholdStreamsLargeResponses(t *testing.T) {
+	newFakeS3(t)
+	override(t, &streamThreshold, 16*1024)
+	m0, t0 := minuteAt(0)
+	var entries []LogEntry
+	for i := 0; i < 2000; i++ {
+		entries = append(entries, LogEntry{Timestamp: t0 + int64(i%59), Message: fmt.Sprintf("request %d served in %dms", i, i%300)})
+	}
+	storeTestMinute(t, m0, entries...)
+
+	query := func(query string) *writeCountingRecorder {
+		t.Helper()
+		recorder := &writeCountingRecorder{ResponseRecorder: httptest.NewRecorder()}
+		queryHandler(recorder, httptest.NewRequest("GET", "/query?"+query, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("query %s answered %d: %s", query, recorder.Code, recorder.Body.String())
+		}
+		return recorder
+	}
+	small := fmt.Sprintf("start=%d&end=%d&text=request+7+served", t0, t0+58)
+	large := fmt.Sprintf("start=%d&end=%d", t0, t0+58)
+
+	if got := query(small); got.writes != 1 || len(decodeEntries(t, got.ResponseRecorder)) != 1 {
+		t.Errorf("small response made %d writes for %s", got.writes, got.Body.String())
+	}
+	streamed := query(large)
+	if streamed.writes < 2 {
+		t.Errorf("large response of %d bytes made %d writes, expected it streamed", streamed.Body.Len(), streamed.writes)
+	}
+
+	// Streaming changes how the response is written, not what it holds
+	for _, pretty := range []string{"", "&pretty=true"} {
+		override(t, &streamThreshold, 16*1024)
+		streamed := query(large + pretty)
+		override(t, &streamThreshold, 0)
+		buffered := query(large + pretty)
+		if buffered.writes != 1 {
+			t.Errorf("without a threshold the response made %d writes", buffered.writes)
+		}
+		if streamed.Body.String() != buffered.Body.String() {
+			t.Errorf("streamed response differs from the buffered one with %q", pretty)
+		}
+	}
+	if got := len(decodeEntries(t, streamed.ResponseRecorder)); got != len(entries) {
+		t.Errorf("streamed response holds %d entries, expected %d", got, len(entries))
+	}
+}
+
+func TestReadyReportsLocalDiskSpaceAndInodes(t *testing.T) {
+	useTempDirectories(t)
+	t.Cleanup(func() {
+		localDiskFreeBytes.Store(0)
+		localFreeInodes.Store(0)
+		localDiskLow.Store(false)
+	})
+	ready := func() (int, readiness) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		readyHandler(recorder, httptest.NewRequest("GET", "/ready", nil))
+		var result readiness
+		if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+			t.Fatalf("decoding %q: %v", recorder.Body.String(), err)
+		}
+		return recorder.Code, result
+	}
+
+	measureLocalFilesystem()
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(logsDirectory, &fs); err != nil {
+		t.Fatal(err)
+	}
+	code, result := ready()
+	if code != http.StatusOK || !result.Ready || result.DiskFreeBytes <= 0 || result.DiskFreeInodes <= 0 {
+		t.Fatalf("ready answered %d %+v", code, result)
+	}
+	if result.DiskFreeInodes > int64(fs.Files) || result.DiskFreeBytes > int64(fs.Blocks)*int64(fs.Bsize) {
+		t.Errorf("reported %+v exceeds the size of the filesystem", result)
+	}
+	if got := metricValue("local_disk_free_inodes"); got != float64(result.DiskFreeInodes) {
+		t.Errorf("local_disk_free_inodes is %v, expected %d", got, result.DiskFreeInodes)
+	}
+	if got := metricValue("local_disk_free_bytes"); got != float64(result.DiskFreeBytes) {
+		t.Errorf("local_disk_free_bytes is %v, expected %d", got, result.DiskFreeBytes)
+	}
+
+	// More inodes than the filesystem has can never be free
+	override(t, &minFreeInodes, int64(fs.Files)+1)
+	measureLocalFilesystem()
+	if code, result := ready(); code != http.StatusServiceUnavailable || result.Ready || len(result.Reasons) != 1 || !strings.Contains(result.Reasons[0], "MIN_FREE_INODES") {
+		t.Errorf("below MIN_FREE_INODES ready answered %d %+v", code, result)
+	}
+	if !localDiskLow.Load() {
+		t.Error("low inodes not recorded")
+	}
+	override(t, &minFreeInodes, 0)
+	override(t, &minFreeDiskBytes, int64(fs.Blocks)*int64(fs.Bsize)+1)
+	if code, result := ready(); code != http.StatusServiceUnavailable || len(result.Reasons) != 1 || !strings.Contains(result.Reasons[0], "MIN_FREE_DISK_BYTES") {
+		t.Errorf("below MIN_FREE_DISK_BYTES ready answered %d %+v", code, result)
+	}
+	override(t, &minFreeDiskBytes, 0)
+	measureLocalFilesystem()
+	if code, _ := ready(); code != http.StatusOK || localDiskLow.Load() {
+		t.Errorf("without minimums ready answered %d", code)
+	}
+}
+
+func TestUploadedObjectsCarryInstanceID(t *testing.T) {
+	fake := newFakeS3(t)
+	override(t, &instanceID, "ingester-1")
+	m0, t0 := minuteAt(0)
+	m1, t1 := minuteAt(1)
+	m2, _ := minuteAt(2)
+	storeTestMinute(t, m0, LogEntry{Timestamp: t0 + 1, Message: "boot ok"})
+	// Multipart uploads carry the metadata of the object too
+	override(t, &multipartThreshold, 16)
+	storeTestMinute(t, m1, LogEntry{Timestamp: t1 + 1, Message: "request served"})
+	// Written by an instance from before INSTANCE_ID
+	fake.put(objectKey(m2), []byte("[]"), nil)
+
+	for _, minute := range []string{m0, m1} {
+		object := fake.object(objectKey(minute))
+		if object == nil {
+			t.Fatalf("minute %s not uploaded", minute)
+		}
+		if got := object.header.Get("X-Amz-Meta-Instance-Id"); got != "ingester-1" {
+			t.Errorf("object of %s has instance %q", minute, got)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	listHandler(recorder, httptest.NewRequest("GET", "/list?day=2024-03-02&details=true", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("list answered %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var details []objectDetails
+	if err := json.Unmarshal(recorder.Body.Bytes(), &details); err != nil {
+		t.Fatal(err)
+	}
+	instances := make(map[string]string)
+	for _, detail := range details {
+		instances[detail.Key] = detail.InstanceID
+		if detail.Size <= 0 || detail.LastModified.IsZero() {
+			t.Errorf("details of %s are incomplete: %+v", detail.Key, detail)
+		}
+	}
+	expected := map[string]string{objectKey(m0): "ingester-1", objectKey(m1): "ingester-1", objectKey(m2): ""}
+	if fmt.Sprint(instances) != fmt.Sprint(expected) {
+		t.Errorf("listed instances %v, expected %v", instances, expected)
+	}
+	if strings.Count(recorder.Body.String(), `"instance_id"`) != 2 {
+		t.Errorf("instance_id not omitted for the object without one: %s", recorder.Body.String())
+	}
+}
+
+func TestConcurrentWritersOfAMinuteLoseNothing(t *testing.T) {
+	fake := newFakeS3(t)
+	override(t, &conditionalWrites, true)
+	m0, t0 := minuteAt(0)
+	key := objectKey(m0)
+	storeTestMinute(t, m0, LogEntry{Timestamp: t0 + 1, Message: "boot ok"})
+
+	// Another instance writes the minute between our read of its ETag and our write of it
+	other, err := encodeObjectEntries([]LogEntry{{Timestamp: t0 + 1, Message: "boot ok"}, {Timestamp: t0 + 2, Message: "written by ingester-2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raced := false
+	fake.before = func(r *http.Request) {
+		if r.Method == "PUT" && strings.HasSuffix(r.URL.Path, key) && !raced {
+			raced = true
+			fake.objects[key] = &fakeObject{data: other, header: make(http.Header), modified: time.Now()}
+		}
+	}
+	conflicts := metricValue("upload_write_conflicts_total")
+	if _, err := storeMinute(m0, []LogEntry{{Timestamp: t0 + 3, Message: "written by ingester-1"}}, false); err != nil {
+		t.Fatal(err)
+	}
+	fake.mu.Lock()
+	fake.before = nil
+	fake.mu.Unlock()
+	if got := metricValue("upload_write_conflicts_total") - conflicts; got != 1 {
+		t.Errorf("recorded %v write conflicts, expected 1", got)
+	}
+	if got := messagesOf(t, m0); got != "boot ok,written by ingester-2,written by ingester-1" {
+		t.Errorf("minute holds %s after the race", got)
+	}
+
+	// Writers racing for real each keep their entries, however their reads and writes interleave. A write giving up
+	// after conditionalWriteAttempts conflicts keeps its local file, so it is retried like the upload loop would
+	m1, t1 := minuteAt(1)
+	var wg sync.WaitGroup
+	for writer := 0; writer < 4; writer++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				entry := LogEntry{Timestamp: t1 + int64(i), Message: fmt.Sprintf("writer %d entry %d", writer, i)}
+				for attempt := 1; ; attempt++ {
+					_, err := storeMinute(m1, []LogEntry{entry}, false)
+					if err == nil {
+						break
+					}
+					if !errors.Is(err, errWriteConflict) || attempt == 10 {
+						t.Errorf("writer %d: %v", writer, err)
+						break
+					}
+				}
+			}
+		}(writer)
+	}
+	wg.Wait()
+	entries, _, err := getMinuteEntries(context.Background(), m1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 20 {
+		t.Errorf("minute holds %d entries of the 20 written", len(entries))
+	}
+}
+
+// messagesOf returns the messages of the stored entries of minute, in order
+func messagesOf(t *testing.T, minute string) string {
+	t.Helper()
+	entries, _, err := getMinuteEntries(context.Background(), minute, nil)
+	if err != nil {
+		t.Fatalf("reading minute %s: %v", minute, err)
+	}
+	var messages []string
+	for _, entry := range entries {
+		messages = append(messages, entry.Message)
+	}
+	return strings.Join(messages, ",")
+}
+
+func TestQueryProjectsRequestedFields(t *testing.T) {
+	newFakeS3(t)
+	useTestBuffer(t)
+	m0, t0 := minuteAt(0)
+	storeTestMinute(t, m0,
+		LogEntry{Timestamp: t0 + 1, Message: "request served", Level: "INFO", Fields: map[string]string{"host": "web-1", "path": "/"}, ClientTimestamp: t0},
+		LogEntry{Timestamp: t0 + 2, Message: "disk full"},
+	)
+	project := func(fields string) string {
+		t.Helper()
+		recorder := serveQuery(t, fmt.Sprintf("start=%d&end=%d&fields=%s", t0, t0+58, fields))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("fields=%s answered %d: %s", fields, recorder.Code, recorder.Body.String())
+		}
+		return recorder.Body.String()
+	}
+
+	for fields, expected := range map[string]string{
+		"time":               fmt.Sprintf(`[{"time":%d},{"time":%d}]`, t0+1, t0+2),
+		"time,level":         fmt.Sprintf(`[{"level":"INFO","time":%d},{"time":%d}]`, t0+1, t0+2),
+		"log,client_ts":      fmt.Sprintf(`[{"client_ts":%d,"log":"request served"},{"log":"disk full"}]`, t0),
+		"host":               `[{"fields":{"host":"web-1"}},{}]`,
+		"fields, host":       `[{"fields":{"host":"web-1","path":"/"}},{}]`,
+		"time,missing,level": fmt.Sprintf(`[{"level":"INFO","time":%d},{"time":%d}]`, t0+1, t0+2),
+	} {
+		if got := project(url.QueryEscape(fields)); got != expected {
+			t.Errorf("fields=%s returned %s, expected %s", fields, got, expected)
+		}
+	}
+
+	for _, invalid := range []string{"fields=", "fields=,", "fields=time&distinct=level", "fields=time&sort=desc"} {
+		if recorder := serveQuery(t, fmt.Sprintf("start=%d&end=%d&%s", t0, t0+58, invalid)); recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s answered %d", invalid, recorder.Code)
+		}
+	}
+}
+
+func TestCheckScope(t *testing.T) {
+	request := func(key string) *http.Request {
+		request := httptest.NewRequest("POST", "/ingest", nil)
+		if key != "" {
+			request.Header.Set("Authorization", "Bearer "+key)
+		}
+		return request
+	}
+	override(t, &scopedKeys, nil)
+	if code, ok := checkScope(request(""), scopeWrite); !ok || code != http.StatusOK {
+		t.Errorf("request without API_KEYS checked as %d %t", code, ok)
+	}
+
+	override(t, &scopedKeys, []scopedKey{{name: "reader", key: "r-key", scopes: map[string]bool{scopeRead: true}}, {name: "shipper", key: "w-key", scopes: map[string]bool{scopeWrite: true}}})
+	for _, test := range []struct {
+		key  string
+		code int
+		ok   bool
+	}{
+		{"", http.StatusUnauthorized, false},
+		{"unknown", http.StatusUnauthorized, false},
+		{"r-key", http.StatusForbidden, false},
+		{"w-key", http.StatusOK, true},
+	} {
+		if code, ok := checkScope(request(test.key), scopeWrite); code != test.code || ok != test.ok {
+			t.Errorf("key %q checked as %d %t, expected %d %t", test.key, code, ok, test.code, test.ok)
+		}
+	}
+}
+
+// grpcFrame prefixes message with the uncompressed flag and length of a gRPC message
+func grpcFrame(message []byte) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+func TestGRPCIngestStreamsBatchesToLogChannel(t *testing.T) {
+	acceptIngest(t)
+	ingestServer := newGRPCServer()
+	server := httptest.NewUnstartedServer(ingestServer.Handler)
+	server.Config.Protocols = ingestServer.Protocols
+	server.Start()
+	t.Cleanup(server.Close)
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+	t.Cleanup(client.CloseIdleConnections)
+
+	// call opens an Ingest call, the frames written to the returned pipe are streamed until it is closed
+	call := func(method string, headers ...string) (*io.PipeWriter, func() (status, message string, body []byte)) {
+		t.Helper()
+		reader, writer := io.Pipe()
+		request, _ := http.NewRequest("POST", server.URL+method, reader)
+		request.Header.Set("Content-Type", "application/grpc")
+		request.Header.Set("TE", "trailers")
+		for i := 0; i+1 < len(headers); i += 2 {
+			request.Header.Set(headers[i], headers[i+1])
+		}
+		done := make(chan *http.Response, 1)
+		go func() {
+			response, err := client.Do(request)
+			if err != nil {
+				t.Errorf("calling %s: %v", method, err)
+			}
+			done <- response
+		}()
+		return writer, func() (string, string, []byte) {
+			response := <-done
+			if response == nil {
+				t.FailNow()
+			}
+			defer response.Body.Close()
+			body, _ := io.ReadAll(response.Body)
+			if response.ProtoMajor != 2 || response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "application/grpc" {
+				t.Errorf("%s answered %s %d %q", method, response.Proto, response.StatusCode, response.Header.Get("Content-Type"))
+			}
+			// A call failing before any message is answered with the status in the headers (Trailers-Only)
+			trailer := response.Trailer
+			if trailer.Get("Grpc-Status") == "" {
+				trailer = response.Header
+			}
+			message, _ := url.PathUnescape(trailer.Get("Grpc-Message"))
+			return trailer.Get("Grpc-Status"), message, body
+		}
+	}
+
+	_, t0 := minuteAt(0)
+	stream, finish := call("/logingest.LogService/Ingest")
+	stream.Write(grpcFrame(protobufBatch(LogEntry{Timestamp: t0, Message: "boot ok"}, LogEntry{Timestamp: t0 + 1, Message: "request served", Level: "INFO"})))
+	// The entries of a batch are queued while the stream is still open
+	deadline := time.Now().Add(5 * time.Second)
+	for len(logChannel) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := drainTestChannel(); len(got) != 2 || got[0].Message != "boot ok" || got[1].Level != "INFO" {
+		t.Fatalf("first batch queued as %+v", got)
+	}
+	stream.Write(grpcFrame(protobufBatch(LogEntry{Timestamp: t0 + 2, Message: "disk full"})))
+	stream.Write(grpcFrame(nil))
+	stream.Close()
+	status, message, body := finish()
+	if status != "0" {
+		t.Fatalf("Ingest ended with status %s: %s", status, message)
+	}
+	if expected := grpcFrame(protowire.AppendVarint([]byte{0x08}, 3)); !bytes.Equal(body, expected) {
+		t.Errorf("IngestResponse is %x, expected %x", body, expected)
+	}
+	if got := drainTestChannel(); len(got) != 1 || got[0].Message != "disk full" {
+		t.Errorf("second batch queued as %+v", got)
+	}
+
+	expectStatus := func(name, expected string, stream *io.PipeWriter, finish func() (string, string, []byte), frames ...[]byte) {
+		t.Helper()
+		for _, frame := range frames {
+			stream.Write(frame)
+		}
+		stream.Close()
+		if status, message, _ := finish(); status != expected {
+			t.Errorf("%s ended with status %s (%s), expected %s", name, status, message, expected)
+		}
+	}
+	valid := grpcFrame(protobufBatch(LogEntry{Timestamp: t0 + 3, Message: "request served"}))
+	compressed := grpcFrame(protobufBatch(LogEntry{Timestamp: t0 + 3, Message: "request served"}))
+	compressed[0] = 1
+	oversized := []byte{0, 0xff, 0xff, 0xff, 0xff}
+	stream, finish = call("/logingest.LogService/Ingest")
+	expectStatus("an invalid batch", "3", stream, finish, valid, grpcFrame([]byte{0x0a, 0x05}))
+	if got := drainTestChannel(); len(got) != 1 {
+		t.Errorf("the batch before the invalid one queued %d entries", len(got))
+	}
+	stream, finish = call("/logingest.LogService/Ingest")
+	expectStatus("a compressed batch", "12", stream, finish, compressed)
+	stream, finish = call("/logingest.LogService/Ingest")
+	expectStatus("an oversized batch", "8", stream, finish, oversized)
+	stream, finish = call("/logingest.LogService/Export")
+	expectStatus("an unknown method", "12", stream, finish)
+
+	readOnly.Store(true)
+	stream, finish = call("/logingest.LogService/Ingest")
+	expectStatus("a read-only ingester", "14", stream, finish, valid)
+	readOnly.Store(false)
+
+	override(t, &scopedKeys, []scopedKey{{name: "reader", key: "r-key", scopes: map[string]bool{scopeRead: true}}, {name: "shipper", key: "w-key", scopes: map[string]bool{scopeWrite: true}}})
+	stream, finish = call("/logingest.LogService/Ingest")
+	expectStatus("a call without a key", "16", stream, finish, valid)
+	stream, finish = call("/logingest.LogService/Ingest", "X-API-Key", "r-key")
+	expectStatus("a call without the write scope", "7", stream, finish, valid)
+	stream, finish = call("/logingest.LogService/Ingest", "Authorization", "Bearer w-key")
+	expectStatus("a call with the write scope", "0", stream, finish, valid)
+	if got := drainTestChannel(); len(got) != 1 {
+		t.Errorf("authorized call queued %d entries", len(got))
+	}
+}
+
+func TestReadSyslogFrameBoundsTheLength(t *testing.T) {
+	for stream, expected := range map[string]string{
+		"5 hello":          "hello",
+		"0000000005 hello": "hello",
+		"hello\nworld":     "hello\n",
+	} {
+		if got, err := readSyslogFrame(bufio.NewReader(strings.NewReader(stream))); err != nil || got != expected {
+			t.Errorf("%q framed as %q, %v", stream, got, err)
+		}
+	}
+	for _, stream := range []string{"12a hello", "5\thello", "0 ", "65537 " + strings.Repeat("x", 65537), "12345678901 hello", "5"} {
+		if got, err := readSyslogFrame(bufio.NewReader(strings.NewReader(stream))); err == nil || err == io.EOF {
+			t.Errorf("%q framed as %q, %v", stream, got, err)
+		}
+	}
+
+	// Digits without the space ending them are rejected without reading on
+	digits := &readCounter{reader: strings.NewReader(strings.Repeat("9", 1<<20))}
+	if _, err := readSyslogFrame(bufio.NewReaderSize(digits, 16)); err == nil {
+		t.Error("endless length accepted")
+	}
+	if digits.read > 32 {
+		t.Errorf("read %d bytes of an endless length", digits.read)
+	}
+}
+
+// readCounter counts the bytes read from reader
+type readCounter struct {
+	reader io.Reader
+	read   int
+}
+
+func (r *readCounter) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += n
+	return n, err
+}
+
+// scriptedPacketConn answers reads with its datagrams, a datagram without data failing the read with err
+type scriptedPacketConn struct {
+	net.PacketConn
+	datagrams []scriptedDatagram
+}
+
+type scriptedDatagram struct {
+	data []byte
+	err  error
+}
+
+func (c *scriptedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	if len(c.datagrams) == 0 {
+		return 0, nil, net.ErrClosed
+	}
+	datagram := c.datagrams[0]
+	c.datagrams = c.datagrams[1:]
+	if datagram.err != nil {
+		return 0, nil, datagram.err
+	}
+	return copy(p, datagram.data), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 514}, nil
+}
+
+func TestSyslogDatagramsSurviveReadErrorsUntilClosed(t *testing.T) {
+	acceptIngest(t)
+	conn := &scriptedPacketConn{datagrams: []scriptedDatagram{
+		{err: errors.New("connection refused")},
+		{data: []byte("<34>1 2024-03-02T05:07:00Z web-1 nginx 812 - - connection reset")},
+		{err: &net.OpError{Op: "read", Net: "udp", Err: net.ErrClosed}},
+		{data: []byte("<34>1 2024-03-02T05:07:01Z web-1 nginx 812 - - read after close")},
+	}}
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		receiveSyslogDatagrams(conn)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("receiving didn't stop once the connection was closed")
+	}
+	if elapsed := time.Since(start); elapsed < inputReadErrorBackoff {
+		t.Errorf("read again %v after an error, expected a backoff of %v", elapsed, inputReadErrorBackoff)
+	}
+	if got := drainTestChannel(); len(got) != 1 || got[0].Message != "connection reset" {
+		t.Errorf("enqueued %+v", got)
+	}
+	if len(conn.datagrams) != 1 {
+		t.Errorf("read on after the connection was closed")
+	}
+}
+
+func TestGELFDatagramsSurviveReadErrorsUntilClosed(t *testing.T) {
+	acceptIngest(t)
+	message := []byte(`{"version":"1.1","host":"web-1","short_message":"connection reset","timestamp":1709356020.5,"level":3}`)
+	chunk := func(sequence int, payload []byte) scriptedDatagram {
+		header := append(append([]byte(nil), gelfChunkMagic...), []byte("message1")...)
+		return scriptedDatagram{data: append(append(header, byte(sequence), 2), payload...)}
+	}
+	conn := &scriptedPacketConn{datagrams: []scriptedDatagram{
+		chunk(0, message[:40]),
+		{err: errors.New("connection refused")},
+		chunk(1, message[40:]),
+		{err: net.ErrClosed},
+		{data: []byte(`{"version":"1.1","host":"web-1","short_message":"read after close"}`)},
+	}}
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		receiveGELFDatagrams(conn)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("receiving didn't stop once the connection was closed")
+	}
+	if elapsed := time.Since(start); elapsed < inputReadErrorBackoff {
+		t.Errorf("read again %v after an error, expected a backoff of %v", elapsed, inputReadErrorBackoff)
+	}
+	// A read error between the chunks of a message doesn't lose the chunks received before it
+	if got := drainTestChannel(); len(got) != 1 || got[0].Message != "connection reset" || got[0].Timestamp != 1709356020 || got[0].Level != "ERR" {
+		t.Errorf("enqueued %+v", got)
+	}
+	if len(conn.datagrams) != 1 {
+		t.Errorf("read on after the connection was closed")
+	}
+}
+
+// msgpackFor encodes v as msgpack: strings, int64, []byte, msgpackExt, nil, bool and arrays and maps of them
+func msgpackFor(v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return []byte{0xc0}
+	case bool:
+		if v {
+			return []byte{0xc3}
+		}
+		return []byte{0xc2}
+	case int:
+		return msgpackFor(int64(v))
+	case int64:
+		if v >= 0 && v <= 0x7f {
+			return []byte{byte(v)}
+		}
+		return binary.BigEndian.AppendUint64([]byte{0xd3}, uint64(v))
+	case string:
+		return append(binary.BigEndian.AppendUint32([]byte{0xdb}, uint32(len(v))), v...)
+	case []byte:
+		return append(binary.BigEndian.AppendUint32([]byte{0xc6}, uint32(len(v))), v...)
+	case msgpackExt:
+		return append(append(binary.BigEndian.AppendUint32([]byte{0xc9}, uint32(len(v.data))), byte(v.typ)), v.data...)
+	case []interface{}:
+		data := binary.BigEndian.AppendUint32([]byte{0xdd}, uint32(len(v)))
+		for _, value := range v {
+			data = append(data, msgpackFor(value)...)
+		}
+		return data
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		data := binary.BigEndian.AppendUint32([]byte{0xdf}, uint32(len(v)))
+		for _, key := range keys {
+			data = append(append(data, msgpackFor(key)...), msgpackFor(v[key])...)
+		}
+		return data
+	}
+	panic(fmt.Sprintf("can't encode %T as msgpack", v))
+}
+
+func TestDecodeMsgpackWidths(t *testing.T) {
+	hexValue := func(s string) []byte {
+		data, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	for _, test := range []struct {
+		input    string
+		expected interface{}
+	}{
+		{"05", int64(5)},
+		{"ff", int64(-1)},
+		{"cc ff", int64(255)},
+		{"cd 01 00", int64(256)},
+		{"ce 00 01 00 00", int64(65536)},
+		{"cf 00 00 00 01 00 00 00 00", int64(1 << 32)},
+		{"cf ff ff ff ff ff ff ff ff", uint64(math.MaxUint64)},
+		{"d0 80", int64(-128)},
+		{"d1 ff 7f", int64(-129)},
+		{"d2 ff ff 7f ff", int64(-32769)},
+		{"d3 ff ff ff ff 7f ff ff ff", int64(-2147483649)},
+		{"ca 3f c0 00 00", 1.5},
+		{"cb 3f f8 00 00 00 00 00 00", 1.5},
+		{"c0", nil},
+		{"c3", true},
+		{"a3 61 62 63", "abc"},
+		{"d9 03 61 62 63", "abc"},
+		{"da 00 03 61 62 63", "abc"},
+		{"db 00 00 00 03 61 62 63", "abc"},
+		{"c4 02 01 02", []byte{1, 2}},
+		{"c5 00 02 01 02", []byte{1, 2}},
+		{"c6 00 00 00 02 01 02", []byte{1, 2}},
+		{"92 01 a1 78", []interface{}{int64(1), "x"}},
+		{"dc 00 01 c0", []interface{}{nil}},
+		{"dd 00 00 00 01 c3", []interface{}{true}},
+		{"81 a1 6b 01", map[string]interface{}{"k": int64(1)}},
+		{"de 00 01 c4 01 6b 01", map[string]interface{}{"k": int64(1)}},
+		{"df 00 00 00 01 05 c2", map[string]interface{}{"5": false}},
+		{"d4 01 aa", msgpackExt{typ: 1, data: []byte{0xaa}}},
+		{"d5 01 aa bb", msgpackExt{typ: 1, data: []byte{0xaa, 0xbb}}},
+		{"d6 00 00 00 00 01", msgpackExt{typ: 0, data: []byte{0, 0, 0, 1}}},
+		{"d7 ff 01 02 03 04 05 06 07 08", msgpackExt{typ: -1, data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}},
+		{"d8 02" + strings.Repeat(" 00", 16), msgpackExt{typ: 2, data: make([]byte, 16)}},
+		{"c7 03 05 61 62 63", msgpackExt{typ: 5, data: []byte("abc")}},
+		{"c8 00 03 05 61 62 63", msgpackExt{typ: 5, data: []byte("abc")}},
+		{"c9 00 00 00 03 05 61 62 63", msgpackExt{typ: 5, data: []byte("abc")}},
+	} {
+		value, err := decodeMsgpack(bufio.NewReader(bytes.NewReader(hexValue(test.input))), 0)
+		if err != nil || !reflect.DeepEqual(value, test.expected) {
+			t.Errorf("%s decoded as %#v, %v, expected %#v", test.input, value, err, test.expected)
+		}
+	}
+
+	for name, input := range map[string][]byte{
+		"an invalid type":        hexValue("c1"),
+		"a truncated string":     hexValue("a3 61"),
+		"a length over the cap":  hexValue("db 7f ff ff ff"),
+		"an array over the cap":  hexValue("dd 7f ff ff ff"),
+		"nesting over the cap":   append(bytes.Repeat([]byte{0x91}, maxMsgpackDepth+1), 0x01),
+		"nested maps":            append(bytes.Repeat([]byte{0x81, 0xa1, 0x6b}, maxMsgpackDepth+1), 0x01),
+		"endless nesting":        bytes.Repeat([]byte{0x91}, 8<<20),
+		"nesting in a map value": append(append([]byte{0x81, 0xa1, 0x6b}, bytes.Repeat([]byte{0x91}, maxMsgpackDepth)...), 0x01),
+	} {
+		if value, err := decodeMsgpack(bufio.NewReader(bytes.NewReader(input)), 0); err == nil {
+			t.Errorf("%s decoded as %#v", name, value)
+		}
+	}
+	if _, err := decodeMsgpack(bufio.NewReader(bytes.NewReader(append(bytes.Repeat([]byte{0x91}, maxMsgpackDepth), 0x01))), 0); err != nil {
+		t.Errorf("nesting at the cap rejected: %v", err)
+	}
+
+	// The bytes of a forward message are bounded as a whole, not only per value
+	limited := &limitedMsgpackReader{reader: bufio.NewReader(bytes.NewReader(hexValue("93 a3 61 62 63 a3 61 62 63 a3 61 62 63"))), remaining: 10}
+	if value, err := decodeMsgpack(limited, 0); !errors.Is(err, errForwardMessageTooLong) {
+		t.Errorf("message over its budget decoded as %#v, %v", value, err)
+	}
+}
+
+func TestDecodeForwardMessageModes(t *testing.T) {
+	_, t0 := minuteAt(0)
+	eventTime := msgpackExt{typ: 0, data: binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, uint32(t0+1)), 500000000)}
+	event := func(time interface{}, record map[string]interface{}) []byte {
+		return msgpackFor([]interface{}{time, record})
+	}
+	packed := append(event(t0, map[string]interface{}{"log": "boot ok", "level": "INFO"}), event(eventTime, map[string]interface{}{"message": "request served", "status": int64(200)})...)
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	gzipWriter.Write(packed)
+	gzipWriter.Close()
+	expected := []LogEntry{
+		{Timestamp: t0, Message: "boot ok", Level: "INFO", Fields: map[string]string{"tag": "app.web"}},
+		{Timestamp: t0 + 1, Message: "request served", Fields: map[string]string{"tag": "app.web", "status": "200"}},
+	}
+
+	for mode, test := range map[string]struct {
+		message  []interface{}
+		expected []LogEntry
+		chunk    string
+	}{
+		"Message": {
+			[]interface{}{"app.web", t0, map[string]interface{}{"log": "boot ok", "level": "INFO"}, map[string]interface{}{"chunk": "c1"}},
+			expected[:1], "c1",
+		},
+		"Message without option": {
+			[]interface{}{"app.web", t0, map[string]interface{}{"log": "boot ok", "level": "INFO"}},
+			expected[:1], "",
+		},
+		"Forward": {
+			[]interface{}{"app.web", []interface{}{
+				[]interface{}{t0, map[string]interface{}{"log": "boot ok", "level": "INFO"}},
+				[]interface{}{eventTime, map[string]interface{}{"message": "request served", "status": int64(200)}},
+			}, map[string]interface{}{"chunk": "c2"}},
+			expected, "c2",
+		},
+		"PackedForward": {
+			[]interface{}{"app.web", packed, map[string]interface{}{"chunk": "c3"}},
+			expected, "c3",
+		},
+		"PackedForward as str": {
+			[]interface{}{"app.web", string(packed)},
+			expected, "",
+		},
+		"CompressedPackedForward": {
+			[]interface{}{"app.web", compressed.Bytes(), map[string]interface{}{"compressed": "gzip", "chunk": "c4"}},
+			expected, "c4",
+		},
+		"Record without a message": {
+			[]interface{}{"app.web", t0, map[string]interface{}{"status": int64(200)}},
+			[]LogEntry{{Timestamp: t0, Message: `{"status":200}`, Fields: map[string]string{"tag": "app.web", "status": "200"}}}, "",
+		},
+	} {
+		value, err := decodeMsgpack(bufio.NewReader(bytes.NewReader(msgpackFor(test.message))), 0)
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		entries, chunk, err := decodeForwardMessage(value)
+		if err != nil || chunk != test.chunk || !reflect.DeepEqual(entries, test.expected) {
+			t.Errorf("%s decoded as %+v, chunk %q, %v", mode, entries, chunk, err)
+		}
+	}
+
+	for name, message := range map[string]interface{}{
+		"a map":             map[string]interface{}{"tag": "app.web"},
+		"a tag alone":       []interface{}{"app.web"},
+		"a non-string tag":  []interface{}{int64(1), t0, map[string]interface{}{"log": "x"}},
+		"a record list":     []interface{}{"app.web", t0, []interface{}{"x"}},
+		"an invalid event":  []interface{}{"app.web", []interface{}{[]interface{}{t0}}},
+		"an invalid time":   []interface{}{"app.web", "soon", map[string]interface{}{"log": "x"}},
+		"an invalid ext":    []interface{}{"app.web", msgpackExt{typ: 1, data: make([]byte, 8)}, map[string]interface{}{"log": "x"}},
+		"invalid gzip":      []interface{}{"app.web", packed, map[string]interface{}{"compressed": "gzip"}},
+		"truncated packing": []interface{}{"app.web", packed[:len(packed)-3]},
+	} {
+		value, err := decodeMsgpack(bufio.NewReader(bytes.NewReader(msgpackFor(message))), 0)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if entries, _, err := decodeForwardMessage(value); err == nil {
+			t.Errorf("%s decoded as %+v", name, entries)
+		}
+	}
+}
+
+func TestForwardAckEncodings(t *testing.T) {
+	for _, test := range []struct {
+		length int
+		prefix string
+	}{
+		{31, "81 a3 61 63 6b bf"},
+		{32, "81 a3 61 63 6b d9 20"},
+		{255, "81 a3 61 63 6b d9 ff"},
+		{256, "81 a3 61 63 6b da 01 00"},
+	} {
+		chunk := strings.Repeat("c", test.length)
+		ack := forwardAck(chunk)
+		if prefix := strings.ReplaceAll(test.prefix, " ", ""); !strings.HasPrefix(hex.EncodeToString(ack), prefix) {
+			t.Errorf("ack of a %d byte chunk starts with %x, expected %s", test.length, ack[:len(prefix)/2], prefix)
+		}
+		value, err := decodeMsgpack(bufio.NewReader(bytes.NewReader(ack)), 0)
+		if err != nil || !reflect.DeepEqual(value, map[string]interface{}{"ack": chunk}) {
+			t.Errorf("ack of a %d byte chunk decoded as %v, %v", test.length, value, err)
+		}
+	}
+}
+
+func TestForwardConnAcknowledgesChunksAndClosesOnDeepNesting(t *testing.T) {
+	acceptIngest(t)
+	_, t0 := minuteAt(0)
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleForwardConn(server)
+		close(done)
+	}()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	client.Write(msgpackFor([]interface{}{"app.web", t0, map[string]interface{}{"log": "boot ok"}, map[string]interface{}{"chunk": "c1"}}))
+	ack := make([]byte, len(forwardAck("c1")))
+	if _, err := io.ReadFull(client, ack); err != nil || !bytes.Equal(ack, forwardAck("c1")) {
+		t.Fatalf("acknowledged with %x, %v", ack, err)
+	}
+	if got := drainTestChannel(); len(got) != 1 || got[0].Message != "boot ok" {
+		t.Errorf("enqueued %+v", got)
+	}
+
+	invalid := metricValue(`input_invalid_messages_total{input="forward"}`)
+	go client.Write(bytes.Repeat([]byte{0x91}, 1<<20))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed on deep nesting")
+	}
+	if got := metricValue(`input_invalid_messages_total{input="forward"}`) - invalid; got != 1 {
+		t.Errorf("counted %v invalid messages", got)
+	}
+}
+
+// gzipped compresses data with gzip
+func gzipped(data string) string {
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	gzipWriter.Write([]byte(data))
+	gzipWriter.Close()
+	return compressed.String()
+}
+
+func TestIngestGzipBody(t *testing.T) {
+	acceptIngest(t)
+	for _, ndjson := range []bool{false, true} {
+		payload := ingestPayload(20, ndjson)
+		format := "/ingest"
+		if ndjson {
+			format = "/ingest?format=ndjson"
+		}
+		if recorder := postIngest(t, format, payload); recorder.Code != http.StatusCreated {
+			t.Fatalf("plain body answered %d: %s", recorder.Code, recorder.Body.String())
+		}
+		plain := drainTestChannel()
+		if recorder := postIngest(t, format, gzipped(payload), "Content-Encoding", "gzip"); recorder.Code != http.StatusCreated {
+			t.Fatalf("gzip body answered %d: %s", recorder.Code, recorder.Body.String())
+		}
+		if compressed := drainTestChannel(); len(plain) != 20 || !reflect.DeepEqual(compressed, plain) {
+			t.Errorf("gzip body decoded as %d entries %+v, the plain one as %d", len(compressed), compressed, len(plain))
+		}
+	}
+
+	compressed := gzipped(ingestPayload(20, false))
+	for name, test := range map[string]struct {
+		body     string
+		encoding string
+		code     int
+	}{
+		"a truncated stream":   {compressed[:len(compressed)/2], "gzip", http.StatusBadRequest},
+		"a malformed header":   {"not gzip at all", "gzip", http.StatusBadRequest},
+		"a corrupted stream":   {compressed[:12] + strings.Repeat("x", len(compressed)-12), "x-gzip", http.StatusBadRequest},
+		"brotli":               {compressed, "br", http.StatusUnsupportedMediaType},
+		"an identity encoding": {ingestPayload(1, false), "identity", http.StatusCreated},
+	} {
+		if recorder := postIngest(t, "/ingest", test.body, "Content-Encoding", test.encoding); recorder.Code != test.code {
+			t.Errorf("%s answered %d, expected %d: %s", name, recorder.Code, test.code, recorder.Body.String())
+		}
+	}
+	drainTestChannel()
+
+	// Without MAX_INGEST_BODY_BYTES, the decompressed size is still bounded by MAX_DECOMPRESSED_BYTES
+	bomb := gzipped("[" + strings.Repeat(" ", 1<<20) + "]")
+	override(t, &maxIngestBodyBytes, 0)
+	override(t, &maxDecompressedBytes, 64*1024)
+	recorder := postIngest(t, "/ingest", bomb, "Content-Encoding", "gzip")
+	if recorder.Code != http.StatusRequestEntityTooLarge || !strings.Contains(recorder.Body.String(), "65536 bytes") {
+		t.Errorf("%d byte body decompressing to 1 MiB answered %d: %s", len(bomb), recorder.Code, recorder.Body.String())
+	}
+	override(t, &maxIngestBodyBytes, 32*1024)
+	recorder = postIngest(t, "/ingest", bomb, "Content-Encoding", "gzip")
+	if recorder.Code != http.StatusRequestEntityTooLarge || !strings.Contains(recorder.Body.String(), "32768 bytes") {
+		t.Errorf("with MAX_INGEST_BODY_BYTES the body answered %d: %s", recorder.Code, recorder.Body.String())
+	}
+	override(t, &maxDecompressedBytes, 0)
+	override(t, &maxIngestBodyBytes, 0)
+	if recorder := postIngest(t, "/ingest", bomb, "Content-Encoding", "gzip"); recorder.Code != http.StatusCreated {
+		t.Errorf("without any limit the body answered %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+// checkBufferIndex fails the test unless bufferIndex holds exactly the entries of inMemorySearchBuffer, by minute in order
+func checkBufferIndex(t *testing.T, step string) {
+	t.Helper()
+	bufferMu.RLock()
+	defer bufferMu.RUnlock()
+	expected := make(map[int64][]LogEntry)
+	for _, entry := range inMemorySearchBuffer {
+		minute := bufferMinute(entry.Timestamp)
+		expected[minute] = append(expected[minute], entry)
+	}
+	indexed := make(map[int64][]LogEntry)
+	for minute, entries := range bufferIndex {
+		if len(entries) > 0 {
+			indexed[minute] = entries
+		}
+	}
+	if !reflect.DeepEqual(indexed, expected) {
+		t.Errorf("after %s the index holds %d minutes %v, the buffer %d minutes %v", step, len(indexed), indexed, len(expected), expected)
+	}
+}
+
+func TestBufferIndexConsistentWithBuffer(t *testing.T) {
+	useTempDirectories(t)
+	override(t, &apiKey, "secret")
+	var entries []LogEntry
+	for i := 0; i < 12; i++ {
+		_, start := minuteAt(i % 4)
+		entries = append(entries, LogEntry{Timestamp: start + int64(i*7%60), Message: fmt.Sprintf("entry %d", i)})
+	}
+	// Timestamps before 1970 belong to the minute starting before them too
+	entries = append(entries, LogEntry{Timestamp: -30, Message: "before the epoch"}, LogEntry{Timestamp: -60, Message: "minute before the epoch"})
+	useTestBuffer(t, entries...)
+	checkBufferIndex(t, "appendToBuffer")
+	if got := bufferIndex[-60]; len(got) != 2 {
+		t.Errorf("minute before the epoch indexed as %+v", got)
+	}
+
+	bufferMu.Lock()
+	resetBuffer(inMemorySearchBuffer[3:])
+	bufferMu.Unlock()
+	checkBufferIndex(t, "resetBuffer")
+
+	m1, _ := minuteAt(1)
+	request := httptest.NewRequest("POST", "/admin/evict-buffer?minute="+m1, nil)
+	request.Header.Set("X-API-Key", "secret")
+	recorder := httptest.NewRecorder()
+	evictBufferHandler(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("evicting answered %d: %s", recorder.Code, recorder.Body.String())
+	}
+	checkBufferIndex(t, "evicting a minute")
+	_, start := minuteAt(1)
+	if got := bufferIndex[start]; len(got) != 0 {
+		t.Errorf("evicted minute still indexed with %+v", got)
+	}
+
+	override(t, &memoryHighWatermark, 1)
+	t.Cleanup(func() { memoryPressure.Store(false) })
+	bufferMu.RLock()
+	before := len(inMemorySearchBuffer)
+	bufferMu.RUnlock()
+	checkMemory()
+	checkBufferIndex(t, "checkMemory")
+	bufferMu.RLock()
+	after := len(inMemorySearchBuffer)
+	bufferMu.RUnlock()
+	if after != before-before/2 {
+		t.Errorf("checkMemory kept %d of %d entries", after, before)
+	}
+
+	bufferMu.Lock()
+	appendToBuffer(LogEntry{Timestamp: start + 1, Message: "after eviction"})
+	bufferMu.Unlock()
+	checkBufferIndex(t, "appending after checkMemory")
+	bufferMu.Lock()
+	resetBuffer(nil)
+	bufferMu.Unlock()
+	checkBufferIndex(t, "emptying the buffer")
+	if len(bufferIndex) != 0 {
+		t.Errorf("emptied buffer still indexes %d minutes", len(bufferIndex))
+	}
+}
+
+func BenchmarkScanBuffer(b *testing.B) {
+	const minutes, perMinute = 1000, 1000
+	entries := make([]LogEntry, 0, minutes*perMinute)
+	for i := 0; i < minutes; i++ {
+		_, start := minuteAt(i)
+		for j := 0; j < perMinute; j++ {
+			entries = append(entries, LogEntry{Timestamp: start + int64(j%60), Message: "GET /orders 200"})
+		}
+	}
+	useTestBuffer(b, entries...)
+	entries = nil
+	query := func(first, last int) *logQuery {
+		_, start := minuteAt(first)
+		_, end := minuteAt(last)
+		query, err := parseLogQuery(httptest.NewRequest("GET", fmt.Sprintf("/query?start=%d&end=%d", start, end+59), nil))
+		if err != nil {
+			b.Fatal(err)
+		}
+		return query
+	}
+
+	narrow, full := query(500, 500), query(0, minutes-1)
+	b.Run("one minute", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if got := narrow.scanBuffer(); len(got) != perMinute {
+				b.Fatalf("scanned %d entries", len(got))
+			}
+		}
+	})
+	// What scanning one minute took before the buffer was indexed
+	b.Run("one minute without the index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var got []LogEntry
+			bufferMu.RLock()
+			for _, entry := range inMemorySearchBuffer {
+				if narrow.matches(entry) {
+					got = append(got, entry)
+				}
+			}
+			bufferMu.RUnlock()
+			if len(got) != perMinute {
+				b.Fatalf("scanned %d entries", len(got))
+			}
+		}
+	})
+	b.Run("full range", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if got := full.scanBuffer(); len(got) != minutes*perMinute {
+				b.Fatalf("scanned %d entries", len(got))
+			}
+		}
+	})
+}
+
+// snappyLiterals encodes data as a snappy block of literals, as a compressor finding no repetition would
+func snappyLiterals(data []byte) []byte {
+	block := binary.AppendUvarint(nil, uint64(len(data)))
+	for len(data) > 0 {
+		n := min(len(data), 65536)
+		block = append(block, 61<<2, byte(n-1), byte((n-1)>>8))
+		block = append(block, data[:n]...)
+		data = data[n:]
+	}
+	return block
+}
+
+func TestDecodeSnappyVectors(t *testing.T) {
+	hexBytes := func(s string) []byte {
+		data, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	hundred := strings.Repeat("0123456789", 10)
+	for name, test := range map[string]struct {
+		block    []byte
+		expected string
+	}{
+		"a literal":                 {hexBytes("05 10 68656c6c6f"), "hello"},
+		"a one byte literal length": {append(hexBytes("64 f0 63"), hundred...), hundred},
+		"a two byte literal length": {snappyLiterals([]byte(strings.Repeat(hundred, 700))), strings.Repeat(hundred, 700)},
+		"a copy with a 1 byte offset": {
+			hexBytes("08 0c 61626364 01 04"), "abcdabcd",
+		},
+		"a copy with a 2 byte offset": {
+			append(append(hexBytes("8802 f0 ff"), strings.Repeat("x", 256)...), hexBytes("1e 00 01")...),
+			strings.Repeat("x", 256) + strings.Repeat("x", 8),
+		},
+		"a copy with a 4 byte offset": {hexBytes("08 0c 61626364 0f 04000000"), "abcdabcd"},
+		"an overlapping copy":         {hexBytes("0a 00 61 15 01"), "aaaaaaaaaa"},
+		"an overlapping 2 byte copy":  {hexBytes("0e 04 6162 2e 0200"), "ababababababab"},
+		"an empty block":              {hexBytes("00"), ""},
+	} {
+		decoded, err := decodeSnappy(test.block, 0)
+		if err != nil || string(decoded) != test.expected {
+			t.Errorf("%s decoded as %q, %v", name, decoded, err)
+		}
+	}
+
+	for name, block := range map[string][]byte{
+		"no length":                   {},
+		"a truncated length":          hexBytes("ff"),
+		"a truncated literal":         hexBytes("05 10 6865"),
+		"a truncated literal length":  hexBytes("64 f4 00"),
+		"a truncated copy":            hexBytes("08 0c 61626364 01"),
+		"a truncated 2 byte copy":     hexBytes("08 0c 61626364 0e 04"),
+		"a copy before the output":    hexBytes("08 0c 61626364 01 05"),
+		"a copy without an offset":    hexBytes("08 0c 61626364 01 00"),
+		"a copy past the length":      hexBytes("06 0c 61626364 01 04"),
+		"a literal past the length":   hexBytes("02 10 68656c6c6f"),
+		"a block shorter than stated": hexBytes("06 10 68656c6c6f"),
+		"a length no input can reach": hexBytes("ffffffff0f 00 61"),
+	} {
+		if decoded, err := decodeSnappy(block, 0); err == nil {
+			t.Errorf("%s decoded as %q", name, decoded)
+		}
+	}
+
+	_, err := decodeSnappy(hexBytes("05 10 68656c6c6f"), 4)
+	var maxBytesErr *http.MaxBytesError
+	if !errors.As(err, &maxBytesErr) || maxBytesErr.Limit != 4 {
+		t.Errorf("block over the limit decoded with %v", err)
+	}
+	if decoded, err := decodeSnappy(hexBytes("05 10 68656c6c6f"), 5); err != nil || string(decoded) != "hello" {
+		t.Errorf("block at the limit decoded as %q, %v", decoded, err)
+	}
+}
+
+func TestParseLokiLabels(t *testing.T) {
+	for labels, expected := range map[string]map[string]string{
+		`{}`:                                  {},
+		`{job="varlogs"}`:                     {"job": "varlogs"},
+		` { job = "varlogs" , host="web-1" }`: {"job": "varlogs", "host": "web-1"},
+		`{msg="say \"hi\"", path="a,b"}`:      {"msg": `say "hi"`, "path": "a,b"},
+		`{filter="x=1,y=2",level="error"}`:    {"filter": "x=1,y=2", "level": "error"},
+		`{path="C:\\logs\\app.log"}`:          {"path": `C:\logs\app.log`},
+		`{msg="tab\there"}`:                   {"msg": "tab\there"},
+	} {
+		if got, err := parseLokiLabels(labels); err != nil || !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s parsed as %v, %v", labels, got, err)
+		}
+	}
+	for _, labels := range []string{``, `job="varlogs"`, `{job="varlogs"`, `{job}`, `{job=varlogs}`, `{job="varlogs}`, `{msg="bad \q escape"}`} {
+		if got, err := parseLokiLabels(labels); err == nil {
+			t.Errorf("%s parsed as %v", labels, got)
+		}
+	}
+}
+
+func TestLokiPushMapsStreamsToEntries(t *testing.T) {
+	acceptIngest(t)
+	_, t0 := minuteAt(0)
+	nanos := t0*int64(time.Second) + 250000000
+	expected := []LogEntry{
+		{Timestamp: t0, Message: "connection reset", Level: "error", Fields: map[string]string{"job": "varlogs", "host": "web,1", "trace_id": "4bf92f35"}},
+		{Timestamp: t0 + 1, Message: `GET "/" 200`, Level: "info", Fields: map[string]string{"job": "varlogs", "host": "web,1"}},
+		{Timestamp: t0 + 2, Message: "disk full", Fields: map[string]string{"job": "node"}},
+	}
+	push := func(contentType, body string) []LogEntry {
+		t.Helper()
+		request := httptest.NewRequest("POST", "/loki/api/v1/push", strings.NewReader(body))
+		request.Header.Set("Content-Type", contentType)
+		recorder := httptest.NewRecorder()
+		lokiPushHandler(recorder, request)
+		if recorder.Code != http.StatusNoContent {
+			t.Fatalf("%s push answered %d: %s", contentType, recorder.Code, recorder.Body.String())
+		}
+		return drainTestChannel()
+	}
+
+	// logproto.PushRequest: streams (1) of labels (1) and entries (2) of a timestamp (1), a line (2) and metadata (3)
+	message := func(num protowire.Number, data []byte) []byte {
+		return protowire.AppendBytes(protowire.AppendTag(nil, num, protowire.BytesType), data)
+	}
+	entry := func(nanos int64, line string, metadata ...string) []byte {
+		timestamp := protowire.AppendVarint(protowire.AppendTag(nil, 1, protowire.VarintType), uint64(nanos/int64(time.Second)))
+		timestamp = protowire.AppendVarint(protowire.AppendTag(timestamp, 2, protowire.VarintType), uint64(nanos%int64(time.Second)))
+		data := append(message(1, timestamp), message(2, []byte(line))...)
+		for i := 0; i+1 < len(metadata); i += 2 {
+			data = append(data, message(3, append(message(1, []byte(metadata[i])), message(2, []byte(metadata[i+1]))...))...)
+		}
+		return data
+	}
+	var pushRequest []byte
+	pushRequest = append(pushRequest, message(1, slices.Concat(
+		message(1, []byte(`{job="varlogs", host="web,1", level="info"}`)),
+		message(2, entry(nanos, "connection reset", "trace_id", "4bf92f35", "level", "error")),
+		message(2, entry(nanos+int64(time.Second), `GET "/" 200`)),
+	))...)
+	pushRequest = append(pushRequest, message(1, slices.Concat(
+		message(1, []byte(`{job="node"}`)),
+		message(2, entry(nanos+2*int64(time.Second), "disk full")),
+	))...)
+	if got := push("application/x-protobuf", string(snappyLiterals(pushRequest))); !reflect.DeepEqual(got, expected) {
+		t.Errorf("protobuf push stored %+v", got)
+	}
+
+	jsonRequest := fmt.Sprintf(`{"streams":[
+		{"stream":{"job":"varlogs","host":"web,1","level":"info"},"values":[["%d","connection reset",{"trace_id":"4bf92f35","level":"error"}],["%d","GET \"/\" 200"]]},
+		{"stream":{"job":"node"},"values":[["%d","disk full"]]}]}`, nanos, nanos+int64(time.Second), nanos+2*int64(time.Second))
+	if got := push("application/json", jsonRequest); !reflect.DeepEqual(got, expected) {
+		t.Errorf("JSON push stored %+v", got)
+	}
+
+	for name, test := range map[string]struct {
+		contentType, body string
+		code              int
+	}{
+		"an unknown content type": {"text/plain", jsonRequest, http.StatusUnsupportedMediaType},
+		"an unsnappied protobuf":  {"application/x-protobuf", string(pushRequest), http.StatusBadRequest},
+		"invalid labels":          {"application/x-protobuf", string(snappyLiterals(message(1, message(1, []byte(`{job=varlogs}`))))), http.StatusBadRequest},
+		"a numeric timestamp":     {"application/json", `{"streams":[{"stream":{},"values":[[1709356020000000000,"x"]]}]}`, http.StatusBadRequest},
+		"a value without a line":  {"application/json", `{"streams":[{"stream":{},"values":[["1709356020000000000"]]}]}`, http.StatusBadRequest},
+	} {
+		request := httptest.NewRequest("POST", "/loki/api/v1/push", strings.NewReader(test.body))
+		request.Header.Set("Content-Type", test.contentType)
+		recorder := httptest.NewRecorder()
+		lokiPushHandler(recorder, request)
+		if recorder.Code != test.code {
+			t.Errorf("%s answered %d, expected %d: %s", name, recorder.Code, test.code, recorder.Body.String())
+		}
+	}
+
+	// The decompressed size is bounded like that of gzip bodies
+	override(t, &maxDecompressedBytes, int64(len(pushRequest)-1))
+	request := httptest.NewRequest("POST", "/loki/api/v1/push", bytes.NewReader(snappyLiterals(pushRequest)))
+	request.Header.Set("Content-Type", "application/x-protobuf")
+	recorder := httptest.NewRecorder()
+	lokiPushHandler(recorder, request)
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("push decompressing past MAX_DECOMPRESSED_BYTES answered %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+// protoBytesField encodes a length-delimited protobuf field
+func protoBytesField(num protowire.Number, data []byte) []byte {
+	return protowire.AppendBytes(protowire.AppendTag(nil, num, protowire.BytesType), data)
+}
+
+// protoVarintField encodes a varint protobuf field
+func protoVarintField(num protowire.Number, value uint64) []byte {
+	return protowire.AppendVarint(protowire.AppendTag(nil, num, protowire.VarintType), value)
+}
+
+// otlpKeyValueProto encodes a KeyValue of key and the encoded AnyValue value
+func otlpKeyValueProto(key string, value []byte) []byte {
+	return append(protoBytesField(1, []byte(key)), protoBytesField(2, value)...)
+}
+
+// otlpTestRequest returns the same ExportLogsServiceRequest in the protobuf and the OTLP/JSON encodings
+func otlpTestRequest(t0 int64) ([]byte, string) {
+	nanos := uint64(t0)*uint64(time.Second) + 500
+	str := func(s string) []byte { return protoBytesField(1, []byte(s)) }
+	attributes := slices.Concat(
+		protoBytesField(6, otlpKeyValueProto("order_id", protoVarintField(3, 42))),
+		protoBytesField(6, otlpKeyValueProto("retried", protoVarintField(2, 1))),
+		protoBytesField(6, otlpKeyValueProto("ratio", protowire.AppendFixed64(protowire.AppendTag(nil, 4, protowire.Fixed64Type), math.Float64bits(1.5)))),
+		protoBytesField(6, otlpKeyValueProto("tags", protoBytesField(5, slices.Concat(protoBytesField(1, str("a")), protoBytesField(1, protoVarintField(3, 1)))))),
+		protoBytesField(6, otlpKeyValueProto("user", protoBytesField(6, protoBytesField(1, otlpKeyValueProto("id", str("u-7")))))),
+		protoBytesField(6, otlpKeyValueProto("raw", protoBytesField(7, []byte{1, 2}))),
+	)
+	records := slices.Concat(
+		// A record with its own time, a severity number and trace context
+		protoBytesField(2, slices.Concat(
+			protowire.AppendFixed64(protowire.AppendTag(nil, 1, protowire.Fixed64Type), nanos),
+			protoVarintField(2, 17),
+			protoBytesField(5, str("payment failed")),
+			attributes,
+			protoBytesField(9, []byte{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36}),
+			protoBytesField(10, []byte{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7}),
+		)),
+		// A record with only its observed time, whose severity text wins over its number and whose body is a kvlist
+		protoBytesField(2, slices.Concat(
+			protowire.AppendFixed64(protowire.AppendTag(nil, 11, protowire.Fixed64Type), nanos+uint64(time.Second)),
+			protoVarintField(2, 9),
+			protoBytesField(3, []byte("warning")),
+			protoBytesField(5, protoBytesField(6, protoBytesField(1, otlpKeyValueProto("status", protoVarintField(3, 503))))),
+		)),
+		// A record without any time or severity
+		protoBytesField(2, protoBytesField(5, str("heartbeat"))),
+	)
+	request := protoBytesField(1, slices.Concat(
+		protoBytesField(1, protoBytesField(1, otlpKeyValueProto("service.name", str("checkout")))),
+		protoBytesField(2, slices.Concat(protoBytesField(1, protoBytesField(1, []byte("payments"))), records)),
+	))
+
+	jsonRequest := fmt.Sprintf(`{"resourceLogs":[{
+		"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"checkout"}}]},
+		"scopeLogs":[{"scope":{"name":"payments"},"logRecords":[
+			{"timeUnixNano":"%d","severityNumber":17,"body":{"stringValue":"payment failed"},"attributes":[
+				{"key":"order_id","value":{"intValue":"42"}},
+				{"key":"retried","value":{"boolValue":true}},
+				{"key":"ratio","value":{"doubleValue":1.5}},
+				{"key":"tags","value":{"arrayValue":{"values":[{"stringValue":"a"},{"intValue":1}]}}},
+				{"key":"user","value":{"kvlistValue":{"values":[{"key":"id","value":{"stringValue":"u-7"}}]}}},
+				{"key":"raw","value":{"bytesValue":"AQI="}}],
+			 "traceId":"4bf92f3577b34da6a3ce929d0e0e4736","spanId":"00f067aa0ba902b7"},
+			{"observedTimeUnixNano":%d,"severityNumber":9,"severityText":"warning","body":{"kvlistValue":{"values":[{"key":"status","value":{"intValue":503}}]}}},
+			{"body":{"stringValue":"heartbeat"}}]}]}]}`, nanos, nanos+uint64(time.Second))
+	return request, jsonRequest
+}
+
+func TestOTLPEncodingsDecodeToTheSameEntries(t *testing.T) {
+	_, t0 := minuteAt(0)
+	now := time.Unix(t0+30, 0)
+	protobufRequest, jsonRequest := otlpTestRequest(t0)
+	resource := map[string]string{"service.name": "checkout", "scope": "payments"}
+	with := func(fields map[string]string) map[string]string {
+		merged := maps.Clone(resource)
+		maps.Copy(merged, fields)
+		return merged
+	}
+	expected := []LogEntry{
+		{Timestamp: t0, Message: "payment failed", Level: "ERROR", Fields: with(map[string]string{
+			"order_id": "42", "retried": "true", "ratio": "1.5", "tags": `["a",1]`, "user": `{"id":"u-7"}`, "raw": `"AQI="`,
+			"trace_id": "4bf92f3577b34da6a3ce929d0e0e4736", "span_id": "00f067aa0ba902b7",
+		})},
+		{Timestamp: t0 + 1, Message: `{"status":503}`, Level: "warning", Fields: with(nil)},
+		{Timestamp: t0 + 30, Message: "heartbeat", Fields: with(nil)},
+	}
+
+	decoded, err := decodeOTLPRequest(protobufRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := otlpEntries(decoded, now); !reflect.DeepEqual(got, expected) {
+		t.Errorf("protobuf request converted to\n%+v\nexpected\n%+v", got, expected)
+	}
+	var jsonDecoded otlpLogsRequest
+	if err := json.Unmarshal([]byte(jsonRequest), &jsonDecoded); err != nil {
+		t.Fatal(err)
+	}
+	if got := otlpEntries(jsonDecoded, now); !reflect.DeepEqual(got, expected) {
+		t.Errorf("JSON request converted to\n%+v\nexpected\n%+v", got, expected)
+	}
+
+	// Every severity number range has its level name
+	for number, level := range map[int]string{1: "TRACE", 5: "DEBUG", 12: "INFO", 13: "WARN", 20: "ERROR", 24: "FATAL", 0: "", 25: ""} {
+		request := otlpLogsRequest{ResourceLogs: []otlpResourceLogs{{ScopeLogs: []otlpScopeLogs{{LogRecords: []otlpLogRecord{{TimeUnixNano: otlpInt(t0) * otlpInt(time.Second), SeverityNumber: number}}}}}}}
+		if got := otlpEntries(request, now); got[0].Level != level {
+			t.Errorf("severity number %d mapped to %q, expected %q", number, got[0].Level, level)
+		}
+	}
+
+	if _, err := decodeOTLPRequest(protobufRequest[:len(protobufRequest)-3]); err == nil {
+		t.Error("truncated protobuf request decoded")
+	}
+}
+
+func TestOTLPRejectsDeeplyNestedValues(t *testing.T) {
+	acceptIngest(t)
+	nested := func(depth int) ([]byte, string) {
+		value := protoBytesField(1, []byte("leaf"))
+		jsonValue := `{"stringValue":"leaf"}`
+		for i := 0; i < depth; i++ {
+			value = protoBytesField(5, protoBytesField(1, value))
+			jsonValue = `{"arrayValue":{"values":[` + jsonValue + `]}}`
+		}
+		record := protoBytesField(2, protoBytesField(6, otlpKeyValueProto("nested", value)))
+		request := protoBytesField(1, protoBytesField(2, record))
+		return request, `{"resourceLogs":[{"scopeLogs":[{"logRecords":[{"attributes":[{"key":"nested","value":` + jsonValue + `}]}]}]}]}`
+	}
+	export := func(contentType, body string) int {
+		request := httptest.NewRequest("POST", "/v1/logs", strings.NewReader(body))
+		request.Header.Set("Content-Type", contentType)
+		recorder := httptest.NewRecorder()
+		otlpLogsHandler(recorder, request)
+		return recorder.Code
+	}
+	for _, test := range []struct {
+		depth int
+		code  int
+	}{
+		{maxOTLPValueDepth, http.StatusOK},
+		{maxOTLPValueDepth + 1, http.StatusBadRequest},
+		{1000, http.StatusBadRequest},
+	} {
+		protobufRequest, jsonRequest := nested(test.depth)
+		if code := export("application/x-protobuf", string(protobufRequest)); code != test.code {
+			t.Errorf("protobuf value nested %d levels answered %d, expected %d", test.depth, code, test.code)
+		}
+		if code := export("application/json", jsonRequest); code != test.code {
+			t.Errorf("JSON value nested %d levels answered %d, expected %d", test.depth, code, test.code)
+		}
+	}
+	drainTestChannel()
+}
+
+func TestOTLPPartialSuccessResponses(t *testing.T) {
+	acceptIngest(t)
+	override(t, &rejectBeyondRetention, true)
+	override(t, &retention, time.Hour)
+	now := time.Now().Unix()
+	_, t0 := minuteAt(0)
+	// One record within retention, two older than it
+	record := func(seconds int64) string {
+		return fmt.Sprintf(`{"timeUnixNano":"%d","body":{"stringValue":"payment failed"}}`, seconds*int64(time.Second))
+	}
+	jsonRequest := `{"resourceLogs":[{"scopeLogs":[{"logRecords":[` + record(now) + "," + record(t0) + "," + record(t0+1) + `]}]}]}`
+	var request otlpLogsRequest
+	if err := json.Unmarshal([]byte(jsonRequest), &request); err != nil {
+		t.Fatal(err)
+	}
+	var protobufRequest []byte
+	for _, seconds := range []int64{now, t0, t0 + 1} {
+		protobufRequest = append(protobufRequest, protoBytesField(2, slices.Concat(
+			protowire.AppendFixed64(protowire.AppendTag(nil, 1, protowire.Fixed64Type), uint64(seconds)*uint64(time.Second)),
+			protoBytesField(5, protoBytesField(1, []byte("payment failed"))),
+		))...)
+	}
+	protobufRequest = protoBytesField(1, protoBytesField(2, protobufRequest))
+	errorMessage := "2 log records rejected: older than retention 1h0m0s"
+
+	export := func(contentType, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		request := httptest.NewRequest("POST", "/v1/logs", strings.NewReader(body))
+		request.Header.Set("Content-Type", contentType)
+		recorder := httptest.NewRecorder()
+		otlpLogsHandler(recorder, request)
+		if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != contentType {
+			t.Fatalf("%s export answered %d %s: %s", contentType, recorder.Code, recorder.Header().Get("Content-Type"), recorder.Body.String())
+		}
+		if got := drainTestChannel(); len(got) != 1 || got[0].Timestamp != now {
+			t.Errorf("%s export stored %+v", contentType, got)
+		}
+		return recorder
+	}
+
+	recorder := export("application/json", jsonRequest)
+	if got, expected := recorder.Body.String(), `{"partialSuccess":{"errorMessage":"`+errorMessage+`","rejectedLogRecords":"2"}}`; got != expected {
+		t.Errorf("JSON response is %s, expected %s", got, expected)
+	}
+
+	recorder = export("application/x-protobuf", string(protobufRequest))
+	fields, err := parseProtoFields(recorder.Body.Bytes())
+	if err != nil || len(fields) != 1 || fields[0].num != 1 {
+		t.Fatalf("protobuf response %x has fields %+v, %v", recorder.Body.Bytes(), fields, err)
+	}
+	partialSuccess, err := parseProtoFields(fields[0].data)
+	if err != nil || len(partialSuccess) != 2 || partialSuccess[0].num != 1 || partialSuccess[0].value != 2 || partialSuccess[1].num != 2 || string(partialSuccess[1].data) != errorMessage {
+		t.Errorf("protobuf partial success is %+v, %v", partialSuccess, err)
+	}
+
+	// Without rejections, both encodings answer an empty ExportLogsServiceResponse
+	for format, expected := range map[string]string{"otlp_json": "{}", "otlp": ""} {
+		recorder := httptest.NewRecorder()
+		writeOTLPResponse(recorder, format, nil)
+		if recorder.Code != http.StatusOK || recorder.Body.String() != expected {
+			t.Errorf("%s response without rejections is %d %q", format, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestHECEventEntry(t *testing.T) {
+	now := time.Unix(1709356100, 0)
+	tests := []struct {
+		name     string
+		event    string
+		expected LogEntry
+		err      error
+	}{
+		{"time as a number", `{"time":1709356020.75,"event":"connection reset"}`, LogEntry{Timestamp: 1709356020, Message: "connection reset"}, nil},
+		{"time as a string", `{"time":"1709356021.5","event":"connection reset"}`, LogEntry{Timestamp: 1709356021, Message: "connection reset"}, nil},
+		{"no time", `{"time":null,"event":"connection reset"}`, LogEntry{Timestamp: 1709356100, Message: "connection reset"}, nil},
+		{"object event", `{"time":1709356020,"event":{ "msg": "retrying",  "attempt": 2 }}`, LogEntry{Timestamp: 1709356020, Message: `{"msg":"retrying","attempt":2}`}, nil},
+		{"number event", `{"time":1709356020,"event":503}`, LogEntry{Timestamp: 1709356020, Message: "503"}, nil},
+		{"metadata and fields", `{"time":1709356020,"host":"web-1","source":"/var/log/nginx","sourcetype":"nginx","index":"main","event":"connection reset","fields":{"region":"eu","level":"error","shard":3}}`,
+			LogEntry{Timestamp: 1709356020, Message: "connection reset", Level: "error", Fields: map[string]string{
+				"host": "web-1", "source": "/var/log/nginx", "sourcetype": "nginx", "index": "main", "region": "eu", "shard": "3",
+			}}, nil},
+		{"non-string level", `{"time":1709356020,"event":"connection reset","fields":{"level":3}}`, LogEntry{Timestamp: 1709356020, Message: "connection reset", Level: "3"}, nil},
+		{"missing event", `{"time":1709356020}`, LogEntry{}, errHECEventRequired},
+		{"null event", `{"time":1709356020,"event":null}`, LogEntry{}, errHECEventRequired},
+		{"blank event", `{"time":1709356020,"event":""}`, LogEntry{}, errHECEventBlank},
+		{"invalid time", `{"time":"yesterday","event":"connection reset"}`, LogEntry{}, nil},
+	}
+	for _, test := range tests {
+		var event hecEvent
+		if err := json.Unmarshal([]byte(test.event), &event); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		entry, err := event.entry(now)
+		if test.name == "invalid time" {
+			if err == nil {
+				t.Errorf("%s: converted to %+v", test.name, entry)
+			}
+			continue
+		}
+		if err != test.err || !reflect.DeepEqual(entry, test.expected) {
+			t.Errorf("%s: converted to %+v, %v, expected %+v, %v", test.name, entry, err, test.expected, test.err)
+		}
+	}
+}
+
+func TestHECEventHandler(t *testing.T) {
+	acceptIngest(t)
+	keys, err := parseScopedKeys([]string{"shipper:write-key:write", "dashboard:read-key:read"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &scopedKeys, keys)
+	handler := requireScope(scopeWrite, hecEventHandler)
+	send := func(token, body string) (int, hecResponse) {
+		t.Helper()
+		request := httptest.NewRequest("POST", "/services/collector/event", strings.NewReader(body))
+		if token != "" {
+			request.Header.Set("Authorization", "Splunk "+token)
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		var response hecResponse
+		if recorder.Code != http.StatusUnauthorized && recorder.Code != http.StatusForbidden {
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatalf("response %q is not an HEC response: %v", recorder.Body.String(), err)
+			}
+		}
+		return recorder.Code, response
+	}
+
+	// Concatenated events of one request are all stored
+	code, response := send("write-key", `{"time":1709356020,"event":"connection reset","fields":{"level":"error"}}
+{"time":"1709356021","event":{"msg":"retrying"}}{"event":"closed"}`)
+	if code != http.StatusOK || response != (hecResponse{Text: "Success"}) {
+		t.Fatalf("events answered %d %+v", code, response)
+	}
+	entries := drainTestChannel()
+	if len(entries) != 3 || entries[0].Message != "connection reset" || entries[0].Level != "error" ||
+		entries[1].Timestamp != 1709356021 || entries[1].Message != `{"msg":"retrying"}` || entries[2].Message != "closed" {
+		t.Errorf("events stored as %+v", entries)
+	}
+
+	// The Splunk token is checked against the scopes of API_KEYS
+	for token, expected := range map[string]int{"": http.StatusUnauthorized, "unknown": http.StatusUnauthorized, "read-key": http.StatusForbidden} {
+		if code, _ := send(token, `{"event":"connection reset"}`); code != expected {
+			t.Errorf("token %q answered %d, expected %d", token, code, expected)
+		}
+	}
+
+	// Malformed requests answer 400 with the HEC error code, and store nothing
+	for _, test := range []struct {
+		body string
+		code int
+	}{
+		{"", hecNoData},
+		{`{"time":1709356020}`, hecEventRequired},
+		{`{"event":"connection reset"}{"event":""}`, hecEventBlank},
+		{`{"event":"connection reset"`, hecInvalidDataFormat},
+		{`{"time":"yesterday","event":"connection reset"}`, hecInvalidDataFormat},
+	} {
+		if code, response := send("write-key", test.body); code != http.StatusBadRequest || response.Code != test.code || response.Text == "" {
+			t.Errorf("body %q answered %d %+v, expected HEC code %d", test.body, code, response, test.code)
+		}
+	}
+	if entries := drainTestChannel(); len(entries) != 0 {
+		t.Errorf("malformed requests stored %+v", entries)
+	}
+}
+
+func TestHECHealthHandler(t *testing.T) {
+	acceptIngest(t)
+	t.Cleanup(func() { readOnly.Store(false) })
+	health := func() (int, hecResponse) {
+		recorder := httptest.NewRecorder()
+		hecHealthHandler(recorder, httptest.NewRequest("GET", "/services/collector/health", nil))
+		var response hecResponse
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatalf("response %q is not an HEC response: %v", recorder.Body.String(), err)
+		}
+		return recorder.Code, response
+	}
+	if code, response := health(); code != http.StatusOK || response.Code != hecHealthy {
+		t.Errorf("health answered %d %+v", code, response)
+	}
+	readOnly.Store(true)
+	if code, response := health(); code != http.StatusServiceUnavailable || response.Code != hecUnhealthy {
+		t.Errorf("health in read-only mode answered %d %+v", code, response)
+	}
+	readOnly.Store(false)
+	ingestAccepting.Store(false)
+	if code, response := health(); code != http.StatusServiceUnavailable || response.Code != hecUnhealthy {
+		t.Errorf("health while shutting down answered %d %+v", code, response)
+	}
+}